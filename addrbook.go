@@ -0,0 +1,199 @@
+package p2p
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AddrInfo is an address a peer may be reachable at.
+type AddrInfo struct {
+	Addr Addr
+	// AddedAt is when the address was first added to the AddrBook
+	AddedAt time.Time
+	// LastSuccess is when the peer was last reached at the address, it is zero if it never has been.
+	LastSuccess time.Time
+}
+
+// AddrBook remembers candidate addresses for peers, and when each was last used successfully.
+// It can be persisted with MarshalBinary and UnmarshalBinary, so peers can be reconnected to after a restart.
+// It is safe for concurrent use.
+type AddrBook struct {
+	parse func([]byte) (Addr, error)
+
+	mu    sync.Mutex
+	peers map[PeerID]map[string]*AddrInfo
+}
+
+// NewAddrBook creates an empty AddrBook.
+// parse is used by UnmarshalBinary to parse addresses, usually it is a swarm's ParseAddr.
+func NewAddrBook(parse func([]byte) (Addr, error)) *AddrBook {
+	return &AddrBook{
+		parse: parse,
+		peers: make(map[PeerID]map[string]*AddrInfo),
+	}
+}
+
+// Add adds addr as a candidate address for id.
+// Adding an address which is already in the book does nothing.
+func (ab *AddrBook) Add(id PeerID, addr Addr) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	ab.add(id, addr, time.Now())
+}
+
+// MarkSuccess records that id was reached at addr at time t, adding addr if it isn't in the book.
+func (ab *AddrBook) MarkSuccess(id PeerID, addr Addr, t time.Time) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	info := ab.add(id, addr, t)
+	if t.After(info.LastSuccess) {
+		info.LastSuccess = t
+	}
+}
+
+// Remove removes addr from the addresses for id.
+func (ab *AddrBook) Remove(id PeerID, addr Addr) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	addrs := ab.peers[id]
+	delete(addrs, addr.Key())
+	if len(addrs) == 0 {
+		delete(ab.peers, id)
+	}
+}
+
+// Addrs returns all the addresses for id, best first.
+// Addresses are ordered by their last success, most recent first, followed by those which have never succeeded,
+// most recently added first.
+func (ab *AddrBook) Addrs(id PeerID) []AddrInfo {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	infos := make([]AddrInfo, 0, len(ab.peers[id]))
+	for _, info := range ab.peers[id] {
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return addrInfoLt(infos[i], infos[j])
+	})
+	return infos
+}
+
+// Best returns the best address for id, or nil if there are none.
+// See Addrs for how addresses are ranked.
+func (ab *AddrBook) Best(id PeerID) Addr {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	var best *AddrInfo
+	for _, info := range ab.peers[id] {
+		if best == nil || addrInfoLt(*info, *best) {
+			best = info
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.Addr
+}
+
+// Peers returns the ids of the peers with at least one address.
+func (ab *AddrBook) Peers() []PeerID {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	ids := make([]PeerID, 0, len(ab.peers))
+	for id := range ab.peers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Key() < ids[j].Key()
+	})
+	return ids
+}
+
+type addrBookEntry struct {
+	ID    PeerID          `json:"id"`
+	Addrs []addrInfoEntry `json:"addrs"`
+}
+
+type addrInfoEntry struct {
+	Addr        string    `json:"addr"`
+	AddedAt     time.Time `json:"added_at"`
+	LastSuccess time.Time `json:"last_success"`
+}
+
+func (ab *AddrBook) MarshalBinary() ([]byte, error) {
+	var entries []addrBookEntry
+	for _, id := range ab.Peers() {
+		e := addrBookEntry{ID: id}
+		for _, info := range ab.Addrs(id) {
+			data, err := info.Addr.MarshalText()
+			if err != nil {
+				return nil, err
+			}
+			e.Addrs = append(e.Addrs, addrInfoEntry{
+				Addr:        string(data),
+				AddedAt:     info.AddedAt,
+				LastSuccess: info.LastSuccess,
+			})
+		}
+		entries = append(entries, e)
+	}
+	return json.Marshal(entries)
+}
+
+// UnmarshalBinary replaces the contents of the AddrBook with data from MarshalBinary.
+func (ab *AddrBook) UnmarshalBinary(data []byte) error {
+	var entries []addrBookEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	peers := make(map[PeerID]map[string]*AddrInfo, len(entries))
+	for _, e := range entries {
+		addrs := make(map[string]*AddrInfo, len(e.Addrs))
+		for _, ae := range e.Addrs {
+			addr, err := ab.parse([]byte(ae.Addr))
+			if err != nil {
+				return err
+			}
+			addrs[addr.Key()] = &AddrInfo{
+				Addr:        addr,
+				AddedAt:     ae.AddedAt,
+				LastSuccess: ae.LastSuccess,
+			}
+		}
+		if len(addrs) > 0 {
+			peers[e.ID] = addrs
+		}
+	}
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	ab.peers = peers
+	return nil
+}
+
+// add must be called with mu
+func (ab *AddrBook) add(id PeerID, addr Addr, now time.Time) *AddrInfo {
+	addrs, exists := ab.peers[id]
+	if !exists {
+		addrs = make(map[string]*AddrInfo)
+		ab.peers[id] = addrs
+	}
+	info, exists := addrs[addr.Key()]
+	if !exists {
+		info = &AddrInfo{Addr: addr, AddedAt: now}
+		addrs[addr.Key()] = info
+	}
+	return info
+}
+
+// addrInfoLt returns true if a is a better address than b
+func addrInfoLt(a, b AddrInfo) bool {
+	if !a.LastSuccess.Equal(b.LastSuccess) {
+		return a.LastSuccess.After(b.LastSuccess)
+	}
+	if !a.AddedAt.Equal(b.AddedAt) {
+		return a.AddedAt.After(b.AddedAt)
+	}
+	return a.Addr.Key() < b.Addr.Key()
+}
@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testAddr string
+
+func (a testAddr) Key() string {
+	return string(a)
+}
+
+func (a testAddr) MarshalText() ([]byte, error) {
+	return []byte(a), nil
+}
+
+func parseTestAddr(data []byte) (Addr, error) {
+	return testAddr(data), nil
+}
+
+func TestAddrBook(t *testing.T) {
+	ab := NewAddrBook(parseTestAddr)
+	id1, id2 := PeerID{1}, PeerID{2}
+	require.Nil(t, ab.Best(id1))
+
+	ab.Add(id1, testAddr("a"))
+	ab.Add(id1, testAddr("b"))
+	ab.Add(id1, testAddr("a"))
+	ab.Add(id2, testAddr("c"))
+	require.Len(t, ab.Addrs(id1), 2)
+	require.Len(t, ab.Addrs(id2), 1)
+	require.Equal(t, []PeerID{id1, id2}, ab.Peers())
+
+	ab.Remove(id2, testAddr("c"))
+	require.Nil(t, ab.Best(id2))
+	require.Equal(t, []PeerID{id1}, ab.Peers())
+}
+
+func TestAddrBookBest(t *testing.T) {
+	ab := NewAddrBook(parseTestAddr)
+	id := PeerID{1}
+	for _, a := range []testAddr{"a", "b", "c"} {
+		ab.Add(id, a)
+	}
+	now := time.Now()
+	ab.MarkSuccess(id, testAddr("a"), now.Add(-time.Hour))
+	ab.MarkSuccess(id, testAddr("b"), now)
+	require.Equal(t, testAddr("b"), ab.Best(id))
+
+	ab.MarkSuccess(id, testAddr("a"), now.Add(time.Minute))
+	require.Equal(t, testAddr("a"), ab.Best(id))
+	// older successes don't replace newer ones
+	ab.MarkSuccess(id, testAddr("a"), now.Add(-2*time.Hour))
+	require.Equal(t, testAddr("a"), ab.Best(id))
+
+	infos := ab.Addrs(id)
+	var order []Addr
+	for _, info := range infos {
+		order = append(order, info.Addr)
+	}
+	require.Equal(t, []Addr{testAddr("a"), testAddr("b"), testAddr("c")}, order)
+	require.True(t, infos[2].LastSuccess.IsZero())
+}
+
+func TestAddrBookMarshal(t *testing.T) {
+	ab := NewAddrBook(parseTestAddr)
+	id1, id2 := PeerID{1}, PeerID{2}
+	now := time.Now()
+	ab.Add(id1, testAddr("a"))
+	ab.MarkSuccess(id1, testAddr("b"), now)
+	ab.MarkSuccess(id2, testAddr("c"), now.Add(-time.Minute))
+
+	data, err := ab.MarshalBinary()
+	require.NoError(t, err)
+	ab2 := NewAddrBook(parseTestAddr)
+	require.NoError(t, ab2.UnmarshalBinary(data))
+	require.Equal(t, ab.Peers(), ab2.Peers())
+	for _, id := range ab.Peers() {
+		expected, actual := ab.Addrs(id), ab2.Addrs(id)
+		require.Len(t, actual, len(expected))
+		for i := range expected {
+			require.Equal(t, expected[i].Addr, actual[i].Addr)
+			require.True(t, expected[i].AddedAt.Equal(actual[i].AddedAt))
+			require.True(t, expected[i].LastSuccess.Equal(actual[i].LastSuccess))
+		}
+	}
+	require.Equal(t, testAddr("b"), ab2.Best(id1))
+}
@@ -0,0 +1,32 @@
+package p2p
+
+import (
+	"context"
+	"time"
+)
+
+type deadlineKey struct{}
+
+// WithDeadline returns a context carrying a deadline for the messages sent with it.
+// Unlike context.WithDeadline, the context is not cancelled at the deadline.
+// Instead, swarms which hold messages before sending them, in a batch or a queue, check the deadline when the message is
+// about to be sent, and drop it if the deadline has passed, returning ErrExpired from Tell.
+// If ctx already has an earlier message deadline, it is kept.
+func WithDeadline(ctx context.Context, t time.Time) context.Context {
+	if prev, ok := DeadlineFromContext(ctx); ok && prev.Before(t) {
+		return ctx
+	}
+	return context.WithValue(ctx, deadlineKey{}, t)
+}
+
+// DeadlineFromContext returns the message deadline set on ctx with WithDeadline, if there is one.
+func DeadlineFromContext(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(deadlineKey{}).(time.Time)
+	return t, ok
+}
+
+// Expired returns true if ctx has a message deadline, and it is not after now.
+func Expired(ctx context.Context, now time.Time) bool {
+	t, ok := DeadlineFromContext(ctx)
+	return ok && !now.Before(t)
+}
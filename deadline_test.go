@@ -0,0 +1,29 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithDeadline(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	_, ok := DeadlineFromContext(ctx)
+	require.False(t, ok)
+	require.False(t, Expired(ctx, now))
+
+	ctx1 := WithDeadline(ctx, now.Add(time.Second))
+	require.False(t, Expired(ctx1, now))
+	require.True(t, Expired(ctx1, now.Add(time.Second)))
+	// the context is not cancelled at the deadline
+	require.Nil(t, ctx1.Err())
+
+	// the earlier deadline is kept
+	d, _ := DeadlineFromContext(WithDeadline(ctx1, now.Add(time.Hour)))
+	require.Equal(t, now.Add(time.Second), d)
+	d, _ = DeadlineFromContext(WithDeadline(ctx1, now.Add(time.Millisecond)))
+	require.Equal(t, now.Add(time.Millisecond), d)
+}
@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Inspector is implemented by layers which can describe their state, for debugging.
+type Inspector interface {
+	// Inspect returns a snapshot of the layer's state, as sections keyed by name.
+	// Each section must be able to be marshaled as JSON.
+	Inspect() map[string]interface{}
+}
+
+// DebugReport is the state of a stack, as served by DebugHandler.
+type DebugReport struct {
+	Layers []LayerReport `json:"layers"`
+}
+
+// LayerReport is the state of one layer of a stack.
+type LayerReport struct {
+	// Layer is the type of the layer
+	Layer    string                 `json:"layer"`
+	Sections map[string]interface{} `json:"sections"`
+}
+
+// Inspect returns a report with the sections from each of the layers, in order.
+func Inspect(layers ...Inspector) DebugReport {
+	r := DebugReport{Layers: []LayerReport{}}
+	for _, x := range layers {
+		r.Layers = append(r.Layers, LayerReport{
+			Layer:    strings.TrimPrefix(fmt.Sprintf("%T", x), "*"),
+			Sections: x.Inspect(),
+		})
+	}
+	return r
+}
+
+// DebugHandler returns a handler which serves the report from Inspect, as JSON.
+// Like Flush, layers should be passed from the top of a stack down.
+// If the request has the query parameter format=html, or accepts text/html, the report is served as an HTML page instead.
+// Each request inspects the layers again, so the report is always current.
+func DebugHandler(layers ...Inspector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Inspect(layers...)
+		if r.URL.Query().Get("format") == "html" || strings.Contains(r.Header.Get("Accept"), "text/html") {
+			serveDebugHTML(w, report)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			Logger.Error("error encoding debug report: ", err)
+		}
+	})
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>p2p</title></head>
+<body>
+{{- range .}}
+<h2>{{.Layer}}</h2>
+{{- range .Sections}}
+<h3>{{.Name}}</h3>
+<pre>{{.Value}}</pre>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
+
+type htmlLayer struct {
+	Layer    string
+	Sections []htmlSection
+}
+
+type htmlSection struct {
+	Name, Value string
+}
+
+// serveDebugHTML renders each section of the report as indented JSON, with the sections of each layer sorted by name.
+func serveDebugHTML(w http.ResponseWriter, report DebugReport) {
+	var layers []htmlLayer
+	for _, l := range report.Layers {
+		hl := htmlLayer{Layer: l.Layer}
+		for name, v := range l.Sections {
+			data, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				data = []byte(err.Error())
+			}
+			hl.Sections = append(hl.Sections, htmlSection{Name: name, Value: string(data)})
+		}
+		sort.Slice(hl.Sections, func(i, j int) bool {
+			return hl.Sections[i].Name < hl.Sections[j].Name
+		})
+		layers = append(layers, hl)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(w, layers); err != nil {
+		Logger.Error("error rendering debug report: ", err)
+	}
+}
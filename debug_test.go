@@ -0,0 +1,45 @@
+package p2p
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testInspector map[string]interface{}
+
+func (x testInspector) Inspect() map[string]interface{} {
+	return x
+}
+
+func TestDebugHandler(t *testing.T) {
+	h := DebugHandler(
+		testInspector{"sessions": []string{"a", "b"}},
+		&testInspector{"counters": map[string]int{"sent": 3}},
+	)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var report struct {
+		Layers []struct {
+			Layer    string                     `json:"layer"`
+			Sections map[string]json.RawMessage `json:"sections"`
+		} `json:"layers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	require.Len(t, report.Layers, 2)
+	require.Equal(t, "p2p.testInspector", report.Layers[0].Layer)
+	require.JSONEq(t, `["a", "b"]`, string(report.Layers[0].Sections["sessions"]))
+	require.Equal(t, "p2p.testInspector", report.Layers[1].Layer)
+	require.JSONEq(t, `{"sent": 3}`, string(report.Layers[1].Sections["counters"]))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?format=html", nil))
+	require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Contains(t, w.Body.String(), "<h3>sessions</h3>")
+	require.Contains(t, w.Body.String(), "<h3>counters</h3>")
+	require.Contains(t, w.Body.String(), "&#34;sent&#34;: 3")
+}
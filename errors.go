@@ -1,8 +1,45 @@
 package p2p
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrMTUExceeded = errors.New("payload is larger than swarms MTU")
 	ErrSwarmClosed = errors.New("swarm closed")
+	// ErrResponseTooLarge is returned by Ask when the response is larger than the configured maximum
+	ErrResponseTooLarge = errors.New("response exceeds max response size")
+	// ErrWouldBlock is returned by Tell when the message was dropped because the transport's send buffer was full.
+	// Callers can retry later, or slow down; the message was not sent.
+	ErrWouldBlock = errors.New("send buffer is full, message was dropped")
+	// ErrNoAddrs is returned when a peer is addressed by its PeerID, and a PeerResolver has no addresses for it.
+	ErrNoAddrs = errors.New("no addresses for peer")
+	// ErrExpired is returned by Tell when the message was dropped because its deadline passed before it was sent.
+	// See WithDeadline.
+	ErrExpired = errors.New("message deadline passed before it was sent")
 )
+
+// MTUExceededError is returned by Tell when the payload is larger than the swarm's MTU.
+// Swarms which do not fragment messages must return it instead of sending a truncated message, or dropping it.
+// It matches ErrMTUExceeded with errors.Is.
+type MTUExceededError struct {
+	MTU  int
+	Size int
+}
+
+func (e MTUExceededError) Error() string {
+	return fmt.Sprintf("payload of %d bytes is larger than swarms MTU of %d", e.Size, e.MTU)
+}
+
+func (e MTUExceededError) Is(target error) bool {
+	return target == ErrMTUExceeded
+}
+
+// CheckMTU returns an MTUExceededError if data is larger than mtu
+func CheckMTU(data IOVec, mtu int) error {
+	if size := VecSize(data); size > mtu {
+		return MTUExceededError{MTU: mtu, Size: size}
+	}
+	return nil
+}
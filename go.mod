@@ -1,12 +1,12 @@
 module github.com/brendoncarroll/go-p2p
 
-go 1.15
+go 1.18
 
 require (
 	github.com/flynn/noise v0.0.0-20180327030543-2492fe189ae6
 	github.com/golang/protobuf v1.4.3
 	github.com/google/uuid v1.1.1
-	github.com/jonboulle/clockwork v0.1.1-0.20190114141812-62fb9bc030d1
+	github.com/jonboulle/clockwork v0.4.0
 	github.com/lucas-clemente/quic-go v0.19.2
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.6.0
@@ -18,3 +18,29 @@ require (
 	golang.zx2c4.com/wireguard v0.0.20201118
 	google.golang.org/protobuf v1.23.0
 )
+
+require (
+	github.com/StackExchange/wmi v0.0.0-20190523213315-cbe66965904d // indirect
+	github.com/bkaradzic/go-lz4 v0.0.0-20160924222819-7224d8d8f27e // indirect
+	github.com/cheekybits/genny v1.0.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-ole/go-ole v1.2.4 // indirect
+	github.com/gogo/protobuf v1.3.1 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
+	github.com/marten-seemann/qtls v0.10.0 // indirect
+	github.com/marten-seemann/qtls-go1-15 v0.1.1 // indirect
+	github.com/minio/sha256-simd v0.1.1 // indirect
+	github.com/miscreant/miscreant.go v0.0.0-20200214223636-26d376326b75 // indirect
+	github.com/petermattis/goid v0.0.0-20180202154549-b0b1615b78e5 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/sasha-s/go-deadlock v0.2.0 // indirect
+	github.com/shirou/gopsutil v3.20.10+incompatible // indirect
+	github.com/spf13/pflag v1.0.3 // indirect
+	github.com/syncthing/notify v0.0.0-20201109091751-9a0e44181151 // indirect
+	github.com/thejerf/suture v4.0.0+incompatible // indirect
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b // indirect
+	golang.org/x/sys v0.0.0-20201117222635-ba5294a509c7 // indirect
+	golang.org/x/text v0.3.4 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
@@ -0,0 +1,17 @@
+package p2p
+
+import "golang.org/x/crypto/sha3"
+
+// HashIDLen is the size of the hashes returned by HashID, and of a PeerID.
+const HashIDLen = 32
+
+// HashID returns the HashIDLen byte SHAKE256 hash of data.
+// It is the hash used to derive PeerIDs, NewPeerID(pub) is HashID(MarshalPublicKey(pub)),
+// and to derive keys in the Kademlia DHT, so an id and a key derived from the same data are equal.
+// SHAKE256 is an extendable output function, so an id truncated to n bytes is the same as n bytes of output,
+// which is how PeerIDSchemes with shorter ids stay comparable with it.
+func HashID(data []byte) []byte {
+	out := make([]byte, HashIDLen)
+	sha3.ShakeSum256(out, data)
+	return out
+}
@@ -0,0 +1,60 @@
+// Package askutil contains the parts of request/response over tells which are shared by datagramask and streamask.
+package askutil
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+)
+
+// Limiter limits the number of requests handled at once.
+type Limiter struct {
+	// tokens holds a token for each request being handled.
+	tokens chan struct{}
+}
+
+// NewLimiter returns a Limiter which allows n requests at once.
+func NewLimiter(n int) *Limiter {
+	return &Limiter{tokens: make(chan struct{}, n)}
+}
+
+// TryAcquire takes a token for a request, or returns false if there are already too many being handled.
+// Each successful call must be followed by a call to Release, once the request is done.
+func (l *Limiter) TryAcquire() bool {
+	select {
+	case l.tokens <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release returns the token taken by TryAcquire.
+func (l *Limiter) Release() {
+	<-l.tokens
+}
+
+// Len returns the number of requests being handled.
+func (l *Limiter) Len() int {
+	return len(l.tokens)
+}
+
+// Refuse sends msg to the asker of a request which won't be handled, so it doesn't wait for the timeout.
+// It gives up after timeout.
+func Refuse(x p2p.Swarm, dst p2p.Addr, msg []byte, timeout time.Duration) error {
+	ctx, cf := context.WithTimeout(context.Background(), timeout)
+	defer cf()
+	return x.Tell(ctx, dst, p2p.IOVec{msg})
+}
+
+// RandomNonce returns a random nonce, for telling apart the responses to different requests.
+func RandomNonce() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
@@ -0,0 +1,18 @@
+package askutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(2)
+	require.True(t, l.TryAcquire())
+	require.True(t, l.TryAcquire())
+	require.False(t, l.TryAcquire())
+	require.Equal(t, 2, l.Len())
+	l.Release()
+	require.True(t, l.TryAcquire())
+	require.Equal(t, 2, l.Len())
+}
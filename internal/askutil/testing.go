@@ -0,0 +1,27 @@
+package askutil
+
+import (
+	"testing"
+
+	"github.com/brendoncarroll/go-p2p"
+)
+
+// Server is an asker which serves requests and responses on its lower swarm.
+type Server interface {
+	ServeAsks(fn p2p.AskHandler) error
+}
+
+// NewTestPair returns a client on clientLower and a server on serverLower, both created with newAsker,
+// and the address of the server.
+// The server responds with fn, the client only serves to receive its responses.
+// The lower swarms are closed when the test is done.
+func NewTestPair[T Server](t testing.TB, newAsker func(p2p.Swarm) T, clientLower, serverLower p2p.Swarm, fn p2p.AskHandler) (client, server T, serverAddr p2p.Addr) {
+	client, server = newAsker(clientLower), newAsker(serverLower)
+	go client.ServeAsks(p2p.NoOpAskHandler)
+	go server.ServeAsks(fn)
+	t.Cleanup(func() {
+		clientLower.Close()
+		serverLower.Close()
+	})
+	return client, server, serverLower.LocalAddrs()[0]
+}
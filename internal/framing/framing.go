@@ -0,0 +1,69 @@
+// Package framing contains the uvarint and length-prefixed encodings shared by the swarms.
+// The Read functions never index past the end of their input, and return an error instead.
+package framing
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrTruncated is returned when the input ends before the uvarint or frame does.
+	ErrTruncated = errors.Errorf("framing: truncated input")
+	// ErrOverflow is returned when a uvarint does not fit in 64 bits.
+	ErrOverflow = errors.Errorf("framing: uvarint overflows 64 bits")
+)
+
+// AppendUvarint appends x to out as a uvarint, and returns the extended slice.
+func AppendUvarint(out []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(out, buf[:n]...)
+}
+
+// UvarintSize returns the number of bytes AppendUvarint appends for x.
+func UvarintSize(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// ReadUvarint reads a uvarint from the start of x, and returns it along with the rest of x.
+func ReadUvarint(x []byte) (v uint64, rest []byte, err error) {
+	v, n := binary.Uvarint(x)
+	switch {
+	case n == 0:
+		return 0, nil, ErrTruncated
+	case n < 0:
+		return 0, nil, ErrOverflow
+	}
+	return v, x[n:], nil
+}
+
+// AppendFrame appends data to out, prefixed with its length as a uvarint.
+func AppendFrame(out []byte, data []byte) []byte {
+	out = AppendUvarint(out, uint64(len(data)))
+	return append(out, data...)
+}
+
+// FrameSize returns the number of bytes AppendFrame appends for n bytes of data.
+func FrameSize(n int) int {
+	return UvarintSize(uint64(n)) + n
+}
+
+// ReadFrame reads a frame written by AppendFrame from the start of x,
+// and returns its data along with the rest of x.
+// data aliases x.
+func ReadFrame(x []byte) (data, rest []byte, err error) {
+	size, rest, err := ReadUvarint(x)
+	if err != nil {
+		return nil, nil, err
+	}
+	if size > uint64(len(rest)) {
+		return nil, nil, ErrTruncated
+	}
+	return rest[:size], rest[size:], nil
+}
@@ -0,0 +1,89 @@
+package framing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUvarint(t *testing.T) {
+	for _, x := range []uint64{0, 1, 0x7f, 0x80, math.MaxUint32, math.MaxUint64} {
+		buf := AppendUvarint([]byte{0xaa}, x)
+		require.Len(t, buf, 1+UvarintSize(x))
+		v, rest, err := ReadUvarint(append(buf[1:], 0xbb))
+		require.NoError(t, err)
+		require.Equal(t, x, v)
+		require.Equal(t, []byte{0xbb}, rest)
+	}
+
+	_, _, err := ReadUvarint(nil)
+	require.Equal(t, ErrTruncated, err)
+	_, _, err = ReadUvarint([]byte{0x80, 0x80})
+	require.Equal(t, ErrTruncated, err)
+	_, _, err = ReadUvarint(bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1))
+	require.Equal(t, ErrOverflow, err)
+}
+
+func TestFrame(t *testing.T) {
+	buf := AppendFrame(nil, []byte("hello"))
+	buf = AppendFrame(buf, nil)
+	require.Len(t, buf, FrameSize(5)+FrameSize(0))
+
+	data, rest, err := ReadFrame(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	data, rest, err = ReadFrame(rest)
+	require.NoError(t, err)
+	require.Len(t, data, 0)
+	require.Len(t, rest, 0)
+
+	// the length is larger than the rest of the input
+	_, _, err = ReadFrame([]byte{6, 'h', 'e', 'l', 'l', 'o'})
+	require.Equal(t, ErrTruncated, err)
+	_, _, err = ReadFrame(AppendUvarint(nil, math.MaxUint64))
+	require.Equal(t, ErrTruncated, err)
+}
+
+func FuzzReadUvarint(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x80})
+	f.Add(AppendUvarint(nil, math.MaxUint64))
+	f.Add(bytes.Repeat([]byte{0xff}, 11))
+	f.Fuzz(func(t *testing.T, x []byte) {
+		v, rest, err := ReadUvarint(x)
+		if err != nil {
+			return
+		}
+		n := len(x) - len(rest)
+		require.True(t, n >= UvarintSize(v) && n <= binary.MaxVarintLen64)
+		require.Equal(t, x[n:], rest)
+		v2, _, err := ReadUvarint(AppendUvarint(nil, v))
+		require.NoError(t, err)
+		require.Equal(t, v, v2)
+	})
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{5, 'h', 'i'})
+	f.Add(AppendFrame(nil, []byte("hello")))
+	f.Add(AppendUvarint(nil, math.MaxUint64))
+	f.Fuzz(func(t *testing.T, x []byte) {
+		for len(x) > 0 {
+			data, rest, err := ReadFrame(x)
+			if err != nil {
+				return
+			}
+			require.True(t, len(data)+len(rest) < len(x))
+			require.Equal(t, x[len(x)-len(rest):], rest)
+			data2, rest2, err := ReadFrame(AppendFrame(nil, data))
+			require.NoError(t, err)
+			require.Equal(t, data, data2)
+			require.Len(t, rest2, 0)
+			x = rest
+		}
+	})
+}
@@ -0,0 +1,258 @@
+// Package datagramask implements request/response over a single unreliable datagram in each direction.
+//
+// A request is sent as one Tell, carrying a random nonce, and the response is sent back as one Tell with the same nonce.
+// Nothing is retransmitted, and no state is kept beyond the requests waiting for a response,
+// so a request or response which is lost makes Ask time out, and the caller can retry.
+// This suits small idempotent exchanges, like DNS queries, which don't need a session.
+package datagramask
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/askutil"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+// DefaultTimeout is the default time Ask waits for a response.
+// It is short, since a response which has not arrived after a round trip has probably been lost.
+const DefaultTimeout = time.Second
+
+// DefaultMaxRequests is the default number of requests handled at once.
+const DefaultMaxRequests = 64
+
+var (
+	// ErrTimeout is returned by Ask when no response arrives within the timeout.
+	// The request or the response may have been lost, so the request can be retried.
+	ErrTimeout = errors.New("datagramask: no response")
+	// ErrBusy is returned by Ask when the remote peer was already handling as many requests as it can.
+	ErrBusy = errors.New("datagramask: remote peer is busy")
+)
+
+const (
+	typeRequest = uint8(iota)
+	typeResponse
+	// typeTooLarge is sent instead of a response which does not fit in a datagram.
+	typeTooLarge
+	// typeBusy is sent instead of a response when there are too many requests being handled.
+	typeBusy
+)
+
+// Overhead is the size of the header on each datagram: a type and a nonce.
+const Overhead = 1 + 8
+
+type Option func(*Asker)
+
+// WithTimeout sets how long Ask waits for a response. The default is DefaultTimeout.
+func WithTimeout(d time.Duration) Option {
+	if d <= 0 {
+		panic("timeout must be positive")
+	}
+	return func(a *Asker) {
+		a.timeout = d
+	}
+}
+
+// WithMaxRequests sets how many requests are handled at once.
+// Requests which arrive while that many are being handled are refused, and their askers get ErrBusy.
+// The default is DefaultMaxRequests.
+func WithMaxRequests(n int) Option {
+	if n <= 0 {
+		panic("max requests must be positive")
+	}
+	return func(a *Asker) {
+		a.maxRequests = n
+	}
+}
+
+// WithClock sets the clock used for timeouts. The default is the real clock.
+func WithClock(clock clockwork.Clock) Option {
+	return func(a *Asker) {
+		a.clock = clock
+	}
+}
+
+// Asker sends asks over a swarm as single datagrams.
+// It receives responses by serving the swarm's tells, so ServeAsks must be running for Ask to succeed,
+// and the swarm must not be used for anything else.
+type Asker struct {
+	swarm       p2p.Swarm
+	timeout     time.Duration
+	maxRequests int
+	clock       clockwork.Clock
+	// requests limits the requests being handled at once.
+	requests *askutil.Limiter
+
+	mu      sync.Mutex
+	pending map[uint64]*pendingAsk
+}
+
+type pendingAsk struct {
+	dst p2p.Addr
+	ch  chan response
+}
+
+type response struct {
+	data []byte
+	err  error
+}
+
+func New(x p2p.Swarm, opts ...Option) *Asker {
+	a := &Asker{
+		swarm:       x,
+		timeout:     DefaultTimeout,
+		maxRequests: DefaultMaxRequests,
+		clock:       clockwork.NewRealClock(),
+		pending:     make(map[uint64]*pendingAsk),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.requests = askutil.NewLimiter(a.maxRequests)
+	return a
+}
+
+// Ask sends req to dst and waits for the response, until ctx is done or the timeout passes.
+// Only a response from dst is accepted.
+// If the response would not fit in a datagram, p2p.ErrResponseTooLarge is returned,
+// and if dst was too busy to handle the request, ErrBusy is.
+func (a *Asker) Ask(ctx context.Context, dst p2p.Addr, req p2p.IOVec) ([]byte, error) {
+	if err := p2p.CheckMTU(req, a.MTU(ctx, dst)); err != nil {
+		return nil, err
+	}
+	nonce, ch := a.addPending(dst)
+	defer a.removePending(nonce)
+	msg := append(p2p.IOVec{newHeader(typeRequest, nonce)}, req...)
+	if err := a.swarm.Tell(ctx, dst, msg); err != nil {
+		return nil, err
+	}
+	timer := a.clock.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res.data, res.err
+	case <-timer.Chan():
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ServeAsks serves the swarm's tells, calling fn with requests and delivering responses to Ask.
+// A write by fn which would make the response larger than the MTU fails with p2p.ErrResponseTooLarge,
+// and the asker gets p2p.ErrResponseTooLarge instead of the response.
+// fn is called in its own goroutine for each request, so a slow handler doesn't hold up responses,
+// at most WithMaxRequests at once.
+func (a *Asker) ServeAsks(fn p2p.AskHandler) error {
+	return a.swarm.ServeTells(func(msg *p2p.Message) {
+		a.handleTell(msg, fn)
+	})
+}
+
+// MTU is the largest request or response which can be sent to addr.
+func (a *Asker) MTU(ctx context.Context, addr p2p.Addr) int {
+	return a.swarm.MTU(ctx, addr) - Overhead
+}
+
+func (a *Asker) handleTell(msg *p2p.Message, fn p2p.AskHandler) {
+	typ, nonce, body, err := parseMessage(msg.Payload)
+	if err != nil {
+		log.WithFields(logrus.Fields{"src": msg.Src}).Debug("datagramask: ", err)
+		return
+	}
+	switch typ {
+	case typeRequest:
+		if !a.requests.TryAcquire() {
+			if err := askutil.Refuse(a.swarm, msg.Src, newHeader(typeBusy, nonce), a.timeout); err != nil {
+				log.WithFields(logrus.Fields{"dst": msg.Src}).Debug("datagramask: error refusing request: ", err)
+			}
+			return
+		}
+		req := &p2p.Message{Src: msg.Src, Dst: msg.Dst, Payload: append([]byte{}, body...)}
+		go func() {
+			defer a.requests.Release()
+			a.handleRequest(req, nonce, fn)
+		}()
+	case typeResponse:
+		a.deliver(msg.Src, nonce, response{data: append([]byte{}, body...)})
+	case typeTooLarge:
+		a.deliver(msg.Src, nonce, response{err: p2p.ErrResponseTooLarge})
+	case typeBusy:
+		a.deliver(msg.Src, nonce, response{err: ErrBusy})
+	}
+}
+
+func (a *Asker) handleRequest(req *p2p.Message, nonce uint64, fn p2p.AskHandler) {
+	ctx, cf := context.WithTimeout(context.Background(), a.timeout)
+	defer cf()
+	buf := bytes.Buffer{}
+	lw := &swarmutil.LimitWriter{W: &buf, N: a.MTU(ctx, req.Src)}
+	fn(ctx, req, lw)
+	res := p2p.IOVec{newHeader(typeResponse, nonce), buf.Bytes()}
+	if lw.Exceeded() {
+		res = p2p.IOVec{newHeader(typeTooLarge, nonce)}
+	}
+	if err := a.swarm.Tell(ctx, req.Src, res); err != nil {
+		log.WithFields(logrus.Fields{"dst": req.Src}).Debug("datagramask: error sending response: ", err)
+	}
+}
+
+func (a *Asker) addPending(dst p2p.Addr) (uint64, chan response) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for {
+		nonce := askutil.RandomNonce()
+		if _, exists := a.pending[nonce]; exists {
+			continue
+		}
+		ch := make(chan response, 1)
+		a.pending[nonce] = &pendingAsk{dst: dst, ch: ch}
+		return nonce, ch
+	}
+}
+
+func (a *Asker) removePending(nonce uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, nonce)
+}
+
+// deliver passes res to the Ask waiting for nonce, if it was sent to src.
+// Duplicate responses, and responses which arrive after Ask has returned, are dropped.
+func (a *Asker) deliver(src p2p.Addr, nonce uint64, res response) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, exists := a.pending[nonce]
+	if !exists || p.dst.Key() != src.Key() {
+		return
+	}
+	delete(a.pending, nonce)
+	p.ch <- res
+}
+
+func newHeader(typ uint8, nonce uint64) []byte {
+	header := make([]byte, Overhead)
+	header[0] = typ
+	binary.BigEndian.PutUint64(header[1:], nonce)
+	return header
+}
+
+func parseMessage(x []byte) (typ uint8, nonce uint64, body []byte, err error) {
+	if len(x) < Overhead {
+		return 0, 0, nil, errors.Errorf("message too short")
+	}
+	typ = x[0]
+	if typ > typeBusy {
+		return 0, 0, nil, errors.Errorf("unknown message type %d", typ)
+	}
+	return typ, binary.BigEndian.Uint64(x[1:Overhead]), x[Overhead:], nil
+}
@@ -0,0 +1,123 @@
+package datagramask
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/askutil"
+	"github.com/brendoncarroll/go-p2p/s/faultyswarm"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsk(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	client, _, addr := newTestPair(t, r.NewSwarm(), r.NewSwarm(), echo)
+	resp, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "echo: ping", string(resp))
+}
+
+func TestAskLossy(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	// half of the requests are lost
+	lower := faultyswarm.New(r.NewSwarm(), faultyswarm.WithDropRate(0.5), faultyswarm.WithSeed(1))
+	client, _, addr := newTestPair(t, lower, r.NewSwarm(), echo, WithTimeout(20*time.Millisecond))
+	var total int
+	for i := 0; i < 10; i++ {
+		var attempts int
+		var resp []byte
+		for {
+			attempts++
+			require.Less(t, attempts, 50)
+			var err error
+			resp, err = client.Ask(ctx, addr, p2p.IOVec{[]byte("ping")})
+			if err == nil {
+				break
+			}
+			require.Equal(t, ErrTimeout, err)
+		}
+		require.Equal(t, "echo: ping", string(resp))
+		total += attempts
+	}
+	// some requests were lost and retried
+	require.Greater(t, total, 10)
+}
+
+func TestAskTimeout(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lower := faultyswarm.New(r.NewSwarm(), faultyswarm.WithDropRate(1))
+	client, _, addr := newTestPair(t, lower, r.NewSwarm(), echo, WithTimeout(10*time.Millisecond))
+	_, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("ping")})
+	require.Equal(t, ErrTimeout, err)
+	// nothing is left behind
+	require.Len(t, client.pending, 0)
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	var server *Asker
+	client, server, addr := newTestPair(t, r.NewSwarm(), r.NewSwarm(), func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write(bytes.Repeat([]byte{1}, server.MTU(ctx, msg.Src)+1))
+	})
+	_, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("ping")})
+	require.Equal(t, p2p.ErrResponseTooLarge, err)
+}
+
+func TestBusy(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	started, release := make(chan struct{}), make(chan struct{})
+	client, server, addr := newTestPair(t, r.NewSwarm(), r.NewSwarm(), func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	}, WithMaxRequests(1))
+	first := make(chan error, 1)
+	go func() {
+		_, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("1")})
+		first <- err
+	}()
+	<-started
+	// the server is handling as many requests as it can, so the next is refused
+	_, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("2")})
+	require.Equal(t, ErrBusy, err)
+	close(release)
+	require.NoError(t, <-first)
+	// once the first request is done there is room again
+	require.Eventually(t, func() bool { return server.requests.Len() == 0 }, time.Second, time.Millisecond)
+	go func() { <-started }()
+	resp, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("3")})
+	require.NoError(t, err)
+	require.Equal(t, "done", string(resp))
+}
+
+func TestParseMessage(t *testing.T) {
+	typ, nonce, body, err := parseMessage(append(newHeader(typeResponse, 7), "hi"...))
+	require.NoError(t, err)
+	require.Equal(t, typeResponse, typ)
+	require.Equal(t, uint64(7), nonce)
+	require.Equal(t, "hi", string(body))
+
+	_, _, _, err = parseMessage(newHeader(typeResponse, 7)[:Overhead-1])
+	require.Error(t, err)
+	_, _, _, err = parseMessage(newHeader(typeBusy+1, 7))
+	require.Error(t, err)
+}
+
+// newTestPair returns a client on clientLower, and a server on serverLower which responds with fn.
+func newTestPair(t testing.TB, clientLower, serverLower p2p.Swarm, fn p2p.AskHandler, opts ...Option) (client, server *Asker, serverAddr p2p.Addr) {
+	return askutil.NewTestPair(t, func(x p2p.Swarm) *Asker { return New(x, opts...) }, clientLower, serverLower, fn)
+}
+
+func echo(ctx context.Context, msg *p2p.Message, w io.Writer) {
+	w.Write(append([]byte("echo: "), msg.Payload...))
+}
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"io"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/brendoncarroll/go-p2p"
 	"github.com/google/uuid"
@@ -24,11 +26,25 @@ type Muxer interface {
 	OpenSecureAsk(x string) (p2p.SecureAskSwarm, error)
 
 	LocalAddrs() []p2p.Addr
+	// LookupStats returns the number of channel lookups which succeeded and failed, for each channel name.
+	LookupStats() map[string]LookupStats
+}
+
+// the Muxer returned by MultiplexSwarm can be included in a debug report with a type assertion.
+var _ p2p.Inspector = &muxer{}
+
+// LookupStats counts the lookups of a channel on remote peers, which are done before each Tell and Ask.
+type LookupStats struct {
+	Succeeded uint64
+	Failed    uint64
 }
 
 type muxer struct {
 	s         p2p.Swarm
 	sessionID uuid.UUID
+	// maxResponseSize is the largest response returned by Ask, 0 means no limit
+	maxResponseSize int
+	onLookupFailure func(addr p2p.Addr, name string, err error)
 
 	mu     sync.RWMutex
 	i2c    []string
@@ -38,9 +54,17 @@ type muxer struct {
 
 	cache    sync.Map
 	sessions sync.Map
+	// lookupStats holds a *lookupCounters for each channel name
+	lookupStats sync.Map
 }
 
-func MultiplexSwarm(s p2p.Swarm) Muxer {
+// lookupCounters are updated atomically
+type lookupCounters struct {
+	succeeded uint64
+	failed    uint64
+}
+
+func MultiplexSwarm(s p2p.Swarm, opts ...Option) Muxer {
 	m := &muxer{
 		s:         s,
 		sessionID: uuid.New(),
@@ -56,6 +80,9 @@ func MultiplexSwarm(s p2p.Swarm) Muxer {
 		},
 		reqs: map[channelKey]chan struct{}{},
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
 
 	go s.ServeTells(m.handleTell)
 	if asker, ok := s.(p2p.Asker); ok {
@@ -207,7 +234,74 @@ func (m *muxer) Close() error {
 	return m.s.Close()
 }
 
+func (m *muxer) LookupStats() map[string]LookupStats {
+	stats := map[string]LookupStats{}
+	m.lookupStats.Range(func(k, v interface{}) bool {
+		c := v.(*lookupCounters)
+		stats[k.(string)] = LookupStats{
+			Succeeded: atomic.LoadUint64(&c.succeeded),
+			Failed:    atomic.LoadUint64(&c.failed),
+		}
+		return true
+	})
+	return stats
+}
+
+// ChannelEntry is a row in a channel table, mapping a channel name to the index used on the wire.
+type ChannelEntry struct {
+	// Peer is the key of the remote address the index was looked up on, it is empty for local channels.
+	Peer  string `json:",omitempty"`
+	Name  string
+	Index uint32
+}
+
+// Inspect returns the local and remote channel tables, and the LookupStats.
+func (m *muxer) Inspect() map[string]interface{} {
+	local := []ChannelEntry{}
+	m.mu.RLock()
+	for i, name := range m.i2c {
+		local = append(local, ChannelEntry{Name: name, Index: uint32(i)})
+	}
+	m.mu.RUnlock()
+	remote := []ChannelEntry{}
+	m.cache.Range(func(k, v interface{}) bool {
+		ck := k.(channelKey)
+		remote = append(remote, ChannelEntry{Peer: ck.AddrKey, Name: ck.Channel, Index: v.(uint32)})
+		return true
+	})
+	sort.Slice(remote, func(i, j int) bool {
+		if remote[i].Peer != remote[j].Peer {
+			return remote[i].Peer < remote[j].Peer
+		}
+		return remote[i].Index < remote[j].Index
+	})
+	return map[string]interface{}{
+		"channels":        local,
+		"remote_channels": remote,
+		"lookups":         m.LookupStats(),
+	}
+}
+
+// lookup returns the channel index addr uses for name, and records the result in the lookup stats.
 func (m *muxer) lookup(ctx context.Context, addr p2p.Addr, name string) (uint32, error) {
+	v, ok := m.lookupStats.Load(name)
+	if !ok {
+		v, _ = m.lookupStats.LoadOrStore(name, &lookupCounters{})
+	}
+	c := v.(*lookupCounters)
+	i, err := m.lookupChannel(ctx, addr, name)
+	if err != nil {
+		atomic.AddUint64(&c.failed, 1)
+		if m.onLookupFailure != nil {
+			m.onLookupFailure(addr, name, err)
+		}
+		return 0, err
+	}
+	atomic.AddUint64(&c.succeeded, 1)
+	return i, nil
+}
+
+func (m *muxer) lookupChannel(ctx context.Context, addr p2p.Addr, name string) (uint32, error) {
 	ck := newChannelKey(addr, name)
 	i := m.getChannel(ck)
 	if i > 0 {
@@ -225,7 +319,10 @@ func (m *muxer) lookup(ctx context.Context, addr p2p.Addr, name string) (uint32,
 	if !exists {
 		msg := newMuxReq(name)
 		if err := m.s.Tell(ctx, addr, p2p.IOVec{msg}); err != nil {
-			return 0, nil
+			m.mu.Lock()
+			delete(m.reqs, ck)
+			m.mu.Unlock()
+			return 0, err
 		}
 	}
 
@@ -2,10 +2,12 @@ package dynmux
 
 import (
 	"context"
+	"io"
 	"testing"
 
 	"github.com/brendoncarroll/go-p2p"
 	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -42,3 +44,81 @@ func TestMux(t *testing.T) {
 	assert.Equal(t, "hello foo", recvFoo)
 	assert.Equal(t, "hello bar", recvBar)
 }
+
+func TestTellEmpty(t *testing.T) {
+	r := memswarm.NewRealm()
+	m1 := MultiplexSwarm(r.NewSwarm())
+	m2 := MultiplexSwarm(r.NewSwarm())
+	m1foo, err := m1.Open("foo")
+	require.Nil(t, err)
+	m2foo, err := m2.Open("foo")
+	require.Nil(t, err)
+	swarmtest.TestTellEmpty(t, m2foo, m1foo)
+}
+
+func TestLookupStats(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	type failure struct {
+		addr p2p.Addr
+		name string
+	}
+	failures := make(chan failure, 1)
+	m1 := MultiplexSwarm(r.NewSwarm())
+	m2 := MultiplexSwarm(r.NewSwarm(), WithOnLookupFailure(func(addr p2p.Addr, name string, err error) {
+		require.Error(t, err)
+		failures <- failure{addr: addr, name: name}
+	}))
+	m1bar, err := m1.Open("bar")
+	require.Nil(t, err)
+	m2foo, err := m2.Open("foo")
+	require.Nil(t, err)
+	m2bar, err := m2.Open("bar")
+	require.Nil(t, err)
+	go m1bar.ServeTells(p2p.NoOpTellHandler)
+	dst := m1.LocalAddrs()[0]
+
+	// m1 doesn't have a foo channel
+	require.Error(t, m2foo.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, failure{addr: dst, name: "foo"}, <-failures)
+	require.NoError(t, m2bar.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, m2bar.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, map[string]LookupStats{
+		"foo": {Failed: 1},
+		"bar": {Succeeded: 2},
+	}, m2.LookupStats())
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	s1 := r.NewSwarm()
+	s2 := r.NewSwarm()
+
+	m1 := MultiplexSwarm(s1)
+	m2 := MultiplexSwarm(s2, WithMaxResponseSize(10))
+
+	m1foo, err := m1.OpenAsk("foo")
+	require.Nil(t, err)
+	m2foo, err := m2.OpenAsk("foo")
+	require.Nil(t, err)
+	go m1foo.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write(msg.Payload)
+	})
+	go m2foo.ServeAsks(p2p.NoOpAskHandler)
+
+	dst := m1foo.LocalAddrs()[0]
+	resp, err := m2foo.Ask(ctx, dst, p2p.IOVec{[]byte("short")})
+	require.Nil(t, err)
+	assert.Equal(t, "short", string(resp))
+	_, err = m2foo.Ask(ctx, dst, p2p.IOVec{[]byte("much too long")})
+	require.Equal(t, p2p.ErrResponseTooLarge, err)
+}
+
+func TestDoubleClose(t *testing.T) {
+	m := MultiplexSwarm(memswarm.NewRealm().NewSwarm())
+	x, err := m.Open("foo")
+	require.NoError(t, err)
+	swarmtest.TestDoubleClose(t, x)
+	require.Equal(t, p2p.ErrSwarmClosed, x.ServeTells(p2p.NoOpTellHandler))
+}
@@ -0,0 +1,24 @@
+package dynmux
+
+import "github.com/brendoncarroll/go-p2p"
+
+type Option func(m *muxer)
+
+// WithOnLookupFailure sets a function to be called whenever a Tell or Ask on the channel name to addr fails,
+// because the channel could not be looked up on addr.
+// This is usually because the peer has not opened a channel with that name.
+func WithOnLookupFailure(fn func(addr p2p.Addr, name string, err error)) Option {
+	return func(m *muxer) {
+		m.onLookupFailure = fn
+	}
+}
+
+// WithMaxResponseSize sets the largest response Ask will return from any of the muxer's swarms.
+// Larger responses are discarded and Ask returns p2p.ErrResponseTooLarge.
+// The response has already been read by the underlying swarm by then, so it should also
+// be configured to limit responses, if it supports that.
+func WithMaxResponseSize(n int) Option {
+	return func(m *muxer) {
+		m.maxResponseSize = n
+	}
+}
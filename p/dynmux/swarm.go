@@ -55,7 +55,14 @@ func (s *baseSwarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]b
 	msg := Message{}
 	msg.SetChannel(i)
 	msg.SetData(p2p.VecBytes(data))
-	return innerSwarm.Ask(ctx, addr, p2p.IOVec{msg})
+	resp, err := innerSwarm.Ask(ctx, addr, p2p.IOVec{msg})
+	if err != nil {
+		return nil, err
+	}
+	if s.m.maxResponseSize > 0 && len(resp) > s.m.maxResponseSize {
+		return nil, p2p.ErrResponseTooLarge
+	}
+	return resp, nil
 }
 
 func (s *baseSwarm) MTU(ctx context.Context, addr p2p.Addr) int {
@@ -0,0 +1,435 @@
+// Package holepunch coordinates UDP hole punching between two peers behind NATs.
+//
+// The peers exchange their candidate addresses over a relay, and then both send punch packets
+// to each other's candidates at the same time, so each NAT sees outbound traffic to the other peer
+// before the other peer's packets arrive.
+// Once a punch or its acknowledgement is received, the direct path is open,
+// and traffic can move off the relay.
+//
+// The initiator measures the round trip time of the address exchange,
+// and then tells the responder to start punching and waits half of it before starting itself,
+// so the responder's first punch and its own are sent at about the same time.
+package holepunch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+const (
+	// DefaultAttempts is the default number of rounds of punches sent to the remote candidates.
+	DefaultAttempts = 10
+	// DefaultInterval is the default time between rounds of punches.
+	DefaultInterval = 50 * time.Millisecond
+	// SyncTimeout is how long a responder waits for the initiator's sync after replying to its connect.
+	SyncTimeout = 10 * time.Second
+	// MaxCandidates is the most candidates punched for a peer, any more it sends are ignored.
+	MaxCandidates = 8
+	// MaxAccepted is the most connects a responder waits on syncs for at once.
+	MaxAccepted = 256
+	// AcceptInterval is how long a responder ignores connects from a peer after accepting one from it.
+	AcceptInterval = time.Second
+)
+
+// ErrPunchFailed is returned by Connect when none of the peer's candidates responded to punches.
+var ErrPunchFailed = errors.New("holepunch: no direct path was found")
+
+type Params struct {
+	// Relay is used to exchange candidate addresses with peers, and to synchronize punching.
+	// It must not be used for anything else.
+	Relay p2p.Swarm
+	// Direct is the swarm punches are sent on, usually a UDP swarm.
+	Direct p2p.Swarm
+	// Candidates returns the addresses on Direct which peers should punch.
+	// It defaults to Direct.LocalAddrs, but should include addresses observed from outside the NAT, if they are known.
+	Candidates func() []p2p.Addr
+	// Allow reports whether to punch for the peer at relayAddr on the relay, when it starts a Connect.
+	// Connects from peers it does not allow are ignored, and if it is nil every connect is ignored,
+	// so only peers which Connect is called for can be punched to.
+	Allow func(relayAddr p2p.Addr) bool
+	// OnConnected, if set, is called when a punch started by a peer succeeds.
+	// relayAddr is the peer's address on the relay, and directAddr is its address on the Puncher.
+	OnConnected func(relayAddr, directAddr p2p.Addr)
+	// Attempts is the number of rounds of punches, it defaults to DefaultAttempts.
+	Attempts int
+	// Interval is the time between rounds of punches, it defaults to DefaultInterval.
+	Interval time.Duration
+	// Clock defaults to the real clock.
+	Clock clockwork.Clock
+}
+
+var _ p2p.Swarm = &Puncher{}
+
+// Puncher is a Swarm on top of the direct swarm, which can punch holes to peers on the relay.
+// It receives punches on the direct swarm, so other messages on the direct swarm must be sent through the Puncher.
+type Puncher struct {
+	p2p.Swarm
+	relay       p2p.Swarm
+	candidates  func() []p2p.Addr
+	allow       func(relayAddr p2p.Addr) bool
+	onConnected func(relayAddr, directAddr p2p.Addr)
+	attempts    int
+	interval    time.Duration
+	clock       clockwork.Clock
+
+	tells     *swarmutil.TellHub
+	closeOnce swarmutil.CloseOnce
+
+	mu sync.Mutex
+	// connecting holds the attempts started by Connect which are waiting for the responder's candidates.
+	connecting map[uint64]*connecting
+
+	// accepted holds the candidates of initiators which are waiting to send a sync.
+	accepted *swarmutil.Pool[uint64, *accepted]
+	// acceptedFrom holds the relay addresses of initiators which had a connect accepted in the last AcceptInterval.
+	acceptedFrom *swarmutil.Pool[string, struct{}]
+	// punches holds the attempts which are sending punches, and those which finished recently,
+	// so punches which arrive after an attempt succeeds are still acknowledged.
+	punches *swarmutil.Pool[uint64, *punch]
+}
+
+// connecting is an attempt waiting for the reply from the responder at relayAddr.
+type connecting struct {
+	relayAddr p2p.Addr
+	ch        chan *connectMsg
+}
+
+type accepted struct {
+	relayAddr p2p.Addr
+	addrs     []p2p.Addr
+}
+
+// punch is an attempt which is sending punches.
+// addr is set to the address a punch or ack was received from, before done is closed.
+type punch struct {
+	once sync.Once
+	done chan struct{}
+	addr p2p.Addr
+}
+
+func (p *punch) complete(addr p2p.Addr) {
+	p.once.Do(func() {
+		p.addr = addr
+		close(p.done)
+	})
+}
+
+func New(params Params) *Puncher {
+	if params.Candidates == nil {
+		params.Candidates = params.Direct.LocalAddrs
+	}
+	if params.Allow == nil {
+		params.Allow = func(p2p.Addr) bool { return false }
+	}
+	if params.Attempts == 0 {
+		params.Attempts = DefaultAttempts
+	}
+	if params.Interval == 0 {
+		params.Interval = DefaultInterval
+	}
+	if params.Clock == nil {
+		params.Clock = clockwork.NewRealClock()
+	}
+	p := &Puncher{
+		Swarm:       params.Direct,
+		relay:       params.Relay,
+		candidates:  params.Candidates,
+		allow:       params.Allow,
+		onConnected: params.OnConnected,
+		attempts:    params.Attempts,
+		interval:    params.Interval,
+		clock:       params.Clock,
+
+		tells:      swarmutil.NewTellHub(),
+		connecting: make(map[uint64]*connecting),
+		accepted: swarmutil.NewPool(swarmutil.PoolParams[uint64, *accepted]{
+			TTL:     SyncTimeout,
+			MaxSize: MaxAccepted,
+			Clock:   params.Clock,
+		}),
+		acceptedFrom: swarmutil.NewPool(swarmutil.PoolParams[string, struct{}]{
+			TTL:     AcceptInterval,
+			MaxSize: MaxAccepted,
+			Clock:   params.Clock,
+		}),
+		punches: swarmutil.NewPool(swarmutil.PoolParams[uint64, *punch]{
+			TTL:   2 * time.Duration(params.Attempts) * params.Interval,
+			Clock: params.Clock,
+		}),
+	}
+	go func() {
+		if err := p.relay.ServeTells(p.handleRelay); err != nil && err != p2p.ErrSwarmClosed {
+			log.Error("holepunch: relay stopped serving: ", err)
+		}
+	}()
+	go func() {
+		if err := p.Swarm.ServeTells(p.handleDirect); err != nil && err != p2p.ErrSwarmClosed {
+			log.Error("holepunch: direct swarm stopped serving: ", err)
+		}
+	}()
+	return p
+}
+
+// Connect punches a hole to the peer at relayAddr on the relay, and returns its address on the Puncher.
+// The peer must also be running a Puncher on the relay, which allows this Puncher's relay address.
+// ErrPunchFailed is returned if none of the peer's candidates could be reached.
+func (p *Puncher) Connect(ctx context.Context, relayAddr p2p.Addr) (p2p.Addr, error) {
+	id := newAttemptID()
+	ch := make(chan *connectMsg, 1)
+	p.mu.Lock()
+	p.connecting[id] = &connecting{relayAddr: relayAddr, ch: ch}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.connecting, id)
+		p.mu.Unlock()
+	}()
+
+	start := p.clock.Now()
+	if err := p.sendRelay(ctx, relayAddr, relayMessage{Connect: p.newConnect(id)}); err != nil {
+		return nil, err
+	}
+	var reply *connectMsg
+	select {
+	case reply = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	rtt := p.clock.Since(start)
+	addrs := p.parseCandidates(reply.Addrs)
+
+	pu := p.newPunch(id)
+	// the sync takes about half the round trip to reach the responder, which starts punching when it arrives.
+	// the wait is measured from before the send, in case sending blocks until delivery.
+	syncAt := p.clock.Now().Add(rtt / 2)
+	if err := p.sendRelay(ctx, relayAddr, relayMessage{Sync: &syncMsg{ID: id}}); err != nil {
+		return nil, err
+	}
+	if d := syncAt.Sub(p.clock.Now()); d > 0 {
+		timer := p.clock.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.Chan():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return p.punch(ctx, id, pu, addrs)
+}
+
+func (p *Puncher) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	return p.Swarm.Tell(ctx, addr, newDataPacket(data))
+}
+
+func (p *Puncher) ServeTells(fn p2p.TellHandler) error {
+	return p.tells.ServeTells(fn)
+}
+
+func (p *Puncher) MTU(ctx context.Context, addr p2p.Addr) int {
+	return p.Swarm.MTU(ctx, addr) - Overhead
+}
+
+// Close closes the relay and the direct swarm.
+func (p *Puncher) Close() error {
+	return p.closeOnce.Do(func() error {
+		p.tells.CloseWithError(p2p.ErrSwarmClosed)
+		if err := p.relay.Close(); err != nil {
+			return err
+		}
+		return p.Swarm.Close()
+	})
+}
+
+// punch sends rounds of punches to addrs until one of them responds, or the attempts run out.
+func (p *Puncher) punch(ctx context.Context, id uint64, pu *punch, addrs []p2p.Addr) (p2p.Addr, error) {
+	timer := p.clock.NewTimer(p.interval)
+	defer timer.Stop()
+	for i := 0; i < p.attempts; i++ {
+		if i > 0 {
+			timer.Reset(p.interval)
+		}
+		for _, addr := range addrs {
+			if err := p.Swarm.Tell(ctx, addr, newPunchPacket(packetPunch, id)); err != nil {
+				log.WithFields(logrus.Fields{"addr": addr}).Debug("holepunch: error sending punch: ", err)
+			}
+		}
+		select {
+		case <-pu.done:
+			return pu.addr, nil
+		case <-ctx.Done():
+			p.punches.Delete(id)
+			return nil, ctx.Err()
+		case <-timer.Chan():
+		}
+	}
+	select {
+	case <-pu.done:
+		return pu.addr, nil
+	default:
+	}
+	p.punches.Delete(id)
+	return nil, ErrPunchFailed
+}
+
+func (p *Puncher) newPunch(id uint64) *punch {
+	pu := &punch{done: make(chan struct{})}
+	p.punches.Put(id, pu)
+	return pu
+}
+
+func (p *Puncher) handleRelay(msg *p2p.Message) {
+	var m relayMessage
+	if err := json.Unmarshal(msg.Payload, &m); err != nil {
+		log.WithFields(logrus.Fields{"src": msg.Src}).Warn("holepunch: could not parse relay message: ", err)
+		return
+	}
+	switch {
+	case m.Connect != nil:
+		p.mu.Lock()
+		c, isReply := p.connecting[m.Connect.ID]
+		p.mu.Unlock()
+		if isReply {
+			if c.relayAddr.Key() != msg.Src.Key() {
+				log.WithFields(logrus.Fields{"src": msg.Src}).Warn("holepunch: ignoring reply from peer the connect was not sent to")
+				return
+			}
+			select {
+			case c.ch <- m.Connect:
+			default:
+			}
+			return
+		}
+		if !p.allow(msg.Src) {
+			log.WithFields(logrus.Fields{"src": msg.Src}).Debug("holepunch: ignoring connect from peer which is not allowed")
+			return
+		}
+		if a, ok := p.accepted.Get(m.Connect.ID); ok && a.relayAddr.Key() != msg.Src.Key() {
+			log.WithFields(logrus.Fields{"src": msg.Src}).Warn("holepunch: ignoring connect, its id was accepted from another peer")
+			return
+		}
+		if _, ok := p.acceptedFrom.Get(msg.Src.Key()); ok {
+			log.WithFields(logrus.Fields{"src": msg.Src}).Debug("holepunch: ignoring connect, one was accepted recently")
+			return
+		}
+		p.acceptedFrom.Put(msg.Src.Key(), struct{}{})
+		p.accepted.Put(m.Connect.ID, &accepted{
+			relayAddr: msg.Src,
+			addrs:     p.parseCandidates(m.Connect.Addrs),
+		})
+		// reply from a new goroutine, since the relay may deliver the reply before this handler returns.
+		go func() {
+			ctx, cf := context.WithTimeout(context.Background(), SyncTimeout)
+			defer cf()
+			if err := p.sendRelay(ctx, msg.Src, relayMessage{Connect: p.newConnect(m.Connect.ID)}); err != nil {
+				log.WithFields(logrus.Fields{"dst": msg.Src}).Warn("holepunch: error replying to connect: ", err)
+			}
+		}()
+	case m.Sync != nil:
+		a, ok := p.accepted.Get(m.Sync.ID)
+		if !ok {
+			return
+		}
+		if a.relayAddr.Key() != msg.Src.Key() {
+			log.WithFields(logrus.Fields{"src": msg.Src}).Warn("holepunch: ignoring sync from peer the connect was not accepted from")
+			return
+		}
+		p.accepted.Delete(m.Sync.ID)
+		pu := p.newPunch(m.Sync.ID)
+		go func() {
+			ctx, cf := context.WithTimeout(context.Background(), SyncTimeout)
+			defer cf()
+			addr, err := p.punch(ctx, m.Sync.ID, pu, a.addrs)
+			if err != nil {
+				log.WithFields(logrus.Fields{"peer": a.relayAddr}).Debug("holepunch: ", err)
+				return
+			}
+			if p.onConnected != nil {
+				p.onConnected(a.relayAddr, addr)
+			}
+		}()
+	}
+}
+
+func (p *Puncher) handleDirect(msg *p2p.Message) {
+	packetType, id, body, err := parsePacket(msg.Payload)
+	if err != nil {
+		log.WithFields(logrus.Fields{"src": msg.Src}).Debug(err)
+		return
+	}
+	switch packetType {
+	case packetData:
+		p.tells.DeliverTell(&p2p.Message{Src: msg.Src, Dst: msg.Dst, Payload: body})
+	case packetPunch, packetAck:
+		pu, ok := p.punches.Get(id)
+		if !ok {
+			return
+		}
+		if packetType == packetPunch {
+			ctx, cf := context.WithTimeout(context.Background(), p.interval)
+			defer cf()
+			if err := p.Swarm.Tell(ctx, msg.Src, newPunchPacket(packetAck, id)); err != nil {
+				log.WithFields(logrus.Fields{"dst": msg.Src}).Debug("holepunch: error sending ack: ", err)
+			}
+		}
+		pu.complete(msg.Src)
+	}
+}
+
+func (p *Puncher) newConnect(id uint64) *connectMsg {
+	var addrs []string
+	for _, addr := range p.candidates() {
+		data, err := addr.MarshalText()
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, string(data))
+	}
+	return &connectMsg{ID: id, Addrs: addrs}
+}
+
+// parseCandidates parses the candidates sent by a peer, leaving out those the direct swarm can't parse,
+// and any after the first MaxCandidates.
+func (p *Puncher) parseCandidates(xs []string) []p2p.Addr {
+	var addrs []p2p.Addr
+	for _, x := range xs {
+		if len(addrs) >= MaxCandidates {
+			log.Debug("holepunch: dropping candidates after ", MaxCandidates)
+			break
+		}
+		addr, err := p.Swarm.ParseAddr([]byte(x))
+		if err != nil {
+			log.Debug("holepunch: dropping candidate: ", err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (p *Puncher) sendRelay(ctx context.Context, dst p2p.Addr, m relayMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return p.relay.Tell(ctx, dst, p2p.IOVec{data})
+}
+
+func newAttemptID() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
@@ -0,0 +1,237 @@
+package holepunch
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPunch(t *testing.T) {
+	ctx := context.Background()
+	relayRealm, directRealm := memswarm.NewRealm(), memswarm.NewRealm()
+	connected := make(chan [2]p2p.Addr, 1)
+	a, _ := newTestPuncher(t, relayRealm, directRealm, Params{})
+	b, _ := newTestPuncher(t, relayRealm, directRealm, Params{
+		Allow: allowAll,
+		OnConnected: func(relayAddr, directAddr p2p.Addr) {
+			connected <- [2]p2p.Addr{relayAddr, directAddr}
+		},
+	})
+	recvA, recvB := make(chan string, 1), make(chan string, 1)
+	go a.ServeTells(func(msg *p2p.Message) { recvA <- string(msg.Payload) })
+	go b.ServeTells(func(msg *p2p.Message) { recvB <- string(msg.Payload) })
+
+	addr, err := a.Connect(ctx, b.relay.LocalAddrs()[0])
+	require.NoError(t, err)
+	require.Equal(t, b.LocalAddrs()[0], addr)
+	conn := <-connected
+	require.Equal(t, a.relay.LocalAddrs()[0], conn[0])
+	require.Equal(t, a.LocalAddrs()[0], conn[1])
+
+	// traffic flows directly in both directions
+	require.NoError(t, a.Tell(ctx, addr, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, "hello", <-recvB)
+	require.NoError(t, b.Tell(ctx, conn[1], p2p.IOVec{[]byte("hi")}))
+	require.Equal(t, "hi", <-recvA)
+}
+
+func TestSimultaneousPunch(t *testing.T) {
+	ctx := context.Background()
+	const latency = 100 * time.Millisecond
+	relayRealm := memswarm.NewRealm(memswarm.WithClock(clockwork.NewRealClock()), memswarm.WithLatency(latency))
+	directRealm := memswarm.NewRealm()
+	a, aNAT := newTestPuncher(t, relayRealm, directRealm, Params{})
+	b, bNAT := newTestPuncher(t, relayRealm, directRealm, Params{Allow: allowAll})
+
+	_, err := a.Connect(ctx, b.relay.LocalAddrs()[0])
+	require.NoError(t, err)
+	// the initiator waits for the sync to reach the responder before punching, so they start together.
+	aFirst, bFirst := aNAT.firstTell(), bNAT.firstTell()
+	require.False(t, aFirst.IsZero())
+	require.False(t, bFirst.IsZero())
+	diff := aFirst.Sub(bFirst)
+	if diff < 0 {
+		diff = -diff
+	}
+	require.Less(t, int64(diff), int64(latency/2))
+}
+
+func TestPunchFailed(t *testing.T) {
+	ctx := context.Background()
+	relayRealm, directRealm := memswarm.NewRealm(), memswarm.NewRealm()
+	a, _ := newTestPuncher(t, relayRealm, directRealm, Params{Attempts: 3, Interval: time.Millisecond})
+	// b's only candidate is not its own address, so punches never reach it.
+	other := directRealm.NewSwarm()
+	defer other.Close()
+	go other.ServeTells(p2p.NoOpTellHandler)
+	b, _ := newTestPuncher(t, relayRealm, directRealm, Params{
+		Allow:      allowAll,
+		Candidates: other.LocalAddrs,
+		Attempts:   3,
+		Interval:   time.Millisecond,
+	})
+	_, err := a.Connect(ctx, b.relay.LocalAddrs()[0])
+	require.Equal(t, ErrPunchFailed, err)
+}
+
+func TestConnectNotAllowed(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cf()
+	relayRealm, directRealm := memswarm.NewRealm(), memswarm.NewRealm()
+	a, _ := newTestPuncher(t, relayRealm, directRealm, Params{})
+	b, bNAT := newTestPuncher(t, relayRealm, directRealm, Params{
+		Allow: func(relayAddr p2p.Addr) bool { return false },
+	})
+	_, err := a.Connect(ctx, b.relay.LocalAddrs()[0])
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, bNAT.firstTell().IsZero())
+}
+
+func TestAcceptInterval(t *testing.T) {
+	relayRealm, directRealm := memswarm.NewRealm(), memswarm.NewRealm()
+	clock := clockwork.NewFakeClock()
+	a, _ := newTestPuncher(t, relayRealm, directRealm, Params{})
+	b, _ := newTestPuncher(t, relayRealm, directRealm, Params{Allow: allowAll, Clock: clock})
+	connect := func(id uint64) {
+		data, err := json.Marshal(relayMessage{Connect: &connectMsg{ID: id}})
+		require.NoError(t, err)
+		b.handleRelay(&p2p.Message{Src: a.relay.LocalAddrs()[0], Payload: data})
+	}
+	connect(1)
+	connect(2)
+	require.Equal(t, 1, b.accepted.Len())
+	clock.Advance(AcceptInterval)
+	connect(3)
+	require.Equal(t, 2, b.accepted.Len())
+}
+
+func TestForgedRelayMessages(t *testing.T) {
+	relayRealm, directRealm := memswarm.NewRealm(), memswarm.NewRealm()
+	a, _ := newTestPuncher(t, relayRealm, directRealm, Params{})
+	b, _ := newTestPuncher(t, relayRealm, directRealm, Params{Allow: allowAll})
+	c := relayRealm.NewSwarm()
+	defer c.Close()
+	send := func(p *Puncher, src p2p.Addr, m relayMessage) {
+		data, err := json.Marshal(m)
+		require.NoError(t, err)
+		p.handleRelay(&p2p.Message{Src: src, Payload: data})
+	}
+
+	// a reply to a's connect is only taken from the responder it was sent to
+	ch := make(chan *connectMsg, 1)
+	a.mu.Lock()
+	a.connecting[1] = &connecting{relayAddr: b.relay.LocalAddrs()[0], ch: ch}
+	a.mu.Unlock()
+	send(a, c.LocalAddrs()[0], relayMessage{Connect: &connectMsg{ID: 1}})
+	require.Len(t, ch, 0)
+	send(a, b.relay.LocalAddrs()[0], relayMessage{Connect: &connectMsg{ID: 1}})
+	require.Len(t, ch, 1)
+
+	// a sync is only taken from the initiator whose connect was accepted
+	send(b, a.relay.LocalAddrs()[0], relayMessage{Connect: &connectMsg{ID: 2}})
+	send(b, c.LocalAddrs()[0], relayMessage{Connect: &connectMsg{ID: 2}})
+	send(b, c.LocalAddrs()[0], relayMessage{Sync: &syncMsg{ID: 2}})
+	require.Equal(t, 1, b.accepted.Len())
+	require.Equal(t, 0, b.punches.Len())
+	acc, ok := b.accepted.Get(2)
+	require.True(t, ok)
+	require.Equal(t, a.relay.LocalAddrs()[0], acc.relayAddr)
+	send(b, a.relay.LocalAddrs()[0], relayMessage{Sync: &syncMsg{ID: 2}})
+	require.Equal(t, 0, b.accepted.Len())
+	require.Equal(t, 1, b.punches.Len())
+}
+
+func TestMaxCandidates(t *testing.T) {
+	p, _ := newTestPuncher(t, memswarm.NewRealm(), memswarm.NewRealm(), Params{})
+	var xs []string
+	for i := 0; i < 2*MaxCandidates; i++ {
+		data, err := memswarm.Addr{N: i}.MarshalText()
+		require.NoError(t, err)
+		xs = append(xs, string(data))
+	}
+	require.Len(t, p.parseCandidates(xs), MaxCandidates)
+}
+
+func TestNATSwarm(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a, b := &natSwarm{Swarm: r.NewSwarm()}, &natSwarm{Swarm: r.NewSwarm()}
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan string, 1)
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(func(msg *p2p.Message) { recv <- string(msg.Payload) })
+	aAddr, bAddr := a.LocalAddrs()[0], b.LocalAddrs()[0]
+
+	// unsolicited messages are dropped
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("1")}))
+	require.Len(t, recv, 0)
+	// once b has sent to a, messages from a are let in
+	require.NoError(t, b.Tell(ctx, aAddr, p2p.IOVec{[]byte("2")}))
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("3")}))
+	require.Equal(t, "3", <-recv)
+}
+
+func allowAll(p2p.Addr) bool {
+	return true
+}
+
+// newTestPuncher creates a Puncher on relayRealm, with a direct swarm on directRealm behind a simulated NAT.
+func newTestPuncher(t testing.TB, relayRealm, directRealm *memswarm.Realm, params Params) (*Puncher, *natSwarm) {
+	nat := &natSwarm{Swarm: directRealm.NewSwarm()}
+	params.Relay = relayRealm.NewSwarm()
+	params.Direct = nat
+	p := New(params)
+	t.Cleanup(func() {
+		require.NoError(t, p.Close())
+	})
+	return p, nat
+}
+
+// natSwarm simulates an address restricted NAT.
+// Messages from an address are dropped unless a message has been sent to that address.
+type natSwarm struct {
+	p2p.Swarm
+
+	mu     sync.Mutex
+	opened map[string]bool
+	first  time.Time
+}
+
+func (s *natSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	s.mu.Lock()
+	if s.opened == nil {
+		s.opened = make(map[string]bool)
+	}
+	s.opened[addr.Key()] = true
+	if s.first.IsZero() {
+		s.first = time.Now()
+	}
+	s.mu.Unlock()
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+func (s *natSwarm) ServeTells(fn p2p.TellHandler) error {
+	return s.Swarm.ServeTells(func(msg *p2p.Message) {
+		s.mu.Lock()
+		open := s.opened[msg.Src.Key()]
+		s.mu.Unlock()
+		if open {
+			fn(msg)
+		}
+	})
+}
+
+// firstTell returns when the first message was sent, or the zero time if none have been.
+func (s *natSwarm) firstTell() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.first
+}
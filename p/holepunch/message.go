@@ -0,0 +1,73 @@
+package holepunch
+
+import (
+	"encoding/binary"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/pkg/errors"
+)
+
+// relayMessage is sent over the relay, encoded as JSON.
+// Exactly one of the fields is set.
+type relayMessage struct {
+	// Connect is sent by the initiator to start an attempt, and by the responder in reply.
+	Connect *connectMsg `json:"connect,omitempty"`
+	// Sync is sent by the initiator, and tells the responder to start punching.
+	Sync *syncMsg `json:"sync,omitempty"`
+}
+
+type connectMsg struct {
+	ID    uint64   `json:"id"`
+	Addrs []string `json:"addrs"`
+}
+
+type syncMsg struct {
+	ID uint64 `json:"id"`
+}
+
+// Every message on the direct swarm starts with a packet type.
+// Punches and acks are followed by the id of the attempt, and data packets by the application's message.
+const (
+	packetData = uint8(iota)
+	packetPunch
+	packetAck
+)
+
+// Overhead is the size of the header added to each message on the direct swarm.
+const Overhead = 1
+
+const punchSize = 1 + 8
+
+var dataHeader = []byte{packetData}
+
+func newDataPacket(data p2p.IOVec) p2p.IOVec {
+	msg := make(p2p.IOVec, 0, 1+len(data))
+	msg = append(msg, dataHeader)
+	return append(msg, data...)
+}
+
+func newPunchPacket(packetType uint8, id uint64) p2p.IOVec {
+	buf := make([]byte, punchSize)
+	buf[0] = packetType
+	binary.BigEndian.PutUint64(buf[1:], id)
+	return p2p.IOVec{buf}
+}
+
+// parsePacket returns the type of x, and either the id of a punch or ack, or the body of a data packet.
+func parsePacket(x []byte) (packetType uint8, id uint64, body []byte, err error) {
+	if len(x) < 1 {
+		return 0, 0, nil, errors.Errorf("holepunch: empty packet")
+	}
+	packetType = x[0]
+	switch packetType {
+	case packetData:
+		return packetType, 0, x[1:], nil
+	case packetPunch, packetAck:
+		if len(x) != punchSize {
+			return 0, 0, nil, errors.Errorf("holepunch: punch packet is %d bytes", len(x))
+		}
+		return packetType, binary.BigEndian.Uint64(x[1:]), nil, nil
+	default:
+		return 0, 0, nil, errors.Errorf("holepunch: unknown packet type %d", packetType)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/framing"
 	"github.com/brendoncarroll/go-p2p/s/swarmutil"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
@@ -205,8 +206,9 @@ type muxedSwarm struct {
 	c uint64
 	m *muxCore
 
-	tellHub *swarmutil.TellHub
-	askHub  *swarmutil.AskHub
+	tellHub   *swarmutil.TellHub
+	askHub    *swarmutil.AskHub
+	closeOnce swarmutil.CloseOnce
 }
 
 func newMuxedSwarm(m *muxCore, c uint64) *muxedSwarm {
@@ -246,16 +248,18 @@ func (ms *muxedSwarm) MTU(ctx context.Context, addr p2p.Addr) int {
 	return ms.m.swarm.MTU(ctx, addr) - binary.MaxVarintLen64
 }
 
+// Close closes the channel.
+// Calling it more than once does nothing, even if the channel has been opened again by another swarm.
 func (ms *muxedSwarm) Close() error {
-	ms.tellHub.CloseWithError(p2p.ErrSwarmClosed)
-	ms.askHub.CloseWithError(p2p.ErrSwarmClosed)
-	return ms.m.close(ms.c)
+	return ms.closeOnce.Do(func() error {
+		ms.tellHub.CloseWithError(p2p.ErrSwarmClosed)
+		ms.askHub.CloseWithError(p2p.ErrSwarmClosed)
+		return ms.m.close(ms.c)
+	})
 }
 
 func makeMessage(c uint64, data p2p.IOVec) p2p.IOVec {
-	header := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutUvarint(header, c)
-	header = header[:n]
+	header := framing.AppendUvarint(nil, c)
 
 	ret := p2p.IOVec{}
 	ret = append(ret, header)
@@ -264,9 +268,9 @@ func makeMessage(c uint64, data p2p.IOVec) p2p.IOVec {
 }
 
 func readMessage(data []byte) (uint64, []byte, error) {
-	c, n := binary.Uvarint(data)
-	if n < 1 {
-		return 0, nil, errors.Errorf("intmux: could not read message")
+	c, rest, err := framing.ReadUvarint(data)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "intmux: could not read message")
 	}
-	return c, data[n:], nil
+	return c, rest, nil
 }
@@ -2,6 +2,8 @@ package kademlia
 
 import (
 	"bytes"
+	"fmt"
+	"sort"
 )
 
 type Entry struct {
@@ -9,14 +11,60 @@ type Entry struct {
 	Value interface{}
 }
 
+// EvictionPolicy chooses which entry Put evicts when the cache is full.
+// It is called with the entries of the bucket farthest from the locus which has more than minPerBucket entries,
+// in no particular order, and returns the index of the entry to evict.
+// Policies can use anything stored in Entry.Value, such as when a peer was last seen, or its RTT.
+type EvictionPolicy func(ents []Entry) int
+
+// EvictAny evicts an arbitrary entry from the bucket.
+// A cache without an EvictionPolicy behaves the same way, but doesn't build the slice of entries to choose from.
+func EvictAny(ents []Entry) int {
+	return 0
+}
+
+type CacheOption func(*Cache)
+
+// WithEvictionPolicy sets the EvictionPolicy used by the cache.
+// Without it, an arbitrary entry is evicted, as with EvictAny.
+func WithEvictionPolicy(p EvictionPolicy) CacheOption {
+	if p == nil {
+		panic("nil EvictionPolicy")
+	}
+	return func(kc *Cache) {
+		kc.evictionPolicy = p
+	}
+}
+
 type Cache struct {
-	locus        []byte
-	minPerBucket int
-	count, max   int
-	buckets      []map[string]Entry
+	locus          []byte
+	minPerBucket   int
+	count, max     int
+	evictionPolicy EvictionPolicy
+	buckets        []map[string]Entry
+	// evictions and rejections count entries removed to make room, and new entries which Put did not keep.
+	evictions, rejections uint64
+}
+
+// CacheMetrics is a snapshot of the health of a Cache, see Cache.Metrics.
+type CacheMetrics struct {
+	// Count is the number of entries in the cache.
+	Count int
+	// Buckets is the number of entries in each bucket.
+	// Bucket i holds the entries which share exactly i leading bits with the locus.
+	Buckets []int
+	// Evictions is the number of entries which have been evicted to make room for another entry.
+	Evictions uint64
+	// Rejections is the number of new entries which were evicted by the Put that added them.
+	// Keys which Observe does not add are not counted, since they were never put.
+	Rejections uint64
+	// AcceptingPrefixLen is the result of Cache.AcceptingPrefixLen.
+	AcceptingPrefixLen int
 }
 
-func NewCache(locus []byte, max, minPerBucket int) *Cache {
+// NewCache returns a cache holding at most max entries, see CacheSize.
+// Entries in buckets with minPerBucket or fewer entries are never evicted.
+func NewCache(locus []byte, max, minPerBucket int, opts ...CacheOption) *Cache {
 	if max < 1 {
 		panic("max < 1")
 	}
@@ -25,9 +73,22 @@ func NewCache(locus []byte, max, minPerBucket int) *Cache {
 		max:          max,
 		locus:        locus,
 	}
+	for _, opt := range opts {
+		opt(kc)
+	}
 	return kc
 }
 
+// CacheSize returns the max for a cache which can hold k entries in each of its farthest buckets,
+// like the routing table in the Kademlia paper.
+// Closer buckets hold fewer keys, so a full cache has more buckets than that.
+func CacheSize(k, buckets int) int {
+	if k < 1 || buckets < 1 {
+		panic(fmt.Sprintf("k and buckets must be at least 1, got %d and %d", k, buckets))
+	}
+	return k * buckets
+}
+
 // Get returns the value at key
 func (kc *Cache) Get(key []byte) interface{} {
 	b := kc.bucket(key)
@@ -50,16 +111,45 @@ func (kc *Cache) Put(key []byte, v interface{}) (evicted *Entry) {
 		kc.buckets = append(kc.buckets, map[string]Entry{})
 	}
 	b := kc.buckets[lz]
-	if _, exists := b[string(e.Key)]; !exists {
+	_, exists := b[string(e.Key)]
+	if !exists {
 		kc.count++
 	}
 	b[string(e.Key)] = e
 
 	needToEvict := kc.count > kc.max
-	if needToEvict {
-		return kc.evict()
+	if !needToEvict {
+		return nil
 	}
-	return nil
+	evicted = kc.evict()
+	switch {
+	case evicted == nil:
+	case !exists && bytes.Equal(evicted.Key, key):
+		kc.rejections++
+	default:
+		kc.evictions++
+	}
+	return evicted
+}
+
+// ReplaceAll replaces every entry in the cache with ents, which are Put in order.
+// The buckets are rebuilt from the cache's locus, and entries are evicted as if they had been Put one at a time.
+// The new buckets are built before any of the old ones are removed,
+// so callers who hold a lock around the cache never see a partially replaced cache.
+// It returns the entries which were evicted to stay under the maximum size.
+func (kc *Cache) ReplaceAll(ents []Entry) (evicted []Entry) {
+	fresh := NewCache(kc.locus, kc.max, kc.minPerBucket)
+	fresh.evictionPolicy = kc.evictionPolicy
+	for _, e := range ents {
+		if ev := fresh.Put(e.Key, e.Value); ev != nil {
+			evicted = append(evicted, *ev)
+		}
+	}
+	kc.buckets = fresh.buckets
+	kc.count = fresh.count
+	kc.evictions += fresh.evictions
+	kc.rejections += fresh.rejections
+	return evicted
 }
 
 // WouldAdd returns true if the key would add a new entry
@@ -89,6 +179,33 @@ func (kc *Cache) WouldPut(key []byte) bool {
 	return false
 }
 
+// Observe adds key to the cache if it improves the cache, and returns true if it was added.
+// If key is already in the cache its value is replaced, but it is not considered added.
+// Once the cache is full, key is only added if there is an entry farther from the locus
+// in a bucket with more than minPerBucket entries, which is evicted to make room.
+// Entries in buckets with minPerBucket or fewer entries are never evicted.
+func (kc *Cache) Observe(key []byte, v interface{}) bool {
+	if b := kc.bucket(key); b != nil {
+		if _, exists := b[string(key)]; exists {
+			b[string(key)] = Entry{Key: key, Value: v}
+			return false
+		}
+	}
+	if kc.count < kc.max {
+		kc.Put(key, v)
+		return true
+	}
+	lz := kc.bucketIndex(key)
+	for i := 0; i < lz && i < len(kc.buckets); i++ {
+		// evict removes from the farthest bucket over minPerBucket, which is i
+		if len(kc.buckets[i]) > kc.minPerBucket {
+			kc.Put(key, v)
+			return true
+		}
+	}
+	return false
+}
+
 // Contains returns true if the key is in the cache
 func (kc *Cache) Contains(key []byte) bool {
 	return kc.Get(key) != nil
@@ -106,18 +223,60 @@ func (kc *Cache) Delete(key []byte) *Entry {
 	return &e
 }
 
-func (kc *Cache) ForEach(fn func(e Entry) bool) {
+// IterAction is returned by the function passed to ForEach, to decide what happens next.
+type IterAction uint8
+
+const (
+	// Continue moves on to the next entry.
+	Continue = IterAction(iota)
+	// Stop ends the iteration.
+	Stop
+	// DeleteAndContinue deletes the current entry from the cache, and moves on to the next one.
+	DeleteAndContinue
+)
+
+// ForEach calls fn with every entry in the cache, closest to the locus first, until fn returns Stop.
+// Entries can be pruned during the iteration by returning DeleteAndContinue.
+// fn must not otherwise modify the cache.
+func (kc *Cache) ForEach(fn func(e Entry) IterAction) {
 	// reverse iteration so the closest keys are first
 	for i := len(kc.buckets) - 1; i >= 0; i-- {
 		b := kc.buckets[i]
-		for _, e := range b {
-			if cont := fn(e); !cont {
+		for k, e := range b {
+			switch fn(e) {
+			case Stop:
 				return
+			case DeleteAndContinue:
+				// deleting the current key while ranging over a map is safe.
+				delete(b, k)
+				kc.count--
 			}
 		}
 	}
 }
 
+// Diff compares the cache to other, a later snapshot, and returns the entries which are in other but not the cache,
+// and the entries which are in the cache but not other.
+// Entries are compared by Key only, so an entry whose Value changed is in neither.
+// added and removed are sorted by Key.
+func (kc *Cache) Diff(other *Cache) (added, removed []Entry) {
+	other.ForEach(func(e Entry) IterAction {
+		if !kc.hasKey(e.Key) {
+			added = append(added, e)
+		}
+		return Continue
+	})
+	kc.ForEach(func(e Entry) IterAction {
+		if !other.hasKey(e.Key) {
+			removed = append(removed, e)
+		}
+		return Continue
+	})
+	sortByKey(added)
+	sortByKey(removed)
+	return added, removed
+}
+
 // Closest returns the Entry in the cache where e.Key is closest to key.
 func (kc *Cache) Closest(key []byte) *Entry {
 	b := kc.bucket(key)
@@ -125,6 +284,7 @@ func (kc *Cache) Closest(key []byte) *Entry {
 	var closestEntry *Entry
 	dist := make([]byte, len(kc.locus))
 	for _, e := range b {
+		e := e
 		XORBytes(dist, e.Key, key)
 		if minDist == nil || bytes.Compare(dist, minDist) < 0 {
 			minDist = append([]byte{}, dist...)
@@ -134,6 +294,62 @@ func (kc *Cache) Closest(key []byte) *Entry {
 	return closestEntry
 }
 
+// ClosestN returns up to n entries in the cache, sorted by their distance to key.
+func (kc *Cache) ClosestN(key []byte, n int) []Entry {
+	var ents []Entry
+	kc.ForEachCloser(key, func(e Entry) bool {
+		if len(ents) >= n {
+			return false
+		}
+		ents = append(ents, e)
+		return true
+	})
+	return ents
+}
+
+// ForEachCloser calls fn with entries in increasing XOR distance from target.
+// The ordering is exact: every entry passed to fn is at least as close to target
+// as all of the entries after it.
+// Iteration stops when fn returns false.
+// Only one bucket (or the buckets closer to the locus than target) is sorted at a time, so
+// stopping early avoids sorting the whole cache.
+func (kc *Cache) ForEachCloser(target []byte, fn func(e Entry) bool) {
+	t := kc.bucketIndex(target)
+	emit := func(ents []Entry) bool {
+		SortByDistance(target, ents)
+		for _, e := range ents {
+			if !fn(e) {
+				return false
+			}
+		}
+		return true
+	}
+	// entries in bucket t agree with target on bit t, so they are the closest.
+	if t < len(kc.buckets) {
+		if !emit(bucketEntries(kc.buckets[t])) {
+			return
+		}
+	}
+	// entries in buckets after t all differ from target first at bit t.
+	var ents []Entry
+	for i := t + 1; i < len(kc.buckets); i++ {
+		ents = append(ents, bucketEntries(kc.buckets[i])...)
+	}
+	if !emit(ents) {
+		return
+	}
+	// entries in bucket i < t differ from target first at bit i.
+	last := t - 1
+	if last >= len(kc.buckets) {
+		last = len(kc.buckets) - 1
+	}
+	for i := last; i >= 0; i-- {
+		if !emit(bucketEntries(kc.buckets[i])) {
+			return
+		}
+	}
+}
+
 // IsFull returns whether the cache is full
 // further calls to Put will attempt an eviction.
 func (kc *Cache) IsFull() bool {
@@ -145,6 +361,8 @@ func (kc *Cache) Count() int {
 	return kc.count
 }
 
+// AcceptingPrefixLen returns the number of leading bits a key must share with the locus
+// for the cache to accept it without evicting an entry closer to the locus.
 func (kc *Cache) AcceptingPrefixLen() int {
 	if kc.count+1 < kc.max {
 		return 0
@@ -157,6 +375,30 @@ func (kc *Cache) AcceptingPrefixLen() int {
 	return len(kc.buckets)
 }
 
+// ShouldStore returns true if key is close enough to the locus for a node with this routing cache to store values under it.
+// While the cache has room every key is accepted, since the node may be one of the closest nodes to any key.
+// Once it is full, only keys sharing at least AcceptingPrefixLen leading bits with the locus are accepted;
+// nodes in the cache are closer to the other keys.
+func (kc *Cache) ShouldStore(key []byte) bool {
+	return kc.bucketIndex(key) >= kc.AcceptingPrefixLen()
+}
+
+// Metrics returns a snapshot of the number of entries in the cache and each bucket,
+// and the evictions and rejections since the cache was created.
+func (kc *Cache) Metrics() CacheMetrics {
+	buckets := make([]int, len(kc.buckets))
+	for i, b := range kc.buckets {
+		buckets[i] = len(b)
+	}
+	return CacheMetrics{
+		Count:              kc.count,
+		Buckets:            buckets,
+		Evictions:          kc.evictions,
+		Rejections:         kc.rejections,
+		AcceptingPrefixLen: kc.AcceptingPrefixLen(),
+	}
+}
+
 func (kc *Cache) Locus() []byte {
 	return kc.locus
 }
@@ -184,6 +426,12 @@ func (kc *Cache) bucket(key []byte) map[string]Entry {
 	return nil
 }
 
+// hasKey is like Contains, but is also true for entries with a nil Value.
+func (kc *Cache) hasKey(key []byte) bool {
+	_, exists := kc.bucket(key)[string(key)]
+	return exists
+}
+
 func (kc *Cache) bucketIndex(key []byte) int {
 	dist := make([]byte, len(kc.locus))
 	XORBytes(dist, kc.locus, key)
@@ -203,13 +451,36 @@ func (kc *Cache) evict() *Entry {
 	}
 
 	b := kc.buckets[n]
-	k := getOne(b)
-	ent := b[k]
-	delete(b, k)
+	var ent Entry
+	if kc.evictionPolicy == nil {
+		ent = b[getOne(b)]
+	} else {
+		ents := bucketEntries(b)
+		i := kc.evictionPolicy(ents)
+		if i < 0 || i >= len(ents) {
+			panic(fmt.Sprintf("EvictionPolicy returned %d for %d entries", i, len(ents)))
+		}
+		ent = ents[i]
+	}
+	delete(b, string(ent.Key))
 	kc.count--
 	return &ent
 }
 
+func bucketEntries(b map[string]Entry) []Entry {
+	ents := make([]Entry, 0, len(b))
+	for _, e := range b {
+		ents = append(ents, e)
+	}
+	return ents
+}
+
+func sortByKey(ents []Entry) {
+	sort.Slice(ents, func(i, j int) bool {
+		return bytes.Compare(ents[i].Key, ents[j].Key) < 0
+	})
+}
+
 func getOne(m map[string]Entry) string {
 	for k := range m {
 		return k
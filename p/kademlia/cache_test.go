@@ -1,9 +1,12 @@
 package kademlia
 
 import (
+	"bytes"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestClosest(t *testing.T) {
@@ -17,3 +20,273 @@ func TestClosest(t *testing.T) {
 
 	assert.Equal(t, closest, []byte{2, 2, 2})
 }
+
+func TestForEachCloser(t *testing.T) {
+	locus := make([]byte, 8)
+	c := NewCache(locus, 1000, 1)
+	rng := rand.New(rand.NewSource(0))
+	var keys [][]byte
+	for i := 0; i < 500; i++ {
+		key := make([]byte, 8)
+		rng.Read(key)
+		c.Put(key, i)
+		keys = append(keys, key)
+	}
+	for i := 0; i < 10; i++ {
+		target := make([]byte, 8)
+		rng.Read(target)
+		var got []Entry
+		c.ForEachCloser(target, func(e Entry) bool {
+			got = append(got, e)
+			return true
+		})
+		require.Len(t, got, c.Count())
+		for j := 1; j < len(got); j++ {
+			require.False(t, DistanceLt(target, got[j].Key, got[j-1].Key))
+		}
+	}
+
+	// stop early
+	var count int
+	c.ForEachCloser(keys[0], func(e Entry) bool {
+		if count == 0 {
+			assert.Equal(t, keys[0], e.Key)
+		}
+		count++
+		return count < 3
+	})
+	assert.Equal(t, 3, count)
+	assert.Len(t, c.ClosestN(keys[0], 5), 5)
+}
+
+func TestObserve(t *testing.T) {
+	locus := []byte{0}
+	// every bucket has exactly minPerBucket entries, so they are all protected.
+	c := NewCache(locus, 4, 1)
+	protected := [][]byte{{0x80}, {0x40}, {0x20}, {0x10}}
+	for _, key := range protected {
+		require.True(t, c.Observe(key, 0))
+	}
+	require.True(t, c.IsFull())
+	for _, key := range [][]byte{{0x08}, {0x01}, {0xc0}, {0x30}} {
+		require.False(t, c.Observe(key, 0))
+	}
+	require.Equal(t, 4, c.Count())
+	for _, key := range protected {
+		require.True(t, c.Contains(key))
+	}
+
+	// existing keys are updated, but not added.
+	require.False(t, c.Observe([]byte{0x80}, 1))
+	require.Equal(t, 1, c.Get([]byte{0x80}))
+}
+
+func TestObserveEvicts(t *testing.T) {
+	locus := []byte{0}
+	c := NewCache(locus, 4, 1)
+	for _, key := range [][]byte{{0x80}, {0x81}, {0x82}, {0x40}} {
+		require.True(t, c.Observe(key, 0))
+	}
+	// a key in the same bucket as the over-full bucket doesn't displace anything.
+	require.False(t, c.Observe([]byte{0x83}, 0))
+	// a closer key evicts from the over-full bucket.
+	require.True(t, c.Observe([]byte{0x20}, 0))
+	require.Equal(t, 4, c.Count())
+	require.True(t, c.Contains([]byte{0x20}))
+	require.True(t, c.Contains([]byte{0x40}))
+}
+
+func TestReplaceAll(t *testing.T) {
+	locus := []byte{0}
+	c := NewCache(locus, 3, 1)
+	for _, key := range [][]byte{{0x80}, {0x40}} {
+		c.Put(key, 0)
+	}
+	evicted := c.ReplaceAll([]Entry{
+		{Key: []byte{0x81}, Value: 1},
+		{Key: []byte{0x82}, Value: 2},
+		{Key: []byte{0x83}, Value: 3},
+		{Key: []byte{0x20}, Value: 4},
+	})
+	require.Len(t, evicted, 1)
+	require.Equal(t, 3, c.Count())
+	require.False(t, c.Contains([]byte{0x80}))
+	require.False(t, c.Contains([]byte{0x40}))
+	require.Equal(t, 4, c.Get([]byte{0x20}))
+	// the buckets are rebuilt, so lookups by distance still work
+	require.Equal(t, []byte{0x20}, c.ClosestN([]byte{0x21}, 1)[0].Key)
+
+	c.ReplaceAll(nil)
+	require.Equal(t, 0, c.Count())
+}
+
+func TestDiff(t *testing.T) {
+	locus := []byte{0}
+	before := NewCache(locus, 10, 1)
+	after := NewCache(locus, 10, 1)
+	for _, key := range [][]byte{{0x80}, {0x40}, {0x20}} {
+		before.Put(key, 0)
+	}
+	// 0x40 is in both, with a different value, 0x20 has a nil value
+	after.Put([]byte{0x40}, 1)
+	after.Put([]byte{0x20}, nil)
+	after.Put([]byte{0x81}, 2)
+	after.Put([]byte{0x10}, 3)
+
+	added, removed := before.Diff(after)
+	require.Equal(t, []Entry{{Key: []byte{0x10}, Value: 3}, {Key: []byte{0x81}, Value: 2}}, added)
+	require.Equal(t, []Entry{{Key: []byte{0x80}, Value: 0}}, removed)
+	// the diff in the other direction swaps added and removed
+	added, removed = after.Diff(before)
+	require.Equal(t, []Entry{{Key: []byte{0x80}, Value: 0}}, added)
+	require.Len(t, removed, 2)
+
+	// disjoint caches
+	other := NewCache(locus, 10, 1)
+	other.Put([]byte{0x01}, 4)
+	added, removed = before.Diff(other)
+	require.Equal(t, []Entry{{Key: []byte{0x01}, Value: 4}}, added)
+	require.Len(t, removed, 3)
+
+	added, removed = before.Diff(before)
+	require.Empty(t, added)
+	require.Empty(t, removed)
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	locus := []byte{0}
+	// evict the entry with the highest value, such as an RTT.
+	var calls int
+	c := NewCache(locus, 3, 1, WithEvictionPolicy(func(ents []Entry) int {
+		calls++
+		var worst int
+		for i, e := range ents {
+			if e.Value.(int) > ents[worst].Value.(int) {
+				worst = i
+			}
+		}
+		return worst
+	}))
+	c.Put([]byte{0x80}, 10)
+	c.Put([]byte{0x81}, 30)
+	c.Put([]byte{0x82}, 20)
+	evicted := c.Put([]byte{0x40}, 40)
+	require.NotNil(t, evicted)
+	require.Equal(t, []byte{0x81}, evicted.Key)
+	require.Equal(t, 1, calls)
+	require.Equal(t, 3, c.Count())
+	require.True(t, c.Contains([]byte{0x80}))
+	require.True(t, c.Contains([]byte{0x82}))
+
+	// the policy is kept by ReplaceAll
+	evicted2 := c.ReplaceAll([]Entry{
+		{Key: []byte{0x80}, Value: 5},
+		{Key: []byte{0x81}, Value: 1},
+		{Key: []byte{0x82}, Value: 3},
+		{Key: []byte{0x20}, Value: 2},
+	})
+	require.Len(t, evicted2, 1)
+	require.Equal(t, []byte{0x80}, evicted2[0].Key)
+}
+
+func TestShouldStore(t *testing.T) {
+	locus := []byte{0}
+	c := NewCache(locus, 4, 1)
+	// every key is accepted while there is room
+	c.Put([]byte{0x80}, 0)
+	require.Equal(t, 0, c.AcceptingPrefixLen())
+	require.True(t, c.ShouldStore([]byte{0xff}))
+
+	for _, key := range [][]byte{{0x81}, {0x82}, {0x40}} {
+		c.Put(key, 0)
+	}
+	// bucket 0 has more than minPerBucket entries, so keys must share the first bit with the locus.
+	require.Equal(t, 1, c.AcceptingPrefixLen())
+	for _, key := range [][]byte{{0x80}, {0xc0}, {0xff}} {
+		require.False(t, c.ShouldStore(key), "%x", key)
+	}
+	for _, key := range [][]byte{{0x40}, {0x7f}, {0x01}, {0x00}} {
+		require.True(t, c.ShouldStore(key), "%x", key)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	locus := []byte{0}
+	// evict the largest key, so evictions are deterministic.
+	c := NewCache(locus, 4, 1, WithEvictionPolicy(func(ents []Entry) int {
+		var largest int
+		for i, e := range ents {
+			if bytes.Compare(e.Key, ents[largest].Key) > 0 {
+				largest = i
+			}
+		}
+		return largest
+	}))
+	for _, key := range [][]byte{{0x80}, {0x81}, {0x82}, {0x40}} {
+		c.Put(key, 0)
+	}
+	require.Equal(t, CacheMetrics{
+		Count:              4,
+		Buckets:            []int{3, 1},
+		AcceptingPrefixLen: 1,
+	}, c.Metrics())
+
+	// a key in the over-full bucket is not added by Observe, and is evicted by the Put adding it.
+	// only the Put counts as a rejection.
+	require.False(t, c.Observe([]byte{0x83}, 0))
+	require.Equal(t, uint64(0), c.Metrics().Rejections)
+	evicted := c.Put([]byte{0x83}, 0)
+	require.Equal(t, []byte{0x83}, evicted.Key)
+	// overwriting an entry is neither
+	c.Put([]byte{0x80}, 1)
+	m := c.Metrics()
+	require.Equal(t, uint64(0), m.Evictions)
+	require.Equal(t, uint64(1), m.Rejections)
+
+	// a closer key evicts from the over-full bucket
+	require.True(t, c.Observe([]byte{0x20}, 0))
+	require.NotNil(t, c.Put([]byte{0x10}, 0))
+	m = c.Metrics()
+	require.Equal(t, uint64(2), m.Evictions)
+	require.Equal(t, uint64(1), m.Rejections)
+	require.Equal(t, []int{1, 1, 1, 1}, m.Buckets)
+	require.Equal(t, 4, m.Count)
+}
+
+func TestForEachDelete(t *testing.T) {
+	locus := make([]byte, 2)
+	c := NewCache(locus, 1000, 1)
+	for i := 0; i < 100; i++ {
+		c.Put([]byte{byte(i), byte(i)}, i)
+	}
+	// prune the odd values in one pass
+	var visited int
+	c.ForEach(func(e Entry) IterAction {
+		visited++
+		if e.Value.(int)%2 == 1 {
+			return DeleteAndContinue
+		}
+		return Continue
+	})
+	require.Equal(t, 100, visited)
+	require.Equal(t, 50, c.Count())
+	for i := 0; i < 100; i++ {
+		require.Equal(t, i%2 == 0, c.Contains([]byte{byte(i), byte(i)}), i)
+	}
+	// lookups by distance still see only the remaining entries
+	require.Len(t, c.ClosestN(locus, 100), 50)
+
+	// Stop ends the iteration, after deleting nothing
+	visited = 0
+	c.ForEach(func(e Entry) IterAction {
+		visited++
+		return Stop
+	})
+	require.Equal(t, 1, visited)
+	require.Equal(t, 50, c.Count())
+}
+
+func TestCacheSize(t *testing.T) {
+	require.Equal(t, 20*13, CacheSize(20, 13))
+	require.Panics(t, func() { CacheSize(0, 1) })
+}
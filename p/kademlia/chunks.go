@@ -0,0 +1,214 @@
+package kademlia
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/framing"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// Values stored by PutLarge start with one of these tags.
+//
+// A direct value is the tag followed by the value.
+//
+// A manifest is the tag, followed by the size of the value and the chunk size as uvarints,
+// followed by the 32 byte p2p.HashID of each chunk, in order.
+// Every chunk is chunk size bytes, except the last which holds the remainder.
+// Each chunk is stored in the DHT under its hash, truncated to the length of a key if the PeerIDScheme has shorter ids,
+// which is the key DeriveKey returns for the chunk.
+const (
+	largeDirect   = uint8(0)
+	largeManifest = uint8(1)
+)
+
+// maxChunkSize bounds the chunk size in a manifest, and so the memory GetLarge allocates for a value.
+const maxChunkSize = 1 << 24
+
+// chunkParallel is the number of chunks PutLarge and GetLarge transfer at once.
+const chunkParallel = 8
+
+// ErrValueTooLarge is returned by PutLarge when a value needs a manifest larger than the chunk size.
+var ErrValueTooLarge = errors.New("kademlia: value is too large to chunk")
+
+// ErrBadChunk is returned by GetLarge when none of the nodes which have a chunk have one matching its hash in the manifest.
+var ErrBadChunk = errors.New("kademlia: chunk does not match its hash")
+
+// ChunkSizeForMTU returns the largest chunk size whose put request fits in mtu.
+// Values are base64 encoded in requests, so a chunk is about 3/4 of the MTU.
+func ChunkSizeForMTU(mtu int) int {
+	// the request is measured with the longest key and TTL
+	empty, err := json.Marshal(request{Put: &putReq{Key: make([]byte, p2p.HashIDLen), TTL: math.MaxInt64}})
+	if err != nil {
+		panic(err)
+	}
+	return (mtu - len(empty)) / 4 * 3
+}
+
+// PutLarge stores value under key using the default TTL, splitting it into chunks if it is larger than DHTParams.ChunkSize.
+// Values stored with PutLarge must be retrieved with GetLarge.
+func (d *DHT) PutLarge(ctx context.Context, key, value []byte) error {
+	return d.PutLargeTTL(ctx, key, value, d.ttl)
+}
+
+// PutLargeTTL is like PutLarge, but the value, and its chunks, expire after ttl.
+// The chunks are stored before the manifest, so a GetLarge which finds the manifest can find the chunks.
+func (d *DHT) PutLargeTTL(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	if len(value) <= d.chunkSize {
+		return d.PutTTL(ctx, key, append([]byte{largeDirect}, value...), ttl)
+	}
+	chunks := splitChunks(value, d.chunkSize)
+	manifest := makeManifest(len(value), d.chunkSize, chunks)
+	if len(manifest) > d.chunkSize {
+		return ErrValueTooLarge
+	}
+	eg, ctx2 := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, chunkParallel)
+	for _, chunk := range chunks {
+		chunk := chunk
+		sem <- struct{}{}
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			h := chunkHash(chunk)
+			return errors.Wrapf(d.PutTTL(ctx2, d.chunkKey(h), chunk, ttl), "storing chunk %x", h[:])
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	return d.PutTTL(ctx, key, manifest, ttl)
+}
+
+// GetLarge retrieves a value stored with PutLarge, fetching and reassembling its chunks.
+// Nodes which have a malformed value, or a chunk which does not match its hash, are skipped for the next closest node.
+// ErrNotFound is returned if the value, or any of its chunks, can not be found.
+func (d *DHT) GetLarge(ctx context.Context, key []byte) ([]byte, error) {
+	data, invalid, err := d.get(ctx, key, func(data []byte) bool {
+		return checkLargeValue(data) == nil
+	})
+	if invalid {
+		return nil, errors.Errorf("kademlia: no valid large value found for key %x", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data[0] == largeDirect {
+		return data[1:], nil
+	}
+	size, chunkSize, hashes, err := parseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, size)
+	eg, ctx2 := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, chunkParallel)
+	for i, h := range hashes {
+		i, h := i, h
+		sem <- struct{}{}
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			start := i * chunkSize
+			end := start + chunkSize
+			if end > size {
+				end = size
+			}
+			chunk, invalid, err := d.get(ctx2, d.chunkKey(h), func(chunk []byte) bool {
+				return len(chunk) == end-start && chunkHash(chunk) == h
+			})
+			if invalid {
+				return ErrBadChunk
+			}
+			if err != nil {
+				return err
+			}
+			copy(out[start:end], chunk)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// checkLargeValue returns an error if data is not a direct value or a well formed manifest.
+func checkLargeValue(data []byte) error {
+	if len(data) == 0 {
+		return errors.Errorf("kademlia: empty large value")
+	}
+	switch data[0] {
+	case largeDirect:
+		return nil
+	case largeManifest:
+		_, _, _, err := parseManifest(data)
+		return err
+	default:
+		return errors.Errorf("kademlia: unknown large value tag %d", data[0])
+	}
+}
+
+// chunkHash returns the hash of a chunk in a manifest.
+func chunkHash(chunk []byte) [p2p.HashIDLen]byte {
+	var h [p2p.HashIDLen]byte
+	copy(h[:], p2p.HashID(chunk))
+	return h
+}
+
+// chunkKey returns the key a chunk with hash h is stored under.
+func (d *DHT) chunkKey(h [p2p.HashIDLen]byte) []byte {
+	return h[:d.scheme.Len()]
+}
+
+func splitChunks(value []byte, chunkSize int) [][]byte {
+	var chunks [][]byte
+	for len(value) > chunkSize {
+		chunks = append(chunks, value[:chunkSize])
+		value = value[chunkSize:]
+	}
+	return append(chunks, value)
+}
+
+func makeManifest(size, chunkSize int, chunks [][]byte) []byte {
+	out := []byte{largeManifest}
+	out = framing.AppendUvarint(out, uint64(size))
+	out = framing.AppendUvarint(out, uint64(chunkSize))
+	for _, chunk := range chunks {
+		h := chunkHash(chunk)
+		out = append(out, h[:]...)
+	}
+	return out
+}
+
+func parseManifest(data []byte) (size, chunkSize int, hashes [][p2p.HashIDLen]byte, err error) {
+	if len(data) < 1 || data[0] != largeManifest {
+		return 0, 0, nil, errors.Errorf("kademlia: not a manifest")
+	}
+	size64, rest, err := framing.ReadUvarint(data[1:])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	chunkSize64, rest, err := framing.ReadUvarint(rest)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if chunkSize64 == 0 || chunkSize64 > maxChunkSize || len(rest)%p2p.HashIDLen != 0 {
+		return 0, 0, nil, errors.Errorf("kademlia: malformed manifest")
+	}
+	count := uint64(len(rest) / p2p.HashIDLen)
+	// the chunks must cover the value exactly, which also bounds size by the length of the manifest.
+	if count == 0 || size64 <= (count-1)*chunkSize64 || size64 > count*chunkSize64 {
+		return 0, 0, nil, errors.Errorf("kademlia: manifest has %d chunks of %d bytes for %d bytes", count, chunkSize64, size64)
+	}
+	hashes = make([][p2p.HashIDLen]byte, count)
+	for i := range hashes {
+		copy(hashes[i][:], rest[i*p2p.HashIDLen:])
+	}
+	return int(size64), int(chunkSize64), hashes, nil
+}
@@ -0,0 +1,131 @@
+package kademlia
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutGetLarge(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 5, DHTParams{})
+	connectAll(dhts)
+
+	for _, size := range []int{0, 10, dhts[0].chunkSize, 3<<20 + 12345} {
+		key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+		value := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(value)
+		require.NoError(t, dhts[0].PutLarge(ctx, key[:], value))
+		for _, d := range dhts[1:] {
+			v, err := d.GetLarge(ctx, key[:])
+			require.NoError(t, err)
+			require.Equal(t, value, v)
+		}
+	}
+}
+
+func TestPutGetLargeSmallMTU(t *testing.T) {
+	ctx := context.Background()
+	const mtu = 2048
+	r := memswarm.NewRealm(memswarm.WithMTU(mtu))
+	dhts := newTestDHTs(t, r, 3, DHTParams{})
+	connectAll(dhts)
+	require.Equal(t, ChunkSizeForMTU(mtu), dhts[0].chunkSize)
+
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	value := make([]byte, 20*mtu)
+	rand.New(rand.NewSource(0)).Read(value)
+	require.NoError(t, dhts[0].PutLarge(ctx, key[:], value))
+	v, err := dhts[1].GetLarge(ctx, key[:])
+	require.NoError(t, err)
+	require.Equal(t, value, v)
+}
+
+func TestChunkSizeForMTU(t *testing.T) {
+	const mtu = 1000
+	chunkSize := ChunkSizeForMTU(mtu)
+	data, err := json.Marshal(request{Put: &putReq{
+		Key:   make([]byte, p2p.HashIDLen),
+		Value: make([]byte, chunkSize),
+		TTL:   DefaultTTL,
+	}})
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(data), mtu)
+	require.Greater(t, chunkSize, mtu/2)
+}
+
+func TestGetLargeSkipsBadChunk(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 3, DHTParams{ChunkSize: 100})
+	connectAll(dhts)
+
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	value := make([]byte, 250)
+	rand.New(rand.NewSource(0)).Read(value)
+	require.NoError(t, dhts[0].PutLarge(ctx, key[:], value))
+	// the local copy of the second chunk is corrupt, but the other nodes have it intact
+	chunkKey := dhts[0].DeriveKey(value[100:200])
+	dhts[0].store.Put(chunkKey, make([]byte, 100), dhts[0].clock.Now().Add(time.Hour))
+	v, err := dhts[0].GetLarge(ctx, key[:])
+	require.NoError(t, err)
+	require.Equal(t, value, v)
+}
+
+func TestGetLargeBadChunk(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 1, DHTParams{ChunkSize: 100})
+
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	value := make([]byte, 250)
+	rand.New(rand.NewSource(0)).Read(value)
+	require.NoError(t, dhts[0].PutLarge(ctx, key[:], value))
+
+	// replace the second chunk with different data under the same key
+	require.NoError(t, dhts[0].Put(ctx, dhts[0].DeriveKey(value[100:200]), make([]byte, 100)))
+	_, err := dhts[0].GetLarge(ctx, key[:])
+	require.Equal(t, ErrBadChunk, err)
+}
+
+func TestPutLargeTooLarge(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 1, DHTParams{ChunkSize: 64})
+
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	// 3 chunks need a manifest of 1 + 2 + 1 + 3*32 bytes
+	err := dhts[0].PutLarge(ctx, key[:], make([]byte, 3*64))
+	require.Equal(t, ErrValueTooLarge, err)
+}
+
+func TestParseManifest(t *testing.T) {
+	chunks := splitChunks(make([]byte, 250), 100)
+	require.Len(t, chunks, 3)
+	size, chunkSize, hashes, err := parseManifest(makeManifest(250, 100, chunks))
+	require.NoError(t, err)
+	require.Equal(t, 250, size)
+	require.Equal(t, 100, chunkSize)
+	require.Len(t, hashes, 3)
+
+	for _, tc := range []struct {
+		size, chunkSize, count int
+	}{
+		{size: 300, chunkSize: 100, count: 2},
+		{size: 200, chunkSize: 100, count: 3},
+		{size: 10, chunkSize: 0, count: 1},
+		{size: 1 << 40, chunkSize: maxChunkSize + 1, count: 1 << 16},
+	} {
+		_, _, _, err := parseManifest(makeManifest(tc.size, tc.chunkSize, make([][]byte, tc.count)))
+		require.Error(t, err, "%+v", tc)
+	}
+	_, _, _, err = parseManifest([]byte{largeManifest, 0x80})
+	require.Error(t, err)
+}
@@ -0,0 +1,714 @@
+package kademlia
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+var log = p2p.Logger
+
+const (
+	// DefaultK is the K used if it is not set.
+	DefaultK = 20
+	// DefaultAlpha is the Alpha used if it is not set.
+	DefaultAlpha = 3
+	// Replication is the number of nodes a value is stored on with the default K.
+	Replication = DefaultK
+	// DefaultTTL is the time a value lives for if no TTL is specified.
+	DefaultTTL = 24 * time.Hour
+	// DefaultMaxTTL is the longest a value put by a peer is kept for, if MaxTTL is not set.
+	DefaultMaxTTL = 7 * 24 * time.Hour
+	// DefaultRepublishInterval is how often a node republishes the values it holds.
+	DefaultRepublishInterval = time.Hour
+	// DefaultPeerCacheBuckets is the number of buckets of K peers in the routing cache, if PeerCacheSize is not set.
+	DefaultPeerCacheBuckets = 13
+	// DefaultPeerCacheSize is the number of peers kept in the routing cache with the default K.
+	DefaultPeerCacheSize = DefaultK * DefaultPeerCacheBuckets
+	// DefaultNegativeCacheSize is the number of missing keys remembered, if NegativeTTL is set.
+	DefaultNegativeCacheSize = 1024
+)
+
+var ErrNotFound = errors.New("kademlia: value not found")
+
+// ErrStoreFull is returned when a peer refuses to store a value because its store is full.
+var ErrStoreFull = errors.New("kademlia: peer's store is full")
+
+type DHTParams struct {
+	Swarm p2p.SecureAskSwarm
+
+	// K is the number of nodes a value is stored on, and the number of peers a lookup finds.
+	// Larger networks, and networks with more churn, need a larger K to keep values available.
+	// It defaults to DefaultK.
+	K int
+	// Alpha is the number of peers a lookup queries at once.
+	// A larger Alpha makes lookups faster, and more tolerant of unresponsive peers, at the cost of more messages.
+	// It defaults to DefaultAlpha.
+	Alpha int
+	// TTL is the TTL used by Put.
+	TTL time.Duration
+	// MaxTTL is the longest this node keeps a value put by a peer, longer TTLs are shortened to it,
+	// so a peer can't have values kept forever.
+	// It defaults to DefaultMaxTTL.
+	MaxTTL time.Duration
+	// RepublishInterval is how often values in the local store are sent to the closest nodes
+	// and expired values are removed.
+	RepublishInterval time.Duration
+	// PeerCacheSize is the number of peers kept in the routing cache.
+	// It defaults to CacheSize(K, DefaultPeerCacheBuckets).
+	// Once it is full, buckets with Alpha or fewer peers are not evicted from, so a lookup has peers to query at every distance.
+	PeerCacheSize int
+	// RefuseFarKeys makes the node refuse puts and provider records from peers for keys it should not store, see ShouldStore.
+	// It protects a node from filling up with values for keys far from it, but the publisher's view of the closest nodes
+	// can differ from the node's own, for example while the network is still converging, and then its values are refused.
+	// It is off by default.
+	RefuseFarKeys bool
+	// MaxValues is the most values the local store will hold, and the most provider records.
+	// Puts from peers for new keys, and provider records for new providers, are refused once it is full.
+	// 0 means there is no limit.
+	MaxValues int
+	// NegativeTTL is how long Get remembers that a key was not found,
+	// and returns ErrNotFound without doing a lookup.
+	// A Put or PutTTL from this node, or a Put from a peer to this node, for the key forgets the miss.
+	// It should be short, since Puts from other nodes which are not sent here are not seen until it ends.
+	// Only misses where every peer asked answered are remembered, not those caused by errors, or by having no peers.
+	// 0 means misses are not remembered.
+	NegativeTTL time.Duration
+	// ChunkSize is the largest value PutLarge stores directly, larger values are split into chunks of this size.
+	// The JSON encoding of a chunk must fit in the swarm's MTU.
+	// It defaults to ChunkSizeForMTU of the swarm's MTU.
+	ChunkSize int
+	// ProviderTTL is how long provider records announced by Provide last,
+	// and the longest this node keeps the records announced to it.
+	// It defaults to DefaultProviderTTL.
+	ProviderTTL time.Duration
+	// PeerIDScheme derives the PeerIDs of nodes from their public keys, it defaults to p2p.DefaultPeerIDScheme.
+	// Every node in the network must use the same scheme.
+	// Keys, and the locus of the routing cache, are the scheme's Len bytes long.
+	PeerIDScheme p2p.PeerIDScheme
+	// Clock is used for TTLs and republishing, it defaults to the real clock.
+	Clock clockwork.Clock
+}
+
+// DHT is a Kademlia distributed hash table, which stores values on the nodes closest to the key.
+// Keys must be the same length as the PeerIDs of the DHTParams.PeerIDScheme.
+type DHT struct {
+	swarm             p2p.SecureAskSwarm
+	scheme            p2p.PeerIDScheme
+	localID           p2p.PeerID
+	k, alpha          int
+	ttl, maxTTL       time.Duration
+	republishInterval time.Duration
+	maxValues         int
+	refuseFarKeys     bool
+	chunkSize         int
+	providerTTL       time.Duration
+	clock             clockwork.Clock
+
+	cf context.CancelFunc
+
+	mu    sync.Mutex
+	peers *Cache
+
+	store     *Store
+	providers *ProviderStore
+	// misses holds the keys which were recently not found by Get, it is nil if NegativeTTL is 0.
+	misses *swarmutil.Pool[string, struct{}]
+}
+
+func NewDHT(params DHTParams) *DHT {
+	if params.TTL == 0 {
+		params.TTL = DefaultTTL
+	}
+	if params.MaxTTL == 0 {
+		params.MaxTTL = DefaultMaxTTL
+	}
+	if params.RepublishInterval == 0 {
+		params.RepublishInterval = DefaultRepublishInterval
+	}
+	if params.K < 0 || params.Alpha < 0 {
+		panic(fmt.Sprintf("K and Alpha must not be negative, got %d and %d", params.K, params.Alpha))
+	}
+	if params.K == 0 {
+		params.K = DefaultK
+	}
+	if params.Alpha == 0 {
+		params.Alpha = DefaultAlpha
+	}
+	if params.PeerCacheSize == 0 {
+		params.PeerCacheSize = CacheSize(params.K, DefaultPeerCacheBuckets)
+	}
+	if params.ChunkSize == 0 {
+		var addr p2p.Addr
+		if addrs := params.Swarm.LocalAddrs(); len(addrs) > 0 {
+			addr = addrs[0]
+		}
+		params.ChunkSize = ChunkSizeForMTU(params.Swarm.MTU(context.Background(), addr))
+		if params.ChunkSize <= 0 {
+			panic(fmt.Sprintf("the swarm's MTU is too small to store values, got %d", params.Swarm.MTU(context.Background(), addr)))
+		}
+	}
+	if params.ProviderTTL == 0 {
+		params.ProviderTTL = DefaultProviderTTL
+	}
+	if params.PeerIDScheme == nil {
+		params.PeerIDScheme = p2p.DefaultPeerIDScheme
+	}
+	if params.Clock == nil {
+		params.Clock = clockwork.NewRealClock()
+	}
+	localID := params.PeerIDScheme.Derive(params.Swarm.PublicKey())
+	ctx, cf := context.WithCancel(context.Background())
+	d := &DHT{
+		swarm:             params.Swarm,
+		scheme:            params.PeerIDScheme,
+		localID:           localID,
+		k:                 params.K,
+		alpha:             params.Alpha,
+		ttl:               params.TTL,
+		maxTTL:            params.MaxTTL,
+		republishInterval: params.RepublishInterval,
+		maxValues:         params.MaxValues,
+		refuseFarKeys:     params.RefuseFarKeys,
+		chunkSize:         params.ChunkSize,
+		providerTTL:       params.ProviderTTL,
+		clock:             params.Clock,
+
+		cf:        cf,
+		peers:     NewCache(localID[:params.PeerIDScheme.Len()], params.PeerCacheSize, params.Alpha),
+		store:     NewStore(),
+		providers: NewProviderStore(),
+	}
+	if params.NegativeTTL > 0 {
+		d.misses = swarmutil.NewPool(swarmutil.PoolParams[string, struct{}]{
+			TTL:     params.NegativeTTL,
+			MaxSize: DefaultNegativeCacheSize,
+			Clock:   params.Clock,
+		})
+	}
+	go d.swarm.ServeAsks(d.handleAsk)
+	go d.maintainLoop(ctx)
+	return d
+}
+
+// LocalID returns the PeerID of this node, which is also its locus in the key space.
+func (d *DHT) LocalID() p2p.PeerID {
+	return d.localID
+}
+
+// AddPeer adds a peer to the routing cache, if it improves the cache.
+// The address of a peer already in the cache is updated.
+func (d *DHT) AddPeer(id p2p.PeerID, addr p2p.Addr) {
+	if id == d.localID {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.peers.Observe(d.idBytes(id), addr)
+}
+
+// ReplacePeers replaces the routing cache with peers, for example from a fresh bootstrap or a saved snapshot.
+// Lookups running at the same time see either the old peers or the new ones, never a mix.
+func (d *DHT) ReplacePeers(peers map[p2p.PeerID]p2p.Addr) {
+	ents := make([]Entry, 0, len(peers))
+	for id, addr := range peers {
+		if id == d.localID {
+			continue
+		}
+		id := id
+		ents = append(ents, Entry{Key: d.idBytes(id), Value: addr})
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.peers.ReplaceAll(ents)
+}
+
+// Resolve returns the address of the peer id on the DHT's swarm, so the DHT can be used as a p2p.PeerResolver.
+// The routing cache is checked first, and the network is searched if id is not in it.
+// p2p.ErrNoAddrs is returned if the peer is not found.
+func (d *DHT) Resolve(ctx context.Context, id p2p.PeerID) ([]p2p.Addr, error) {
+	d.mu.Lock()
+	v := d.peers.Get(d.idBytes(id))
+	d.mu.Unlock()
+	if v != nil {
+		return []p2p.Addr{v.(p2p.Addr)}, nil
+	}
+	for _, p := range d.lookup(ctx, d.idBytes(id), d.k) {
+		if p.id == id {
+			return []p2p.Addr{p.addr}, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, p2p.ErrNoAddrs
+}
+
+// ShouldStore returns true if key is within the range of keys this node is responsible for,
+// given the peers in its routing cache. If RefuseFarKeys is set, puts from peers for other keys are refused.
+// See Cache.ShouldStore.
+func (d *DHT) ShouldStore(key []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.peers.ShouldStore(key)
+}
+
+// Put stores value under key on the closest nodes using the default TTL.
+func (d *DHT) Put(ctx context.Context, key, value []byte) error {
+	return d.PutTTL(ctx, key, value, d.ttl)
+}
+
+// PutTTL stores value under key on the closest nodes.
+// The value will expire after ttl.
+func (d *DHT) PutTTL(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	d.forgetMiss(key)
+	return d.publish(ctx, key, value, d.clock.Now().Add(ttl))
+}
+
+// Get retrieves the value at key from the closest nodes.
+// ErrNotFound is returned if no node has the value, or if the key was not found within the last NegativeTTL.
+func (d *DHT) Get(ctx context.Context, key []byte) ([]byte, error) {
+	v, _, err := d.get(ctx, key, nil)
+	return v, err
+}
+
+// get is like Get, but only returns a value which valid accepts, asking the next closest node when one does not.
+// invalid is true if a value was found, but none were accepted. A nil valid accepts every value.
+func (d *DHT) get(ctx context.Context, key []byte, valid func([]byte) bool) (_ []byte, invalid bool, _ error) {
+	if err := d.checkKey(key); err != nil {
+		return nil, false, err
+	}
+	if v := d.store.Get(key, d.clock.Now()); v != nil {
+		if valid == nil || valid(v) {
+			return v, false, nil
+		}
+		invalid = true
+	}
+	if d.misses != nil {
+		if _, ok := d.misses.Get(string(key)); ok {
+			return nil, invalid, ErrNotFound
+		}
+	}
+	peers := d.lookup(ctx, key, d.k)
+	// the miss is only remembered if every peer asked says it doesn't have the key,
+	// a miss because of a failed or unanswered ask may not be one.
+	definitive := len(peers) > 0
+	for _, p := range peers {
+		res, err := d.askGet(ctx, p.addr, key)
+		if err != nil {
+			log.Debug(err)
+			definitive = false
+			continue
+		}
+		if !res.Found {
+			continue
+		}
+		if valid == nil || valid(res.Value) {
+			return res.Value, false, nil
+		}
+		log.Debugf("kademlia: invalid value for key %x from %v", key, p.addr)
+		invalid = true
+	}
+	if d.misses != nil && definitive && !invalid {
+		d.misses.Put(string(key), struct{}{})
+	}
+	return nil, invalid, ErrNotFound
+}
+
+func (d *DHT) Close() error {
+	d.cf()
+	return nil
+}
+
+// publish sends the value to the closest nodes, including this node if it is one of them.
+// Nodes which refuse the value because they are full are replaced by the next closest nodes,
+// so the value is stored on up to K nodes.
+func (d *DHT) publish(ctx context.Context, key, value []byte, expiresAt time.Time) error {
+	// extra candidates replace the nodes which are full
+	peers := d.lookup(ctx, key, 2*d.k)
+	if len(peers) < d.k || DistanceLt(key, d.idBytes(d.localID), d.idBytes(peers[d.k-1].id)) {
+		d.putLocal(key, value, expiresAt)
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	ttl := expiresAt.Sub(d.clock.Now())
+	var stored, full int
+	next := 0
+	for want := d.k; want > 0 && next < len(peers); {
+		end := next + want
+		if end > len(peers) {
+			end = len(peers)
+		}
+		var mu sync.Mutex
+		var refused int
+		eg := errgroup.Group{}
+		for _, p := range peers[next:end] {
+			p := p
+			eg.Go(func() error {
+				err := d.askPut(ctx, p.addr, key, value, ttl)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					stored++
+				case err == ErrStoreFull:
+					refused++
+				default:
+					log.Debug(err)
+				}
+				return nil
+			})
+		}
+		eg.Wait()
+		full += refused
+		next = end
+		want = refused
+	}
+	if stored == 0 {
+		return errors.Errorf("kademlia: could not store value on any of %d peers, %d were full", next, full)
+	}
+	return nil
+}
+
+// republish sends every value in the local store to the current closest nodes.
+func (d *DHT) republish(ctx context.Context) {
+	type kv struct {
+		key, value []byte
+		expiresAt  time.Time
+	}
+	var kvs []kv
+	d.store.ForEach(d.clock.Now(), func(key, value []byte, expiresAt time.Time) bool {
+		kvs = append(kvs, kv{key: key, value: value, expiresAt: expiresAt})
+		return true
+	})
+	for _, x := range kvs {
+		if err := d.publish(ctx, x.key, x.value, x.expiresAt); err != nil {
+			log.Debug(err)
+		}
+	}
+}
+
+func (d *DHT) maintainLoop(ctx context.Context) {
+	ticker := d.clock.NewTicker(d.republishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+		d.store.Expire(d.clock.Now())
+		d.providers.Expire(d.clock.Now())
+		d.republish(ctx)
+	}
+}
+
+// lookup iteratively queries the closest known peers to find the closest peers to key.
+// It returns up to n peers, closest first.
+func (d *DHT) lookup(ctx context.Context, key []byte, n int) []peerInfo {
+	d.mu.Lock()
+	ents := d.peers.ClosestN(key, n)
+	d.mu.Unlock()
+	var closest []peerInfo
+	for _, e := range ents {
+		closest = append(closest, peerInfo{id: idFromBytes(e.Key), addr: e.Value.(p2p.Addr)})
+	}
+	queried := map[p2p.PeerID]bool{}
+	for {
+		var toQuery []peerInfo
+		for _, p := range closest {
+			if len(toQuery) >= d.alpha {
+				break
+			}
+			if !queried[p.id] {
+				toQuery = append(toQuery, p)
+				queried[p.id] = true
+			}
+		}
+		if len(toQuery) == 0 {
+			return closest
+		}
+		var mu sync.Mutex
+		eg := errgroup.Group{}
+		for _, p := range toQuery {
+			p := p
+			eg.Go(func() error {
+				found, err := d.askFindNode(ctx, p.addr, key)
+				if err != nil {
+					log.Debug(err)
+					return nil
+				}
+				mu.Lock()
+				closest = mergePeers(key, closest, found, d.localID)
+				mu.Unlock()
+				return nil
+			})
+		}
+		eg.Wait()
+		if len(closest) > n {
+			closest = closest[:n]
+		}
+	}
+}
+
+func (d *DHT) handleAsk(ctx context.Context, msg *p2p.Message, w io.Writer) {
+	remoteID := d.scheme.Derive(p2p.LookupPublicKeyInHandler(d.swarm, msg.Src))
+	d.AddPeer(remoteID, msg.Src)
+
+	var req request
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		log.Warn("kademlia: could not parse request from ", msg.Src)
+		return
+	}
+	var res interface{}
+	switch {
+	case req.FindNode != nil:
+		res = findNodeRes{Peers: d.closestPeers(req.FindNode.Key)}
+	case req.Put != nil:
+		res = d.handlePut(req.Put)
+	case req.Get != nil:
+		r := getRes{}
+		if v := d.store.Get(req.Get.Key, d.clock.Now()); v != nil {
+			r.Found = true
+			r.Value = v
+		} else {
+			r.Peers = d.closestPeers(req.Get.Key)
+		}
+		res = r
+	case req.AddProvider != nil:
+		res = d.handleAddProvider(msg, remoteID, req.AddProvider)
+	case req.GetProviders != nil:
+		res = d.handleGetProviders(req.GetProviders)
+	default:
+		return
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		log.Error(err)
+	}
+}
+
+func (d *DHT) handlePut(req *putReq) putRes {
+	if d.checkKey(req.Key) != nil || req.TTL <= 0 {
+		return putRes{Accepted: false}
+	}
+	if d.refuseFarKeys && !d.ShouldStore(req.Key) {
+		return putRes{Accepted: false}
+	}
+	ttl := req.TTL
+	if ttl > d.maxTTL {
+		ttl = d.maxTTL
+	}
+	d.forgetMiss(req.Key)
+	if !d.putLocal(req.Key, req.Value, d.clock.Now().Add(ttl)) {
+		return putRes{Accepted: false, Full: true}
+	}
+	return putRes{Accepted: true}
+}
+
+// putLocal adds the value to the local store, if there is room for it.
+func (d *DHT) putLocal(key, value []byte, expiresAt time.Time) bool {
+	if d.maxValues == 0 {
+		d.store.Put(key, value, expiresAt)
+		return true
+	}
+	if d.store.PutLimit(key, value, expiresAt, d.maxValues) {
+		return true
+	}
+	// make room by removing expired values
+	d.store.Expire(d.clock.Now())
+	return d.store.PutLimit(key, value, expiresAt, d.maxValues)
+}
+
+// forgetMiss removes key from the recent misses, so the next Get for it does a lookup.
+func (d *DHT) forgetMiss(key []byte) {
+	if d.misses != nil {
+		d.misses.Delete(string(key))
+	}
+}
+
+func (d *DHT) closestPeers(key []byte) []peerRecord {
+	d.mu.Lock()
+	ents := d.peers.ClosestN(key, d.k)
+	d.mu.Unlock()
+	recs := make([]peerRecord, 0, len(ents))
+	for _, e := range ents {
+		data, err := e.Value.(p2p.Addr).MarshalText()
+		if err != nil {
+			continue
+		}
+		recs = append(recs, peerRecord{ID: idFromBytes(e.Key), Addr: string(data)})
+	}
+	return recs
+}
+
+func (d *DHT) askFindNode(ctx context.Context, addr p2p.Addr, key []byte) ([]peerInfo, error) {
+	var res findNodeRes
+	if err := d.ask(ctx, addr, request{FindNode: &findNodeReq{Key: key}}, &res); err != nil {
+		return nil, err
+	}
+	return d.parsePeers(res.Peers), nil
+}
+
+func (d *DHT) askPut(ctx context.Context, addr p2p.Addr, key, value []byte, ttl time.Duration) error {
+	var res putRes
+	if err := d.ask(ctx, addr, request{Put: &putReq{Key: key, Value: value, TTL: ttl}}, &res); err != nil {
+		return err
+	}
+	if res.Full {
+		return ErrStoreFull
+	}
+	if !res.Accepted {
+		return errors.Errorf("kademlia: put refused by %v", addr)
+	}
+	return nil
+}
+
+func (d *DHT) askGet(ctx context.Context, addr p2p.Addr, key []byte) (*getRes, error) {
+	var res getRes
+	if err := d.ask(ctx, addr, request{Get: &getReq{Key: key}}, &res); err != nil {
+		return nil, err
+	}
+	for _, p := range d.parsePeers(res.Peers) {
+		d.AddPeer(p.id, p.addr)
+	}
+	return &res, nil
+}
+
+func (d *DHT) ask(ctx context.Context, addr p2p.Addr, req request, res interface{}) error {
+	reqData, err := json.Marshal(req)
+	if err != nil {
+		panic(err)
+	}
+	resData, err := d.swarm.Ask(ctx, addr, p2p.IOVec{reqData})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resData, res)
+}
+
+func (d *DHT) parsePeers(recs []peerRecord) []peerInfo {
+	var ps []peerInfo
+	for _, rec := range recs {
+		addr, err := d.swarm.ParseAddr([]byte(rec.Addr))
+		if err != nil {
+			log.Debug(err)
+			continue
+		}
+		d.AddPeer(rec.ID, addr)
+		ps = append(ps, peerInfo{id: rec.ID, addr: addr})
+	}
+	return ps
+}
+
+type peerInfo struct {
+	id   p2p.PeerID
+	addr p2p.Addr
+}
+
+// mergePeers adds ys to xs, skipping duplicates and the local peer, and sorts the result by distance to key.
+// Only the first len(key) bytes of the ids are compared, since the bytes after the scheme's Len are zero.
+func mergePeers(key []byte, xs, ys []peerInfo, localID p2p.PeerID) []peerInfo {
+	seen := map[p2p.PeerID]bool{localID: true}
+	var ret []peerInfo
+	for _, p := range append(xs, ys...) {
+		if !seen[p.id] {
+			seen[p.id] = true
+			ret = append(ret, p)
+		}
+	}
+	ents := make([]Entry, len(ret))
+	for i := range ret {
+		ents[i] = Entry{Key: ret[i].id[:len(key)], Value: ret[i]}
+	}
+	SortByDistance(key, ents)
+	for i := range ents {
+		ret[i] = ents[i].Value.(peerInfo)
+	}
+	return ret
+}
+
+// DeriveKey returns the key for data: its p2p.HashID, truncated to the length of a key.
+// Keys are derived the same way as PeerIDs, so the key for a marshaled public key is the PeerID of that key,
+// and DeriveKey(p2p.MarshalPublicKey(pub)) can be used to store a value under a node's own id.
+func (d *DHT) DeriveKey(data []byte) []byte {
+	return p2p.HashID(data)[:d.scheme.Len()]
+}
+
+func (d *DHT) checkKey(key []byte) error {
+	if len(key) != d.scheme.Len() {
+		return errors.Errorf("kademlia: key must be %d bytes, got %d", d.scheme.Len(), len(key))
+	}
+	return nil
+}
+
+// idBytes returns the bytes of id which are used as a key, see DHTParams.PeerIDScheme.
+func (d *DHT) idBytes(id p2p.PeerID) []byte {
+	return id[:d.scheme.Len()]
+}
+
+func idFromBytes(x []byte) p2p.PeerID {
+	id := p2p.PeerID{}
+	copy(id[:], x)
+	return id
+}
+
+type request struct {
+	FindNode *findNodeReq `json:"find_node,omitempty"`
+	Put      *putReq      `json:"put,omitempty"`
+	Get      *getReq      `json:"get,omitempty"`
+
+	AddProvider  *addProviderReq  `json:"add_provider,omitempty"`
+	GetProviders *getProvidersReq `json:"get_providers,omitempty"`
+}
+
+type findNodeReq struct {
+	Key []byte `json:"key"`
+}
+
+type findNodeRes struct {
+	Peers []peerRecord `json:"peers"`
+}
+
+type putReq struct {
+	Key   []byte        `json:"key"`
+	Value []byte        `json:"value"`
+	TTL   time.Duration `json:"ttl"`
+}
+
+type putRes struct {
+	Accepted bool `json:"accepted"`
+	// Full is true if the put was refused because the store is full
+	Full bool `json:"full,omitempty"`
+}
+
+type getReq struct {
+	Key []byte `json:"key"`
+}
+
+type getRes struct {
+	Found bool         `json:"found"`
+	Value []byte       `json:"value,omitempty"`
+	Peers []peerRecord `json:"peers,omitempty"`
+}
+
+type peerRecord struct {
+	ID   p2p.PeerID `json:"id"`
+	Addr string     `json:"addr"`
+}
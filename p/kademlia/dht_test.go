@@ -0,0 +1,492 @@
+package kademlia
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestDHTPutGet(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 5, DHTParams{})
+	connectAll(dhts)
+
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	require.NoError(t, dhts[0].Put(ctx, key[:], []byte("hello")))
+	for _, d := range dhts {
+		v, err := d.Get(ctx, key[:])
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(v))
+	}
+}
+
+func TestDHTRepublish(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	params := DHTParams{RepublishInterval: 50 * time.Millisecond}
+	dhts := newTestDHTs(t, r, 2, params)
+	connectAll(dhts)
+
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	require.NoError(t, dhts[0].Put(ctx, key[:], []byte("hello")))
+
+	// a node joins after the value was stored.
+	late := newTestDHTs(t, r, 1, params)[0]
+	dhts[0].AddPeer(late.LocalID(), late.swarm.LocalAddrs()[0])
+	require.Nil(t, late.store.Get(key[:], time.Now()))
+
+	require.Eventually(t, func() bool {
+		return late.store.Get(key[:], time.Now()) != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDHTExpire(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	clock := clockwork.NewFakeClock()
+	params := DHTParams{RepublishInterval: time.Minute, Clock: clock}
+	dhts := newTestDHTs(t, r, 3, params)
+	connectAll(dhts)
+
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	require.NoError(t, dhts[0].PutTTL(ctx, key[:], []byte("hello"), time.Second))
+	_, err := dhts[1].Get(ctx, key[:])
+	require.NoError(t, err)
+
+	// every node's maintenance loop is waiting on its ticker
+	clock.BlockUntil(len(dhts))
+	clock.Advance(time.Minute)
+	for _, d := range dhts {
+		_, err := d.Get(ctx, key[:])
+		require.Equal(t, ErrNotFound, err)
+		require.Eventually(t, func() bool {
+			return d.store.Count() == 0
+		}, time.Second, time.Millisecond)
+	}
+}
+
+func TestDHTMaxTTL(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	clock := clockwork.NewFakeClock()
+	dhts := newTestDHTs(t, r, 2, DHTParams{MaxTTL: time.Hour, Clock: clock})
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	// the longer TTL a peer asks for is shortened to MaxTTL
+	require.NoError(t, dhts[0].askPut(ctx, dhts[1].swarm.LocalAddrs()[0], key[:], []byte("hello"), 100*time.Hour))
+	require.NotNil(t, dhts[1].store.Get(key[:], clock.Now().Add(time.Hour-time.Second)))
+	require.Nil(t, dhts[1].store.Get(key[:], clock.Now().Add(time.Hour)))
+}
+
+func TestDHTStoreFull(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, Replication+10, DHTParams{})
+	connectAll(dhts)
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+
+	// the closest nodes to the key are full
+	byDistance := append([]*DHT{}, dhts...)
+	sort.Slice(byDistance, func(i, j int) bool {
+		return DistanceLt(key[:], byDistance[i].localID[:], byDistance[j].localID[:])
+	})
+	publisher := byDistance[len(byDistance)-1]
+	full := byDistance[:5]
+	for i, d := range full {
+		d.maxValues = 1
+		other := p2p.NewPeerID(p2ptest.NewTestKey(t, 1000+i).Public())
+		d.store.Put(other[:], []byte("other"), time.Now().Add(time.Hour))
+	}
+	require.Equal(t, ErrStoreFull, publisher.askPut(ctx, full[0].swarm.LocalAddrs()[0], key[:], []byte("hello"), time.Hour))
+
+	require.NoError(t, publisher.Put(ctx, key[:], []byte("hello")))
+	for _, d := range full {
+		require.Nil(t, d.store.Get(key[:], time.Now()))
+	}
+	// the value is stored on the next closest nodes instead
+	var stored int
+	for _, d := range byDistance[5:] {
+		if d.store.Get(key[:], time.Now()) != nil {
+			stored++
+		}
+	}
+	require.Equal(t, Replication, stored)
+}
+
+func TestDHTShouldStore(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 10, DHTParams{PeerCacheSize: 2, RefuseFarKeys: true})
+	connectAll(dhts)
+	d, publisher := dhts[0], dhts[1]
+	addr := d.swarm.LocalAddrs()[0]
+
+	// a full cache doesn't accept keys which differ from the locus in the first bit.
+	far := d.LocalID()
+	far[0] ^= 0x80
+	require.False(t, d.ShouldStore(far[:]))
+	require.Error(t, publisher.askPut(ctx, addr, far[:], []byte("hello"), time.Hour))
+	require.Nil(t, d.store.Get(far[:], time.Now()))
+	// unless RefuseFarKeys is set, they are stored anyway
+	other := newTestDHTs(t, r, 1, DHTParams{PeerCacheSize: 2})[0]
+	for _, x := range dhts {
+		other.AddPeer(x.LocalID(), x.swarm.LocalAddrs()[0])
+	}
+	far = other.LocalID()
+	far[0] ^= 0x80
+	require.False(t, other.ShouldStore(far[:]))
+	require.NoError(t, publisher.askPut(ctx, other.swarm.LocalAddrs()[0], far[:], []byte("hello"), time.Hour))
+	require.Equal(t, []byte("hello"), other.store.Get(far[:], time.Now()))
+
+	near := d.LocalID()
+	near[len(near)-1] ^= 1
+	require.True(t, d.ShouldStore(near[:]))
+	require.NoError(t, publisher.askPut(ctx, addr, near[:], []byte("hello"), time.Hour))
+	require.Equal(t, []byte("hello"), d.store.Get(near[:], time.Now()))
+}
+
+func TestDHTNegativeTTL(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	clock := clockwork.NewFakeClock()
+	dhts := newTestDHTs(t, r, 3, DHTParams{NegativeTTL: time.Minute, Clock: clock})
+	connectAll(dhts)
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+
+	_, err := dhts[0].Get(ctx, key[:])
+	require.Equal(t, ErrNotFound, err)
+	// the value appears on another node without being sent to dhts[0], which still remembers the miss
+	dhts[1].store.Put(key[:], []byte("hello"), clock.Now().Add(time.Hour))
+	_, err = dhts[0].Get(ctx, key[:])
+	require.Equal(t, ErrNotFound, err)
+
+	clock.Advance(time.Minute)
+	v, err := dhts[0].Get(ctx, key[:])
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(v))
+
+	// a Put forgets the miss, both on the node which made it, and on the nodes it is sent to
+	key2 := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	for _, d := range dhts {
+		_, err := d.Get(ctx, key2[:])
+		require.Equal(t, ErrNotFound, err)
+		require.Equal(t, 1, d.misses.Len())
+	}
+	require.NoError(t, dhts[0].Put(ctx, key2[:], []byte("world")))
+	for _, d := range dhts {
+		_, ok := d.misses.Get(string(key2[:]))
+		require.False(t, ok)
+		v, err := d.Get(ctx, key2[:])
+		require.NoError(t, err)
+		require.Equal(t, "world", string(v))
+	}
+}
+
+func TestDHTNegativeTTLErrors(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 3, DHTParams{NegativeTTL: time.Minute})
+	connectAll(dhts)
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+
+	// a peer can't be reached, so it might have the value, and the miss isn't remembered
+	r.Block(dhts[0].swarm.LocalAddrs()[0], dhts[2].swarm.LocalAddrs()[0])
+	_, err := dhts[0].Get(ctx, key[:])
+	require.Equal(t, ErrNotFound, err)
+	require.Equal(t, 0, dhts[0].misses.Len())
+
+	// nor is a miss without any peers
+	lonely := newTestDHTs(t, r, 1, DHTParams{NegativeTTL: time.Minute})[0]
+	_, err = lonely.Get(ctx, key[:])
+	require.Equal(t, ErrNotFound, err)
+	require.Equal(t, 0, lonely.misses.Len())
+
+	r.Unblock(dhts[0].swarm.LocalAddrs()[0], dhts[2].swarm.LocalAddrs()[0])
+	_, err = dhts[0].Get(ctx, key[:])
+	require.Equal(t, ErrNotFound, err)
+	require.Equal(t, 1, dhts[0].misses.Len())
+}
+
+func TestDHTReplacePeers(t *testing.T) {
+	r := memswarm.NewRealm()
+	d := newTestDHTs(t, r, 1, DHTParams{})[0]
+	newPeers := func(offset int) map[p2p.PeerID]p2p.Addr {
+		peers := map[p2p.PeerID]p2p.Addr{}
+		for i := 0; i < 10; i++ {
+			id := p2p.NewPeerID(p2ptest.NewTestKey(t, offset+i).Public())
+			peers[id] = r.NewSwarm().LocalAddrs()[0]
+		}
+		return peers
+	}
+	sets := []map[p2p.PeerID]p2p.Addr{newPeers(100), newPeers(200)}
+	d.ReplacePeers(sets[0])
+
+	done := make(chan struct{})
+	eg := errgroup.Group{}
+	for i := 0; i < 4; i++ {
+		eg.Go(func() error {
+			for {
+				select {
+				case <-done:
+					return nil
+				default:
+				}
+				recs := d.closestPeers(d.localID[:])
+				if len(recs) != 10 {
+					return fmt.Errorf("got %d peers", len(recs))
+				}
+				set := sets[0]
+				if _, ok := set[recs[0].ID]; !ok {
+					set = sets[1]
+				}
+				for _, rec := range recs {
+					if _, ok := set[rec.ID]; !ok {
+						return fmt.Errorf("saw peers from both sets")
+					}
+				}
+			}
+		})
+	}
+	for i := 0; i < 1000; i++ {
+		d.ReplacePeers(sets[i%2])
+	}
+	close(done)
+	require.NoError(t, eg.Wait())
+}
+
+func TestDHTResolve(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 5, DHTParams{})
+	// each node only knows the next one, so most peers have to be found by searching.
+	for i := 0; i < len(dhts)-1; i++ {
+		dhts[i].AddPeer(dhts[i+1].LocalID(), dhts[i+1].swarm.LocalAddrs()[0])
+		dhts[i+1].AddPeer(dhts[i].LocalID(), dhts[i].swarm.LocalAddrs()[0])
+	}
+	var _ p2p.PeerResolver = dhts[0]
+	for _, d := range dhts[1:] {
+		addrs, err := dhts[0].Resolve(ctx, d.LocalID())
+		require.NoError(t, err)
+		require.Equal(t, []p2p.Addr{d.swarm.LocalAddrs()[0]}, addrs)
+	}
+	addrs, err := dhts[0].Resolve(ctx, p2p.PeerID{1})
+	require.Equal(t, p2p.ErrNoAddrs, err)
+	require.Len(t, addrs, 0)
+}
+
+func TestDHTK(t *testing.T) {
+	ctx := context.Background()
+	for _, k := range []int{1, 3, 8} {
+		r := memswarm.NewRealm()
+		dhts := newTestDHTs(t, r, 12, DHTParams{K: k})
+		connectAll(dhts)
+		key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+
+		// the publisher is the farthest node, so it does not store the value itself
+		sort.Slice(dhts, func(i, j int) bool {
+			return DistanceLt(key[:], dhts[i].localID[:], dhts[j].localID[:])
+		})
+		require.NoError(t, dhts[len(dhts)-1].Put(ctx, key[:], []byte("hello")))
+		for i, d := range dhts {
+			stored := d.store.Get(key[:], time.Now()) != nil
+			require.Equal(t, i < k, stored, "k=%d node=%d", k, i)
+		}
+		res, err := dhts[0].Resolve(ctx, dhts[len(dhts)-1].LocalID())
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+	}
+}
+
+func TestDHTAlpha(t *testing.T) {
+	ctx := context.Background()
+	for _, alpha := range []int{1, 3, 5} {
+		r := memswarm.NewRealm()
+		var counter *inflightSwarm
+		dhts := make([]*DHT, 20)
+		for i := range dhts {
+			s := &inflightSwarm{SecureAskSwarm: r.NewSwarm(), wait: alpha, started: make(chan struct{})}
+			if i == 0 {
+				counter = s
+			}
+			dhts[i] = NewDHT(DHTParams{Swarm: s, Alpha: alpha})
+			defer dhts[i].Close()
+		}
+		connectAll(dhts)
+
+		key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+		_, err := dhts[0].Get(ctx, key[:])
+		require.Equal(t, ErrNotFound, err)
+		require.Equal(t, alpha, counter.getMax(), "alpha=%d", alpha)
+	}
+}
+
+func TestDHTNegativeK(t *testing.T) {
+	require.Panics(t, func() {
+		NewDHT(DHTParams{Swarm: memswarm.NewRealm().NewSwarm(), K: -1})
+	})
+}
+
+func TestDHTPeerIDScheme(t *testing.T) {
+	ctx := context.Background()
+	for _, scheme := range []p2p.PeerIDScheme{p2p.DefaultPeerIDScheme, p2p.NewShakePeerIDScheme(16)} {
+		scheme := scheme
+		t.Run(fmt.Sprint(scheme.Len()), func(t *testing.T) {
+			r := memswarm.NewRealm()
+			dhts := newTestDHTs(t, r, 5, DHTParams{PeerIDScheme: scheme, ChunkSize: 128})
+			connectAll(dhts)
+			for _, d := range dhts {
+				require.Equal(t, scheme.Derive(d.swarm.PublicKey()), d.LocalID())
+				require.Len(t, d.peers.Locus(), scheme.Len())
+			}
+
+			key := scheme.Derive(r.NewSwarm().PublicKey())
+			require.Error(t, dhts[0].Put(ctx, make([]byte, scheme.Len()+1), []byte("hello")))
+			k := key[:scheme.Len()]
+			require.NoError(t, dhts[0].Put(ctx, k, []byte("hello")))
+			require.NoError(t, dhts[1].PutLarge(ctx, k, make([]byte, 300)))
+			require.NoError(t, dhts[2].Provide(ctx, k))
+			for _, d := range dhts {
+				v, err := d.GetLarge(ctx, k)
+				require.NoError(t, err)
+				require.Len(t, v, 300)
+				ids, err := d.FindProviders(ctx, k, 1)
+				require.NoError(t, err)
+				require.Equal(t, []p2p.PeerID{dhts[2].LocalID()}, ids)
+			}
+			for _, d := range dhts[:4] {
+				addrs, err := d.Resolve(ctx, dhts[4].LocalID())
+				require.NoError(t, err)
+				require.Equal(t, dhts[4].swarm.LocalAddrs(), addrs)
+			}
+		})
+	}
+}
+
+// inflightSwarm records the most asks it has had in flight at once.
+// The first asks wait until wait of them are in flight, so a round of that many is seen at once.
+type inflightSwarm struct {
+	p2p.SecureAskSwarm
+	wait    int
+	started chan struct{}
+
+	mu            sync.Mutex
+	inflight, max int
+}
+
+func (s *inflightSwarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	s.mu.Lock()
+	s.inflight++
+	if s.inflight > s.max {
+		s.max = s.inflight
+	}
+	if s.inflight == s.wait && isChanOpen(s.started) {
+		close(s.started)
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inflight--
+		s.mu.Unlock()
+	}()
+	select {
+	case <-s.started:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.SecureAskSwarm.Ask(ctx, addr, data)
+}
+
+func isChanOpen(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *inflightSwarm) getMax() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+func newTestDHTs(t testing.TB, r *memswarm.Realm, n int, params DHTParams) []*DHT {
+	dhts := make([]*DHT, n)
+	for i := range dhts {
+		params := params
+		params.Swarm = r.NewSwarm()
+		dhts[i] = NewDHT(params)
+	}
+	t.Cleanup(func() {
+		for _, d := range dhts {
+			require.NoError(t, d.Close())
+		}
+	})
+	return dhts
+}
+
+func connectAll(dhts []*DHT) {
+	for i := range dhts {
+		for j := range dhts {
+			if i != j {
+				dhts[i].AddPeer(dhts[j].LocalID(), dhts[j].swarm.LocalAddrs()[0])
+			}
+		}
+	}
+}
+
+func TestDHTInspect(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 5, DHTParams{})
+	connectAll(dhts)
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	require.NoError(t, dhts[0].Put(ctx, key[:], []byte("hello")))
+
+	rt := dhts[0].RoutingTable()
+	require.Len(t, rt, 4)
+	for i, e := range rt {
+		id, err := p2p.DefaultPeerIDScheme.Parse([]byte(e.ID))
+		require.NoError(t, err)
+		if i > 0 {
+			prev, _ := p2p.DefaultPeerIDScheme.Parse([]byte(rt[i-1].ID))
+			local := dhts[0].LocalID()
+			require.False(t, DistanceLt(local[:], id[:], prev[:]), "routing table must be ordered by distance")
+		}
+	}
+	sections := dhts[0].Inspect()
+	require.Contains(t, sections, "routing_table")
+	require.Equal(t, 4, sections["cache"].(CacheMetrics).Count)
+	require.Equal(t, 1, sections["counters"].(map[string]int)["values"])
+}
+
+func TestDeriveKey(t *testing.T) {
+	ctx := context.Background()
+	for _, scheme := range []p2p.PeerIDScheme{p2p.DefaultPeerIDScheme, p2p.NewShakePeerIDScheme(16)} {
+		r := memswarm.NewRealm()
+		dhts := newTestDHTs(t, r, 3, DHTParams{PeerIDScheme: scheme})
+		connectAll(dhts)
+
+		// the key for a node's public key is its own id
+		local := dhts[0].LocalID()
+		key := dhts[0].DeriveKey(p2p.MarshalPublicKey(dhts[0].swarm.PublicKey()))
+		require.Equal(t, local[:scheme.Len()], key)
+		require.Equal(t, key, dhts[1].DeriveKey(p2p.MarshalPublicKey(dhts[0].swarm.PublicKey())))
+
+		require.NoError(t, dhts[0].Put(ctx, key, []byte("mine")))
+		value, err := dhts[1].Get(ctx, local[:scheme.Len()])
+		require.NoError(t, err)
+		require.Equal(t, "mine", string(value))
+	}
+}
@@ -0,0 +1,48 @@
+package kademlia
+
+import (
+	"github.com/brendoncarroll/go-p2p"
+)
+
+var _ p2p.Inspector = &DHT{}
+
+// RoutingEntry is a peer in the DHT's routing cache.
+type RoutingEntry struct {
+	// ID is formatted with the DHT's PeerIDScheme.
+	ID   string
+	Addr string
+	// Bucket is the number of leading bits the peer's id shares with the local id.
+	Bucket int
+}
+
+// RoutingTable returns the peers in the routing cache, closest to the local id first.
+func (d *DHT) RoutingTable() []RoutingEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rt := []RoutingEntry{}
+	for _, e := range d.peers.ClosestN(d.idBytes(d.localID), d.peers.Count()) {
+		addr, _ := e.Value.(p2p.Addr).MarshalText()
+		rt = append(rt, RoutingEntry{
+			ID:     string(d.scheme.Format(idFromBytes(e.Key))),
+			Addr:   string(addr),
+			Bucket: d.peers.bucketIndex(e.Key),
+		})
+	}
+	return rt
+}
+
+// Inspect implements p2p.Inspector, with the RoutingTable, the routing cache's metrics,
+// and the number of values and provider records held.
+func (d *DHT) Inspect() map[string]interface{} {
+	d.mu.Lock()
+	metrics := d.peers.Metrics()
+	d.mu.Unlock()
+	return map[string]interface{}{
+		"routing_table": d.RoutingTable(),
+		"cache":         metrics,
+		"counters": map[string]int{
+			"values":    d.store.Count(),
+			"providers": d.providers.Count(),
+		},
+	}
+}
@@ -1,7 +1,9 @@
 package kademlia
 
 import (
+	"bytes"
 	"math/bits"
+	"sort"
 )
 
 func Leading0s(x []byte) int {
@@ -38,3 +40,26 @@ func HasPrefix(x []byte, prefix []byte, nbits int) bool {
 	lz := Leading0s(xor)
 	return lz >= nbits
 }
+
+// DistanceLt returns true if a is closer to key than b in XOR space.
+func DistanceLt(key, a, b []byte) bool {
+	l := len(key)
+	if len(a) > l {
+		l = len(a)
+	}
+	if len(b) > l {
+		l = len(b)
+	}
+	da := make([]byte, l)
+	db := make([]byte, l)
+	XORBytes(da, key, a)
+	XORBytes(db, key, b)
+	return bytes.Compare(da, db) < 0
+}
+
+// SortByDistance sorts ents in place by the distance of their key to key.
+func SortByDistance(key []byte, ents []Entry) {
+	sort.SliceStable(ents, func(i, j int) bool {
+		return DistanceLt(key, ents[i].Key, ents[j].Key)
+	})
+}
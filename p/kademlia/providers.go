@@ -0,0 +1,268 @@
+package kademlia
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultProviderTTL is the time a provider record lives for if ProviderTTL is not set.
+	DefaultProviderTTL = 24 * time.Hour
+	// MaxProvidersPerKey is the most providers of a key a node records for its peers.
+	MaxProvidersPerKey = 2 * DefaultK
+)
+
+// ProviderStore holds the provider records a node is responsible for.
+// Each key has a set of providers, and each provider has its own expiry.
+type ProviderStore struct {
+	mu      sync.RWMutex
+	entries map[string]map[p2p.PeerID]providerEntry
+	count   int
+}
+
+type providerEntry struct {
+	addr      p2p.Addr
+	expiresAt time.Time
+}
+
+func NewProviderStore() *ProviderStore {
+	return &ProviderStore{
+		entries: make(map[string]map[p2p.PeerID]providerEntry),
+	}
+}
+
+// Add inserts or refreshes the record that id, reachable at addr, provides key.
+func (s *ProviderStore) Add(key []byte, id p2p.PeerID, addr p2p.Addr, expiresAt time.Time) {
+	s.AddLimit(key, id, addr, expiresAt, 0, 0)
+}
+
+// AddLimit is like Add, but a new record is not inserted if key already has perKey providers,
+// or the store already holds total records. A limit of 0 means there is no limit.
+// Expired records which have not been removed count towards the limits.
+// It returns false if the record was not stored.
+func (s *ProviderStore) AddLimit(key []byte, id p2p.PeerID, addr p2p.Addr, expiresAt time.Time, perKey, total int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	provs := s.entries[string(key)]
+	if _, exists := provs[id]; !exists {
+		if (perKey > 0 && len(provs) >= perKey) || (total > 0 && s.count >= total) {
+			return false
+		}
+		s.count++
+	}
+	if provs == nil {
+		provs = make(map[p2p.PeerID]providerEntry)
+		s.entries[string(key)] = provs
+	}
+	provs[id] = providerEntry{addr: addr, expiresAt: expiresAt}
+	return true
+}
+
+// Get calls fn with each unexpired provider of key, until fn returns false.
+// fn must not call methods on the store.
+func (s *ProviderStore) Get(key []byte, now time.Time, fn func(id p2p.PeerID, addr p2p.Addr) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for id, e := range s.entries[string(key)] {
+		if !now.Before(e.expiresAt) {
+			continue
+		}
+		if !fn(id, e.addr) {
+			return
+		}
+	}
+}
+
+// Expire removes all the records which have expired as of now.
+// It returns the number of records removed.
+func (s *ProviderStore) Expire(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int
+	for k, provs := range s.entries {
+		for id, e := range provs {
+			if !now.Before(e.expiresAt) {
+				delete(provs, id)
+				count++
+			}
+		}
+		if len(provs) == 0 {
+			delete(s.entries, k)
+		}
+	}
+	s.count -= count
+	return count
+}
+
+// Count returns the number of records in the store, including expired records which have not been removed.
+func (s *ProviderStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count
+}
+
+// Provide announces this node as a provider of key to the closest nodes, including this node if it is one of them.
+// The records expire after ProviderTTL, so Provide must be called again before then for the node to stay discoverable.
+// An error is returned if the swarm has no local address, since peers would have nowhere to reach this node.
+func (d *DHT) Provide(ctx context.Context, key []byte) error {
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	localAddrs := d.swarm.LocalAddrs()
+	if len(localAddrs) == 0 {
+		return errors.Errorf("kademlia: can't provide key %x, the swarm has no local address", key)
+	}
+	peers := d.lookup(ctx, key, d.k)
+	if len(peers) < d.k || DistanceLt(key, d.idBytes(d.localID), d.idBytes(peers[d.k-1].id)) {
+		d.providers.Add(key, d.localID, localAddrs[0], d.clock.Now().Add(d.providerTTL))
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	var mu sync.Mutex
+	var stored int
+	eg := errgroup.Group{}
+	for _, p := range peers {
+		p := p
+		eg.Go(func() error {
+			if err := d.askAddProvider(ctx, p.addr, key, d.providerTTL); err != nil {
+				log.Debug(err)
+				return nil
+			}
+			mu.Lock()
+			stored++
+			mu.Unlock()
+			return nil
+		})
+	}
+	eg.Wait()
+	if stored == 0 {
+		return errors.Errorf("kademlia: could not announce provider to any of %d peers", len(peers))
+	}
+	return nil
+}
+
+// FindProviders returns up to n peers which provide key, from this node and the closest nodes.
+// The addresses of the providers are added to the routing cache, so they can be found with Resolve.
+// ErrNotFound is returned if no providers are found.
+func (d *DHT) FindProviders(ctx context.Context, key []byte, n int) ([]p2p.PeerID, error) {
+	if err := d.checkKey(key); err != nil {
+		return nil, err
+	}
+	var ids []p2p.PeerID
+	seen := map[p2p.PeerID]bool{}
+	add := func(id p2p.PeerID) {
+		if len(ids) < n && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	d.providers.Get(key, d.clock.Now(), func(id p2p.PeerID, _ p2p.Addr) bool {
+		add(id)
+		return len(ids) < n
+	})
+	if len(ids) < n {
+		for _, p := range d.lookup(ctx, key, d.k) {
+			provs, err := d.askGetProviders(ctx, p.addr, key, n)
+			if err != nil {
+				log.Debug(err)
+				continue
+			}
+			for _, prov := range provs {
+				add(prov.id)
+			}
+			if len(ids) >= n {
+				break
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, ErrNotFound
+	}
+	return ids, nil
+}
+
+// handleAddProvider records the sender of the request as a provider of the key.
+// TTLs longer than ProviderTTL are shortened to it.
+// New providers are refused once the key has MaxProvidersPerKey, or the store holds MaxValues records.
+func (d *DHT) handleAddProvider(msg *p2p.Message, id p2p.PeerID, req *addProviderReq) addProviderRes {
+	if d.checkKey(req.Key) != nil || req.TTL <= 0 {
+		return addProviderRes{Accepted: false}
+	}
+	if d.refuseFarKeys && !d.ShouldStore(req.Key) {
+		return addProviderRes{Accepted: false}
+	}
+	ttl := req.TTL
+	if ttl > d.providerTTL {
+		ttl = d.providerTTL
+	}
+	expiresAt := d.clock.Now().Add(ttl)
+	if !d.providers.AddLimit(req.Key, id, msg.Src, expiresAt, MaxProvidersPerKey, d.maxValues) {
+		// make room by removing expired records
+		d.providers.Expire(d.clock.Now())
+		if !d.providers.AddLimit(req.Key, id, msg.Src, expiresAt, MaxProvidersPerKey, d.maxValues) {
+			return addProviderRes{Accepted: false, Full: true}
+		}
+	}
+	return addProviderRes{Accepted: true}
+}
+
+func (d *DHT) handleGetProviders(req *getProvidersReq) getProvidersRes {
+	r := getProvidersRes{}
+	d.providers.Get(req.Key, d.clock.Now(), func(id p2p.PeerID, addr p2p.Addr) bool {
+		data, err := addr.MarshalText()
+		if err != nil {
+			return true
+		}
+		r.Providers = append(r.Providers, peerRecord{ID: id, Addr: string(data)})
+		return len(r.Providers) < req.N
+	})
+	return r
+}
+
+func (d *DHT) askAddProvider(ctx context.Context, addr p2p.Addr, key []byte, ttl time.Duration) error {
+	var res addProviderRes
+	if err := d.ask(ctx, addr, request{AddProvider: &addProviderReq{Key: key, TTL: ttl}}, &res); err != nil {
+		return err
+	}
+	if res.Full {
+		return ErrStoreFull
+	}
+	if !res.Accepted {
+		return errors.Errorf("kademlia: provider refused by %v", addr)
+	}
+	return nil
+}
+
+func (d *DHT) askGetProviders(ctx context.Context, addr p2p.Addr, key []byte, n int) ([]peerInfo, error) {
+	var res getProvidersRes
+	if err := d.ask(ctx, addr, request{GetProviders: &getProvidersReq{Key: key, N: n}}, &res); err != nil {
+		return nil, err
+	}
+	return d.parsePeers(res.Providers), nil
+}
+
+type addProviderReq struct {
+	Key []byte        `json:"key"`
+	TTL time.Duration `json:"ttl"`
+}
+
+type addProviderRes struct {
+	Accepted bool `json:"accepted"`
+	// Full is true if the record was refused because the key has too many providers, or the store is full
+	Full bool `json:"full,omitempty"`
+}
+
+type getProvidersReq struct {
+	Key []byte `json:"key"`
+	N   int    `json:"n"`
+}
+
+type getProvidersRes struct {
+	Providers []peerRecord `json:"providers,omitempty"`
+}
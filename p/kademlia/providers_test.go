@@ -0,0 +1,149 @@
+package kademlia
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDHTProviders(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 10, DHTParams{})
+	connectAll(dhts)
+
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	_, err := dhts[0].FindProviders(ctx, key[:], 10)
+	require.Equal(t, ErrNotFound, err)
+
+	var expected []p2p.PeerID
+	for _, d := range dhts[:4] {
+		require.NoError(t, d.Provide(ctx, key[:]))
+		expected = append(expected, d.LocalID())
+	}
+	sortIDs(expected)
+	for _, d := range dhts {
+		ids, err := d.FindProviders(ctx, key[:], 10)
+		require.NoError(t, err)
+		sortIDs(ids)
+		require.Equal(t, expected, ids)
+	}
+
+	// n limits the providers returned
+	ids, err := dhts[9].FindProviders(ctx, key[:], 2)
+	require.NoError(t, err)
+	require.Len(t, ids, 2)
+}
+
+func TestDHTProvidersExpire(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	clock := clockwork.NewFakeClock()
+	params := DHTParams{ProviderTTL: time.Hour, RepublishInterval: time.Minute, Clock: clock}
+	dhts := newTestDHTs(t, r, 3, params)
+	connectAll(dhts)
+
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	require.NoError(t, dhts[0].Provide(ctx, key[:]))
+	ids, err := dhts[1].FindProviders(ctx, key[:], 1)
+	require.NoError(t, err)
+	require.Equal(t, []p2p.PeerID{dhts[0].LocalID()}, ids)
+
+	// each node's maintenance loop is waiting on its ticker
+	clock.BlockUntil(len(dhts))
+	clock.Advance(time.Hour)
+	for _, d := range dhts {
+		_, err := d.FindProviders(ctx, key[:], 1)
+		require.Equal(t, ErrNotFound, err)
+		require.Eventually(t, func() bool {
+			return d.providers.Count() == 0
+		}, time.Second, time.Millisecond)
+	}
+
+	// announcing again makes the provider discoverable
+	require.NoError(t, dhts[0].Provide(ctx, key[:]))
+	ids, err = dhts[2].FindProviders(ctx, key[:], 1)
+	require.NoError(t, err)
+	require.Equal(t, []p2p.PeerID{dhts[0].LocalID()}, ids)
+}
+
+func TestProviderStoreLimit(t *testing.T) {
+	s := NewProviderStore()
+	now := time.Now()
+	key1, key2 := []byte("key1"), []byte("key2")
+	id := func(i int) p2p.PeerID { return p2p.PeerID{byte(i)} }
+	require.True(t, s.AddLimit(key1, id(1), memswarm.Addr{N: 1}, now.Add(time.Hour), 2, 3))
+	require.True(t, s.AddLimit(key1, id(2), memswarm.Addr{N: 2}, now.Add(time.Hour), 2, 3))
+	// key1 has as many providers as it can
+	require.False(t, s.AddLimit(key1, id(3), memswarm.Addr{N: 3}, now.Add(time.Hour), 2, 3))
+	require.True(t, s.AddLimit(key2, id(3), memswarm.Addr{N: 3}, now.Add(time.Hour), 2, 3))
+	// the store is full
+	require.False(t, s.AddLimit(key2, id(4), memswarm.Addr{N: 4}, now.Add(time.Hour), 2, 3))
+	// but records can be refreshed
+	require.True(t, s.AddLimit(key1, id(1), memswarm.Addr{N: 1}, now.Add(2*time.Hour), 2, 3))
+	require.Equal(t, 3, s.Count())
+	require.Equal(t, 2, s.Expire(now.Add(time.Hour)))
+	require.Equal(t, 1, s.Count())
+}
+
+func TestDHTProvidersMaxValues(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 2, DHTParams{MaxValues: 1})
+	connectAll(dhts)
+	k1 := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	k2 := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	require.NoError(t, dhts[0].Provide(ctx, k1[:]))
+	// dhts[1] holds a record for k1, and has no room for k2
+	err := dhts[0].Provide(ctx, k2[:])
+	require.Error(t, err)
+	require.Equal(t, 1, dhts[1].providers.Count())
+}
+
+func TestProvideNoLocalAddr(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	d := NewDHT(DHTParams{Swarm: noAddrSwarm{r.NewSwarm()}})
+	defer d.Close()
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	require.Error(t, d.Provide(ctx, key[:]))
+}
+
+type noAddrSwarm struct {
+	*memswarm.Swarm
+}
+
+func (noAddrSwarm) LocalAddrs() []p2p.Addr {
+	return nil
+}
+
+func TestDHTProvidersResolve(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	dhts := newTestDHTs(t, r, 3, DHTParams{})
+	connectAll(dhts[:2])
+
+	// dhts[2] only knows dhts[0], and announces itself to it.
+	dhts[2].AddPeer(dhts[0].LocalID(), dhts[0].swarm.LocalAddrs()[0])
+	key := p2p.NewPeerID(r.NewSwarm().PublicKey())
+	require.NoError(t, dhts[2].Provide(ctx, key[:]))
+
+	ids, err := dhts[1].FindProviders(ctx, key[:], 1)
+	require.NoError(t, err)
+	require.Equal(t, []p2p.PeerID{dhts[2].LocalID()}, ids)
+	addrs, err := dhts[1].Resolve(ctx, ids[0])
+	require.NoError(t, err)
+	require.Equal(t, dhts[2].swarm.LocalAddrs(), addrs)
+}
+
+func sortIDs(ids []p2p.PeerID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return string(ids[i][:]) < string(ids[j][:])
+	})
+}
@@ -0,0 +1,105 @@
+package kademlia
+
+import (
+	"sync"
+	"time"
+)
+
+// Store holds the values a node is responsible for.
+// Every value has an expiry, after which it is no longer returned.
+type Store struct {
+	mu      sync.RWMutex
+	entries map[string]storeEntry
+}
+
+type storeEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func NewStore() *Store {
+	return &Store{
+		entries: make(map[string]storeEntry),
+	}
+}
+
+// Put inserts or replaces the value at key.
+func (s *Store) Put(key, value []byte, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[string(key)] = storeEntry{
+		value:     append([]byte{}, value...),
+		expiresAt: expiresAt,
+	}
+}
+
+// PutLimit inserts or replaces the value at key, unless key is new and the store already holds limit values.
+// Expired values which have not been removed count towards the limit.
+// It returns false if the value was not stored.
+func (s *Store) PutLimit(key, value []byte, expiresAt time.Time, limit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.entries[string(key)]; !exists && len(s.entries) >= limit {
+		return false
+	}
+	s.entries[string(key)] = storeEntry{
+		value:     append([]byte{}, value...),
+		expiresAt: expiresAt,
+	}
+	return true
+}
+
+// Get returns the value at key, or nil if it does not exist or has expired.
+func (s *Store) Get(key []byte, now time.Time) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, exists := s.entries[string(key)]
+	if !exists || !now.Before(e.expiresAt) {
+		return nil
+	}
+	return e.value
+}
+
+// Delete removes the value at key
+func (s *Store) Delete(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, string(key))
+}
+
+// Expire removes all the values which have expired as of now.
+// It returns the number of values removed.
+func (s *Store) Expire(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int
+	for k, e := range s.entries {
+		if !now.Before(e.expiresAt) {
+			delete(s.entries, k)
+			count++
+		}
+	}
+	return count
+}
+
+// ForEach calls fn with every unexpired value in the store.
+// fn must not call methods on the store.
+func (s *Store) ForEach(now time.Time, fn func(key, value []byte, expiresAt time.Time) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, e := range s.entries {
+		if !now.Before(e.expiresAt) {
+			continue
+		}
+		if !fn([]byte(k), e.value, e.expiresAt) {
+			return
+		}
+	}
+}
+
+// Count returns the number of values in the store, including expired values which have not been removed.
+func (s *Store) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries)
+}
@@ -0,0 +1,602 @@
+// Package streamask implements asks whose responses are streamed back in chunks, so large responses don't need to be buffered.
+//
+// A request is sent as one Tell, carrying a random nonce.
+// The handler's writes are cut into chunks which fit the swarm's MTU, each sent as a Tell with the nonce and a sequence number,
+// followed by an end message with the number of chunks.
+// The asker reorders the chunks, and acknowledges them as they are read, and the handler's writes block once
+// a window of chunks is unacknowledged, so neither side buffers more than a window.
+// Until the first chunk is acknowledged the window is one chunk, so a request from a forged address
+// can't make the handler send more than a chunk to it.
+// Nothing is retransmitted, so if a message is lost the stream stalls, and reading from it times out.
+package streamask
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/askutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+const (
+	// DefaultTimeout is the default time to wait for the next message of a stream.
+	DefaultTimeout = 5 * time.Second
+	// DefaultWindow is the default number of chunks which can be sent before they are acknowledged.
+	DefaultWindow = 16
+	// DefaultMaxRequests is the default number of requests handled at once.
+	DefaultMaxRequests = 64
+)
+
+var (
+	// ErrTimeout is returned when the next message of a stream does not arrive within the timeout.
+	ErrTimeout = errors.New("streamask: timed out waiting for stream")
+	// ErrCanceled is returned by the handler's writer once the asker has closed the stream.
+	ErrCanceled = errors.New("streamask: stream canceled by asker")
+	// ErrBusy is returned when reading from a stream, if the remote peer was already handling as many requests as it can.
+	ErrBusy = errors.New("streamask: remote peer is busy")
+)
+
+const (
+	typeRequest = uint8(iota)
+	// typeChunk carries the part of the response with the sequence number in the header.
+	typeChunk
+	// typeEnd ends the response, and carries the number of chunks in the sequence number.
+	typeEnd
+	// typeAck is sent by the asker, and carries the number of chunks it has read in the sequence number.
+	typeAck
+	// typeCancel is sent by the asker when it closes a stream before the end.
+	typeCancel
+	// typeBusy is sent instead of a response when there are too many requests being handled.
+	typeBusy
+)
+
+// Overhead is the size of the header on each message: a type, a nonce and a sequence number.
+const Overhead = 1 + 8 + 4
+
+type Option func(*Asker)
+
+// WithTimeout sets how long to wait for the next message of a stream. The default is DefaultTimeout.
+// Reads from a stream, and writes by a handler waiting for acknowledgements, fail after waiting this long.
+func WithTimeout(d time.Duration) Option {
+	if d <= 0 {
+		panic("timeout must be positive")
+	}
+	return func(a *Asker) {
+		a.timeout = d
+	}
+}
+
+// WithWindow sets the number of chunks which can be sent before they are acknowledged. The default is DefaultWindow.
+func WithWindow(n int) Option {
+	if n < 1 {
+		panic("window must be at least 1")
+	}
+	return func(a *Asker) {
+		a.window = uint32(n)
+	}
+}
+
+// WithMaxRequests sets how many requests are handled at once.
+// Requests which arrive while that many are being handled are refused, and reading their streams returns ErrBusy.
+// The default is DefaultMaxRequests.
+func WithMaxRequests(n int) Option {
+	if n <= 0 {
+		panic("max requests must be positive")
+	}
+	return func(a *Asker) {
+		a.maxRequests = n
+	}
+}
+
+// WithClock sets the clock used for timeouts. The default is the real clock.
+func WithClock(clock clockwork.Clock) Option {
+	return func(a *Asker) {
+		a.clock = clock
+	}
+}
+
+// Asker sends asks over a swarm and streams their responses.
+// It receives responses by serving the swarm's tells, so ServeAsks must be running for AskStream to succeed,
+// and the swarm must not be used for anything else.
+type Asker struct {
+	swarm       p2p.Swarm
+	timeout     time.Duration
+	window      uint32
+	maxRequests int
+	clock       clockwork.Clock
+	// requests limits the requests being handled at once.
+	requests *askutil.Limiter
+
+	mu      sync.Mutex
+	streams map[uint64]*stream
+	writers map[writerKey]*chunkWriter
+}
+
+type writerKey struct {
+	src   string
+	nonce uint64
+}
+
+func New(x p2p.Swarm, opts ...Option) *Asker {
+	a := &Asker{
+		swarm:       x,
+		timeout:     DefaultTimeout,
+		window:      DefaultWindow,
+		maxRequests: DefaultMaxRequests,
+		clock:       clockwork.NewRealClock(),
+		streams:     make(map[uint64]*stream),
+		writers:     make(map[writerKey]*chunkWriter),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.requests = askutil.NewLimiter(a.maxRequests)
+	return a
+}
+
+// AskStream sends req to dst, and returns the response as a stream.
+// The stream must be closed, which tells dst to stop sending if the response has not been read to the end.
+// Reads fail once ctx is done, or if the next chunk does not arrive within the timeout.
+// Only chunks from dst are accepted.
+func (a *Asker) AskStream(ctx context.Context, dst p2p.Addr, req p2p.IOVec) (io.ReadCloser, error) {
+	if err := p2p.CheckMTU(req, a.MTU(ctx, dst)); err != nil {
+		return nil, err
+	}
+	s := a.addStream(ctx, dst)
+	msg := append(p2p.IOVec{newHeader(typeRequest, s.nonce, 0)}, req...)
+	if err := a.swarm.Tell(ctx, dst, msg); err != nil {
+		a.removeStream(s.nonce)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Ask sends req to dst and reads the whole response.
+func (a *Asker) Ask(ctx context.Context, dst p2p.Addr, req p2p.IOVec) ([]byte, error) {
+	rc, err := a.AskStream(ctx, dst, req)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// ServeAsks serves the swarm's tells, calling fn with requests and delivering responses to AskStream.
+// fn is called in its own goroutine for each request, at most WithMaxRequests at once,
+// and what it writes is sent as it fills each chunk, and when it returns.
+// Writes fail once the asker has closed the stream, and the context passed to fn is canceled.
+func (a *Asker) ServeAsks(fn p2p.AskHandler) error {
+	return a.swarm.ServeTells(func(msg *p2p.Message) {
+		a.handleTell(msg, fn)
+	})
+}
+
+// MTU is the largest request which can be sent to addr.
+// Responses can be any size.
+func (a *Asker) MTU(ctx context.Context, addr p2p.Addr) int {
+	return a.swarm.MTU(ctx, addr) - Overhead
+}
+
+func (a *Asker) handleTell(msg *p2p.Message, fn p2p.AskHandler) {
+	typ, nonce, seq, body, err := parseMessage(msg.Payload)
+	if err != nil {
+		log.WithFields(logrus.Fields{"src": msg.Src}).Debug("streamask: ", err)
+		return
+	}
+	switch typ {
+	case typeRequest:
+		if !a.requests.TryAcquire() {
+			if err := askutil.Refuse(a.swarm, msg.Src, newHeader(typeBusy, nonce, 0), a.timeout); err != nil {
+				log.WithFields(logrus.Fields{"dst": msg.Src}).Debug("streamask: error refusing request: ", err)
+			}
+			return
+		}
+		req := &p2p.Message{Src: msg.Src, Dst: msg.Dst, Payload: append([]byte{}, body...)}
+		w := a.addWriter(req.Src, nonce)
+		if w == nil {
+			a.requests.Release()
+			return
+		}
+		go func() {
+			defer a.requests.Release()
+			a.handleRequest(req, w, fn)
+		}()
+	case typeChunk, typeEnd, typeBusy:
+		if s := a.getStream(msg.Src, nonce); s != nil {
+			s.deliver(typ, seq, body)
+		}
+	case typeAck, typeCancel:
+		if w := a.getWriter(msg.Src, nonce); w != nil {
+			w.handle(typ, seq)
+		}
+	}
+}
+
+func (a *Asker) handleRequest(req *p2p.Message, w *chunkWriter, fn p2p.AskHandler) {
+	defer a.removeWriter(req.Src, w.nonce)
+	defer w.cf()
+	fn(w.ctx, req, w)
+	if err := w.finish(); err != nil {
+		log.WithFields(logrus.Fields{"dst": req.Src}).Debug("streamask: error sending response: ", err)
+	}
+}
+
+func (a *Asker) addStream(ctx context.Context, dst p2p.Addr) *stream {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for {
+		nonce := askutil.RandomNonce()
+		if _, exists := a.streams[nonce]; exists {
+			continue
+		}
+		s := &stream{
+			a:      a,
+			ctx:    ctx,
+			dst:    dst,
+			nonce:  nonce,
+			chunks: make(map[uint32][]byte),
+			signal: make(chan struct{}, 1),
+		}
+		a.streams[nonce] = s
+		return s
+	}
+}
+
+func (a *Asker) getStream(src p2p.Addr, nonce uint64) *stream {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, exists := a.streams[nonce]
+	if !exists || s.dst.Key() != src.Key() {
+		return nil
+	}
+	return s
+}
+
+func (a *Asker) removeStream(nonce uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.streams, nonce)
+}
+
+// addWriter returns a writer for the response to a request, or nil if the request is a duplicate.
+func (a *Asker) addWriter(src p2p.Addr, nonce uint64) *chunkWriter {
+	k := writerKey{src: src.Key(), nonce: nonce}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, exists := a.writers[k]; exists {
+		return nil
+	}
+	ctx, cf := context.WithCancel(context.Background())
+	w := &chunkWriter{
+		a:         a,
+		ctx:       ctx,
+		cf:        cf,
+		dst:       src,
+		nonce:     nonce,
+		chunkSize: a.swarm.MTU(ctx, src) - Overhead,
+		signal:    make(chan struct{}, 1),
+	}
+	a.writers[k] = w
+	return w
+}
+
+func (a *Asker) getWriter(src p2p.Addr, nonce uint64) *chunkWriter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.writers[writerKey{src: src.Key(), nonce: nonce}]
+}
+
+func (a *Asker) removeWriter(src p2p.Addr, nonce uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.writers, writerKey{src: src.Key(), nonce: nonce})
+}
+
+// stream is the asker's end of a response.
+type stream struct {
+	a     *Asker
+	ctx   context.Context
+	dst   p2p.Addr
+	nonce uint64
+	// signal is sent on when a message is delivered
+	signal chan struct{}
+
+	mu sync.Mutex
+	// chunks holds the chunks which have arrived but not been read, by sequence number.
+	chunks map[uint32][]byte
+	// next is the sequence number of the next chunk to read
+	next uint32
+	// end is the number of chunks, once the end message has arrived
+	end    uint32
+	ended  bool
+	closed bool
+	busy   bool
+	// buf is the unread part of the chunk being read
+	buf []byte
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	for {
+		n, ack, err := s.tryRead(p)
+		if ack {
+			s.sendAck()
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+		if err := s.wait(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// tryRead reads from the chunks which have arrived.
+// ack is true if an acknowledgement should be sent for the chunks read so far.
+func (s *stream) tryRead(p []byte) (n int, ack bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, false, errors.New("streamask: read from closed stream")
+	}
+	if s.busy {
+		return 0, false, ErrBusy
+	}
+	for len(s.buf) == 0 {
+		if s.ended && s.next == s.end {
+			return 0, false, io.EOF
+		}
+		chunk, exists := s.chunks[s.next]
+		if !exists {
+			return 0, false, nil
+		}
+		delete(s.chunks, s.next)
+		s.buf = chunk
+		s.next++
+		// the first chunk is acknowledged as soon as it is read, since the writer waits for it before sending more.
+		ack = s.next == 1 || s.next%s.ackEvery() == 0
+	}
+	n = copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, ack, nil
+}
+
+// ackEvery is the number of chunks read between acknowledgements.
+// Acknowledging every half window keeps the writer from waiting while the asker is reading.
+func (s *stream) ackEvery() uint32 {
+	if s.a.window < 2 {
+		return 1
+	}
+	return s.a.window / 2
+}
+
+// sendAck tells the writer how many chunks have been read.
+func (s *stream) sendAck() {
+	s.mu.Lock()
+	next := s.next
+	s.mu.Unlock()
+	if err := s.a.swarm.Tell(s.ctx, s.dst, p2p.IOVec{newHeader(typeAck, s.nonce, next)}); err != nil {
+		log.WithFields(logrus.Fields{"dst": s.dst}).Debug("streamask: error sending ack: ", err)
+	}
+}
+
+func (s *stream) wait() error {
+	timer := s.a.clock.NewTimer(s.a.timeout)
+	defer timer.Stop()
+	select {
+	case <-s.signal:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-timer.Chan():
+		return ErrTimeout
+	}
+}
+
+// deliver is called with each chunk or end message for the stream.
+// Duplicate chunks, and chunks too far ahead of the reader to have been sent, are dropped.
+func (s *stream) deliver(typ uint8, seq uint32, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch typ {
+	case typeChunk:
+		if seq < s.next || seq-s.next >= s.a.window {
+			return
+		}
+		if _, exists := s.chunks[seq]; exists {
+			return
+		}
+		s.chunks[seq] = append([]byte{}, body...)
+	case typeEnd:
+		if s.ended || seq < s.next {
+			return
+		}
+		s.end = seq
+		s.ended = true
+	case typeBusy:
+		// the request was refused, so nothing else is coming
+		if s.next > 0 || len(s.chunks) > 0 || s.ended {
+			return
+		}
+		s.busy = true
+	}
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops accepting the response, and tells the handler to stop writing if it has not finished.
+func (s *stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	done := (s.ended && s.next == s.end) || s.busy
+	s.mu.Unlock()
+	s.a.removeStream(s.nonce)
+	if !done {
+		ctx, cf := context.WithTimeout(context.Background(), s.a.timeout)
+		defer cf()
+		return s.a.swarm.Tell(ctx, s.dst, p2p.IOVec{newHeader(typeCancel, s.nonce, 0)})
+	}
+	return nil
+}
+
+// chunkWriter is the io.Writer passed to the handler, which sends each chunk as it is filled.
+type chunkWriter struct {
+	a         *Asker
+	ctx       context.Context
+	cf        context.CancelFunc
+	dst       p2p.Addr
+	nonce     uint64
+	chunkSize int
+	// signal is sent on when an acknowledgement or cancelation arrives
+	signal chan struct{}
+
+	buf []byte
+	// seq is the sequence number of the next chunk
+	seq uint32
+
+	mu       sync.Mutex
+	acked    uint32
+	canceled bool
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.chunkSize <= 0 {
+		return 0, p2p.ErrMTUExceeded
+	}
+	var n int
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.chunkSize)
+		}
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush sends the buffered chunk, once there is room in the window.
+func (w *chunkWriter) flush() error {
+	if err := w.waitWindow(); err != nil {
+		return err
+	}
+	msg := p2p.IOVec{newHeader(typeChunk, w.nonce, w.seq), w.buf}
+	if err := w.a.swarm.Tell(w.ctx, w.dst, msg); err != nil {
+		return err
+	}
+	w.seq++
+	w.buf = nil
+	return nil
+}
+
+// finish sends what is left, followed by the end message.
+func (w *chunkWriter) finish() error {
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if w.isCanceled() {
+		return ErrCanceled
+	}
+	return w.a.swarm.Tell(w.ctx, w.dst, p2p.IOVec{newHeader(typeEnd, w.nonce, w.seq)})
+}
+
+// waitWindow waits until the next chunk is in the window.
+// The window is one chunk until the first is acknowledged.
+func (w *chunkWriter) waitWindow() error {
+	var timeout <-chan time.Time
+	for {
+		w.mu.Lock()
+		canceled, acked := w.canceled, w.acked
+		w.mu.Unlock()
+		if canceled {
+			return ErrCanceled
+		}
+		window := w.a.window
+		if acked == 0 {
+			window = 1
+		}
+		if w.seq-acked < window {
+			return nil
+		}
+		if timeout == nil {
+			timer := w.a.clock.NewTimer(w.a.timeout)
+			defer timer.Stop()
+			timeout = timer.Chan()
+		}
+		select {
+		case <-w.signal:
+		case <-w.ctx.Done():
+			// the context is only canceled before the handler returns by a cancel message
+			return ErrCanceled
+		case <-timeout:
+			return ErrTimeout
+		}
+	}
+}
+
+func (w *chunkWriter) isCanceled() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.canceled
+}
+
+func (w *chunkWriter) handle(typ uint8, seq uint32) {
+	w.mu.Lock()
+	switch typ {
+	case typeAck:
+		if seq > w.acked {
+			w.acked = seq
+		}
+	case typeCancel:
+		w.canceled = true
+	}
+	w.mu.Unlock()
+	if typ == typeCancel {
+		w.cf()
+	}
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+func newHeader(typ uint8, nonce uint64, seq uint32) []byte {
+	header := make([]byte, Overhead)
+	header[0] = typ
+	binary.BigEndian.PutUint64(header[1:9], nonce)
+	binary.BigEndian.PutUint32(header[9:], seq)
+	return header
+}
+
+func parseMessage(x []byte) (typ uint8, nonce uint64, seq uint32, body []byte, err error) {
+	if len(x) < Overhead {
+		return 0, 0, 0, nil, errors.Errorf("message too short")
+	}
+	typ = x[0]
+	if typ > typeBusy {
+		return 0, 0, 0, nil, errors.Errorf("unknown message type %d", typ)
+	}
+	return typ, binary.BigEndian.Uint64(x[1:9]), binary.BigEndian.Uint32(x[9:Overhead]), x[Overhead:], nil
+}
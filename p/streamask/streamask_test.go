@@ -0,0 +1,208 @@
+package streamask
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/askutil"
+	"github.com/brendoncarroll/go-p2p/s/faultyswarm"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+const testMTU = 100
+
+func TestAskStream(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(testMTU))
+	const chunkSize = testMTU - Overhead
+	first := bytes.Repeat([]byte{1}, chunkSize)
+	rest := make([]byte, 10*testMTU+7)
+	for i := range rest {
+		rest[i] = uint8(i)
+	}
+	proceed := make(chan struct{})
+	client, _, addr := newTestPair(t, r.NewSwarm(), r.NewSwarm(), func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write(first)
+		<-proceed
+		w.Write(rest)
+	})
+
+	rc, err := client.AskStream(ctx, addr, p2p.IOVec{[]byte("scan")})
+	require.NoError(t, err)
+	defer rc.Close()
+	// the first chunk can be read while the handler is still running
+	buf := make([]byte, chunkSize)
+	_, err = io.ReadFull(rc, buf)
+	require.NoError(t, err)
+	require.Equal(t, first, buf)
+	close(proceed)
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, rest, data)
+}
+
+func TestAsk(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(testMTU))
+	resp := make([]byte, 10*testMTU)
+	for i := range resp {
+		resp[i] = uint8(i)
+	}
+	client, _, addr := newTestPair(t, r.NewSwarm(), r.NewSwarm(), func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write(resp)
+	})
+	data, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("scan")})
+	require.NoError(t, err)
+	require.Equal(t, resp, data)
+	// an empty response is only the end message
+	client2, _, addr2 := newTestPair(t, r.NewSwarm(), r.NewSwarm(), p2p.NoOpAskHandler)
+	data, err = client2.Ask(ctx, addr2, p2p.IOVec{[]byte("scan")})
+	require.NoError(t, err)
+	require.Len(t, data, 0)
+	require.Len(t, client.streams, 0)
+}
+
+func TestWindow(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(testMTU))
+	const window, total = 2, 10
+	const chunkSize = testMTU - Overhead
+	var written int32
+	// the clock never advances, it is only used to see when the handler is waiting for an ack.
+	clock := clockwork.NewFakeClock()
+	client, _, addr := newTestPair(t, r.NewSwarm(), r.NewSwarm(), func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		for i := 0; i < total; i++ {
+			if _, err := w.Write(make([]byte, chunkSize)); err != nil {
+				return
+			}
+			atomic.AddInt32(&written, 1)
+		}
+	}, WithWindow(window), WithClock(clock))
+
+	rc, err := client.AskStream(ctx, addr, p2p.IOVec{[]byte("scan")})
+	require.NoError(t, err)
+	defer rc.Close()
+	// only the first chunk is sent until it is acknowledged
+	clock.BlockUntil(1)
+	require.Equal(t, int32(1), atomic.LoadInt32(&written))
+	_, err = io.ReadFull(rc, make([]byte, chunkSize))
+	require.NoError(t, err)
+	// then the handler stops writing once a window is unacknowledged
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&written) == 1+window
+	}, time.Second, time.Millisecond)
+	clock.BlockUntil(1)
+	require.Equal(t, int32(1+window), atomic.LoadInt32(&written))
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.Len(t, data, (total-1)*chunkSize)
+	require.Equal(t, int32(total), atomic.LoadInt32(&written))
+}
+
+func TestBusy(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(testMTU))
+	started, release := make(chan struct{}), make(chan struct{})
+	client, _, addr := newTestPair(t, r.NewSwarm(), r.NewSwarm(), func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	}, WithMaxRequests(1))
+	first := make(chan error, 1)
+	go func() {
+		_, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("1")})
+		first <- err
+	}()
+	<-started
+	// the server is handling as many requests as it can, so the next is refused
+	_, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("2")})
+	require.Equal(t, ErrBusy, err)
+	close(release)
+	require.NoError(t, <-first)
+	require.Len(t, client.streams, 0)
+}
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(testMTU))
+	errs := make(chan error, 1)
+	client, _, addr := newTestPair(t, r.NewSwarm(), r.NewSwarm(), func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		for {
+			if _, err := w.Write(make([]byte, testMTU)); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}, WithWindow(2))
+
+	rc, err := client.AskStream(ctx, addr, p2p.IOVec{[]byte("scan")})
+	require.NoError(t, err)
+	_, err = rc.Read(make([]byte, 10))
+	require.NoError(t, err)
+	// closing the stream stops the handler
+	require.NoError(t, rc.Close())
+	require.Equal(t, ErrCanceled, <-errs)
+	_, err = rc.Read(make([]byte, 10))
+	require.Error(t, err)
+	require.Len(t, client.streams, 0)
+}
+
+func TestTimeout(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	// the responses are lost
+	lower := faultyswarm.New(r.NewSwarm(), faultyswarm.WithDropRate(1))
+	client, _, addr := newTestPair(t, r.NewSwarm(), lower, func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write([]byte("hello"))
+	}, WithTimeout(10*time.Millisecond))
+	_, err := client.Ask(ctx, addr, p2p.IOVec{[]byte("scan")})
+	require.Equal(t, ErrTimeout, err)
+}
+
+func TestReorder(t *testing.T) {
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm())
+	defer a.swarm.Close()
+	// the stream acknowledges chunks as they are read
+	dst := r.NewSwarm()
+	defer dst.Close()
+	go dst.ServeTells(p2p.NoOpTellHandler)
+	s := a.addStream(context.Background(), dst.LocalAddrs()[0])
+	s.deliver(typeEnd, 3, nil)
+	s.deliver(typeChunk, 2, []byte("c"))
+	s.deliver(typeChunk, 0, []byte("a"))
+	s.deliver(typeChunk, 2, []byte("x"))
+	s.deliver(typeChunk, 1, []byte("b"))
+	// too far ahead to have been sent
+	s.deliver(typeChunk, DefaultWindow, []byte("y"))
+	data, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(data))
+}
+
+func TestParseMessage(t *testing.T) {
+	typ, nonce, seq, body, err := parseMessage(append(newHeader(typeChunk, 7, 3), "hi"...))
+	require.NoError(t, err)
+	require.Equal(t, typeChunk, typ)
+	require.Equal(t, uint64(7), nonce)
+	require.Equal(t, uint32(3), seq)
+	require.Equal(t, "hi", string(body))
+
+	_, _, _, _, err = parseMessage(newHeader(typeChunk, 7, 3)[:Overhead-1])
+	require.Error(t, err)
+	_, _, _, _, err = parseMessage(newHeader(typeBusy+1, 7, 0))
+	require.Error(t, err)
+}
+
+// newTestPair returns a client on clientLower, and a server on serverLower which responds with fn.
+func newTestPair(t testing.TB, clientLower, serverLower p2p.Swarm, fn p2p.AskHandler, opts ...Option) (client, server *Asker, serverAddr p2p.Addr) {
+	return askutil.NewTestPair(t, func(x p2p.Swarm) *Asker { return New(x, opts...) }, clientLower, serverLower, fn)
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/framing"
 	"github.com/brendoncarroll/go-p2p/s/swarmutil"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
@@ -205,8 +206,9 @@ type muxedSwarm struct {
 	c ChannelID
 	m *muxCore
 
-	tellHub *swarmutil.TellHub
-	askHub  *swarmutil.AskHub
+	tellHub   *swarmutil.TellHub
+	askHub    *swarmutil.AskHub
+	closeOnce swarmutil.CloseOnce
 }
 
 func newMuxedSwarm(m *muxCore, c ChannelID) *muxedSwarm {
@@ -246,17 +248,18 @@ func (ms *muxedSwarm) MTU(ctx context.Context, addr p2p.Addr) int {
 	return ms.m.swarm.MTU(ctx, addr) - binary.MaxVarintLen64
 }
 
+// Close closes the channel.
+// Calling it more than once does nothing, even if the channel has been opened again by another swarm.
 func (ms *muxedSwarm) Close() error {
-	ms.tellHub.CloseWithError(p2p.ErrSwarmClosed)
-	ms.askHub.CloseWithError(p2p.ErrSwarmClosed)
-	return ms.m.close(ms.c)
+	return ms.closeOnce.Do(func() error {
+		ms.tellHub.CloseWithError(p2p.ErrSwarmClosed)
+		ms.askHub.CloseWithError(p2p.ErrSwarmClosed)
+		return ms.m.close(ms.c)
+	})
 }
 
 func makeMessage(c ChannelID, data p2p.IOVec) p2p.IOVec {
-	header := make([]byte, binary.MaxVarintLen64+len(c))
-	n := binary.PutUvarint(header, uint64(len(c)))
-	header = header[:n]
-	header = append(header, []byte(c)...)
+	header := framing.AppendFrame(nil, []byte(c))
 
 	ret := p2p.IOVec{}
 	ret = append(ret, header)
@@ -265,18 +268,12 @@ func makeMessage(c ChannelID, data p2p.IOVec) p2p.IOVec {
 }
 
 func readMessage(data []byte) (string, []byte, error) {
-	chanLength, n := binary.Uvarint(data)
-	if n < 1 {
-		return "", nil, errors.Errorf("stringmux: could not read message")
-	}
-	data = data[n:]
-	if len(data) < int(chanLength) {
-		return "", nil, errors.Errorf("stringmux: length smaller than message")
+	chanBytes, msg, err := framing.ReadFrame(data)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "stringmux: could not read message")
 	}
-	chanBytes := data[:chanLength]
-	var msg []byte
-	if int(chanLength) < len(data) {
-		msg = data[chanLength:]
+	if len(msg) == 0 {
+		msg = nil
 	}
 	return string(chanBytes), msg, nil
 }
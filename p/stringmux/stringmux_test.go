@@ -40,3 +40,42 @@ func TestMux(t *testing.T) {
 	assert.Equal(t, "hello foo", recvFoo)
 	assert.Equal(t, "hello bar", recvBar)
 }
+
+func TestCloseAfterReopen(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	s1, s2 := r.NewSwarm(), r.NewSwarm()
+	m1, m2 := WrapSwarm(s1), WrapSwarm(s2)
+	x := m1.Open("test")
+	require.NoError(t, x.Close())
+	// once the channel is reopened, closing the old swarm again must not close the new one
+	x2 := m1.Open("test")
+	require.NoError(t, x.Close())
+	recv := make(chan string, 1)
+	go x2.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	y := m2.Open("test")
+	require.NoError(t, y.Tell(ctx, x2.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, "hello", <-recv)
+}
+
+func TestReadMessage(t *testing.T) {
+	c, msg, err := readMessage(p2p.VecBytes(makeMessage("test", p2p.IOVec{[]byte("hello")})))
+	require.NoError(t, err)
+	require.Equal(t, "test", c)
+	require.Equal(t, "hello", string(msg))
+
+	for _, x := range [][]byte{
+		nil,
+		// the channel is longer than the message
+		{5, 'a'},
+		// a length which does not fit in an int
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		// a uvarint which overflows 64 bits
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02},
+	} {
+		_, _, err := readMessage(x)
+		require.Error(t, err, "%x", x)
+	}
+}
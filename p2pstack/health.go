@@ -0,0 +1,61 @@
+package p2pstack
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/brendoncarroll/go-p2p"
+)
+
+// HealthStatus describes whether a Stack is operational.
+// Healthy is suitable for a liveness probe, and Ready for a readiness probe.
+type HealthStatus struct {
+	// Healthy is true if the stack is open, bound to at least one address, receiving from the lower swarm,
+	// and its cleanup loops are running.
+	Healthy bool `json:"healthy"`
+	// Ready is true if the stack is Healthy and has at least MinPeers peers.
+	Ready bool `json:"ready"`
+	// Problems describes each check which failed.
+	Problems []string `json:"problems,omitempty"`
+
+	Closed     bool       `json:"closed"`
+	LocalAddrs []p2p.Addr `json:"local_addrs"`
+	// Receiving is true if the encryption layer is receiving messages from the lower swarm.
+	Receiving bool `json:"receiving"`
+	// CleanupRunning is false if the cleanup loop of the fragmentation or encryption layer has stopped.
+	// Layers created with WithManualCleanup have no loop, and are not checked.
+	CleanupRunning bool `json:"cleanup_running"`
+	// Peers is the number of peers with a ready session.
+	Peers    int `json:"peers"`
+	MinPeers int `json:"min_peers"`
+}
+
+// Health checks whether the stack is operational.
+func (s *Stack) Health() HealthStatus {
+	hs := HealthStatus{
+		Closed:         atomic.LoadInt32(&s.closed) == 1,
+		LocalAddrs:     s.noise.LocalAddrs(),
+		Receiving:      s.noise.Receiving(),
+		CleanupRunning: !s.frag.CleanupStopped() && !s.noise.CleanupStopped(),
+		Peers:          len(s.noise.ReadyPeers()),
+		MinPeers:       s.minPeers,
+	}
+	if hs.Closed {
+		hs.Problems = append(hs.Problems, "stack is closed")
+	}
+	if len(hs.LocalAddrs) == 0 {
+		hs.Problems = append(hs.Problems, "lower swarm has no local addresses")
+	}
+	if !hs.Receiving {
+		hs.Problems = append(hs.Problems, "not receiving from the lower swarm")
+	}
+	if !hs.CleanupRunning {
+		hs.Problems = append(hs.Problems, "cleanup loop is not running")
+	}
+	hs.Healthy = len(hs.Problems) == 0
+	if hs.Peers < hs.MinPeers {
+		hs.Problems = append(hs.Problems, fmt.Sprintf("have %d peers, need %d", hs.Peers, hs.MinPeers))
+	}
+	hs.Ready = len(hs.Problems) == 0
+	return hs
+}
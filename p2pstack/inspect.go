@@ -0,0 +1,32 @@
+package p2pstack
+
+import (
+	"sync/atomic"
+
+	"github.com/brendoncarroll/go-p2p"
+)
+
+var _ p2p.Inspector = &Stack{}
+
+// Inspect implements p2p.Inspector, with the Health of the stack, and the sections of each of its layers,
+// prefixed with "mux.", "noise." or "frag.".
+// The muxer is only included once Mux has been called.
+// p2p.DebugHandler(s) serves the state of the whole stack.
+func (s *Stack) Inspect() map[string]interface{} {
+	sections := map[string]interface{}{
+		"health": s.Health(),
+	}
+	add := func(prefix string, x p2p.Inspector) {
+		for k, v := range x.Inspect() {
+			sections[prefix+"."+k] = v
+		}
+	}
+	if atomic.LoadInt32(&s.muxCreated) == 1 {
+		if x, ok := s.mux.(p2p.Inspector); ok {
+			add("mux", x)
+		}
+	}
+	add("noise", s.noise)
+	add("frag", s.frag)
+	return sections
+}
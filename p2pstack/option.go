@@ -0,0 +1,54 @@
+package p2pstack
+
+import (
+	"github.com/brendoncarroll/go-p2p/p/dynmux"
+	"github.com/brendoncarroll/go-p2p/s/fragswarm"
+	"github.com/brendoncarroll/go-p2p/s/noiseswarm"
+)
+
+type Option func(s *Stack)
+
+// WithMTU sets the MTU of messages provided by the fragmentation layer.
+// Messages larger than the lower swarm's MTU are split into at most 255 fragments,
+// so mtu should be no larger than 255 times the lower swarm's MTU, less fragswarm.Overhead per fragment.
+// The default is DefaultMTU.
+func WithMTU(mtu int) Option {
+	if mtu <= noiseswarm.Overhead {
+		panic(mtu)
+	}
+	return func(s *Stack) {
+		s.mtu = mtu
+	}
+}
+
+// WithFragOptions sets options to pass to the fragmentation layer.
+func WithFragOptions(opts ...fragswarm.Option) Option {
+	return func(s *Stack) {
+		s.fragOpts = append(s.fragOpts, opts...)
+	}
+}
+
+// WithNoiseOptions sets options to pass to the encryption layer.
+func WithNoiseOptions(opts ...noiseswarm.Option) Option {
+	return func(s *Stack) {
+		s.noiseOpts = append(s.noiseOpts, opts...)
+	}
+}
+
+// WithMinPeers sets the number of peers with ready sessions the stack must have for Health to report it as Ready.
+// The default is 0.
+func WithMinPeers(n int) Option {
+	if n < 0 {
+		panic(n)
+	}
+	return func(s *Stack) {
+		s.minPeers = n
+	}
+}
+
+// WithMuxOptions sets options to pass to the muxer returned by Stack.Mux.
+func WithMuxOptions(opts ...dynmux.Option) Option {
+	return func(s *Stack) {
+		s.muxOpts = append(s.muxOpts, opts...)
+	}
+}
@@ -0,0 +1,84 @@
+// Package p2pstack composes the standard layers on top of an insecure transport.
+//
+// A Stack is made of, from the bottom up:
+//   - a fragswarm, so messages may be larger than the transport's MTU
+//   - a noiseswarm, which encrypts and authenticates messages, and supports asks
+//   - optionally, a dynmux muxer, which provides named channels over the noiseswarm
+package p2pstack
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p/dynmux"
+	"github.com/brendoncarroll/go-p2p/s/fragswarm"
+	"github.com/brendoncarroll/go-p2p/s/noiseswarm"
+)
+
+// DefaultMTU is the default MTU of the fragmentation layer.
+// The encryption layer's MTU is smaller by noiseswarm.Overhead.
+const DefaultMTU = 1 << 16
+
+type Stack struct {
+	mtu       int
+	fragOpts  []fragswarm.Option
+	noiseOpts []noiseswarm.Option
+	muxOpts   []dynmux.Option
+	minPeers  int
+
+	frag  *fragswarm.Swarm
+	noise *noiseswarm.Swarm
+
+	muxOnce sync.Once
+	mux     dynmux.Muxer
+	// muxCreated is set to 1 once mux has been created
+	muxCreated int32
+	closed     int32
+}
+
+// New creates a Stack on top of lower, using privateKey for the encryption layer.
+func New(lower p2p.Swarm, privateKey p2p.PrivateKey, opts ...Option) *Stack {
+	s := &Stack{
+		mtu: DefaultMTU,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.frag = fragswarm.New(lower, s.mtu, s.fragOpts...)
+	s.noise = noiseswarm.New(s.frag, privateKey, s.noiseOpts...)
+	return s
+}
+
+// Swarm returns the top of the stack, which is secure and supports asks.
+// Swarm must not be served if Mux has been called, since the muxer serves it.
+func (s *Stack) Swarm() p2p.SecureAskSwarm {
+	return s.noise
+}
+
+// Mux returns a muxer over the stack's Swarm, creating it on the first call.
+// Each channel's MTU is a few bytes smaller than the Swarm's, to make room for the channel id.
+func (s *Stack) Mux() dynmux.Muxer {
+	s.muxOnce.Do(func() {
+		s.mux = dynmux.MultiplexSwarm(s.noise, s.muxOpts...)
+		atomic.StoreInt32(&s.muxCreated, 1)
+	})
+	return s.mux
+}
+
+// Frag returns the fragmentation layer, for access to its Stats.
+func (s *Stack) Frag() *fragswarm.Swarm {
+	return s.frag
+}
+
+// MTU returns the MTU of the stack's Swarm
+func (s *Stack) MTU(ctx context.Context, addr p2p.Addr) int {
+	return s.noise.MTU(ctx, addr)
+}
+
+// Close closes every layer of the stack, including the lower swarm.
+func (s *Stack) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return s.noise.Close()
+}
@@ -0,0 +1,185 @@
+package p2pstack
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p/dynmux"
+	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/brendoncarroll/go-p2p/s/fragswarm"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/noiseswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
+)
+
+const lowerMTU = 1000
+
+func TestMTU(t *testing.T) {
+	ctx := context.Background()
+	a, b := newPair(t, WithMTU(4096))
+	dst := b.Swarm().LocalAddrs()[0]
+	require.Equal(t, 4096-noiseswarm.Overhead, a.MTU(ctx, dst))
+
+	recv := make(chan []byte, 1)
+	go b.Swarm().ServeTells(func(msg *p2p.Message) {
+		recv <- append([]byte{}, msg.Payload...)
+	})
+	// establish the session first, so handshake messages are not counted
+	require.NoError(t, a.Swarm().Tell(ctx, dst, p2p.IOVec{}))
+	<-recv
+
+	for _, tc := range []struct {
+		size      int
+		fragments uint64
+	}{
+		// fits in a single fragment after encryption
+		{size: lowerMTU - fragswarm.Overhead - noiseswarm.Overhead, fragments: 1},
+		// over the lower MTU after encryption
+		{size: lowerMTU, fragments: 2},
+		// just under the composed MTU
+		{size: a.MTU(ctx, dst) - 1, fragments: 5},
+		{size: a.MTU(ctx, dst), fragments: 5},
+	} {
+		before := a.Frag().Stats().FragmentsSent
+		data := randomBytes(tc.size)
+		require.NoError(t, a.Swarm().Tell(ctx, dst, p2p.IOVec{data}))
+		require.Equal(t, data, <-recv)
+		require.Equal(t, tc.fragments, a.Frag().Stats().FragmentsSent-before, "size %d", tc.size)
+	}
+}
+
+func TestMux(t *testing.T) {
+	ctx := context.Background()
+	a, b := newPair(t)
+	aSwarm, err := a.Mux().OpenSecureAsk("test")
+	require.NoError(t, err)
+	bSwarm, err := b.Mux().OpenSecureAsk("test")
+	require.NoError(t, err)
+	dst := bSwarm.LocalAddrs()[0]
+	require.Less(t, aSwarm.MTU(ctx, dst), a.MTU(ctx, dst))
+
+	recv := make(chan []byte, 1)
+	go bSwarm.ServeTells(func(msg *p2p.Message) {
+		recv <- append([]byte{}, msg.Payload...)
+	})
+	data := randomBytes(aSwarm.MTU(ctx, dst))
+	require.NoError(t, aSwarm.Tell(ctx, dst, p2p.IOVec{data}))
+	require.Equal(t, data, <-recv)
+}
+
+func TestTellEmpty(t *testing.T) {
+	a, b := newPair(t)
+	swarmtest.TestTellEmpty(t, a.Swarm(), b.Swarm())
+
+	a, b = newPair(t)
+	aSwarm, err := a.Mux().Open("test")
+	require.NoError(t, err)
+	bSwarm, err := b.Mux().Open("test")
+	require.NoError(t, err)
+	swarmtest.TestTellEmpty(t, aSwarm, bSwarm)
+}
+
+func newPair(t testing.TB, opts ...Option) (*Stack, *Stack) {
+	r := memswarm.NewRealm(memswarm.WithMTU(lowerMTU))
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), opts...)
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), opts...)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+	return a, b
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return buf
+}
+
+func TestHealth(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithMinPeers(1))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer b.Close()
+	go b.Swarm().ServeTells(p2p.NoOpTellHandler)
+
+	hs := a.Health()
+	require.True(t, hs.Healthy, hs.Problems)
+	require.False(t, hs.Ready)
+	require.Equal(t, 0, hs.Peers)
+	require.Len(t, hs.Problems, 1)
+
+	require.NoError(t, a.Swarm().Tell(ctx, b.Swarm().LocalAddrs()[0], p2p.IOVec{}))
+	hs = a.Health()
+	require.True(t, hs.Ready, hs.Problems)
+	require.Equal(t, 1, hs.Peers)
+	require.Empty(t, hs.Problems)
+
+	require.NoError(t, a.Close())
+	hs = a.Health()
+	require.True(t, hs.Closed)
+	require.False(t, hs.Healthy)
+	require.False(t, hs.Ready)
+	// the loops stop shortly after the stack is closed.
+	require.Eventually(t, func() bool {
+		hs := a.Health()
+		return !hs.Receiving && !hs.CleanupRunning
+	}, time.Second, time.Millisecond)
+}
+
+func TestDebugHandler(t *testing.T) {
+	ctx := context.Background()
+	a, b := newPair(t)
+	aSwarm, err := a.Mux().Open("test")
+	require.NoError(t, err)
+	bSwarm, err := b.Mux().Open("test")
+	require.NoError(t, err)
+	recv := make(chan struct{}, 1)
+	go bSwarm.ServeTells(func(*p2p.Message) {
+		recv <- struct{}{}
+	})
+	require.NoError(t, aSwarm.Tell(ctx, bSwarm.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	<-recv
+
+	w := httptest.NewRecorder()
+	p2p.DebugHandler(a).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var report struct {
+		Layers []struct {
+			Layer    string
+			Sections map[string]json.RawMessage
+		}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	require.Len(t, report.Layers, 1)
+	require.Equal(t, "p2pstack.Stack", report.Layers[0].Layer)
+	sections := report.Layers[0].Sections
+	for _, name := range []string{
+		"health",
+		"noise.sessions",
+		"frag.counters",
+		"frag.pending_fragments",
+		"mux.channels",
+		"mux.remote_channels",
+		"mux.lookups",
+	} {
+		require.Contains(t, sections, name)
+	}
+
+	var sessions []noiseswarm.SessionInfo
+	require.NoError(t, json.Unmarshal(sections["noise.sessions"], &sessions))
+	require.Len(t, sessions, 1)
+	require.Equal(t, "ready", sessions[0].State)
+	require.Equal(t, b.Swarm().LocalAddrs()[0].(noiseswarm.Addr).ID.String(), sessions[0].PeerID)
+
+	var remote []dynmux.ChannelEntry
+	require.NoError(t, json.Unmarshal(sections["mux.remote_channels"], &remote))
+	require.Len(t, remote, 1)
+	require.Equal(t, "test", remote[0].Name)
+}
@@ -0,0 +1,69 @@
+package simnet
+
+import (
+	"time"
+
+	"github.com/brendoncarroll/go-p2p/p/kademlia"
+)
+
+type Option func(n *Network)
+
+// WithSeed sets the seed for the random decisions made when injecting faults.
+// Networks with the same seed and the same sequence of messages make the same decisions.
+func WithSeed(seed int64) Option {
+	return func(n *Network) {
+		n.seed = seed
+	}
+}
+
+// WithLoss sets the probability that a message is dropped.
+func WithLoss(p float64) Option {
+	if p < 0 || p > 1 {
+		panic(p)
+	}
+	return func(n *Network) {
+		n.loss = p
+	}
+}
+
+// WithLatency sets how long, in virtual time, each message takes to arrive.
+func WithLatency(d time.Duration) Option {
+	if d < 0 {
+		panic(d)
+	}
+	return func(n *Network) {
+		n.latency = d
+	}
+}
+
+// WithMTU sets the MTU of the links between nodes.
+// Larger messages are fragmented by each node's fragswarm.
+// The default is DefaultMTU.
+func WithMTU(mtu int) Option {
+	if mtu <= 0 {
+		panic(mtu)
+	}
+	return func(n *Network) {
+		n.mtu = mtu
+	}
+}
+
+// WithSpeed sets how many times faster virtual time passes than real time.
+// 0 stops virtual time, so it only moves when the Network is advanced.
+// The default is DefaultSpeed.
+func WithSpeed(x int) Option {
+	if x < 0 {
+		panic(x)
+	}
+	return func(n *Network) {
+		n.speed = x
+	}
+}
+
+// WithDHTParams sets the parameters used for each node's DHT.
+// The Swarm and Clock are set by the Network.
+func WithDHTParams(params kademlia.DHTParams) Option {
+	return func(n *Network) {
+		n.dhtParams = params
+	}
+}
@@ -0,0 +1,259 @@
+// Package simnet runs many nodes, each with a full noiseswarm, fragswarm and kademlia stack, in one process.
+// Nodes are connected by an in-memory network with controllable loss, latency and partitions,
+// and every layer uses the same virtual clock.
+package simnet
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p/kademlia"
+	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/brendoncarroll/go-p2p/s/faultyswarm"
+	"github.com/brendoncarroll/go-p2p/s/fragswarm"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/noiseswarm"
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	// DefaultMTU is the default MTU of the links between nodes.
+	DefaultMTU = 1500
+	// DefaultSpeed is the default number of times faster virtual time passes than real time.
+	DefaultSpeed = 100
+	// FragMTU is the MTU each node's fragswarm provides to its noiseswarm.
+	FragMTU = 1 << 16
+)
+
+// Network is a simulated network of nodes.
+// Nodes are added with AddNode, and are closed when the test finishes.
+type Network struct {
+	t         testing.TB
+	seed      int64
+	loss      float64
+	latency   time.Duration
+	mtu       int
+	speed     int
+	dhtParams kademlia.DHTParams
+
+	clock clockwork.FakeClock
+	realm *memswarm.Realm
+	stop  chan struct{}
+
+	mu      sync.Mutex
+	nodes   []*Node
+	blocked [][2]*Node
+}
+
+// New creates a Network with no nodes.
+// Virtual time starts passing immediately, see WithSpeed.
+func New(t testing.TB, opts ...Option) *Network {
+	n := &Network{
+		t:     t,
+		mtu:   DefaultMTU,
+		speed: DefaultSpeed,
+		clock: clockwork.NewFakeClock(),
+		stop:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	n.realm = memswarm.NewRealm(
+		memswarm.WithClock(n.clock),
+		memswarm.WithLatency(n.latency),
+		memswarm.WithMTU(n.mtu),
+	)
+	if n.speed > 0 {
+		go n.runClock()
+	}
+	t.Cleanup(n.close)
+	return n
+}
+
+// Node is a member of a Network.
+type Node struct {
+	// Index is the order the node was added to the Network, starting at 0.
+	Index int
+	Swarm *noiseswarm.Swarm
+	DHT   *kademlia.DHT
+
+	mem *memswarm.Swarm
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// AddNode adds a node to the network.
+// Its key is p2ptest.NewTestKey with its Index, so nodes are the same across runs.
+func (n *Network) AddNode() *Node {
+	// the index is taken and the node appended under the same lock, so concurrent calls get different indexes.
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	i := len(n.nodes)
+
+	privateKey := p2ptest.NewTestKey(n.t, i)
+	mem := n.realm.NewSwarm()
+	faulty := faultyswarm.New(mem,
+		faultyswarm.WithSeed(n.seed+int64(i)),
+		faultyswarm.WithDropRate(n.loss),
+	)
+	frag := fragswarm.New(faulty, FragMTU, fragswarm.WithClock(n.clock))
+	noise := noiseswarm.New(frag, privateKey, noiseswarm.WithClock(n.clock))
+	params := n.dhtParams
+	params.Swarm = noise
+	params.Clock = n.clock
+	node := &Node{
+		Index: i,
+		Swarm: noise,
+		DHT:   kademlia.NewDHT(params),
+		mem:   mem,
+	}
+	n.nodes = append(n.nodes, node)
+	return node
+}
+
+// AddNodes adds count nodes to the network, and returns them.
+func (n *Network) AddNodes(count int) []*Node {
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		nodes[i] = n.AddNode()
+	}
+	return nodes
+}
+
+// Nodes returns all the nodes which have been added, including those which have been closed.
+func (n *Network) Nodes() []*Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*Node{}, n.nodes...)
+}
+
+// Bootstrap introduces every open node to the first open node,
+// and then bootstraps each of them, see Node.Bootstrap.
+func (n *Network) Bootstrap(ctx context.Context) error {
+	var open []*Node
+	for _, node := range n.Nodes() {
+		if !node.isClosed() {
+			open = append(open, node)
+		}
+	}
+	if len(open) == 0 {
+		return nil
+	}
+	for _, node := range open[1:] {
+		node.DHT.AddPeer(open[0].ID(), open[0].Addr())
+	}
+	for _, node := range open {
+		if err := node.Bootstrap(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Partition blocks all the links between nodes in different groups.
+// Links to nodes which are not in any of the groups are unaffected.
+func (n *Network) Partition(groups ...[]*Node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := range groups {
+		for j := i + 1; j < len(groups); j++ {
+			for _, a := range groups[i] {
+				for _, b := range groups[j] {
+					n.realm.Block(a.mem.LocalAddrs()[0], b.mem.LocalAddrs()[0])
+					n.blocked = append(n.blocked, [2]*Node{a, b})
+				}
+			}
+		}
+	}
+}
+
+// Heal undoes all calls to Partition
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, pair := range n.blocked {
+		n.realm.Unblock(pair[0].mem.LocalAddrs()[0], pair[1].mem.LocalAddrs()[0])
+	}
+	n.blocked = nil
+}
+
+// Clock returns the network's virtual clock.
+func (n *Network) Clock() clockwork.Clock {
+	return n.clock
+}
+
+// Advance moves virtual time forward by d, immediately firing any timers which expire in that time.
+func (n *Network) Advance(d time.Duration) {
+	n.clock.Advance(d)
+}
+
+func (n *Network) runClock() {
+	const tick = time.Millisecond
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			n.clock.Advance(time.Duration(n.speed) * tick)
+		}
+	}
+}
+
+func (n *Network) close() {
+	close(n.stop)
+	for _, node := range n.Nodes() {
+		if err := node.Close(); err != nil {
+			n.t.Error(err)
+		}
+	}
+}
+
+// ID returns the node's PeerID
+func (node *Node) ID() p2p.PeerID {
+	return p2p.NewPeerID(node.Swarm.PublicKey())
+}
+
+// Addr returns the node's address on the network
+func (node *Node) Addr() p2p.Addr {
+	return node.Swarm.LocalAddrs()[0]
+}
+
+// Bootstrap adds peers to the node's DHT, and then looks up the node's own id,
+// which fills its routing cache with its neighbours.
+func (node *Node) Bootstrap(ctx context.Context, peers ...*Node) error {
+	for _, peer := range peers {
+		node.DHT.AddPeer(peer.ID(), peer.Addr())
+	}
+	id := node.ID()
+	if _, err := node.DHT.Get(ctx, id[:]); err != nil && err != kademlia.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// Close stops the node's DHT and closes its swarms.
+// Closed nodes stop responding, to simulate churn, and cannot be reopened.
+func (node *Node) Close() error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.closed {
+		return nil
+	}
+	node.closed = true
+	if err := node.DHT.Close(); err != nil {
+		return err
+	}
+	return node.Swarm.Close()
+}
+
+func (node *Node) isClosed() bool {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.closed
+}
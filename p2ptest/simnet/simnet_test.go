@@ -0,0 +1,88 @@
+package simnet
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDHT(t *testing.T) {
+	ctx := context.Background()
+	net := New(t, WithLatency(5*time.Millisecond), WithMTU(512))
+	nodes := net.AddNodes(20)
+	require.NoError(t, net.Bootstrap(ctx))
+
+	keys := make([]p2p.PeerID, 5)
+	for i := range keys {
+		keys[i] = p2p.NewPeerID(p2ptest.NewTestKey(t, 1000+i).Public())
+		require.NoError(t, nodes[i].DHT.Put(ctx, keys[i][:], []byte("value")))
+	}
+	for _, node := range nodes {
+		for _, key := range keys {
+			v, err := node.DHT.Get(ctx, key[:])
+			require.NoError(t, err)
+			require.Equal(t, "value", string(v))
+		}
+	}
+}
+
+func TestConcurrentAddNode(t *testing.T) {
+	net := New(t)
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			net.AddNode()
+		}()
+	}
+	wg.Wait()
+	nodes := net.Nodes()
+	require.Len(t, nodes, n)
+	for i, node := range nodes {
+		require.Equal(t, i, node.Index)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	ctx := context.Background()
+	net := New(t)
+	nodes := net.AddNodes(10)
+	require.NoError(t, net.Bootstrap(ctx))
+
+	net.Partition(nodes[:5], nodes[5:])
+	key := p2p.NewPeerID(p2ptest.NewTestKey(t, 1000).Public())
+	require.NoError(t, nodes[0].DHT.Put(ctx, key[:], []byte("value")))
+	_, err := nodes[9].DHT.Get(ctx, key[:])
+	require.Error(t, err)
+
+	net.Heal()
+	v, err := nodes[9].DHT.Get(ctx, key[:])
+	require.NoError(t, err)
+	require.Equal(t, "value", string(v))
+}
+
+func TestChurn(t *testing.T) {
+	ctx := context.Background()
+	net := New(t, WithLoss(0.01), WithSeed(1))
+	nodes := net.AddNodes(10)
+	require.NoError(t, net.Bootstrap(ctx))
+
+	key := p2p.NewPeerID(p2ptest.NewTestKey(t, 1000).Public())
+	require.NoError(t, nodes[0].DHT.Put(ctx, key[:], []byte("value")))
+	for _, node := range nodes[:3] {
+		require.NoError(t, node.Close())
+	}
+	// a node joins after some of the network has left
+	late := net.AddNode()
+	require.NoError(t, late.Bootstrap(ctx, nodes[9]))
+	v, err := late.DHT.Get(ctx, key[:])
+	require.NoError(t, err)
+	require.Equal(t, "value", string(v))
+}
@@ -5,19 +5,18 @@ import (
 	"encoding/base64"
 
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/sha3"
 )
 
-type PeerID [32]byte
+type PeerID [HashIDLen]byte
 
 func ZeroPeerID() PeerID {
 	return PeerID{}
 }
 
+// NewPeerID returns the HashID of the marshaled public key.
 func NewPeerID(pubKey PublicKey) PeerID {
-	data := MarshalPublicKey(pubKey)
 	id := PeerID{}
-	sha3.ShakeSum256(id[:], data)
+	copy(id[:], HashID(MarshalPublicKey(pubKey)))
 	return id
 }
 
@@ -30,6 +29,16 @@ func (pid PeerID) String() string {
 	return string(data)
 }
 
+// ShortLen is the length of the string returned by PeerID.Short
+const ShortLen = 8
+
+// Short returns a prefix of the PeerID's text encoding, for telling peers apart in logs.
+// It contains 48 bits of the PeerID, so collisions are unlikely until there are millions of peers.
+// It should not be used to identify peers, use the full PeerID for that.
+func (pid PeerID) Short() string {
+	return pid.String()[:ShortLen]
+}
+
 func (pid PeerID) Key() string {
 	return string(pid[:])
 }
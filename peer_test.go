@@ -0,0 +1,72 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerIDShort(t *testing.T) {
+	newID := func(i int) PeerID {
+		seed := make([]byte, ed25519.SeedSize)
+		binary.BigEndian.PutUint64(seed[len(seed)-8:], uint64(i))
+		return NewPeerID(ed25519.NewKeyFromSeed(seed).Public())
+	}
+	// deterministic
+	id := newID(0)
+	require.Len(t, id.Short(), ShortLen)
+	require.Equal(t, id.Short(), newID(0).Short())
+	require.Equal(t, id.String()[:ShortLen], id.Short())
+
+	// unique for a small fleet
+	seen := map[string]struct{}{}
+	for i := 0; i < 10000; i++ {
+		seen[newID(i).Short()] = struct{}{}
+	}
+	require.Len(t, seen, 10000)
+}
+
+func TestPeerIDScheme(t *testing.T) {
+	pub := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public()
+	// the default is unchanged
+	id := DefaultPeerIDScheme.Derive(pub)
+	require.Equal(t, NewPeerID(pub), id)
+	text, err := id.MarshalText()
+	require.NoError(t, err)
+	require.Equal(t, text, DefaultPeerIDScheme.Format(id))
+
+	short := NewShakePeerIDScheme(16)
+	sid := short.Derive(pub)
+	require.Equal(t, 16, short.Len())
+	require.Equal(t, make([]byte, 16), sid[16:])
+	require.NotEqual(t, id, sid)
+	for _, s := range []PeerIDScheme{DefaultPeerIDScheme, short} {
+		id := s.Derive(pub)
+		parsed, err := s.Parse(s.Format(id))
+		require.NoError(t, err)
+		require.Equal(t, id, parsed)
+	}
+	_, err = short.Parse(text)
+	require.Error(t, err)
+	_, err = DefaultPeerIDScheme.Parse(short.Format(sid))
+	require.Error(t, err)
+
+	require.Panics(t, func() { NewShakePeerIDScheme(0) })
+	require.Panics(t, func() { NewShakePeerIDScheme(33) })
+}
+
+func TestHashID(t *testing.T) {
+	pub := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public()
+	h := HashID(MarshalPublicKey(pub))
+	require.Len(t, h, HashIDLen)
+	require.Equal(t, h, HashID(MarshalPublicKey(pub)))
+	require.NotEqual(t, h, HashID([]byte("something else")))
+
+	// PeerIDs are HashIDs, and shorter ids are prefixes of them
+	id := NewPeerID(pub)
+	require.Equal(t, h, id[:])
+	sid := NewShakePeerIDScheme(16).Derive(pub)
+	require.Equal(t, h[:16], sid[:16])
+}
@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// PeerIDScheme derives PeerIDs from public keys, and encodes them as text.
+// Schemes with ids shorter than a PeerID leave the remaining bytes zero, so ids from different schemes should not be mixed.
+// Every peer in a network must use the same scheme.
+type PeerIDScheme interface {
+	// Len returns the number of bytes in the ids, which is at most the size of a PeerID.
+	Len() int
+	// Derive returns the PeerID for pubKey.
+	Derive(pubKey PublicKey) PeerID
+	// Format returns the text encoding of the first Len bytes of id.
+	Format(id PeerID) []byte
+	// Parse is the inverse of Format.
+	Parse(data []byte) (PeerID, error)
+}
+
+// DefaultPeerIDScheme derives the same 32 byte ids as NewPeerID, with the same text encoding.
+var DefaultPeerIDScheme PeerIDScheme = NewShakePeerIDScheme(len(PeerID{}))
+
+// NewShakePeerIDScheme returns a scheme with ids of the first n bytes of the HashID of the marshaled public key,
+// encoded as unpadded URL safe base64.
+// With n set to the size of a PeerID it is the same as DefaultPeerIDScheme.
+// It panics if n is not between 1 and the size of a PeerID.
+func NewShakePeerIDScheme(n int) PeerIDScheme {
+	if n < 1 || n > len(PeerID{}) {
+		panic(fmt.Sprintf("id length must be between 1 and %d, got %d", len(PeerID{}), n))
+	}
+	return shakeScheme{n: n}
+}
+
+type shakeScheme struct {
+	n int
+}
+
+func (s shakeScheme) Len() int {
+	return s.n
+}
+
+func (s shakeScheme) Derive(pubKey PublicKey) PeerID {
+	id := PeerID{}
+	copy(id[:s.n], HashID(MarshalPublicKey(pubKey)))
+	return id
+}
+
+func (s shakeScheme) Format(id PeerID) []byte {
+	enc := base64.RawURLEncoding
+	data := make([]byte, enc.EncodedLen(s.n))
+	enc.Encode(data, id[:s.n])
+	return data
+}
+
+func (s shakeScheme) Parse(data []byte) (PeerID, error) {
+	enc := base64.RawURLEncoding
+	id := PeerID{}
+	if len(data) != enc.EncodedLen(s.n) {
+		return id, errors.Errorf("peer id must be %d characters, got %d", enc.EncodedLen(s.n), len(data))
+	}
+	if _, err := enc.Decode(id[:s.n], data); err != nil {
+		return PeerID{}, err
+	}
+	return id, nil
+}
@@ -0,0 +1,53 @@
+package p2p
+
+import "context"
+
+// PeerResolver finds the addresses a peer may be reachable at, best first.
+// If the peer is not known Resolve returns no addresses, and either no error or ErrNoAddrs.
+// It is not to be confused with Resolver, which looks up host names.
+type PeerResolver interface {
+	Resolve(ctx context.Context, id PeerID) ([]Addr, error)
+}
+
+// StaticPeerResolver resolves peers from a fixed set of addresses.
+type StaticPeerResolver map[PeerID][]Addr
+
+func (r StaticPeerResolver) Resolve(ctx context.Context, id PeerID) ([]Addr, error) {
+	return append([]Addr{}, r[id]...), nil
+}
+
+// Resolve returns the addresses for id, best first, so an AddrBook can be used as a PeerResolver.
+func (ab *AddrBook) Resolve(ctx context.Context, id PeerID) ([]Addr, error) {
+	infos := ab.Addrs(id)
+	addrs := make([]Addr, len(infos))
+	for i := range infos {
+		addrs[i] = infos[i].Addr
+	}
+	return addrs, nil
+}
+
+// ChainPeerResolvers returns a PeerResolver which tries each of rs in order, and returns the addresses from the first to have any.
+// An error from one resolver does not stop the others from being tried,
+// it is only returned if none of the resolvers have addresses for the peer.
+func ChainPeerResolvers(rs ...PeerResolver) PeerResolver {
+	return chainPeerResolver(rs)
+}
+
+type chainPeerResolver []PeerResolver
+
+func (rs chainPeerResolver) Resolve(ctx context.Context, id PeerID) ([]Addr, error) {
+	var firstErr error
+	for _, r := range rs {
+		addrs, err := r.Resolve(ctx, id)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, firstErr
+}
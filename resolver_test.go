@@ -0,0 +1,54 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainPeerResolvers(t *testing.T) {
+	ctx := context.Background()
+	id1, id2, id3 := PeerID{1}, PeerID{2}, PeerID{3}
+	ab := NewAddrBook(parseTestAddr)
+	ab.Add(id1, testAddr("book"))
+	ab.MarkSuccess(id2, testAddr("book-best"), time.Now())
+	ab.Add(id2, testAddr("book-other"))
+	static := StaticPeerResolver{
+		id1: {testAddr("static")},
+		id3: {testAddr("static")},
+	}
+	errBroken := errors.New("broken")
+	broken := resolverFunc(func(context.Context, PeerID) ([]Addr, error) {
+		return nil, errBroken
+	})
+	r := ChainPeerResolvers(broken, ab, static)
+
+	// the first resolver with addresses wins, and errors are skipped
+	addrs, err := r.Resolve(ctx, id1)
+	require.NoError(t, err)
+	require.Equal(t, []Addr{testAddr("book")}, addrs)
+	addrs, err = r.Resolve(ctx, id2)
+	require.NoError(t, err)
+	require.Equal(t, []Addr{testAddr("book-best"), testAddr("book-other")}, addrs)
+	// falls back to later resolvers
+	addrs, err = r.Resolve(ctx, id3)
+	require.NoError(t, err)
+	require.Equal(t, []Addr{testAddr("static")}, addrs)
+
+	// errors are only returned if no resolver has addresses
+	addrs, err = r.Resolve(ctx, PeerID{4})
+	require.Equal(t, errBroken, err)
+	require.Len(t, addrs, 0)
+	addrs, err = ChainPeerResolvers(ab, static).Resolve(ctx, PeerID{4})
+	require.NoError(t, err)
+	require.Len(t, addrs, 0)
+}
+
+type resolverFunc func(ctx context.Context, id PeerID) ([]Addr, error)
+
+func (f resolverFunc) Resolve(ctx context.Context, id PeerID) ([]Addr, error) {
+	return f(ctx, id)
+}
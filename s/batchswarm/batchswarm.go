@@ -0,0 +1,295 @@
+package batchswarm
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/framing"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+// Overhead is the most bytes added to a message, to frame it within a batch.
+const Overhead = binary.MaxVarintLen32
+
+// DefaultWindow is the default amount of time a batch waits for more messages.
+const DefaultWindow = time.Millisecond
+
+var _ p2p.Swarm = &Swarm{}
+
+var _ p2p.SecureSwarm = &SecureSwarm{}
+
+var _ p2p.Flusher = &Swarm{}
+
+func New(x p2p.Swarm, opts ...Option) *Swarm {
+	return newSwarm(x, opts...)
+}
+
+func NewSecure(x p2p.SecureSwarm, opts ...Option) *SecureSwarm {
+	return &SecureSwarm{
+		Swarm:  newSwarm(x, opts...),
+		Secure: x,
+	}
+}
+
+// SecureSwarm is a Swarm which gets its identity from the lower swarm
+type SecureSwarm struct {
+	*Swarm
+	p2p.Secure
+}
+
+// Swarm coalesces small messages to the same destination into a single message on the lower swarm.
+// A batch is sent when its window ends, or when it reaches the max batch size, whichever happens first.
+// Each message is prefixed with its length, so the receiving Swarm can split the batch back into messages.
+type Swarm struct {
+	p2p.Swarm
+	window       time.Duration
+	maxBatchSize int
+	clock        clockwork.Clock
+
+	mu      sync.Mutex
+	closed  bool
+	pending map[string]*batch
+
+	closeOnce swarmutil.CloseOnce
+}
+
+func newSwarm(x p2p.Swarm, opts ...Option) *Swarm {
+	s := &Swarm{
+		Swarm:  x,
+		window: DefaultWindow,
+		clock:  clockwork.NewRealClock(),
+
+		pending: make(map[string]*batch),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+type batch struct {
+	addr p2p.Addr
+	buf  []byte
+	msgs []batchMsg
+	// sending is guarded by the swarm's mu, and is set once the batch has been taken to be sent.
+	sending bool
+	done    chan struct{}
+	err     error
+}
+
+// batchMsg is the position of a message in a batch's buf, and its deadline, see p2p.WithDeadline.
+type batchMsg struct {
+	start, end int
+	deadline   time.Time
+	// expired is set when the message is dropped from the batch because its deadline passed.
+	expired bool
+}
+
+// Tell adds data to the pending batch for addr, and waits until the batch has been sent.
+// It returns the error from sending the batch, which is shared by all the messages in it.
+// If ctx is cancelled while waiting, the batch is sent immediately.
+// If ctx has a message deadline, see p2p.WithDeadline, which has passed when the batch is sent,
+// the message is left out of the batch and p2p.ErrExpired is returned.
+// Messages which would not fit in a batch are sent on their own, without waiting.
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	if p2p.Expired(ctx, s.clock.Now()) {
+		return p2p.ErrExpired
+	}
+	size := p2p.VecSize(data)
+	framedSize := framing.FrameSize(size)
+	limit := s.batchLimit(ctx, addr)
+	if framedSize > limit {
+		return s.tellSingle(ctx, addr, data)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return p2p.ErrSwarmClosed
+	}
+	var full *batch
+	b := s.pending[addr.Key()]
+	if b != nil && len(b.buf)+framedSize > limit {
+		full = b
+		b = nil
+	}
+	if b == nil {
+		b = &batch{
+			addr: addr,
+			done: make(chan struct{}),
+		}
+		s.pending[addr.Key()] = b
+		go s.waitWindow(b)
+	}
+	msg := batchMsg{start: len(b.buf)}
+	msg.deadline, _ = p2p.DeadlineFromContext(ctx)
+	b.buf = framing.AppendUvarint(b.buf, uint64(size))
+	for _, x := range data {
+		b.buf = append(b.buf, x...)
+	}
+	msg.end = len(b.buf)
+	i := len(b.msgs)
+	b.msgs = append(b.msgs, msg)
+	if len(b.buf) == limit {
+		full = b
+	}
+	s.mu.Unlock()
+
+	if full != nil {
+		s.send(full)
+	}
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		s.send(b)
+	}
+	if b.msgs[i].expired {
+		return p2p.ErrExpired
+	}
+	return b.err
+}
+
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	return s.Swarm.ServeTells(func(x *p2p.Message) {
+		s.handleTell(x, fn)
+	})
+}
+
+// handleTell splits a batch into messages and delivers each of them to next.
+func (s *Swarm) handleTell(x *p2p.Message, next p2p.TellHandler) {
+	data := x.Payload
+	for len(data) > 0 {
+		payload, rest, err := framing.ReadFrame(data)
+		if err != nil {
+			log.WithFields(logrus.Fields{"src": x.Src}).Warn("batchswarm: dropping malformed batch")
+			return
+		}
+		next(&p2p.Message{
+			Src:     x.Src,
+			Dst:     x.Dst,
+			Payload: payload,
+		})
+		data = rest
+	}
+}
+
+func (s *Swarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	return s.Swarm.MTU(ctx, addr) - Overhead
+}
+
+// Flush sends all the pending batches without waiting for their windows to end, and then flushes the lower swarm.
+// It returns the first error from sending a batch, which is also returned to the Tells in that batch.
+func (s *Swarm) Flush(ctx context.Context) error {
+	var retErr error
+	for _, b := range s.pendingBatches() {
+		s.send(b)
+		if b.err != nil && retErr == nil {
+			retErr = b.err
+		}
+	}
+	if retErr != nil {
+		return retErr
+	}
+	return p2p.Flush(ctx, s.Swarm)
+}
+
+// Close sends any pending batches and then closes the lower swarm.
+func (s *Swarm) Close() error {
+	return s.closeOnce.Do(func() error {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		for _, b := range s.pendingBatches() {
+			s.send(b)
+		}
+		return s.Swarm.Close()
+	})
+}
+
+func (s *Swarm) pendingBatches() []*batch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []*batch
+	for _, b := range s.pending {
+		pending = append(pending, b)
+	}
+	return pending
+}
+
+// send sends b on the lower swarm, if it has not already been sent, and waits until it has been.
+func (s *Swarm) send(b *batch) {
+	s.mu.Lock()
+	if b.sending {
+		s.mu.Unlock()
+		<-b.done
+		return
+	}
+	b.sending = true
+	if s.pending[b.addr.Key()] == b {
+		delete(s.pending, b.addr.Key())
+	}
+	s.mu.Unlock()
+
+	// the batch is shared by Tells with different contexts, so none of them are used.
+	if buf := b.dropExpired(s.clock.Now()); len(buf) > 0 {
+		b.err = s.Swarm.Tell(context.Background(), b.addr, p2p.IOVec{buf})
+	}
+	close(b.done)
+}
+
+// dropExpired marks the messages whose deadline is not after now as expired,
+// and returns the batch without them.
+func (b *batch) dropExpired(now time.Time) []byte {
+	var buf []byte
+	var dropped bool
+	for i := range b.msgs {
+		m := &b.msgs[i]
+		if !m.deadline.IsZero() && !now.Before(m.deadline) {
+			m.expired = true
+			if !dropped {
+				buf = append([]byte{}, b.buf[:m.start]...)
+				dropped = true
+			}
+			continue
+		}
+		if dropped {
+			buf = append(buf, b.buf[m.start:m.end]...)
+		}
+	}
+	if !dropped {
+		return b.buf
+	}
+	return buf
+}
+
+func (s *Swarm) waitWindow(b *batch) {
+	select {
+	case <-s.clock.After(s.window):
+		s.send(b)
+	case <-b.done:
+	}
+}
+
+func (s *Swarm) tellSingle(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	header := framing.AppendUvarint(nil, uint64(p2p.VecSize(data)))
+	msg := make(p2p.IOVec, 0, 1+len(data))
+	msg = append(msg, header)
+	msg = append(msg, data...)
+	return s.Swarm.Tell(ctx, addr, msg)
+}
+
+// batchLimit is the largest a batch to addr can be
+func (s *Swarm) batchLimit(ctx context.Context, addr p2p.Addr) int {
+	limit := s.Swarm.MTU(ctx, addr)
+	if s.maxBatchSize > 0 && s.maxBatchSize < limit {
+		limit = s.maxBatchSize
+	}
+	return limit
+}
@@ -0,0 +1,300 @@
+package batchswarm
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/framing"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/brendoncarroll/go-p2p/s/udpswarm"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestSplit(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	r := memswarm.NewRealm()
+	lower := &countSwarm{Swarm: r.NewSwarm()}
+	a := New(lower, WithWindow(time.Hour), WithClock(clock))
+	b := New(r.NewSwarm())
+	defer a.Close()
+	defer b.Close()
+	const n = 20
+	recv := make(chan string, n)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+
+	eg := errgroup.Group{}
+	expected := map[string]bool{}
+	for i := 0; i < n; i++ {
+		data := "message " + strconv.Itoa(i)
+		expected[data] = true
+		eg.Go(func() error {
+			return a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte(data)})
+		})
+	}
+	// wait for all the messages to be added to the batch.
+	// messages 0-9 are 10 bytes with their length prefix, and 10-19 are 11 bytes.
+	require.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		batch := a.pending[b.LocalAddrs()[0].Key()]
+		return batch != nil && len(batch.buf) == 10*10+10*11
+	}, time.Second, time.Millisecond)
+	clock.Advance(time.Hour)
+	require.NoError(t, eg.Wait())
+
+	actual := map[string]bool{}
+	for i := 0; i < n; i++ {
+		actual[<-recv] = true
+	}
+	require.Equal(t, expected, actual)
+	require.Equal(t, int32(1), atomic.LoadInt32(&lower.n))
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lower := &countSwarm{Swarm: r.NewSwarm()}
+	// the window never ends, so batches are only sent when they are full
+	a := New(lower, WithWindow(time.Hour), WithClock(clockwork.NewFakeClock()), WithMaxBatchSize(30))
+	b := New(r.NewSwarm())
+	defer b.Close()
+	recv := make(chan string, 6)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+
+	eg := errgroup.Group{}
+	for i := 0; i < 6; i++ {
+		// each message is 10 bytes with its length prefix.
+		data := "message " + strconv.Itoa(i)
+		eg.Go(func() error {
+			return a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte(data)})
+		})
+	}
+	require.NoError(t, eg.Wait())
+	require.Equal(t, int32(2), atomic.LoadInt32(&lower.n))
+	require.Len(t, recv, 6)
+}
+
+func TestLargeMessage(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), WithWindow(time.Hour), WithClock(clockwork.NewFakeClock()), WithMaxBatchSize(30))
+	b := New(r.NewSwarm())
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan []byte, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- append([]byte{}, msg.Payload...)
+	})
+	data := make([]byte, 100)
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{data}))
+	require.Equal(t, data, <-recv)
+}
+
+func TestCancelFlushes(t *testing.T) {
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), WithWindow(time.Hour), WithClock(clockwork.NewFakeClock()))
+	b := New(r.NewSwarm())
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan string, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cf()
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, "hello", <-recv)
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lower := &flushSwarm{Swarm: r.NewSwarm()}
+	// the window never ends, so batches are only sent by Flush
+	a := New(lower, WithWindow(time.Hour), WithClock(clockwork.NewFakeClock()))
+	b := New(r.NewSwarm())
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan string, 2)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	dst := b.LocalAddrs()[0]
+
+	eg := errgroup.Group{}
+	for _, data := range []string{"hello", "world"} {
+		data := data
+		eg.Go(func() error {
+			return a.Tell(ctx, dst, p2p.IOVec{[]byte(data)})
+		})
+	}
+	require.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		batch := a.pending[dst.Key()]
+		return batch != nil && len(batch.buf) == 2*6
+	}, time.Second, time.Millisecond)
+	require.Len(t, recv, 0)
+
+	require.NoError(t, p2p.Flush(ctx, a))
+	require.NoError(t, eg.Wait())
+	require.ElementsMatch(t, []string{"hello", "world"}, []string{<-recv, <-recv})
+	// the lower swarm is flushed after the batches are sent
+	require.Equal(t, int32(1), atomic.LoadInt32(&lower.flushes))
+	require.NoError(t, a.Flush(ctx))
+	require.Equal(t, int32(2), atomic.LoadInt32(&lower.flushes))
+}
+
+func TestDeadline(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	r := memswarm.NewRealm()
+	lower := &countSwarm{Swarm: r.NewSwarm()}
+	a := New(lower, WithWindow(time.Hour), WithClock(clock))
+	b := New(r.NewSwarm())
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan string, 2)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	dst := b.LocalAddrs()[0]
+
+	// a message whose deadline has already passed is not sent
+	expiredCtx := p2p.WithDeadline(ctx, clock.Now())
+	require.Equal(t, p2p.ErrExpired, a.Tell(expiredCtx, dst, p2p.IOVec{[]byte("expired")}))
+
+	// a message whose deadline passes while it waits in a batch is dropped from the batch
+	staleCtx := p2p.WithDeadline(ctx, clock.Now().Add(time.Minute))
+	errs := make(chan error, 3)
+	for _, x := range []struct {
+		ctx  context.Context
+		data string
+	}{{ctx, "first"}, {staleCtx, "stale"}, {ctx, "last"}} {
+		x := x
+		go func() {
+			errs <- a.Tell(x.ctx, dst, p2p.IOVec{[]byte(x.data)})
+		}()
+		require.Eventually(t, func() bool {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			batch := a.pending[dst.Key()]
+			return batch != nil && batch.msgs[len(batch.msgs)-1].end == len(batch.buf) &&
+				string(batch.buf[len(batch.buf)-len(x.data):]) == x.data
+		}, time.Second, time.Millisecond)
+	}
+	clock.Advance(time.Hour)
+	var expired int
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			require.Equal(t, p2p.ErrExpired, err)
+			expired++
+		}
+	}
+	require.Equal(t, 1, expired)
+	require.Equal(t, []string{"first", "last"}, []string{<-recv, <-recv})
+	require.Equal(t, int32(1), atomic.LoadInt32(&lower.n))
+}
+
+func TestMalformed(t *testing.T) {
+	s := New(memswarm.NewRealm().NewSwarm())
+	defer s.Close()
+	var recv []string
+	batch := framing.AppendUvarint(nil, 5)
+	batch = append(batch, "hello"...)
+	// claims to be longer than the rest of the batch
+	batch = framing.AppendUvarint(batch, 100)
+	batch = append(batch, "world"...)
+	s.handleTell(&p2p.Message{Payload: batch}, func(msg *p2p.Message) {
+		recv = append(recv, string(msg.Payload))
+	})
+	require.Equal(t, []string{"hello"}, recv)
+}
+
+func BenchmarkTinyTells(b *testing.B) {
+	newSwarm := func(b *testing.B) p2p.Swarm {
+		s, err := udpswarm.New("127.0.0.1:")
+		require.NoError(b, err)
+		b.Cleanup(func() { s.Close() })
+		return s
+	}
+	for _, batched := range []bool{false, true} {
+		name := "udpswarm"
+		if batched {
+			name = "batchswarm"
+		}
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			x, y := newSwarm(b), newSwarm(b)
+			if batched {
+				x, y = New(x), New(y)
+			}
+			go y.ServeTells(p2p.NoOpTellHandler)
+			dst := y.LocalAddrs()[0]
+			data := p2p.IOVec{make([]byte, 16)}
+
+			// each Tell waits for its batch to be sent, so batches only fill up with many senders.
+			b.SetParallelism(128)
+			b.SetBytes(16)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := x.Tell(ctx, dst, data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// countSwarm counts the messages sent on it
+type countSwarm struct {
+	p2p.Swarm
+	n int32
+}
+
+func (s *countSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	atomic.AddInt32(&s.n, 1)
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+// flushSwarm counts the calls to Flush
+type flushSwarm struct {
+	p2p.Swarm
+	flushes int32
+}
+
+func (s *flushSwarm) Flush(ctx context.Context) error {
+	atomic.AddInt32(&s.flushes, 1)
+	return nil
+}
@@ -0,0 +1,39 @@
+package batchswarm
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+type Option func(s *Swarm)
+
+// WithWindow sets how long a batch waits for more messages before it is sent.
+// The default is DefaultWindow
+func WithWindow(d time.Duration) Option {
+	if d <= 0 {
+		panic(d)
+	}
+	return func(s *Swarm) {
+		s.window = d
+	}
+}
+
+// WithMaxBatchSize sets the size, in bytes, at which a batch is sent without waiting for the window to end.
+// Batches are never larger than the lower swarm's MTU, which is also the default.
+func WithMaxBatchSize(n int) Option {
+	if n <= 0 {
+		panic(n)
+	}
+	return func(s *Swarm) {
+		s.maxBatchSize = n
+	}
+}
+
+// WithClock sets the clock used to time batch windows.
+// The default is the real clock.
+func WithClock(clock clockwork.Clock) Option {
+	return func(s *Swarm) {
+		s.clock = clock
+	}
+}
@@ -0,0 +1,101 @@
+package faultyswarm
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+var _ p2p.Swarm = &Swarm{}
+
+// Swarm injects faults into the messages sent with Tell.
+// Incoming messages are unaffected, wrap the other side of a link to affect both directions.
+type Swarm struct {
+	p2p.Swarm
+
+	seed          int64
+	dropRate      float64
+	duplicateRate float64
+	corruptRate   float64
+	reorderRate   float64
+	reorderDelay  time.Duration
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func New(x p2p.Swarm, opts ...Option) *Swarm {
+	s := &Swarm{Swarm: x}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.rng = rand.New(rand.NewSource(s.seed))
+	return s
+}
+
+// Tell sends data to addr after applying faults.
+// Dropped and delayed messages return nil, just as if they had been lost in transit.
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	d := s.decide(p2p.VecSize(data))
+	if d.drop {
+		return nil
+	}
+	buf := p2p.VecBytes(data)
+	if d.corruptBit >= 0 {
+		buf = append([]byte{}, buf...)
+		buf[d.corruptBit/8] ^= 1 << (d.corruptBit % 8)
+	}
+	n := 1
+	if d.duplicate {
+		n = 2
+	}
+	if d.reorder {
+		// data may be reused by the caller after Tell returns.
+		buf = append([]byte{}, buf...)
+		time.AfterFunc(s.reorderDelay, func() {
+			for i := 0; i < n; i++ {
+				if err := s.Swarm.Tell(context.Background(), addr, p2p.IOVec{buf}); err != nil {
+					log.WithFields(logrus.Fields{"dst": addr}).Warn("error sending delayed message: ", err)
+				}
+			}
+		})
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		if err := s.Swarm.Tell(ctx, addr, p2p.IOVec{buf}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type decision struct {
+	drop, duplicate, reorder bool
+	// corruptBit is the index of the bit to flip, or -1
+	corruptBit int
+}
+
+// decide makes all the random decisions for a message of size bytes.
+// The same number of values are drawn for every message, so decisions don't depend on previous outcomes.
+func (s *Swarm) decide(size int) decision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := decision{
+		drop:       s.rng.Float64() < s.dropRate,
+		duplicate:  s.rng.Float64() < s.duplicateRate,
+		reorder:    s.rng.Float64() < s.reorderRate,
+		corruptBit: -1,
+	}
+	corrupt := s.rng.Float64() < s.corruptRate
+	bit := s.rng.Int63()
+	if corrupt && size > 0 {
+		d.corruptBit = int(bit % int64(size*8))
+	}
+	return d
+}
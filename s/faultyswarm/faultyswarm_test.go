@@ -0,0 +1,93 @@
+package faultyswarm
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestDropRate(t *testing.T) {
+	const n = 10000
+	const dropRate = 0.3
+	rec := &recordSwarm{}
+	s := New(rec, WithDropRate(dropRate), WithSeed(1))
+	sendN(t, s, n)
+	observed := 1 - float64(len(rec.getMsgs()))/n
+	require.InDelta(t, dropRate, observed, 0.03)
+}
+
+func TestReproducible(t *testing.T) {
+	run := func(seed int64) [][]byte {
+		rec := &recordSwarm{}
+		s := New(rec,
+			WithSeed(seed),
+			WithDropRate(0.1),
+			WithDuplicateRate(0.1),
+			WithCorruptRate(0.1),
+		)
+		sendN(t, s, 1000)
+		return rec.getMsgs()
+	}
+	require.Equal(t, run(1), run(1))
+	require.NotEqual(t, run(1), run(2))
+}
+
+func TestReorder(t *testing.T) {
+	rec := &recordSwarm{}
+	s := New(rec, WithReorder(1, 10*time.Millisecond))
+	sendN(t, s, 10)
+	require.Len(t, rec.getMsgs(), 0)
+	require.Eventually(t, func() bool {
+		return len(rec.getMsgs()) == 10
+	}, time.Second, time.Millisecond)
+}
+
+func sendN(t *testing.T, s p2p.Swarm, n int) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(i))
+		require.NoError(t, s.Tell(ctx, memswarm.Addr{}, p2p.IOVec{buf}))
+	}
+}
+
+// recordSwarm records messages instead of sending them
+type recordSwarm struct {
+	p2p.Swarm
+	mu   sync.Mutex
+	msgs [][]byte
+}
+
+func (s *recordSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append(s.msgs, append([]byte{}, p2p.VecBytes(data)...))
+	return nil
+}
+
+func (s *recordSwarm) getMsgs() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte{}, s.msgs...)
+}
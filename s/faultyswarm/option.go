@@ -0,0 +1,53 @@
+package faultyswarm
+
+import "time"
+
+type Option func(s *Swarm)
+
+// WithSeed sets the seed for the random decisions made by the swarm.
+// Swarms with the same seed and options make the same decisions for the same sequence of Tells.
+func WithSeed(seed int64) Option {
+	return func(s *Swarm) {
+		s.seed = seed
+	}
+}
+
+// WithDropRate sets the probability that a message is silently dropped.
+func WithDropRate(p float64) Option {
+	checkProb(p)
+	return func(s *Swarm) {
+		s.dropRate = p
+	}
+}
+
+// WithDuplicateRate sets the probability that a message is sent twice.
+func WithDuplicateRate(p float64) Option {
+	checkProb(p)
+	return func(s *Swarm) {
+		s.duplicateRate = p
+	}
+}
+
+// WithCorruptRate sets the probability that a single bit of a message is flipped.
+func WithCorruptRate(p float64) Option {
+	checkProb(p)
+	return func(s *Swarm) {
+		s.corruptRate = p
+	}
+}
+
+// WithReorder sets the probability that a message is held for delay before being sent,
+// allowing messages sent after it to arrive first.
+func WithReorder(p float64, delay time.Duration) Option {
+	checkProb(p)
+	return func(s *Swarm) {
+		s.reorderRate = p
+		s.reorderDelay = delay
+	}
+}
+
+func checkProb(p float64) {
+	if p < 0 || p > 1 {
+		panic(p)
+	}
+}
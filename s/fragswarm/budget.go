@@ -0,0 +1,75 @@
+package fragswarm
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/brendoncarroll/go-p2p"
+	"golang.org/x/sync/errgroup"
+)
+
+// tellBudgeted sends the total fragments of data concurrently, while keeping the bytes of the fragments in flight within the send budget.
+// Fragments are only created once there is room for them in the budget, so a large message waits for its earlier fragments to be sent.
+func (s *Swarm) tellBudgeted(ctx context.Context, addr p2p.Addr, id uint32, avail, total int, data p2p.IOVec) error {
+	size := p2p.VecSize(data)
+	eg, egCtx := errgroup.WithContext(ctx)
+	var start int
+	for part := 0; part < total; part++ {
+		hsize := headerSize(id, part, total)
+		end := start + avail - hsize
+		if end > size {
+			end = size
+		}
+		if p2p.Expired(ctx, s.clock.Now()) {
+			if err := eg.Wait(); err != nil {
+				return err
+			}
+			return p2p.ErrExpired
+		}
+		n := int64(hsize + end - start)
+		if n > s.sendBudget {
+			n = s.sendBudget
+		}
+		// egCtx is canceled if a fragment fails, so no more are created.
+		if err := s.budget.Acquire(egCtx, n); err != nil {
+			if err2 := eg.Wait(); err2 != nil {
+				return err2
+			}
+			return err
+		}
+		msg := newMessage(id, uint8(part), uint8(total), p2p.IOVec{vecCopy(data, start, end)})
+		start = end
+		eg.Go(func() error {
+			defer s.budget.Release(n)
+			if err := s.Swarm.Tell(ctx, addr, msg); err != nil {
+				return err
+			}
+			atomic.AddUint64(&s.counters.fragmentsSent, 1)
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// vecCopy copies the bytes of v from start to end, as if v were contiguous, into a new buffer.
+func vecCopy(v p2p.IOVec, start, end int) []byte {
+	out := make([]byte, 0, end-start)
+	var offset int
+	for _, b := range v {
+		if offset >= end {
+			break
+		}
+		lo, hi := start-offset, end-offset
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(b) {
+			hi = len(b)
+		}
+		if lo < hi {
+			out = append(out, b[lo:hi]...)
+		}
+		offset += len(b)
+	}
+	return out
+}
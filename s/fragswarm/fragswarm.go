@@ -1,99 +1,365 @@
 package fragswarm
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/framing"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
-const Overhead = 3 * binary.MaxVarintLen32
+// Overhead is the size of the largest fragment header: a uvarint message id, followed by the part and total as uvarints.
+// Most headers are smaller, and fragments are sized using the actual size of their header, so they fill the lower MTU.
+const Overhead = binary.MaxVarintLen32 + 2*maxUint8VarintLen
 
-func New(x p2p.Swarm, mtu int) p2p.Swarm {
-	return newSwarm(x, mtu)
+// maxUint8VarintLen is the size of a uint8 encoded as a uvarint
+const maxUint8VarintLen = 2
+
+// ErrMTUTooSmall is returned by Tell when the lower swarm's MTU, less Overhead and any headroom, leaves no room for data.
+// This happens when too many swarms which add overhead are layered below.
+var ErrMTUTooSmall = errors.New("fragswarm: lower MTU too small")
+
+var (
+	// ErrNoParts is passed to the WithOnMalformed callback for a fragment whose header says its message has 0 parts.
+	ErrNoParts = errors.New("fragswarm: invalid message: total is 0")
+	// ErrPartOutOfRange is passed to the WithOnMalformed callback for a fragment whose part is not less than the total.
+	ErrPartOutOfRange = errors.New("fragswarm: invalid message: part >= total")
+)
+
+// DefaultTimeout is the default amount of time to wait for all the fragments of a message.
+const DefaultTimeout = 5 * time.Second
+
+const (
+	// AdvertiseInterval is how long a peer is sent the receive MTU, see WithReceiveMTU, before it is sent again with the next message,
+	// so a peer which restarts learns it again. Advertised MTUs are forgotten after twice as long without being refreshed.
+	AdvertiseInterval = time.Minute
+	// MaxPeers is the most peers for which advertised MTUs are remembered, the least recently used are forgotten first.
+	MaxPeers = 4096
+	// maxAdvertising is the most advertisements sent at once in reply to received messages.
+	// Peers heard from while that many are being sent are advertised to with a later message.
+	maxAdvertising = 16
+)
+
+var _ p2p.Swarm = &Swarm{}
+
+var _ p2p.SecureSwarm = &SecureSwarm{}
+
+var _ p2p.Inspector = &Swarm{}
+
+// New creates a Swarm on top of x, which sends messages up to mtu by splitting them into fragments.
+// The buffers passed to x.Tell are reused once it returns, so x must not retain them, it has to copy anything it keeps.
+func New(x p2p.Swarm, mtu int, opts ...Option) *Swarm {
+	return newSwarm(x, mtu, opts...)
+}
+
+// NewSecure is like New, but for a secure lower swarm, whose identity the Swarm uses.
+// The same rule about retaining buffers applies.
+func NewSecure(x p2p.SecureSwarm, mtu int, opts ...Option) *SecureSwarm {
+	return &SecureSwarm{
+		Swarm:  newSwarm(x, mtu, opts...),
+		Secure: x,
+	}
 }
 
-func NewSecure(x p2p.SecureSwarm, mtu int) p2p.SecureSwarm {
-	y := newSwarm(x, mtu)
-	return p2p.ComposeSecureSwarm(y, x)
+// SecureSwarm is a Swarm which gets its identity from the lower swarm
+type SecureSwarm struct {
+	*Swarm
+	p2p.Secure
 }
 
-type swarm struct {
+type Swarm struct {
+	counters counters
+
 	p2p.Swarm
-	mtu int
+	mtu         int
+	headroom    int
+	onMalformed func(p2p.Addr, error)
+	// receiveMTU is 0 if it has not been set with WithReceiveMTU
+	receiveMTU int
+	// secure is true if the lower swarm authenticates the source of messages, which is required to trust advertised MTUs.
+	secure     bool
+	fair       bool
+	sequential bool
+	// sendBudget is 0 if it has not been set with WithSendBudget
+	sendBudget int64
+	// budget is the semaphore for sendBudget, it is nil if there is no budget.
+	budget *semaphore.Weighted
+
+	clock           clockwork.Clock
+	timeout         time.Duration
+	cleanupInterval time.Duration
+	manualCleanup   bool
 
-	cf context.CancelFunc
+	// ctx is canceled when the swarm is closed
+	ctx       context.Context
+	cf        context.CancelFunc
+	closeOnce swarmutil.CloseOnce
+	// workers are the swarm's goroutines, which Close waits for
+	workers swarmutil.Workers
+	// cleanupStopped is 1 once the cleanup loop has returned
+	cleanupStopped int32
 
-	mu     sync.Mutex
-	aggs   map[aggKey]*aggregator
-	msgIDs map[string]uint32
+	// msgIDs holds a *uint32 counter for each destination
+	msgIDs sync.Map
+	// peerMTUs holds the receive MTU advertised by each peer
+	peerMTUs *swarmutil.Pool[string, int]
+	// advertised holds the keys of the peers which have been sent the receive MTU in the last AdvertiseInterval
+	advertised *swarmutil.Pool[string, struct{}]
+	// advertising holds a token for each advertisement being sent in reply to a received message
+	advertising chan struct{}
+	// queues holds a *sendQueue for each destination, if fair scheduling is enabled
+	queues sync.Map
+
+	mu   sync.Mutex
+	aggs map[aggKey]*aggregator
+	// expiries holds aggregators in the order they were created, which is also the order they expire.
+	// entries are not removed when an aggregator completes, instead they are skipped during cleanup.
+	// A completed aggregator releases its parts when it is assembled, so its entry only holds the key and creation time.
+	expiries []expiry
 }
 
-func newSwarm(x p2p.Swarm, mtu int) *swarm {
+func newSwarm(x p2p.Swarm, mtu int, opts ...Option) *Swarm {
 	ctx, cf := context.WithCancel(context.Background())
-	s := &swarm{
-		Swarm: x,
-		mtu:   mtu,
+	s := &Swarm{
+		Swarm:   x,
+		mtu:     mtu,
+		clock:   clockwork.NewRealClock(),
+		timeout: DefaultTimeout,
 
-		cf:     cf,
-		aggs:   make(map[aggKey]*aggregator),
-		msgIDs: make(map[string]uint32),
+		ctx:  ctx,
+		cf:   cf,
+		aggs: make(map[aggKey]*aggregator),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.cleanupInterval == 0 {
+		s.cleanupInterval = s.timeout / 2
+	}
+	if s.sendBudget > 0 {
+		s.budget = semaphore.NewWeighted(s.sendBudget)
+	}
+	_, s.secure = x.(p2p.Secure)
+	s.peerMTUs = swarmutil.NewPool(swarmutil.PoolParams[string, int]{
+		TTL:     2 * AdvertiseInterval,
+		MaxSize: MaxPeers,
+		Clock:   s.clock,
+	})
+	s.advertised = swarmutil.NewPool(swarmutil.PoolParams[string, struct{}]{
+		TTL:     AdvertiseInterval,
+		MaxSize: MaxPeers,
+		Clock:   s.clock,
+	})
+	s.advertising = make(chan struct{}, maxAdvertising)
+	if !s.manualCleanup {
+		s.workers.Go(func() {
+			s.cleanupLoop(ctx)
+		})
 	}
-	go s.cleanupLoop(ctx)
 	return s
 }
 
-func (s *swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
-	underMTU := s.Swarm.MTU(ctx, addr) - Overhead
-	s.mu.Lock()
-	id := s.msgIDs[addr.Key()]
-	s.msgIDs[addr.Key()]++
-	s.mu.Unlock()
+// Tell fragments data to fit the lower swarm's MTU, and sends the fragments.
+// If the lower swarm returns p2p.ErrMTUExceeded and its MTU has shrunk since the fragments were sized,
+// the whole message is fragmented again with the new MTU and resent under a new message id.
+// Any fragments of the earlier attempt which were delivered are discarded by the receiver when they time out.
+// Fragments are also made to fit the receive MTU advertised by addr, if it has advertised one.
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	if s.receiveMTU > 0 && s.secure {
+		s.advertise(ctx, addr)
+	}
+	lowerMTU := s.sendMTU(ctx, addr)
+	for {
+		err := s.tell(ctx, addr, lowerMTU, data)
+		if !errors.Is(err, p2p.ErrMTUExceeded) {
+			return err
+		}
+		newMTU := s.sendMTU(ctx, addr)
+		if newMTU >= lowerMTU {
+			return err
+		}
+		atomic.AddUint64(&s.counters.messagesRefragmented, 1)
+		lowerMTU = newMTU
+	}
+}
 
-	total := len(data) / underMTU
-	if len(data)%underMTU > 0 {
-		total++
+// tell fragments data for lowerMTU and sends it.
+// If the message deadline in ctx passes before every fragment is sent, the rest are dropped, since the message can not be assembled.
+func (s *Swarm) tell(ctx context.Context, addr p2p.Addr, lowerMTU int, data p2p.IOVec) error {
+	if p2p.Expired(ctx, s.clock.Now()) {
+		return p2p.ErrExpired
 	}
-	if total == 0 {
-		total = 1
+	avail := lowerMTU - s.headroom
+	if avail-Overhead <= 0 {
+		return ErrMTUTooSmall
 	}
-	if total == 1 {
-		msg := newMessage(id, 0, 1, data)
-		return s.Swarm.Tell(ctx, addr, msg)
+	id := s.nextMsgID(addr)
+
+	size := p2p.VecSize(data)
+	if size <= avail-headerSize(id, 0, 1) {
+		if err := s.tellSingle(ctx, addr, id, data); err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.counters.fragmentsSent, 1)
+		atomic.AddUint64(&s.counters.messagesSent, 1)
+		return nil
+	}
+	total := fragmentCount(id, avail, size)
+	if total > math.MaxUint8 {
+		return p2p.ErrMTUExceeded
+	}
+	if s.budget != nil && !s.fair && !s.sequential {
+		if err := s.tellBudgeted(ctx, addr, id, avail, total, data); err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.counters.messagesSent, 1)
+		return nil
 	}
 
-	eg := errgroup.Group{}
-	for part := 0; part < total; part++ {
-		part := part
-		start := underMTU * part
-		end := len(data)
-		if start+underMTU < end {
-			end = start + underMTU
+	buf := p2p.VecBytes(data)
+	frags := make([]p2p.IOVec, total)
+	var start int
+	for part := range frags {
+		end := start + avail - headerSize(id, part, total)
+		if end > len(buf) {
+			end = len(buf)
 		}
-		eg.Go(func() error {
-			msg := newMessage(id, uint8(part), uint8(total), data[start:end])
-			return s.Swarm.Tell(ctx, addr, msg)
-		})
+		frags[part] = newMessage(id, uint8(part), uint8(total), p2p.IOVec{buf[start:end]})
+		start = end
+	}
+	if s.fair {
+		if err := s.tellFair(ctx, addr, frags); err != nil {
+			return err
+		}
+	} else if s.sequential {
+		for _, msg := range frags {
+			if p2p.Expired(ctx, s.clock.Now()) {
+				return p2p.ErrExpired
+			}
+			if err := s.Swarm.Tell(ctx, addr, msg); err != nil {
+				return err
+			}
+			atomic.AddUint64(&s.counters.fragmentsSent, 1)
+		}
+	} else {
+		eg := errgroup.Group{}
+		for _, msg := range frags {
+			msg := msg
+			eg.Go(func() error {
+				if err := s.Swarm.Tell(ctx, addr, msg); err != nil {
+					return err
+				}
+				atomic.AddUint64(&s.counters.fragmentsSent, 1)
+				return nil
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			return err
+		}
+	}
+	atomic.AddUint64(&s.counters.messagesSent, 1)
+	return nil
+}
+
+// tellSingle sends a message which fits in a single fragment.
+// The header and vector are taken from a pool, so the lower swarm must not retain data after Tell returns, see New.
+func (s *Swarm) tellSingle(ctx context.Context, addr p2p.Addr, id uint32, data p2p.IOVec) error {
+	mb := msgBufPool.Get().(*msgBuf)
+	n := putHeader(mb.header[:], id, 0, 1)
+	mb.vec = append(mb.vec, mb.header[:n])
+	mb.vec = append(mb.vec, data...)
+	err := s.Swarm.Tell(ctx, addr, mb.vec)
+	// don't keep references to data in the pool
+	for i := range mb.vec {
+		mb.vec[i] = nil
+	}
+	mb.vec = mb.vec[:0]
+	msgBufPool.Put(mb)
+	return err
+}
+
+// sendMTU is the size of the largest message which can be sent to addr on the lower swarm
+func (s *Swarm) sendMTU(ctx context.Context, addr p2p.Addr) int {
+	mtu := s.Swarm.MTU(ctx, addr)
+	if v, ok := s.peerMTUs.Get(addr.Key()); ok && v < mtu {
+		mtu = v
+	}
+	return mtu
+}
+
+// advertise sends the receive MTU to addr, if it has not been sent in the last AdvertiseInterval.
+func (s *Swarm) advertise(ctx context.Context, addr p2p.Addr) {
+	_, _, err := s.advertised.GetOrCreate(addr.Key(), func() (struct{}, error) {
+		return struct{}{}, s.Swarm.Tell(ctx, addr, newControlMessage(s.receiveMTU))
+	})
+	if err != nil {
+		// nothing is recorded, so it is tried again with the next message
+		logrus.WithFields(logrus.Fields{"dst": addr}).Warn("fragswarm: error advertising receive MTU: ", err)
+	}
+}
+
+// advertiseReply advertises the receive MTU to src, which a message was received from, without blocking the receive loop.
+// If maxAdvertising advertisements are already being sent, it is skipped, and src is advertised to with a later message.
+func (s *Swarm) advertiseReply(src p2p.Addr) {
+	if _, advertised := s.advertised.Get(src.Key()); advertised {
+		return
+	}
+	select {
+	case s.advertising <- struct{}{}:
+	default:
+		return
+	}
+	s.workers.Go(func() {
+		defer func() { <-s.advertising }()
+		s.advertise(s.ctx, src)
+	})
+}
+
+// nextMsgID returns the next message id for addr.
+// ids for each address start at 0 and increase by 1 with each call.
+func (s *Swarm) nextMsgID(addr p2p.Addr) uint32 {
+	v, ok := s.msgIDs.Load(addr.Key())
+	if !ok {
+		v, _ = s.msgIDs.LoadOrStore(addr.Key(), new(uint32))
 	}
-	return eg.Wait()
+	return atomic.AddUint32(v.(*uint32), 1) - 1
 }
 
-func (s *swarm) ServeTells(fn p2p.TellHandler) error {
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
 	return s.Swarm.ServeTells(func(x *p2p.Message) {
 		s.handleTell(x, fn)
 	})
 }
 
-func (s *swarm) handleTell(x *p2p.Message, next p2p.TellHandler) {
+func (s *Swarm) handleTell(x *p2p.Message, next p2p.TellHandler) {
+	if mtu, ok, err := parseControlMessage(x.Payload); ok {
+		if err != nil {
+			s.malformed(x.Src, err)
+			return
+		}
+		// without a secure lower swarm anyone could shrink the MTU used for a peer, so advertisements are ignored.
+		if s.secure {
+			s.peerMTUs.Put(x.Src.Key(), mtu)
+		}
+		return
+	}
+	if s.receiveMTU > 0 && s.secure {
+		s.advertiseReply(x.Src)
+	}
 	id, part, totalParts, data, err := parseMessage(x.Payload)
 	if err != nil {
-		log := logrus.WithFields(logrus.Fields{"src": x.Src})
-		log.Error("error parsing message")
+		s.malformed(x.Src, err)
 		return
 	}
 	// if there is only one part skip creating the aggregator
@@ -109,54 +375,119 @@ func (s *swarm) handleTell(x *p2p.Message, next p2p.TellHandler) {
 	s.mu.Lock()
 	agg, exists := s.aggs[key]
 	if !exists {
-		agg = newAggregator()
+		agg = newAggregator(s.clock.Now())
 		s.aggs[key] = agg
+		s.expiries = append(s.expiries, expiry{key: key, agg: agg})
+		atomic.AddUint64(&s.counters.pendingAggregators, 1)
 	}
 	s.mu.Unlock()
-	if agg.addPart(part, totalParts, data) {
+	added, complete, err := agg.addPart(part, totalParts, data)
+	if err != nil {
+		s.malformed(x.Src, err)
+		return
+	}
+	if !added {
+		atomic.AddUint64(&s.counters.duplicateFragments, 1)
+		return
+	}
+	if complete {
+		atomic.AddUint64(&s.counters.messagesReassembled, 1)
 		next(&p2p.Message{
 			Src:     x.Src,
 			Dst:     x.Dst,
 			Payload: agg.assemble(),
 		})
 		s.mu.Lock()
-		delete(s.aggs, key)
+		if s.aggs[key] == agg {
+			delete(s.aggs, key)
+			atomic.AddUint64(&s.counters.pendingAggregators, ^uint64(0))
+		}
 		s.mu.Unlock()
 	}
 }
 
-func (s *swarm) MTU(ctx context.Context, target p2p.Addr) int {
+func (s *Swarm) malformed(src p2p.Addr, err error) {
+	log := logrus.WithFields(logrus.Fields{"src": src})
+	log.Error("error parsing message: ", err)
+	if s.onMalformed != nil {
+		s.onMalformed(src, err)
+	}
+}
+
+func (s *Swarm) MTU(ctx context.Context, target p2p.Addr) int {
 	return s.mtu
 }
 
-func (s *swarm) Close() error {
-	s.cf()
-	return s.Swarm.Close()
+// Close stops the cleanup loop and closes the lower swarm.
+// It returns once the swarm's goroutines, including those sending queued fragments, have exited.
+func (s *Swarm) Close() error {
+	return s.closeOnce.Do(func() error {
+		s.cf()
+		err := s.Swarm.Close()
+		s.workers.Wait()
+		return err
+	})
+}
+
+// CleanupStopped returns true if the goroutine which periodically calls Cleanup has stopped, which happens when the swarm is closed.
+// Swarms created with WithManualCleanup never start it, so always return false.
+func (s *Swarm) CleanupStopped() bool {
+	return atomic.LoadInt32(&s.cleanupStopped) == 1
 }
 
-func (s *swarm) cleanupLoop(ctx context.Context) {
-	ticker := time.NewTicker(time.Minute)
+func (s *Swarm) cleanupLoop(ctx context.Context) {
+	defer atomic.StoreInt32(&s.cleanupStopped, 1)
+	ticker := s.clock.NewTicker(s.cleanupInterval)
 	defer ticker.Stop()
 	for {
-		s.cleanup()
+		s.Cleanup(s.clock.Now())
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-ticker.Chan():
 		}
 	}
 }
 
-func (s *swarm) cleanup() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	now := time.Now()
-	cutoff := now.Add(-5 * time.Second)
-	for k, a := range s.aggs {
-		if a.createdAt.Before(cutoff) {
-			delete(s.aggs, k)
+// Cleanup removes aggregators which have timed out as of now.
+// It is called periodically unless the swarm was created with WithManualCleanup.
+// Only expired entries are visited, and the lock is released every cleanupChunkSize entries.
+func (s *Swarm) Cleanup(now time.Time) {
+	cutoff := now.Add(-s.timeout)
+	for {
+		s.mu.Lock()
+		done := s.cleanupChunk(cutoff, cleanupChunkSize)
+		s.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+const cleanupChunkSize = 1024
+
+// cleanupChunk removes up to n expired aggregators, and returns true if there are no more to remove.
+// It must be called with mu.
+func (s *Swarm) cleanupChunk(cutoff time.Time, n int) bool {
+	var i int
+	for ; i < len(s.expiries) && i < n; i++ {
+		e := s.expiries[i]
+		if !e.agg.createdAt.Before(cutoff) {
+			break
 		}
+		if s.aggs[e.key] == e.agg {
+			delete(s.aggs, e.key)
+			atomic.AddUint64(&s.counters.aggregatorsExpired, 1)
+			atomic.AddUint64(&s.counters.pendingAggregators, ^uint64(0))
+		}
+		s.expiries[i] = expiry{}
+	}
+	s.expiries = s.expiries[i:]
+	if len(s.expiries) == 0 {
+		// release the backing array
+		s.expiries = nil
 	}
+	return i < n
 }
 
 type aggKey struct {
@@ -164,80 +495,171 @@ type aggKey struct {
 	id   uint32
 }
 
+type expiry struct {
+	key aggKey
+	agg *aggregator
+}
+
 type aggregator struct {
 	mu        sync.Mutex
 	createdAt time.Time
 	parts     [][]byte
+	// size is the total length of the parts which have been added
+	size int
+	// assembled is set once the parts have been assembled and released
+	assembled bool
 }
 
-func newAggregator() *aggregator {
-	return &aggregator{createdAt: time.Now()}
+func newAggregator(now time.Time) *aggregator {
+	return &aggregator{createdAt: now}
 }
 
-func (a *aggregator) addPart(part, total uint8, data []byte) bool {
+// addPart adds a part to the aggregator.
+// added is false if the part had already been added, in which case it is ignored.
+// complete is true if this part was the last one needed.
+func (a *aggregator) addPart(part, total uint8, data []byte) (added, complete bool, err error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	if a.assembled {
+		return false, false, nil
+	}
 	if a.parts == nil {
 		a.parts = make([][]byte, total)
 	}
+	if len(a.parts) != int(total) {
+		return false, false, errors.Errorf("part has total %d, expected %d", total, len(a.parts))
+	}
+	if a.parts[int(part)] != nil {
+		return false, false, nil
+	}
 	a.parts[int(part)] = append([]byte{}, data...)
+	a.size += len(data)
 	for i := range a.parts {
 		if a.parts[i] == nil {
-			return false
+			return true, false, nil
 		}
 	}
-	return true
+	return true, true, nil
 }
 
+// assemble concatenates the parts into a buffer allocated at exactly the size of the message.
+// Parts are copied as they arrive rather than into the final buffer, because the final size is not known
+// until the last part arrives, and allocating for the largest possible message would let a single fragment
+// reserve 255 fragments of memory.
+// The parts are released, and later parts are ignored as duplicates.
 func (a *aggregator) assemble() []byte {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	if a.parts == nil {
 		return nil
 	}
-	var buf []byte
+	buf := make([]byte, 0, a.size)
 	for _, part := range a.parts {
 		buf = append(buf, part...)
 	}
+	a.parts, a.size, a.assembled = nil, 0, true
 	return buf
 }
 
+type msgBuf struct {
+	header [Overhead]byte
+	vec    p2p.IOVec
+}
+
+var msgBufPool = sync.Pool{
+	New: func() interface{} {
+		return &msgBuf{}
+	},
+}
+
 func newMessage(id uint32, part uint8, total uint8, data p2p.IOVec) p2p.IOVec {
-	var msg [][]byte
-	msg = appendUvarint(msg, uint64(id))
-	msg = appendUvarint(msg, uint64(part))
-	msg = appendUvarint(msg, uint64(total))
+	header := make([]byte, Overhead)
+	n := putHeader(header, id, part, total)
+	msg := make(p2p.IOVec, 0, 1+len(data))
+	msg = append(msg, header[:n])
 	msg = append(msg, data...)
 	return msg
 }
 
-func parseMessage(x []byte) (id uint32, part uint8, total uint8, data []byte, err error) {
-	fields := [3]uint64{}
-	var n int
-	if err := func() error {
-		for i := range fields {
-			field, n2 := binary.Uvarint(x[n:])
-			if n2 < 1 {
-				return errors.Errorf("invalid message")
-			}
-			fields[i] = field
-			n += n2
+// controlHeader starts a control message.
+// It is the header of a message with 0 parts, which is otherwise invalid.
+var controlHeader = []byte{0, 0, 0}
+
+// newControlMessage creates a message advertising receiveMTU
+func newControlMessage(receiveMTU int) p2p.IOVec {
+	buf := append([]byte{}, controlHeader...)
+	return p2p.IOVec{framing.AppendUvarint(buf, uint64(receiveMTU))}
+}
+
+// parseControlMessage returns ok if x is a control message, and the receive MTU it advertises.
+func parseControlMessage(x []byte) (receiveMTU int, ok bool, err error) {
+	if !bytes.HasPrefix(x, controlHeader) {
+		return 0, false, nil
+	}
+	mtu, _, err := framing.ReadUvarint(x[len(controlHeader):])
+	if err != nil || mtu <= Overhead || mtu > math.MaxInt32 {
+		return 0, true, errors.Errorf("invalid control message")
+	}
+	return int(mtu), true, nil
+}
+
+// headerSize is the size of the header written by putHeader
+func headerSize(id uint32, part, total int) int {
+	return framing.UvarintSize(uint64(id)) + framing.UvarintSize(uint64(part)) + framing.UvarintSize(uint64(total))
+}
+
+// fragmentCount returns the number of fragments needed to send size bytes under message id,
+// when each fragment, including its header, can be avail bytes.
+// The result can be larger than math.MaxUint8, in which case the message can't be sent.
+func fragmentCount(id uint32, avail, size int) int {
+	// no header is smaller than headerSize(id, 0, 1), so this is a lower bound on the count.
+	total := (size + avail - headerSize(id, 0, 1) - 1) / (avail - headerSize(id, 0, 1))
+	for ; total <= math.MaxUint8; total++ {
+		var capacity int
+		for part := 0; part < total; part++ {
+			capacity += avail - headerSize(id, part, total)
 		}
-		id = uint32(fields[0])
-		part = uint8(fields[1])
-		total = uint8(fields[2])
-		if part >= total {
-			return errors.Errorf("part >= total")
+		if capacity >= size {
+			break
 		}
-		return nil
-	}(); err != nil {
-		return 0, 0, 0, nil, err
 	}
-	return id, part, total, x[n:], nil
+	return total
+}
+
+// putHeader writes the header fields to buf as uvarints, and returns the number of bytes written.
+// Uvarints are a sequence of 7 bit groups, least significant first, so the encoding is the same on any host,
+// and there are no fixed width fields whose byte order could be confused.
+func putHeader(buf []byte, id uint32, part uint8, total uint8) int {
+	header := framing.AppendUvarint(buf[:0], uint64(id))
+	header = framing.AppendUvarint(header, uint64(part))
+	header = framing.AppendUvarint(header, uint64(total))
+	return len(header)
 }
 
-func appendUvarint(b p2p.IOVec, x uint64) p2p.IOVec {
-	buf := [binary.MaxVarintLen64]byte{}
-	n := binary.PutUvarint(buf[:], x)
-	return append(b, buf[:n])
+// parseMessage parses the header written by putHeader, and returns the rest of x as data.
+// Each field is checked against the largest value its type can hold before it is converted, so values are never truncated.
+// A total of 0, which is only valid for control messages, returns ErrNoParts, and a part which is not less than the total returns ErrPartOutOfRange.
+func parseMessage(x []byte) (id uint32, part uint8, total uint8, data []byte, err error) {
+	// the largest value each field can hold
+	limits := [3]uint64{math.MaxUint32, math.MaxUint8, math.MaxUint8}
+	fields := [3]uint64{}
+	data = x
+	for i := range fields {
+		if fields[i], data, err = framing.ReadUvarint(data); err != nil {
+			return 0, 0, 0, nil, errors.Wrap(err, "invalid message")
+		}
+		if fields[i] > limits[i] {
+			return 0, 0, 0, nil, errors.Errorf("invalid message: header field %d is too large", i)
+		}
+	}
+	id = uint32(fields[0])
+	part = uint8(fields[1])
+	total = uint8(fields[2])
+	if total == 0 {
+		return 0, 0, 0, nil, ErrNoParts
+	}
+	if part >= total {
+		return 0, 0, 0, nil, ErrPartOutOfRange
+	}
+	return id, part, total, data, nil
 }
@@ -2,12 +2,18 @@ package fragswarm
 
 import (
 	"context"
+	"math"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/brendoncarroll/go-p2p"
 	"github.com/brendoncarroll/go-p2p/s/memswarm"
 	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestSwarm(t *testing.T) {
@@ -47,3 +53,945 @@ func TestFragment(t *testing.T) {
 	<-done
 	require.Equal(t, send, recv)
 }
+
+func TestOnMalformed(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	raw := r.NewSwarm()
+	type report struct {
+		src p2p.Addr
+		err error
+	}
+	reports := make(chan report, 1)
+	a := New(r.NewSwarm(), 1024, WithOnMalformed(func(src p2p.Addr, err error) {
+		reports <- report{src: src, err: err}
+	}))
+	go a.ServeTells(func(*p2p.Message) {
+		t.Error("malformed message should not be delivered")
+	})
+
+	for _, payload := range [][]byte{
+		{0xff},
+		{0, 3, 2},
+	} {
+		require.NoError(t, raw.Tell(ctx, a.LocalAddrs()[0], p2p.IOVec{payload}))
+		rep := <-reports
+		require.Error(t, rep.err)
+		require.Equal(t, raw.LocalAddrs()[0], rep.src)
+	}
+}
+
+func TestCleanupInterval(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	raw := r.NewSwarm()
+	const timeout = 50 * time.Millisecond
+	const interval = 10 * time.Millisecond
+	a := newSwarm(r.NewSwarm(), 1024, WithTimeout(timeout), WithCleanupInterval(interval))
+	defer a.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+
+	// send the first of 2 parts, so the message is never completed.
+	msg := newMessage(0, 0, 2, p2p.IOVec{[]byte("hello")})
+	require.NoError(t, raw.Tell(ctx, a.LocalAddrs()[0], msg))
+	start := time.Now()
+	require.Equal(t, 1, a.numAggs())
+
+	require.Eventually(t, func() bool {
+		return a.numAggs() == 0
+	}, time.Second, time.Millisecond)
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, int64(elapsed), int64(timeout))
+	require.Less(t, int64(elapsed), int64(timeout+3*interval))
+}
+
+func TestCleanupChunks(t *testing.T) {
+	r := memswarm.NewRealm()
+	clock := clockwork.NewFakeClock()
+	s := newSwarm(r.NewSwarm(), 1024, WithTimeout(time.Millisecond), WithClock(clock), WithManualCleanup())
+	defer s.Close()
+	src := memswarm.Addr{N: 1}
+	n := 3*cleanupChunkSize + 1
+	for i := 0; i < n; i++ {
+		s.handleTell(&p2p.Message{
+			Src:     src,
+			Payload: p2p.VecBytes(newMessage(uint32(i), 0, 2, p2p.IOVec{[]byte("hello")})),
+		}, p2p.NoOpTellHandler)
+	}
+	require.Equal(t, n, s.numAggs())
+	s.Cleanup(clock.Now())
+	require.Equal(t, n, s.numAggs())
+	clock.Advance(2 * time.Millisecond)
+	s.Cleanup(clock.Now())
+	require.Equal(t, 0, s.numAggs())
+	require.Len(t, s.expiries, 0)
+}
+
+func TestManualCleanup(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	raw := r.NewSwarm()
+	a := New(r.NewSwarm(), 1024, WithTimeout(time.Minute), WithManualCleanup())
+	defer a.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+
+	msg := newMessage(0, 0, 2, p2p.IOVec{[]byte("hello")})
+	require.NoError(t, raw.Tell(ctx, a.LocalAddrs()[0], msg))
+	now := time.Now()
+	a.Cleanup(now)
+	require.Equal(t, 1, a.numAggs())
+	a.Cleanup(now.Add(time.Minute))
+	require.Equal(t, 0, a.numAggs())
+	require.Equal(t, uint64(1), a.Stats().AggregatorsExpired)
+}
+
+func TestLossRecovery(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(100))
+	clock := clockwork.NewFakeClock()
+	lower := &dropSwarm{Swarm: r.NewSwarm(), drop: map[int]bool{2: true}}
+	a := New(lower, 1024, WithSequentialFragments())
+	b := New(r.NewSwarm(), 1024, WithTimeout(time.Second), WithClock(clock), WithManualCleanup())
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan []byte, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- append([]byte{}, msg.Payload...)
+	})
+	data := make([]byte, 500)
+	for i := range data {
+		data[i] = uint8(i)
+	}
+	dst := b.LocalAddrs()[0]
+
+	// the 3rd fragment is dropped, so the message is never completed.
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{data}))
+	require.Len(t, recv, 0)
+	require.Equal(t, 1, b.numAggs())
+
+	// the incomplete message times out, and sending it again succeeds.
+	clock.Advance(2 * time.Second)
+	b.Cleanup(clock.Now())
+	require.Equal(t, 0, b.numAggs())
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{data}))
+	require.Equal(t, data, <-recv)
+	require.Equal(t, uint64(1), b.Stats().AggregatorsExpired)
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(100))
+	raw := r.NewSwarm()
+	go raw.ServeTells(p2p.NoOpTellHandler)
+	a := New(r.NewSwarm(), 1024)
+	b := New(r.NewSwarm(), 1024, WithTimeout(50*time.Millisecond), WithCleanupInterval(10*time.Millisecond))
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan []byte, 1)
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- msg.Payload
+	})
+
+	data := make([]byte, 250)
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{data}))
+	require.Equal(t, data, <-recv)
+	require.Equal(t, uint64(1), a.Stats().MessagesSent)
+	require.Equal(t, uint64(3), a.Stats().FragmentsSent)
+	require.Equal(t, uint64(1), b.Stats().MessagesReassembled)
+	require.Equal(t, uint64(0), b.Stats().PendingAggregators)
+
+	// send the first part of a message twice, and never send the second.
+	msg := newMessage(0, 0, 2, p2p.IOVec{[]byte("hello")})
+	require.NoError(t, raw.Tell(ctx, b.LocalAddrs()[0], msg))
+	require.NoError(t, raw.Tell(ctx, b.LocalAddrs()[0], msg))
+	require.Equal(t, uint64(1), b.Stats().DuplicateFragments)
+	require.Equal(t, uint64(1), b.Stats().PendingAggregators)
+
+	require.Eventually(t, func() bool {
+		return b.Stats().AggregatorsExpired == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, uint64(0), b.Stats().PendingAggregators)
+	require.Equal(t, uint64(1), b.Stats().MessagesReassembled)
+}
+
+func (s *Swarm) numAggs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.aggs)
+}
+
+func TestHeadroom(t *testing.T) {
+	ctx := context.Background()
+	const lowerMTU, headroom = 100, 10
+	r := memswarm.NewRealm(memswarm.WithMTU(lowerMTU))
+	a := New(&headerSwarm{Swarm: r.NewSwarm(), t: t, max: lowerMTU - headroom}, 1024, WithHeadroom(headroom))
+	b := New(r.NewSwarm(), 1024)
+
+	done := make(chan []byte, 1)
+	go b.ServeTells(func(m *p2p.Message) {
+		done <- append([]byte{}, m.Payload...)
+	})
+	send := make([]byte, 1000)
+	for i := range send {
+		send[i] = uint8(i)
+	}
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{send}))
+	require.Equal(t, send, <-done)
+
+	c := New(r.NewSwarm(), 1024, WithHeadroom(lowerMTU))
+	require.Equal(t, ErrMTUTooSmall, c.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{send}))
+}
+
+func TestMTUTooSmall(t *testing.T) {
+	ctx := context.Background()
+	for _, lowerMTU := range []int{0, 1, Overhead} {
+		r := memswarm.NewRealm(memswarm.WithMTU(lowerMTU))
+		a := New(r.NewSwarm(), 1024)
+		b := r.NewSwarm()
+		require.Equal(t, ErrMTUTooSmall, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}), lowerMTU)
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	}
+
+	// the MTU shrinks too far to refragment after the first fragment has been sent
+	r := memswarm.NewRealm()
+	a := New(&shrinkSwarm{Swarm: r.NewSwarm(), mtu: 200, shrinkTo: Overhead - 1, shrinkAfter: 1}, 1024)
+	b := r.NewSwarm()
+	defer a.Close()
+	defer b.Close()
+	go b.ServeTells(p2p.NoOpTellHandler)
+	require.Equal(t, ErrMTUTooSmall, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{make([]byte, 1000)}))
+}
+
+// headerSwarm checks that each message leaves room for a header of its own.
+type headerSwarm struct {
+	p2p.Swarm
+	t   testing.TB
+	max int
+}
+
+func (s *headerSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	require.LessOrEqual(s.t, p2p.VecSize(data), s.max)
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+func TestMTUShrink(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	// the MTU shrinks after the first fragment has been sent
+	lower := &shrinkSwarm{Swarm: r.NewSwarm(), mtu: 200, shrinkTo: 100, shrinkAfter: 1}
+	a := New(lower, 1024)
+	b := New(r.NewSwarm(), 1024)
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan []byte, 1)
+	go b.ServeTells(func(m *p2p.Message) {
+		recv <- append([]byte{}, m.Payload...)
+	})
+
+	send := make([]byte, 1000)
+	for i := range send {
+		send[i] = uint8(i)
+	}
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{send}))
+	require.Equal(t, send, <-recv)
+	require.Equal(t, uint64(1), a.Stats().MessagesRefragmented)
+	// the fragment from the first attempt waits to time out
+	require.Equal(t, uint64(1), b.Stats().PendingAggregators)
+
+	// if the MTU has not changed, the error is returned
+	c := New(&shrinkSwarm{Swarm: r.NewSwarm(), mtu: 200, reject: true}, 1024)
+	defer c.Close()
+	require.Equal(t, p2p.ErrMTUExceeded, c.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{send}))
+}
+
+// shrinkSwarm rejects messages larger than its MTU, and shrinks its MTU after a number of messages have been sent.
+// It sends one message at a time, so the shrink happens at a predictable point.
+// If reject is set every message is rejected, without the MTU changing.
+type shrinkSwarm struct {
+	p2p.Swarm
+	mu          sync.Mutex
+	reject      bool
+	mtu         int
+	shrinkTo    int
+	shrinkAfter int
+	sent        int
+}
+
+func (s *shrinkSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reject || p2p.VecSize(data) > s.mtu {
+		return p2p.ErrMTUExceeded
+	}
+	if err := s.Swarm.Tell(ctx, addr, data); err != nil {
+		return err
+	}
+	s.sent++
+	if s.sent == s.shrinkAfter {
+		s.mtu = s.shrinkTo
+	}
+	return nil
+}
+
+func (s *shrinkSwarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mtu
+}
+
+func TestReceiveMTU(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	// b can only receive messages of up to 200 bytes, but can send larger ones.
+	const receiveMTU = 200
+	lower := r.NewSwarm()
+	sizes := &sizeSwarm{Swarm: lower}
+	a := New(secureSwarm{Swarm: sizes, Secure: lower}, 1<<16)
+	b := New(r.NewSwarm(), 1<<16, WithReceiveMTU(receiveMTU))
+	defer a.Close()
+	defer b.Close()
+	aRecv := make(chan []byte, 1)
+	bRecv := make(chan []byte, 1)
+	go a.ServeTells(func(m *p2p.Message) {
+		aRecv <- append([]byte{}, m.Payload...)
+	})
+	go b.ServeTells(func(m *p2p.Message) {
+		bRecv <- append([]byte{}, m.Payload...)
+	})
+
+	// b advertises its receive MTU before the first message it sends to a.
+	large := make([]byte, 1000)
+	for i := range large {
+		large[i] = uint8(i)
+	}
+	require.NoError(t, b.Tell(ctx, a.LocalAddrs()[0], p2p.IOVec{large}))
+	require.Equal(t, large, <-aRecv)
+	require.Equal(t, receiveMTU, a.sendMTU(ctx, b.LocalAddrs()[0]))
+
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{large}))
+	require.Equal(t, large, <-bRecv)
+	require.LessOrEqual(t, sizes.getMax(), receiveMTU)
+}
+
+func TestReceiveMTUOnReceive(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), 1<<16)
+	b := New(r.NewSwarm(), 1<<16, WithReceiveMTU(200))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+
+	// b advertises its receive MTU the first time it hears from a
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Eventually(t, func() bool {
+		return a.sendMTU(ctx, b.LocalAddrs()[0]) == 200
+	}, time.Second, time.Millisecond)
+}
+
+func TestReceiveMTUInsecure(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	// neither side's lower swarm authenticates sources, so nothing is advertised or honored.
+	a := New(insecureSwarm{r.NewSwarm()}, 1<<16)
+	b := New(insecureSwarm{r.NewSwarm()}, 1<<16, WithReceiveMTU(200))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	require.NoError(t, b.Tell(ctx, a.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, 0, b.advertised.Len())
+
+	a.handleTell(&p2p.Message{Src: b.LocalAddrs()[0], Payload: p2p.VecBytes(newControlMessage(100))}, p2p.NoOpTellHandler)
+	require.Equal(t, a.Swarm.MTU(ctx, b.LocalAddrs()[0]), a.sendMTU(ctx, b.LocalAddrs()[0]))
+}
+
+func TestReadvertise(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	clock := clockwork.NewFakeClock()
+	lower := r.NewSwarm()
+	sizes := &sizeSwarm{Swarm: lower}
+	a := New(r.NewSwarm(), 1<<16)
+	b := New(secureSwarm{Swarm: sizes, Secure: lower}, 1<<16, WithReceiveMTU(200), WithClock(clock), WithManualCleanup())
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	aAddr := a.LocalAddrs()[0]
+
+	// the control frame and the message are sent, and the next message goes alone
+	require.NoError(t, b.Tell(ctx, aAddr, p2p.IOVec{[]byte("1")}))
+	require.NoError(t, b.Tell(ctx, aAddr, p2p.IOVec{[]byte("2")}))
+	require.Len(t, sizes.takeSizes(), 3)
+	// a may have restarted, so it is advertised to again
+	clock.Advance(AdvertiseInterval)
+	require.NoError(t, b.Tell(ctx, aAddr, p2p.IOVec{[]byte("3")}))
+	require.Len(t, sizes.takeSizes(), 2)
+}
+
+func TestPeerMTUsBounded(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	clock := clockwork.NewFakeClock()
+	s := New(r.NewSwarm(), 1<<16, WithClock(clock), WithManualCleanup())
+	defer s.Close()
+	control := p2p.VecBytes(newControlMessage(100))
+	for i := 0; i < MaxPeers+10; i++ {
+		s.handleTell(&p2p.Message{Src: memswarm.Addr{N: 1000 + i}, Payload: control}, p2p.NoOpTellHandler)
+	}
+	require.Equal(t, MaxPeers, s.peerMTUs.Len())
+	last := memswarm.Addr{N: 1000 + MaxPeers + 9}
+	require.Equal(t, 100, s.sendMTU(ctx, last))
+	// advertisements expire unless they are refreshed
+	clock.Advance(2 * AdvertiseInterval)
+	require.Equal(t, s.Swarm.MTU(ctx, last), s.sendMTU(ctx, last))
+}
+
+// secureSwarm adds a p2p.Secure to a test swarm which wraps a secure swarm
+type secureSwarm struct {
+	p2p.Swarm
+	p2p.Secure
+}
+
+// insecureSwarm hides the p2p.Secure methods of the swarm it wraps
+type insecureSwarm struct {
+	p2p.Swarm
+}
+
+// sizeSwarm records the size of the largest message sent on it
+type sizeSwarm struct {
+	p2p.Swarm
+	mu    sync.Mutex
+	max   int
+	sizes []int
+}
+
+func (s *sizeSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	s.mu.Lock()
+	size := p2p.VecSize(data)
+	if size > s.max {
+		s.max = size
+	}
+	s.sizes = append(s.sizes, size)
+	s.mu.Unlock()
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+func (s *sizeSwarm) getMax() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+// takeSizes returns the sizes of the messages sent since the last call
+func (s *sizeSwarm) takeSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sizes := s.sizes
+	s.sizes = nil
+	return sizes
+}
+
+func TestFragmentsFillMTU(t *testing.T) {
+	ctx := context.Background()
+	const lowerMTU = 100
+	r := memswarm.NewRealm(memswarm.WithMTU(lowerMTU))
+	lower := &sizeSwarm{Swarm: r.NewSwarm()}
+	a := New(lower, 1<<16, WithSequentialFragments())
+	b := New(r.NewSwarm(), 1<<16)
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan []byte, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- append([]byte{}, msg.Payload...)
+	})
+	dst := b.LocalAddrs()[0]
+
+	// small ids, parts and totals have 1 byte uvarints, so the header is 3 bytes
+	data := make([]byte, lowerMTU-3)
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{data}))
+	require.Equal(t, data, <-recv)
+	require.Equal(t, []int{lowerMTU}, lower.takeSizes())
+
+	// parts and totals above 127 have 2 byte uvarints
+	for _, size := range []int{lowerMTU - 2, 1000, 150 * (lowerMTU - 3)} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = uint8(i)
+		}
+		require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{data}))
+		require.Equal(t, data, <-recv)
+		sizes := lower.takeSizes()
+		require.Greater(t, len(sizes), 1)
+		// every fragment but the last is full
+		for i, n := range sizes[:len(sizes)-1] {
+			require.Equal(t, lowerMTU, n, "size %d fragment %d", size, i)
+		}
+		require.LessOrEqual(t, sizes[len(sizes)-1], lowerMTU)
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	buf := make([]byte, Overhead)
+	for _, h := range []struct {
+		id          uint32
+		part, total int
+	}{{0, 0, 1}, {127, 126, 127}, {128, 127, 128}, {math.MaxUint32, math.MaxUint8 - 1, math.MaxUint8}} {
+		require.Equal(t, putHeader(buf, h.id, uint8(h.part), uint8(h.total)), headerSize(h.id, h.part, h.total))
+	}
+	require.Equal(t, Overhead, headerSize(math.MaxUint32, math.MaxUint8, math.MaxUint8))
+}
+
+func TestParseMessage(t *testing.T) {
+	buf := make([]byte, Overhead)
+	n := putHeader(buf, 7, 1, 2)
+	id, part, total, data, err := parseMessage(append(buf[:n], "hi"...))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{uint32(7), uint8(1), uint8(2), "hi"}, []interface{}{id, part, total, string(data)})
+
+	for _, x := range [][]byte{
+		nil,
+		{7, 1},
+		{7, 2, 2},
+		// fields which don't fit are rejected, rather than truncated
+		{7, 0x80, 0x02, 0x81, 0x02},
+		{0x80, 0x80, 0x80, 0x80, 0x10, 0, 1},
+	} {
+		_, _, _, _, err := parseMessage(x)
+		require.Error(t, err, "%x", x)
+	}
+
+	_, _, _, _, err = parseMessage([]byte{7, 0, 0})
+	require.Equal(t, ErrNoParts, err)
+	_, _, _, _, err = parseMessage([]byte{7, 2, 2})
+	require.Equal(t, ErrPartOutOfRange, err)
+}
+
+// FuzzFragParse checks that the parsers for received messages never panic, and reject malformed input.
+func FuzzFragParse(f *testing.F) {
+	buf := make([]byte, Overhead)
+	f.Add(buf[:putHeader(buf, 7, 1, 2)])
+	f.Add(buf[:putHeader(buf, math.MaxUint32, math.MaxUint8-1, math.MaxUint8)])
+	f.Add(p2p.VecBytes(newControlMessage(1 << 16)))
+	f.Add([]byte{0x80, 0x80})
+	f.Fuzz(func(t *testing.T, x []byte) {
+		id, part, total, data, err := parseMessage(x)
+		if err == nil {
+			require.GreaterOrEqual(t, total, uint8(1))
+			require.Less(t, part, total)
+			require.True(t, len(data) <= len(x)-headerSize(id, int(part), int(total)))
+		}
+		mtu, ok, err := parseControlMessage(x)
+		if ok && err == nil {
+			require.Greater(t, mtu, Overhead)
+		}
+		if !ok {
+			require.NoError(t, err)
+		}
+	})
+}
+
+// FuzzFragHeader checks that every valid header parses back to the fields it was written with.
+func FuzzFragHeader(f *testing.F) {
+	f.Add(uint32(7), uint8(1), uint8(2), []byte("hi"))
+	f.Add(uint32(math.MaxUint32), uint8(math.MaxUint8-1), uint8(math.MaxUint8), []byte{})
+	f.Add(uint32(0), uint8(0), uint8(0), []byte{})
+	f.Fuzz(func(t *testing.T, id uint32, part, total uint8, data []byte) {
+		x := p2p.VecBytes(newMessage(id, part, total, p2p.IOVec{data}))
+		id2, part2, total2, data2, err := parseMessage(x)
+		switch {
+		case total == 0:
+			require.Equal(t, ErrNoParts, err)
+		case part >= total:
+			require.Equal(t, ErrPartOutOfRange, err)
+		default:
+			require.NoError(t, err)
+			require.Equal(t, []interface{}{id, part, total}, []interface{}{id2, part2, total2})
+			require.Equal(t, data, data2)
+		}
+	})
+}
+
+func TestFairScheduling(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(100))
+	lower := &gateSwarm{
+		Swarm:   r.NewSwarm(),
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	a := New(lower, 1<<16, WithFairScheduling())
+	b := New(r.NewSwarm(), 1<<16)
+	defer a.Close()
+	defer b.Close()
+	go b.ServeTells(p2p.NoOpTellHandler)
+	dst := b.LocalAddrs()[0]
+	// the ids, parts and totals all have 1 byte uvarints, so each fragment has a 3 byte header
+	const underMTU = 100 - 3
+	const largeParts, smallParts = 20, 2
+
+	eg := errgroup.Group{}
+	eg.Go(func() error {
+		return a.Tell(ctx, dst, p2p.IOVec{make([]byte, largeParts*underMTU)})
+	})
+	// the first fragment of the large message is being sent
+	<-lower.entered
+	eg.Go(func() error {
+		return a.Tell(ctx, dst, p2p.IOVec{make([]byte, smallParts*underMTU)})
+	})
+	require.Eventually(t, func() bool {
+		v, _ := a.queues.Load(dst.Key())
+		q := v.(*sendQueue)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.msgs) == 2
+	}, time.Second, time.Millisecond)
+	for i := 1; i < largeParts+smallParts; i++ {
+		lower.release <- struct{}{}
+		<-lower.entered
+	}
+	lower.release <- struct{}{}
+	require.NoError(t, eg.Wait())
+
+	// the large message is id 0 and the small message is id 1.
+	// after the fragment which was in progress, the small message's fragments alternate with the large message's.
+	ids := lower.getIDs()
+	require.Len(t, ids, largeParts+smallParts)
+	require.Equal(t, []uint32{0, 1, 0, 1, 0}, ids[:5])
+	// the queue is removed once it is empty
+	require.Eventually(t, func() bool {
+		_, ok := a.queues.Load(dst.Key())
+		return !ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestDeadline(t *testing.T) {
+	for _, opt := range []Option{WithFairScheduling(), WithSequentialFragments()} {
+		ctx := context.Background()
+		clock := clockwork.NewFakeClock()
+		r := memswarm.NewRealm(memswarm.WithMTU(100))
+		lower := &gateSwarm{
+			Swarm:   r.NewSwarm(),
+			entered: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+		a := New(lower, 1<<16, opt, WithClock(clock))
+		b := New(r.NewSwarm(), 1<<16)
+		go b.ServeTells(p2p.NoOpTellHandler)
+		dst := b.LocalAddrs()[0]
+
+		require.Equal(t, p2p.ErrExpired, a.Tell(p2p.WithDeadline(ctx, clock.Now()), dst, p2p.IOVec{[]byte("expired")}))
+
+		// the deadline passes while the first fragment is being sent, so the rest are dropped
+		done := make(chan error, 1)
+		go func() {
+			done <- a.Tell(p2p.WithDeadline(ctx, clock.Now().Add(time.Minute)), dst, p2p.IOVec{make([]byte, 500)})
+		}()
+		<-lower.entered
+		clock.Advance(time.Hour)
+		lower.release <- struct{}{}
+		require.Equal(t, p2p.ErrExpired, <-done)
+		require.Len(t, lower.getIDs(), 1)
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	}
+}
+
+// gateSwarm waits for the test to release each message before sending it
+type gateSwarm struct {
+	p2p.Swarm
+	entered, release chan struct{}
+
+	mu  sync.Mutex
+	ids []uint32
+}
+
+func (s *gateSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	id, _, _, _, err := parseMessage(p2p.VecBytes(data))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ids = append(s.ids, id)
+	s.mu.Unlock()
+	s.entered <- struct{}{}
+	<-s.release
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+func (s *gateSwarm) getIDs() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint32{}, s.ids...)
+}
+
+func TestMsgIDs(t *testing.T) {
+	r := memswarm.NewRealm()
+	s := newSwarm(r.NewSwarm(), 1024)
+	defer s.Close()
+	a, b := memswarm.Addr{N: 10}, memswarm.Addr{N: 11}
+	for i := 0; i < 10; i++ {
+		require.Equal(t, uint32(i), s.nextMsgID(a))
+	}
+	require.Equal(t, uint32(0), s.nextMsgID(b))
+
+	const N = 1000
+	ids := make(chan uint32, N)
+	eg := errgroup.Group{}
+	for i := 0; i < N; i++ {
+		eg.Go(func() error {
+			ids <- s.nextMsgID(b)
+			return nil
+		})
+	}
+	require.NoError(t, eg.Wait())
+	close(ids)
+	seen := map[uint32]bool{}
+	for id := range ids {
+		require.False(t, seen[id])
+		seen[id] = true
+	}
+	require.Len(t, seen, N)
+}
+
+func BenchmarkTellBidirectional(b *testing.B) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	const mtu = 1 << 16
+	x := New(r.NewSwarm(), mtu)
+	y := New(r.NewSwarm(), mtu)
+	go x.ServeTells(p2p.NoOpTellHandler)
+	go y.ServeTells(p2p.NoOpTellHandler)
+	data := p2p.IOVec{make([]byte, 100)}
+	xAddr, yAddr := x.LocalAddrs()[0], y.LocalAddrs()[0]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			src, dst := x, yAddr
+			if i%2 == 1 {
+				src, dst = y, xAddr
+			}
+			if err := src.Tell(ctx, dst, data); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func TestSingleFragmentWire(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	rec := &recordSwarm{Swarm: r.NewSwarm()}
+	s := newSwarm(rec, 1024)
+	defer s.Close()
+	dst := memswarm.Addr{N: 1}
+	data := p2p.IOVec{[]byte("hello"), []byte(" world")}
+	for i := 0; i < 300; i++ {
+		require.NoError(t, s.Tell(ctx, dst, data))
+		expected := p2p.VecBytes(newMessage(uint32(i), 0, 1, data))
+		require.Equal(t, expected, rec.last)
+
+		id, part, total, body, err := parseMessage(rec.last)
+		require.NoError(t, err)
+		require.Equal(t, uint32(i), id)
+		require.Equal(t, uint8(0), part)
+		require.Equal(t, uint8(1), total)
+		require.Equal(t, "hello world", string(body))
+	}
+}
+
+func BenchmarkTellSingleFragment(b *testing.B) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	s := New(&recordSwarm{Swarm: r.NewSwarm(), discard: true}, 1024)
+	defer s.Close()
+	dst := memswarm.Addr{N: 1}
+	data := p2p.IOVec{make([]byte, 100)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.Tell(ctx, dst, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// recordSwarm copies the last message sent instead of sending it.
+type recordSwarm struct {
+	p2p.Swarm
+	discard bool
+	last    []byte
+}
+
+func (s *recordSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	if !s.discard {
+		s.last = append(s.last[:0], p2p.VecBytes(data)...)
+	}
+	return nil
+}
+
+func BenchmarkCleanup(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			r := memswarm.NewRealm()
+			s := newSwarm(r.NewSwarm(), 1024)
+			defer s.Close()
+			src := memswarm.Addr{N: 1}
+			for i := 0; i < n; i++ {
+				s.handleTell(&p2p.Message{
+					Src:     src,
+					Payload: p2p.VecBytes(newMessage(uint32(i), 0, 2, p2p.IOVec{[]byte("hello")})),
+				}, p2p.NoOpTellHandler)
+			}
+			b.ResetTimer()
+			// none of the aggregators have expired, so this measures the time the lock is held for nothing.
+			for i := 0; i < b.N; i++ {
+				s.Cleanup(time.Now())
+			}
+		})
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	const partSize = 1000
+	data := make([]byte, 4*partSize+1)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	agg := newAggregator(time.Now())
+	// parts are added out of order, and the buffer is reused between parts like a lower swarm's would be.
+	var buf []byte
+	for i, part := range []int{3, 0, 4, 2, 1} {
+		end := (part + 1) * partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		buf = append(buf[:0], data[part*partSize:end]...)
+		added, complete, err := agg.addPart(uint8(part), 5, buf)
+		require.NoError(t, err)
+		require.True(t, added)
+		require.Equal(t, i == 4, complete)
+	}
+	out := agg.assemble()
+	require.Equal(t, data, out)
+	require.Equal(t, len(data), cap(out))
+	// the parts are released, since the aggregator stays referenced until its expiry is cleaned up.
+	require.Nil(t, agg.parts)
+	added, _, err := agg.addPart(0, 5, data[:partSize])
+	require.NoError(t, err)
+	require.False(t, added)
+}
+
+func BenchmarkAssemble(b *testing.B) {
+	const partSize = 1 << 16
+	const total = 64
+	part := make([]byte, partSize)
+	b.SetBytes(partSize * total)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		agg := newAggregator(time.Time{})
+		for j := 0; j < total; j++ {
+			if _, _, err := agg.addPart(uint8(j), total, part); err != nil {
+				b.Fatal(err)
+			}
+		}
+		agg.assemble()
+	}
+}
+
+// dropSwarm drops the messages sent with Tell whose index, counting from 0, is in drop.
+type dropSwarm struct {
+	p2p.Swarm
+	mu   sync.Mutex
+	drop map[int]bool
+	sent int
+}
+
+func (s *dropSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	s.mu.Lock()
+	i := s.sent
+	s.sent++
+	s.mu.Unlock()
+	if s.drop[i] {
+		return nil
+	}
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+func TestSendBudget(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	const lowerMTU = 1024
+	const budget = 4 * lowerMTU
+	r := memswarm.NewRealm(memswarm.WithMTU(lowerMTU))
+	lower := &inflightSwarm{Swarm: r.NewSwarm()}
+	a := New(lower, 1<<20, WithSendBudget(budget))
+	b := New(r.NewSwarm(), 1<<20)
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan []byte, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- append([]byte{}, msg.Payload...)
+	})
+
+	// the message is many times the budget, and split across buffers so it can't be sliced in place
+	data := make([]byte, 200*(lowerMTU-Overhead))
+	for i := range data {
+		data[i] = uint8(i)
+	}
+	third := len(data) / 3
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{data[:third], data[third : 2*third], data[2*third:]}))
+	require.Equal(t, data, <-recv)
+	require.Greater(t, lower.getCount(), 100)
+	require.LessOrEqual(t, lower.getMax(), budget)
+}
+
+// inflightSwarm records the most bytes which were inside calls to Tell at once
+type inflightSwarm struct {
+	p2p.Swarm
+	mu       sync.Mutex
+	inflight int
+	max      int
+	count    int
+}
+
+func (s *inflightSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	size := p2p.VecSize(data)
+	s.mu.Lock()
+	s.inflight += size
+	if s.inflight > s.max {
+		s.max = s.inflight
+	}
+	s.count++
+	s.mu.Unlock()
+	// give other fragments a chance to overlap.
+	time.Sleep(100 * time.Microsecond)
+	err := s.Swarm.Tell(ctx, addr, data)
+	s.mu.Lock()
+	s.inflight -= size
+	s.mu.Unlock()
+	return err
+}
+
+func (s *inflightSwarm) getMax() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+func (s *inflightSwarm) getCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
@@ -0,0 +1,116 @@
+package fragswarm
+
+import (
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/jonboulle/clockwork"
+)
+
+type Option func(s *Swarm)
+
+// WithOnMalformed sets a function to be called whenever a message from src is dropped
+// because it could not be parsed or assembled.
+func WithOnMalformed(fn func(src p2p.Addr, err error)) Option {
+	return func(s *Swarm) {
+		s.onMalformed = fn
+	}
+}
+
+// WithHeadroom reserves n bytes of the lower swarm's MTU in addition to Overhead.
+// Fragments sent to the lower swarm will be no larger than its MTU - n
+func WithHeadroom(n int) Option {
+	if n < 0 {
+		panic(n)
+	}
+	return func(s *Swarm) {
+		s.headroom = n
+	}
+}
+
+// WithReceiveMTU sets the size of the largest message the lower swarm can receive, when it is smaller than the lower swarm's MTU.
+// This is the case on links where the MTU is different in each direction.
+// It is advertised to each peer in a control frame, and peers fragment the messages they send to fit it.
+// It is advertised again every AdvertiseInterval while messages are exchanged with the peer.
+// Advertisements are only sent and honored when the lower swarm is a p2p.Secure, which authenticates where they came from,
+// so the option has no effect over other swarms.
+func WithReceiveMTU(n int) Option {
+	if n <= Overhead {
+		panic(n)
+	}
+	return func(s *Swarm) {
+		s.receiveMTU = n
+	}
+}
+
+// WithFairScheduling sends the fragments of concurrent messages to the same peer one at a time,
+// taking a fragment from each message in turn, so a small message is not stuck behind all the fragments of a large one.
+// Messages which fit in a single fragment are sent immediately, as they are without this option.
+// By default every fragment of a message is sent concurrently.
+func WithFairScheduling() Option {
+	return func(s *Swarm) {
+		s.fair = true
+	}
+}
+
+// WithSequentialFragments sends the fragments of a message one at a time, in index order, from the goroutine calling Tell.
+// The lower swarm sees the same sequence of fragments on every run, so tests can drop or reorder specific fragments.
+// It is slower than the default of sending every fragment concurrently, and has no effect with WithFairScheduling.
+func WithSequentialFragments() Option {
+	return func(s *Swarm) {
+		s.sequential = true
+	}
+}
+
+// WithSendBudget limits the fragments buffered or in flight to the lower swarm, across all concurrent Tells, to n bytes.
+// Each fragment is copied out of the message just before it is sent, and its buffer is released when the lower swarm's Tell returns,
+// so memory used for sending is bounded regardless of message size.
+// A fragment larger than n is sent on its own.
+// It has no effect with WithFairScheduling or WithSequentialFragments, which send one fragment of a message at a time.
+func WithSendBudget(n int) Option {
+	if n <= 0 {
+		panic(n)
+	}
+	return func(s *Swarm) {
+		s.sendBudget = int64(n)
+	}
+}
+
+// WithTimeout sets how long to wait for all the fragments of a message before discarding them.
+// The default is DefaultTimeout
+func WithTimeout(d time.Duration) Option {
+	if d <= 0 {
+		panic(d)
+	}
+	return func(s *Swarm) {
+		s.timeout = d
+	}
+}
+
+// WithCleanupInterval sets how often incomplete messages are checked for timeouts.
+// Incomplete messages can be held for up to the timeout plus the interval.
+// The default is half the timeout.
+func WithCleanupInterval(d time.Duration) Option {
+	if d <= 0 {
+		panic(d)
+	}
+	return func(s *Swarm) {
+		s.cleanupInterval = d
+	}
+}
+
+// WithManualCleanup stops the swarm from starting a goroutine to discard timed out messages.
+// The caller is responsible for calling Cleanup instead, and WithCleanupInterval has no effect.
+func WithManualCleanup() Option {
+	return func(s *Swarm) {
+		s.manualCleanup = true
+	}
+}
+
+// WithClock sets the clock used to time out incomplete messages.
+// The default is the real clock.
+func WithClock(clock clockwork.Clock) Option {
+	return func(s *Swarm) {
+		s.clock = clock
+	}
+}
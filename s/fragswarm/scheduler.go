@@ -0,0 +1,109 @@
+package fragswarm
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/brendoncarroll/go-p2p"
+)
+
+// outMsg is a fragmented message waiting in a sendQueue
+type outMsg struct {
+	ctx   context.Context
+	frags []p2p.IOVec
+	next  int
+
+	done chan struct{}
+	err  error
+}
+
+// sendQueue holds the messages being sent to a single peer when using WithFairScheduling.
+// One goroutine sends fragments from the queue, taking one from each message in turn,
+// and exits when the queue is empty, removing the queue so idle peers don't take up space.
+type sendQueue struct {
+	mu      sync.Mutex
+	msgs    []*outMsg
+	pos     int
+	running bool
+	// removed is set once the queue has been removed from the swarm, it must not be added to after that.
+	removed bool
+}
+
+// tellFair adds frags to the queue for addr, and waits until they have all been sent, or one of them fails.
+func (s *Swarm) tellFair(ctx context.Context, addr p2p.Addr, frags []p2p.IOVec) error {
+	m := &outMsg{
+		ctx:   ctx,
+		frags: frags,
+		done:  make(chan struct{}),
+	}
+	var q *sendQueue
+	var start bool
+	for {
+		v, ok := s.queues.Load(addr.Key())
+		if !ok {
+			v, _ = s.queues.LoadOrStore(addr.Key(), &sendQueue{})
+		}
+		q = v.(*sendQueue)
+		q.mu.Lock()
+		if q.removed {
+			// the queue emptied after it was loaded, the next one is in the map.
+			q.mu.Unlock()
+			continue
+		}
+		q.msgs = append(q.msgs, m)
+		start = !q.running
+		q.running = true
+		q.mu.Unlock()
+		break
+	}
+	// once the swarm is closed the queue is sent from here, so it does not outlive Close.
+	if start && !s.workers.Go(func() { s.runQueue(addr, q) }) {
+		s.runQueue(addr, q)
+	}
+	<-m.done
+	return m.err
+}
+
+// runQueue sends fragments from q in round robin order until it is empty.
+func (s *Swarm) runQueue(addr p2p.Addr, q *sendQueue) {
+	for {
+		q.mu.Lock()
+		if len(q.msgs) == 0 {
+			q.running = false
+			q.removed = true
+			s.queues.Delete(addr.Key())
+			q.mu.Unlock()
+			return
+		}
+		q.pos %= len(q.msgs)
+		m := q.msgs[q.pos]
+		q.mu.Unlock()
+
+		err := m.ctx.Err()
+		if err == nil && p2p.Expired(m.ctx, s.clock.Now()) {
+			err = p2p.ErrExpired
+		}
+		if err == nil {
+			err = s.Swarm.Tell(m.ctx, addr, m.frags[m.next])
+		}
+		if err == nil {
+			atomic.AddUint64(&s.counters.fragmentsSent, 1)
+			m.next++
+		}
+		finished := err != nil || m.next == len(m.frags)
+
+		q.mu.Lock()
+		if finished {
+			// the next message moves into pos
+			q.msgs = append(q.msgs[:q.pos], q.msgs[q.pos+1:]...)
+		} else {
+			q.pos++
+		}
+		q.mu.Unlock()
+		if finished {
+			m.err = err
+			close(m.done)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package fragswarm
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a Swarm's counters
+type Stats struct {
+	// MessagesSent is the number of calls to Tell which succeeded
+	MessagesSent uint64
+	// FragmentsSent is the number of fragments successfully sent to the lower swarm
+	FragmentsSent uint64
+	// MessagesRefragmented is the number of times a message was fragmented again,
+	// because the lower swarm's MTU shrank while it was being sent.
+	MessagesRefragmented uint64
+	// MessagesReassembled is the number of messages assembled from multiple fragments
+	MessagesReassembled uint64
+	// DuplicateFragments is the number of fragments dropped because that part had already been received
+	DuplicateFragments uint64
+	// AggregatorsExpired is the number of messages discarded because not all of their fragments arrived before the timeout.
+	AggregatorsExpired uint64
+	// PendingAggregators is the number of messages currently waiting for more fragments
+	PendingAggregators uint64
+}
+
+// counters are updated atomically.
+// It is the first field in Swarm for alignment.
+type counters struct {
+	messagesSent         uint64
+	fragmentsSent        uint64
+	messagesRefragmented uint64
+	messagesReassembled  uint64
+	duplicateFragments   uint64
+	aggregatorsExpired   uint64
+	pendingAggregators   uint64
+}
+
+// Stats returns a snapshot of the swarm's counters.
+// Each counter is read atomically, but the snapshot as a whole is not.
+func (s *Swarm) Stats() Stats {
+	c := &s.counters
+	return Stats{
+		MessagesSent:         atomic.LoadUint64(&c.messagesSent),
+		FragmentsSent:        atomic.LoadUint64(&c.fragmentsSent),
+		MessagesRefragmented: atomic.LoadUint64(&c.messagesRefragmented),
+		MessagesReassembled:  atomic.LoadUint64(&c.messagesReassembled),
+		DuplicateFragments:   atomic.LoadUint64(&c.duplicateFragments),
+		AggregatorsExpired:   atomic.LoadUint64(&c.aggregatorsExpired),
+		PendingAggregators:   atomic.LoadUint64(&c.pendingAggregators),
+	}
+}
+
+// PendingMessage describes a message which is waiting for more of its fragments.
+type PendingMessage struct {
+	// Src is the key of the address the fragments are from
+	Src string
+	ID  uint32
+	// Received is the number of fragments which have arrived, out of Total.
+	Received, Total int
+	// Size is the total length of the fragments which have arrived.
+	Size      int
+	CreatedAt time.Time
+}
+
+// PendingMessages returns a PendingMessage for each message which is waiting for more fragments.
+func (s *Swarm) PendingMessages() []PendingMessage {
+	type pending struct {
+		key aggKey
+		agg *aggregator
+	}
+	s.mu.Lock()
+	aggs := make([]pending, 0, len(s.aggs))
+	for k, agg := range s.aggs {
+		aggs = append(aggs, pending{key: k, agg: agg})
+	}
+	s.mu.Unlock()
+	pms := []PendingMessage{}
+	for _, p := range aggs {
+		pm := PendingMessage{Src: p.key.addr, ID: p.key.id}
+		p.agg.mu.Lock()
+		pm.Total = len(p.agg.parts)
+		for _, part := range p.agg.parts {
+			if part != nil {
+				pm.Received++
+			}
+		}
+		pm.Size = p.agg.size
+		pm.CreatedAt = p.agg.createdAt
+		p.agg.mu.Unlock()
+		pms = append(pms, pm)
+	}
+	sort.Slice(pms, func(i, j int) bool {
+		return pms[i].CreatedAt.Before(pms[j].CreatedAt)
+	})
+	return pms
+}
+
+// Inspect implements p2p.Inspector, with the Stats and the PendingMessages.
+func (s *Swarm) Inspect() map[string]interface{} {
+	return map[string]interface{}{
+		"counters":          s.Stats(),
+		"pending_fragments": s.PendingMessages(),
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -24,10 +25,22 @@ type Realm struct {
 	dropRate float64
 	logw     io.Writer
 	mtu      int
+	// maxResponseSize is the largest response Ask will accept, it defaults to mtu
+	maxResponseSize int
 
-	mu     sync.RWMutex
-	n      int
-	swarms map[int]*Swarm
+	mu        sync.RWMutex
+	n         int
+	swarms    map[int]*Swarm
+	blocked   map[link]struct{}
+	latencies map[link]time.Duration
+}
+
+// ErrBlocked is returned when sending on a link which has been blocked with Realm.Block
+var ErrBlocked = errors.New("memswarm: link blocked")
+
+// link is a directed connection from src to dst
+type link struct {
+	src, dst int
 }
 
 func NewRealm(opts ...Option) *Realm {
@@ -36,10 +49,16 @@ func NewRealm(opts ...Option) *Realm {
 		logw:   ioutil.Discard,
 		mtu:    1 << 20,
 		swarms: make(map[int]*Swarm),
+
+		blocked:   make(map[link]struct{}),
+		latencies: make(map[link]time.Duration),
 	}
 	for _, opt := range opts {
 		opt(r)
 	}
+	if r.maxResponseSize == 0 {
+		r.maxResponseSize = r.mtu
+	}
 	return r
 }
 
@@ -52,15 +71,71 @@ func (r *Realm) log(isAsk bool, msg *p2p.Message) {
 	r.logw.Write([]byte(s))
 }
 
-func (r *Realm) block() bool {
-	if r.latency > 0 {
-		r.clock.Sleep(r.latency)
+// transmit simulates a message travelling from src to dst.
+// It returns ErrBlocked if the link is blocked, and false if the message was dropped.
+func (r *Realm) transmit(src, dst int) (bool, error) {
+	l := link{src: src, dst: dst}
+	r.mu.RLock()
+	_, blocked := r.blocked[l]
+	latency, ok := r.latencies[l]
+	r.mu.RUnlock()
+	if blocked {
+		return false, ErrBlocked
+	}
+	if !ok {
+		latency = r.latency
+	}
+	if latency > 0 {
+		r.clock.Sleep(latency)
 	}
 	x := rand.Float64()
 	if x < r.dropRate {
-		return false
+		return false, nil
 	}
-	return true
+	return true, nil
+}
+
+// Swarms returns all the open swarms in the realm, ordered by the order they were created.
+func (r *Realm) Swarms() []p2p.Swarm {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ns := make([]int, 0, len(r.swarms))
+	for n := range r.swarms {
+		ns = append(ns, n)
+	}
+	sort.Ints(ns)
+	xs := make([]p2p.Swarm, len(ns))
+	for i, n := range ns {
+		xs[i] = r.swarms[n]
+	}
+	return xs
+}
+
+// Block causes all messages between a and b, in both directions, to fail with ErrBlocked.
+func (r *Realm) Block(a, b p2p.Addr) {
+	x, y := a.(Addr).N, b.(Addr).N
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blocked[link{src: x, dst: y}] = struct{}{}
+	r.blocked[link{src: y, dst: x}] = struct{}{}
+}
+
+// Unblock undoes a call to Block
+func (r *Realm) Unblock(a, b p2p.Addr) {
+	x, y := a.(Addr).N, b.(Addr).N
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.blocked, link{src: x, dst: y})
+	delete(r.blocked, link{src: y, dst: x})
+}
+
+// SetLatency sets the latency for messages sent from a to b.
+// It overrides the latency set with WithLatency, and does not affect messages from b to a.
+func (r *Realm) SetLatency(a, b p2p.Addr, d time.Duration) {
+	x, y := a.(Addr).N, b.(Addr).N
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies[link{src: x, dst: y}] = d
 }
 
 func (r *Realm) NewSwarm() *Swarm {
@@ -110,19 +185,29 @@ func (s *Swarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte,
 		Dst:     addr,
 		Payload: p2p.VecBytes(data),
 	}
-	if len(data) > s.r.mtu {
-		return nil, p2p.ErrMTUExceeded
+	if err := p2p.CheckMTU(data, s.r.mtu); err != nil {
+		return nil, err
+	}
+	ok, err := s.r.transmit(s.n, a.N)
+	if err != nil {
+		return nil, err
 	}
-	if !s.r.block() {
+	if !ok {
 		return nil, errors.New("message dropped")
 	}
 	s.r.log(true, msg)
 	buf := bytes.Buffer{}
-	lw := &swarmutil.LimitWriter{W: &buf, N: s.r.mtu}
+	// the handler writes directly into our buffer, so the limit is enforced before anything over it is buffered.
+	lw := &swarmutil.LimitWriter{W: &buf, N: s.r.maxResponseSize}
 	s.r.mu.RLock()
 	s2 := s.r.swarms[a.N]
 	s.r.mu.RUnlock()
-	s2.asks.DeliverAsk(ctx, msg, lw)
+	if err := s2.asks.DeliverAsk(ctx, msg, lw); err != nil {
+		return nil, err
+	}
+	if lw.Exceeded() {
+		return nil, p2p.ErrResponseTooLarge
+	}
 	return buf.Bytes(), nil
 }
 
@@ -133,19 +218,23 @@ func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
 		Dst:     addr,
 		Payload: p2p.VecBytes(data),
 	}
-	if len(data) > s.r.mtu {
-		return p2p.ErrMTUExceeded
+	if err := p2p.CheckMTU(data, s.r.mtu); err != nil {
+		return err
 	}
-	if !s.r.block() {
+	ok, err := s.r.transmit(s.n, a.N)
+	if err != nil {
+		return err
+	}
+	if !ok {
 		return nil
 	}
 	s.r.log(false, msg)
 	s.r.mu.RLock()
 	s2 := s.r.swarms[a.N]
+	s.r.mu.RUnlock()
 	if s2 == nil {
 		return nil
 	}
-	s.r.mu.RUnlock()
 	s2.tells.DeliverTell(msg)
 	return nil
 }
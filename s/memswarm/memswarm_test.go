@@ -1,7 +1,11 @@
 package memswarm
 
 import (
+	"context"
+	"errors"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/brendoncarroll/go-p2p"
 	"github.com/brendoncarroll/go-p2p/s/swarmtest"
@@ -48,3 +52,105 @@ func TestSwarm(t *testing.T) {
 		return xs
 	})
 }
+
+func TestSwarms(t *testing.T) {
+	r := NewRealm()
+	a, b, c := r.NewSwarm(), r.NewSwarm(), r.NewSwarm()
+	require.Equal(t, []p2p.Swarm{a, b, c}, r.Swarms())
+	require.NoError(t, b.Close())
+	require.Equal(t, []p2p.Swarm{a, c}, r.Swarms())
+	require.NoError(t, a.Close())
+	require.NoError(t, c.Close())
+}
+
+func TestPartition(t *testing.T) {
+	ctx := context.Background()
+	r := NewRealm()
+	a, b := r.NewSwarm(), r.NewSwarm()
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan string, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	go a.ServeTells(p2p.NoOpTellHandler)
+
+	aAddr, bAddr := a.LocalAddrs()[0], b.LocalAddrs()[0]
+	r.Block(aAddr, bAddr)
+	err := a.Tell(ctx, bAddr, p2p.IOVec{[]byte("blocked")})
+	require.Equal(t, ErrBlocked, err)
+	err = b.Tell(ctx, aAddr, p2p.IOVec{[]byte("blocked")})
+	require.Equal(t, ErrBlocked, err)
+
+	r.Unblock(aAddr, bAddr)
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("unblocked")}))
+	require.Equal(t, "unblocked", <-recv)
+}
+
+func TestSetLatency(t *testing.T) {
+	ctx := context.Background()
+	r := NewRealm()
+	a, b := r.NewSwarm(), r.NewSwarm()
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+
+	aAddr, bAddr := a.LocalAddrs()[0], b.LocalAddrs()[0]
+	const d = 50 * time.Millisecond
+	r.SetLatency(aAddr, bAddr, d)
+
+	start := time.Now()
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("slow")}))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(d))
+
+	start = time.Now()
+	require.NoError(t, b.Tell(ctx, aAddr, p2p.IOVec{[]byte("fast")}))
+	require.Less(t, int64(time.Since(start)), int64(d))
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	ctx := context.Background()
+	r := NewRealm(WithMaxResponseSize(250))
+	a, b := r.NewSwarm(), r.NewSwarm()
+	defer a.Close()
+	defer b.Close()
+	var written int
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		chunk := make([]byte, 100)
+		for i := 0; i < int(msg.Payload[0]); i++ {
+			if _, err := w.Write(chunk); err != nil {
+				require.Equal(t, p2p.ErrResponseTooLarge, err)
+				return
+			}
+			written += len(chunk)
+		}
+	})
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	bAddr := b.LocalAddrs()[0]
+
+	resp, err := a.Ask(ctx, bAddr, p2p.IOVec{[]byte{2}})
+	require.NoError(t, err)
+	require.Len(t, resp, 200)
+
+	written = 0
+	_, err = a.Ask(ctx, bAddr, p2p.IOVec{[]byte{10}})
+	require.Equal(t, p2p.ErrResponseTooLarge, err)
+	// the handler is cut off at the first write over the limit, not allowed to write the whole response.
+	require.Equal(t, 200, written)
+}
+
+func TestMTUExceeded(t *testing.T) {
+	ctx := context.Background()
+	r := NewRealm(WithMTU(100))
+	a, b := r.NewSwarm(), r.NewSwarm()
+	defer a.Close()
+	defer b.Close()
+	bAddr := b.LocalAddrs()[0]
+	// the size of the whole vector is checked, not the number of buffers
+	err := a.Tell(ctx, bAddr, p2p.IOVec{make([]byte, 60), make([]byte, 60)})
+	require.True(t, errors.Is(err, p2p.ErrMTUExceeded))
+	require.Equal(t, p2p.MTUExceededError{MTU: 100, Size: 120}, err)
+	_, err = a.Ask(ctx, bAddr, p2p.IOVec{make([]byte, 101)})
+	require.True(t, errors.Is(err, p2p.ErrMTUExceeded))
+}
@@ -41,3 +41,12 @@ func WithMTU(x int) Option {
 		r.mtu = x
 	}
 }
+
+// WithMaxResponseSize sets the largest response Ask will accept.
+// Asks with larger responses return p2p.ErrResponseTooLarge.
+// The default is the MTU.
+func WithMaxResponseSize(x int) Option {
+	return func(r *Realm) {
+		r.maxResponseSize = x
+	}
+}
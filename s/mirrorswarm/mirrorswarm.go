@@ -0,0 +1,58 @@
+package mirrorswarm
+
+import (
+	"context"
+	"sync"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+var _ p2p.Swarm = &Swarm{}
+
+// Swarm sends a copy of every outbound Tell to a set of mirror addresses.
+// Mirrors are sent to on a best effort basis, errors are logged and do not affect the result of Tell.
+type Swarm struct {
+	p2p.Swarm
+
+	mu      sync.RWMutex
+	mirrors []p2p.Addr
+}
+
+func New(x p2p.Swarm, mirrors []p2p.Addr) *Swarm {
+	s := &Swarm{Swarm: x}
+	s.SetMirrors(mirrors)
+	return s
+}
+
+// Tell sends data to addr, and then to each of the mirrors.
+// The error returned is only from sending to addr.
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	err := s.Swarm.Tell(ctx, addr, data)
+	for _, mirror := range s.Mirrors() {
+		if mirror.Key() == addr.Key() {
+			continue
+		}
+		if err := s.Swarm.Tell(ctx, mirror, data); err != nil {
+			log.WithFields(logrus.Fields{"mirror": mirror}).Warn("error telling mirror: ", err)
+		}
+	}
+	return err
+}
+
+// SetMirrors replaces the mirror set
+func (s *Swarm) SetMirrors(mirrors []p2p.Addr) {
+	mirrors = append([]p2p.Addr{}, mirrors...)
+	s.mu.Lock()
+	s.mirrors = mirrors
+	s.mu.Unlock()
+}
+
+// Mirrors returns a copy of the current mirror set
+func (s *Swarm) Mirrors() []p2p.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]p2p.Addr{}, s.mirrors...)
+}
@@ -0,0 +1,62 @@
+package mirrorswarm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm(), nil)
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	src, dst, good, bad := r.NewSwarm(), r.NewSwarm(), r.NewSwarm(), r.NewSwarm()
+	xs := []p2p.Swarm{src, dst, good, bad}
+	defer swarmtest.CloseSwarms(t, xs)
+
+	recv := make([]chan string, len(xs))
+	for i := range xs {
+		i := i
+		recv[i] = make(chan string, 10)
+		go xs[i].ServeTells(func(msg *p2p.Message) {
+			recv[i] <- string(msg.Payload)
+		})
+	}
+	srcAddr, dstAddr := src.LocalAddrs()[0], dst.LocalAddrs()[0]
+	goodAddr, badAddr := good.LocalAddrs()[0], bad.LocalAddrs()[0]
+	r.Block(srcAddr, badAddr)
+
+	s := New(src, []p2p.Addr{badAddr, goodAddr})
+	require.NoError(t, s.Tell(ctx, dstAddr, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, "hello", <-recv[1])
+	require.Equal(t, "hello", <-recv[2])
+	require.Len(t, recv[3], 0)
+
+	// changing the returned set doesn't change the mirrors
+	mirrors := s.Mirrors()
+	mirrors[1] = badAddr
+	require.Equal(t, []p2p.Addr{badAddr, goodAddr}, s.Mirrors())
+
+	// remove the good mirror
+	s.SetMirrors([]p2p.Addr{badAddr})
+	require.NoError(t, s.Tell(ctx, dstAddr, p2p.IOVec{[]byte("hello2")}))
+	require.Equal(t, "hello2", <-recv[1])
+	require.Len(t, recv[2], 0)
+}
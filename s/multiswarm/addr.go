@@ -51,25 +51,41 @@ func (a Addr) MarshalText() ([]byte, error) {
 
 var addrRe = regexp.MustCompile(`^(.+?)://(.+)$`)
 
+// ErrUnknownAddrScheme is matched by the error returned from ParseAddr for an address
+// whose scheme does not name one of the swarm's transports.
+var ErrUnknownAddrScheme = errors.New("unknown address scheme")
+
+// UnknownAddrSchemeError is returned by ParseAddr for an address with a scheme which is not a transport.
+// It matches ErrUnknownAddrScheme with errors.Is.
+type UnknownAddrSchemeError struct {
+	Scheme string
+}
+
+func (e UnknownAddrSchemeError) Error() string {
+	return fmt.Sprintf("multiswarm: unknown address scheme %q", e.Scheme)
+}
+
+func (e UnknownAddrSchemeError) Is(target error) bool {
+	return target == ErrUnknownAddrScheme
+}
+
+// ParseAddr parses addresses of the form transport://addr, using the named transport to parse addr.
 func (ms multiSwarm) ParseAddr(data []byte) (p2p.Addr, error) {
-	addr := Addr{}
 	groups := addrRe.FindSubmatch(data)
 	if len(groups) != 3 {
-		return nil, errors.New("could not unmarshal")
+		return nil, fmt.Errorf("multiswarm: address %q is not of the form transport://addr", data)
 	}
-	addr.Transport = string(groups[1])
-
-	// transport
 	tname := string(groups[1])
 	inner, ok := ms[tname]
 	if !ok {
-		return nil, fmt.Errorf("AggSwarm does not have transport %s", tname)
+		return nil, UnknownAddrSchemeError{Scheme: tname}
 	}
-	addr.Transport = tname
 	innerAddr, err := inner.ParseAddr(groups[2])
 	if err != nil {
 		return nil, err
 	}
-	addr.Addr = innerAddr
-	return addr, nil
+	return Addr{
+		Transport: tname,
+		Addr:      innerAddr,
+	}, nil
 }
@@ -1,12 +1,14 @@
 package multiswarm
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/brendoncarroll/go-p2p"
 	"github.com/brendoncarroll/go-p2p/p2ptest"
 	"github.com/brendoncarroll/go-p2p/s/memswarm"
 	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMultiSwarm(t *testing.T) {
@@ -31,3 +33,40 @@ func TestMultiSwarm(t *testing.T) {
 		return xs
 	})
 }
+
+func TestParseAddr(t *testing.T) {
+	r1, r2 := memswarm.NewRealm(), memswarm.NewRealm()
+	x := NewSwarm(map[string]p2p.Swarm{
+		"mem1": r1.NewSwarm(),
+		"mem2": r2.NewSwarm(),
+	})
+	defer x.Close()
+
+	// each transport's addresses round trip
+	for _, addr := range x.LocalAddrs() {
+		data, err := addr.MarshalText()
+		require.NoError(t, err)
+		parsed, err := x.ParseAddr(data)
+		require.NoError(t, err)
+		require.Equal(t, addr, parsed)
+	}
+	addr, err := x.ParseAddr([]byte("mem2://7"))
+	require.NoError(t, err)
+	require.Equal(t, Addr{Transport: "mem2", Addr: memswarm.Addr{N: 7}}, addr)
+
+	_, err = x.ParseAddr([]byte("udp://127.0.0.1:1234"))
+	require.True(t, errors.Is(err, ErrUnknownAddrScheme))
+	var schemeErr UnknownAddrSchemeError
+	require.True(t, errors.As(err, &schemeErr))
+	require.Equal(t, "udp", schemeErr.Scheme)
+
+	// malformed addresses and bad inner addresses are not unknown schemes
+	for _, data := range []string{"", "mem1", "://7", "mem1://"} {
+		_, err := x.ParseAddr([]byte(data))
+		require.Error(t, err, data)
+		require.False(t, errors.Is(err, ErrUnknownAddrScheme), data)
+	}
+	_, err = x.ParseAddr([]byte("mem1://abc"))
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrUnknownAddrScheme))
+}
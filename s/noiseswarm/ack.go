@@ -0,0 +1,78 @@
+package noiseswarm
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrAckTimeout is returned by TellAck when no ack is received within AskTimeout
+var ErrAckTimeout = errors.Errorf("noiseswarm: timed out waiting for tell ack")
+
+// TellAck is like Tell, but returns only once the receiving swarm has acknowledged the message,
+// after queueing it for its tell handler. Messages dropped because the queue is full are not acknowledged, see TellQueueSize.
+// The ack only means the message was received, unlike an Ask there is no response from the application.
+// If the message or the ack is lost, TellAck returns ctx.Err() when ctx is done, or ErrAckTimeout after AskTimeout,
+// and the message may or may not have been received, so reliable delivery built on it must tolerate duplicates.
+// Peers which do not support acks drop the message as malformed, so TellAck always times out with them,
+// and ErrNoFrames is returned for peers from before frames without sending anything.
+func (s *Swarm) TellAck(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	dst := addr.(Addr)
+	return s.withAnyReadySession(ctx, dst, func(sess *session) error {
+		if p2p.Expired(ctx, s.clock.Now()) {
+			return p2p.ErrExpired
+		}
+		return sess.tellAck(ctx, data)
+	})
+}
+
+func (s *Swarm) sendAck(sess *session, id uint32) {
+	if err := sess.downward(s.ctx, newAskFrame(frameAck, id, nil)); err != nil {
+		logrus.Warn("noiseswarm: error sending tell ack: ", err)
+	}
+}
+
+// tellAck sends a tell over the session, and waits for the ack with the same id.
+func (s *session) tellAck(ctx context.Context, data p2p.IOVec) error {
+	if !s.isFramed() {
+		return ErrNoFrames
+	}
+	id := atomic.AddUint32(&s.lastAckID, 1)
+	ch := make(chan struct{}, 1)
+	s.askMu.Lock()
+	s.pendingAcks[id] = ch
+	s.askMu.Unlock()
+	defer func() {
+		s.askMu.Lock()
+		delete(s.pendingAcks, id)
+		s.askMu.Unlock()
+	}()
+	if err := s.tell(ctx, newAskFrame(frameTellAck, id, data)); err != nil {
+		return err
+	}
+	timer := s.params.clock.NewTimer(AskTimeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.Chan():
+		return ErrAckTimeout
+	}
+}
+
+// deliverAck wakes the TellAck waiting for id.
+// Acks with ids which are not pending, because TellAck has returned, are ignored.
+func (s *session) deliverAck(id uint32) {
+	s.askMu.Lock()
+	ch, exists := s.pendingAcks[id]
+	delete(s.pendingAcks, id)
+	s.askMu.Unlock()
+	if exists {
+		ch <- struct{}{}
+	}
+}
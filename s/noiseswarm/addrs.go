@@ -0,0 +1,79 @@
+package noiseswarm
+
+import (
+	"sync/atomic"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/framing"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// advertiseAddrs sends the lower swarm's LocalAddrs to the remote party, once per session.
+// It is called when a session becomes ready, and does nothing unless WithOnPeerAddrs is used.
+// Addresses which would not fit in a single message are left out.
+func (s *Swarm) advertiseAddrs(sess *session) {
+	if s.onPeerAddrs == nil || !atomic.CompareAndSwapUint32(&sess.addrsSent, 0, 1) {
+		return
+	}
+	limit := s.MTU(s.ctx, Addr{Addr: sess.getLowerRaddr()})
+	s.workers.Go(func() {
+		frame := newAddrsFrame(s.swarm.LocalAddrs(), limit)
+		if err := sess.downward(s.ctx, frame); err != nil {
+			logrus.Warn("noiseswarm: error advertising addresses: ", err)
+		}
+	})
+}
+
+// handleAddrs passes the addresses advertised by the remote party of sess to the OnPeerAddrs callback.
+// Addresses which the lower swarm cannot parse are dropped.
+func (s *Swarm) handleAddrs(sess *session, body []byte) error {
+	if s.onPeerAddrs == nil {
+		return nil
+	}
+	datas, err := parseAddrsFrame(body)
+	if err != nil {
+		return err
+	}
+	id := sess.getRemotePeerID()
+	addrs := make([]p2p.Addr, 0, len(datas))
+	for _, data := range datas {
+		lower, err := s.swarm.ParseAddr(data)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"peer": id}).Debug("noiseswarm: dropping advertised address: ", err)
+			continue
+		}
+		addrs = append(addrs, Addr{ID: id, Addr: lower})
+	}
+	s.onPeerAddrs(id, addrs)
+	return nil
+}
+
+// newAddrsFrame encodes addrs, each prefixed with its length, in a frame no larger than limit.
+func newAddrsFrame(addrs []p2p.Addr, limit int) p2p.IOVec {
+	buf := []byte{frameAddrs}
+	for _, addr := range addrs {
+		data, err := addr.MarshalText()
+		if err != nil {
+			continue
+		}
+		if len(buf)+framing.FrameSize(len(data)) > limit {
+			continue
+		}
+		buf = framing.AppendFrame(buf, data)
+	}
+	return p2p.IOVec{buf}
+}
+
+func parseAddrsFrame(body []byte) ([][]byte, error) {
+	var datas [][]byte
+	for len(body) > 0 {
+		data, rest, err := framing.ReadFrame(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed addrs frame")
+		}
+		datas = append(datas, data)
+		body = rest
+	}
+	return datas, nil
+}
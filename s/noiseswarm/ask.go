@@ -0,0 +1,241 @@
+package noiseswarm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// AskTimeout is the longest an Ask will wait for a response, if the context does not expire first.
+	AskTimeout = 30 * time.Second
+	// MaxConcurrentAsks is the most asks the swarm will handle at once.
+	// Asks which arrive while that many are being handled are dropped, and the asker times out.
+	MaxConcurrentAsks = 256
+)
+
+// ErrAskTimeout is returned by Ask when no response is received within AskTimeout
+var ErrAskTimeout = errors.Errorf("noiseswarm: timed out waiting for ask response")
+
+// ErrNoFrames is returned by Ask and TellAck when the remote party is from before frames, and only understands tells.
+var ErrNoFrames = errors.Errorf("noiseswarm: remote party does not support frames")
+
+// Every post-handshake plaintext starts with a frame type, once both parties have said they support frames in the handshake.
+// Parties from before frames take the whole plaintext as a tell.
+// Ask frames are followed by a request id, which is used to match responses to requests.
+const (
+	frameTell = uint8(iota)
+	frameAskReq
+	frameAskResp
+	// frameAskErr is sent instead of a response which is too large to send.
+	frameAskErr
+	// frameAddrs carries the sender's lower swarm addresses, see WithOnPeerAddrs.
+	frameAddrs
+	// frameCaps carries the sender's Capabilities.
+	frameCaps
+	// frameTellAck is a tell which the receiver acknowledges with a frameAck with the same id, see TellAck.
+	frameTellAck
+	frameAck
+	// frameTicket carries a resumption ticket from a responder, see WithResumption.
+	frameTicket
+	// framePathChallenge carries a nonce sent to an address a session may move to, see WithConnectionIDs.
+	// It is answered with a framePathResponse with the same nonce, sent back to the address the challenge came from.
+	framePathChallenge
+	framePathResponse
+)
+
+// frameOverhead is the size of the largest frame header.
+const frameOverhead = 1 + 4
+
+var tellHeader = []byte{frameTell}
+
+func newTellFrame(data p2p.IOVec) p2p.IOVec {
+	frame := make(p2p.IOVec, 0, 1+len(data))
+	frame = append(frame, tellHeader)
+	return append(frame, data...)
+}
+
+func newAskFrame(frameType uint8, id uint32, data p2p.IOVec) p2p.IOVec {
+	header := make([]byte, frameOverhead)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], id)
+	frame := make(p2p.IOVec, 0, 1+len(data))
+	frame = append(frame, header)
+	return append(frame, data...)
+}
+
+func parseFrame(x []byte) (frameType uint8, id uint32, body []byte, err error) {
+	if len(x) < 1 {
+		return 0, 0, nil, errors.Errorf("empty frame")
+	}
+	frameType = x[0]
+	switch frameType {
+	case frameTell, frameAddrs, frameCaps, frameTicket, framePathChallenge, framePathResponse:
+		return frameType, 0, x[1:], nil
+	case frameAskReq, frameAskResp, frameAskErr, frameTellAck, frameAck:
+		if len(x) < frameOverhead {
+			return 0, 0, nil, errors.Errorf("ask frame too short")
+		}
+		return frameType, binary.BigEndian.Uint32(x[1:frameOverhead]), x[frameOverhead:], nil
+	default:
+		return 0, 0, nil, errors.Errorf("unknown frame type %d", frameType)
+	}
+}
+
+func (s *Swarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	dst := addr.(Addr)
+	var resp []byte
+	err := s.withAnyReadySession(ctx, dst, func(sess *session) error {
+		var err error
+		resp, err = sess.ask(ctx, data)
+		return err
+	})
+	return resp, err
+}
+
+// AskVia is like TellVia, but sends an ask and waits for the response.
+func (s *Swarm) AskVia(ctx context.Context, id p2p.PeerID, lower p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	return s.Ask(ctx, Addr{ID: id, Addr: lower}, data)
+}
+
+func (s *Swarm) ServeAsks(fn p2p.AskHandler) error {
+	return s.asks.ServeAsks(fn)
+}
+
+// handleFrame delivers a decrypted message from sess to the tell or ask handlers, or to a waiting Ask.
+func (s *Swarm) handleFrame(sess *session, msg *p2p.Message, ptext []byte) error {
+	src := Addr{ID: sess.getRemotePeerID(), Addr: msg.Src}
+	dst := Addr{ID: sess.getLocalID(), Addr: msg.Dst}
+	if !sess.isFramed() {
+		s.tells.DeliverTell(&p2p.Message{Src: src, Dst: dst, Payload: ptext})
+		return nil
+	}
+	if len(ptext) > 0 && ptext[0]&frameCompressed != 0 {
+		if !s.compress {
+			return errors.Errorf("compressed frame received, but compression is not enabled")
+		}
+		var err error
+		if ptext, err = decompressFrame(ptext, s.MTU(context.Background(), Addr{Addr: msg.Src})+frameOverhead); err != nil {
+			return err
+		}
+	}
+	frameType, id, body, err := parseFrame(ptext)
+	if err != nil {
+		return err
+	}
+	switch frameType {
+	case frameTell:
+		s.tells.DeliverTell(&p2p.Message{Src: src, Dst: dst, Payload: body})
+	case frameAskReq:
+		select {
+		case s.askSlots <- struct{}{}:
+		default:
+			logrus.WithFields(malformedFields(msg)).Debug("noiseswarm: dropping ask, too many in progress")
+			return nil
+		}
+		// copy the body, since the handler runs after the lower swarm's buffer may be reused.
+		req := &p2p.Message{Src: src, Dst: dst, Payload: append([]byte{}, body...)}
+		// handlers are not run as workers, since Close does not wait for them.
+		go func() {
+			defer func() { <-s.askSlots }()
+			s.handleAsk(sess, id, req)
+		}()
+	case frameAskResp:
+		sess.deliverResponse(id, append([]byte{}, body...), nil)
+	case frameAskErr:
+		sess.deliverResponse(id, nil, p2p.ErrResponseTooLarge)
+	case frameAddrs:
+		return s.handleAddrs(sess, body)
+	case frameCaps:
+		return s.handleCaps(sess, body)
+	case frameTellAck:
+		if !s.tells.DeliverTell(&p2p.Message{Src: src, Dst: dst, Payload: body}) {
+			// the tell was dropped, so it is not acked.
+			return nil
+		}
+		s.workers.Go(func() {
+			s.sendAck(sess, id)
+		})
+	case frameAck:
+		sess.deliverAck(id)
+	case frameTicket:
+		return s.handleTicket(sess, body)
+	case framePathChallenge:
+		return s.handlePathChallenge(sess, msg.Src, body)
+	case framePathResponse:
+		return s.handlePathResponse(sess, msg.Src, body)
+	}
+	return nil
+}
+
+func (s *Swarm) handleAsk(sess *session, id uint32, req *p2p.Message) {
+	ctx, cf := context.WithTimeout(s.ctx, AskTimeout)
+	defer cf()
+	buf := bytes.Buffer{}
+	lw := &swarmutil.LimitWriter{W: &buf, N: s.MTU(ctx, req.Src)}
+	if err := s.asks.DeliverAsk(ctx, req, lw); err != nil {
+		// the swarm is closed, the asker will time out.
+		return
+	}
+	frame := newAskFrame(frameAskResp, id, p2p.IOVec{buf.Bytes()})
+	if lw.Exceeded() {
+		frame = newAskFrame(frameAskErr, id, nil)
+	}
+	if err := sess.downward(ctx, sess.compressFrame(frame)); err != nil {
+		logrus.Warn("noiseswarm: error sending ask response: ", err)
+	}
+}
+
+// ask sends an ask request over the session, and waits for the response with the same id.
+func (s *session) ask(ctx context.Context, data p2p.IOVec) ([]byte, error) {
+	if !s.isFramed() {
+		return nil, ErrNoFrames
+	}
+	id := atomic.AddUint32(&s.lastAskID, 1)
+	ch := make(chan askResult, 1)
+	s.askMu.Lock()
+	s.pendingAsks[id] = ch
+	s.askMu.Unlock()
+	defer func() {
+		s.askMu.Lock()
+		delete(s.pendingAsks, id)
+		s.askMu.Unlock()
+	}()
+	if err := s.tell(ctx, newAskFrame(frameAskReq, id, data)); err != nil {
+		return nil, err
+	}
+	timer := s.params.clock.NewTimer(AskTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res.data, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.Chan():
+		return nil, ErrAskTimeout
+	}
+}
+
+// deliverResponse passes a response to the Ask waiting for id.
+// Responses with ids which are not pending, because the Ask has returned, are ignored.
+func (s *session) deliverResponse(id uint32, data []byte, err error) {
+	s.askMu.Lock()
+	ch, exists := s.pendingAsks[id]
+	delete(s.pendingAsks, id)
+	s.askMu.Unlock()
+	if exists {
+		ch <- askResult{data: data, err: err}
+	}
+}
+
+type askResult struct {
+	data []byte
+	err  error
+}
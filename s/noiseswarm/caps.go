@@ -0,0 +1,153 @@
+package noiseswarm
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/framing"
+	"github.com/sirupsen/logrus"
+)
+
+// Capabilities is a set of optional features.
+// After a handshake each party sends the capabilities it has, and a feature is only used on the session
+// if both parties have it.
+type Capabilities uint64
+
+const (
+	// CapCompression is set by WithCompression.
+	// Frames are compressed with DEFLATE.
+	CapCompression = Capabilities(1 << iota)
+	// CapAddrs is set by WithOnPeerAddrs.
+	// The lower swarm addresses are only advertised to parties which use them.
+	CapAddrs
+	// CapResumption is set by WithResumption.
+	// Responders only issue tickets to initiators which can redeem them.
+	CapResumption
+)
+
+var capNames = []string{"compression", "addrs", "resumption"}
+
+// Has returns true if c contains every capability in x.
+func (c Capabilities) Has(x Capabilities) bool {
+	return c&x == x
+}
+
+func (c Capabilities) String() string {
+	var names []string
+	for i, name := range capNames {
+		if c.Has(1 << i) {
+			names = append(names, name)
+			c &^= 1 << i
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint64(c)))
+	}
+	return "{" + strings.Join(names, ",") + "}"
+}
+
+// localCaps returns the capabilities enabled by the swarm's options.
+func (s *Swarm) localCaps() Capabilities {
+	var c Capabilities
+	if s.compress {
+		c |= CapCompression
+	}
+	if s.onPeerAddrs != nil {
+		c |= CapAddrs
+	}
+	if s.issuer != nil {
+		c |= CapResumption
+	}
+	return c
+}
+
+// advertiseCaps sends the swarm's capabilities to the remote party of sess, once per session.
+// The initiator sends first after a handshake, since the responder is ready first,
+// and its capabilities could overtake its sig and be rejected.
+// The responder sends first after a resumption, see resumedCaps.
+// Either way, the other party replies with its own, see handleCaps.
+// Nothing is sent if the swarm has no capabilities, since nothing would be in common,
+// or if the remote party is from before frames, since it would take them as a tell.
+func (s *Swarm) advertiseCaps(sess *session) {
+	if !atomic.CompareAndSwapUint32(&sess.capsSent, 0, 1) {
+		return
+	}
+	s.sendCaps(sess)
+}
+
+// resumedCaps is called when a responder accepts a resumption ticket.
+// The resumption continues the inbound session, so the responder sends its capabilities again for the initiator's new session.
+func (s *Swarm) resumedCaps(sess *session) {
+	atomic.StoreUint32(&sess.capsSent, 1)
+	s.sendCaps(sess)
+}
+
+func (s *Swarm) sendCaps(sess *session) {
+	caps := s.localCaps()
+	if caps == 0 || !sess.isFramed() {
+		return
+	}
+	s.workers.Go(func() {
+		if err := sess.downward(s.ctx, newCapsFrame(caps)); err != nil {
+			logrus.Warn("noiseswarm: error advertising capabilities: ", err)
+		}
+	})
+}
+
+// handleCaps records the capabilities both parties of sess have, and starts using them.
+// Bits the swarm does not know are ignored, so parties can add capabilities without breaking older ones.
+func (s *Swarm) handleCaps(sess *session, body []byte) error {
+	remote, err := parseCapsFrame(body)
+	if err != nil {
+		return err
+	}
+	common := s.localCaps() & remote
+	atomic.StoreUint64(&sess.caps, uint64(common))
+	if sess.isInitiator() {
+		s.advertiseCaps(sess)
+	} else {
+		// the initiator only sends once per session, so this does not loop.
+		s.sendCaps(sess)
+	}
+	if common.Has(CapAddrs) {
+		s.advertiseAddrs(sess)
+	}
+	if common.Has(CapResumption) && !sess.isInitiator() {
+		s.sendTicket(sess)
+	}
+	return nil
+}
+
+// SessionCapabilities returns the capabilities in use on a ready session with addr, which are the ones both parties have.
+// There are none until the parties have exchanged their capabilities, shortly after the session becomes ready.
+// It returns false if there is no ready session with addr.
+// If there are sessions in both directions, either may be used.
+func (s *Swarm) SessionCapabilities(addr p2p.Addr) (Capabilities, bool) {
+	target := addr.(Addr)
+	sess := s.getAnyReadySession(target)
+	if sess == nil || sess.getRemotePeerID() != target.ID {
+		return 0, false
+	}
+	return sess.getCaps(), true
+}
+
+// getCaps returns the capabilities both parties have, or none until the remote party has sent them.
+func (s *session) getCaps() Capabilities {
+	return Capabilities(atomic.LoadUint64(&s.caps))
+}
+
+func newCapsFrame(c Capabilities) p2p.IOVec {
+	return p2p.IOVec{framing.AppendUvarint([]byte{frameCaps}, uint64(c))}
+}
+
+// parseCapsFrame parses the body of a caps frame.
+// Anything after the capabilities is ignored, so later versions can extend the frame.
+func parseCapsFrame(body []byte) (Capabilities, error) {
+	c, _, err := framing.ReadUvarint(body)
+	if err != nil {
+		return 0, err
+	}
+	return Capabilities(c), nil
+}
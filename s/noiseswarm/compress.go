@@ -0,0 +1,75 @@
+package noiseswarm
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/pkg/errors"
+)
+
+// frameCompressed is set in the frame type of a compressed frame.
+// Everything after the frame type is compressed, including the ask id.
+const frameCompressed = uint8(0x80)
+
+// compressFrame returns frame compressed, if both parties have CapCompression and compressing makes the frame smaller.
+// Otherwise frame is returned unchanged.
+func (s *session) compressFrame(frame p2p.IOVec) p2p.IOVec {
+	if !s.getCaps().Has(CapCompression) {
+		return frame
+	}
+	ptext := p2p.VecBytes(frame)
+	buf := bytes.Buffer{}
+	buf.WriteByte(ptext[0] | frameCompressed)
+	fw := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(fw)
+	fw.Reset(&buf)
+	if _, err := fw.Write(ptext[1:]); err != nil {
+		panic(err)
+	}
+	if err := fw.Close(); err != nil {
+		panic(err)
+	}
+	if buf.Len() >= len(ptext) {
+		return frame
+	}
+	return p2p.IOVec{buf.Bytes()}
+}
+
+// decompressFrame reverses compressFrame.
+// An error is returned if the frame decompresses to more than limit bytes.
+func decompressFrame(ptext []byte, limit int) ([]byte, error) {
+	fr := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(fr)
+	if err := fr.(flate.Resetter).Reset(bytes.NewReader(ptext[1:]), nil); err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	buf.WriteByte(ptext[0] &^ frameCompressed)
+	// the frame type counts towards limit, so a body of limit bytes is detected as too large.
+	if _, err := io.Copy(&buf, io.LimitReader(fr, int64(limit))); err != nil {
+		return nil, errors.Wrap(err, "decompressing frame")
+	}
+	if buf.Len() > limit {
+		return nil, errors.Errorf("compressed frame is larger than %d bytes", limit)
+	}
+	return buf.Bytes(), nil
+}
+
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		fw, err := flate.NewWriter(nil, flate.BestSpeed)
+		if err != nil {
+			panic(err)
+		}
+		return fw
+	},
+}
+
+var flateReaderPool = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
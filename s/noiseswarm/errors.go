@@ -3,6 +3,7 @@ package noiseswarm
 import (
 	"fmt"
 
+	"github.com/brendoncarroll/go-p2p"
 	"github.com/pkg/errors"
 )
 
@@ -32,6 +33,22 @@ func (err *ErrTransport) Error() string {
 	return fmt.Sprintf("message %d: %s", err.Num, err.Message)
 }
 
+// ErrMalformed is passed to the function set with WithOnMalformed when a message from the lower swarm is dropped.
+// Cause is the reason it was dropped.
+type ErrMalformed struct {
+	Src   p2p.Addr
+	Len   int
+	Cause error
+}
+
+func (err *ErrMalformed) Error() string {
+	return fmt.Sprintf("malformed message from %v (%d bytes): %s", err.Src, err.Len, err.Cause)
+}
+
+func (err *ErrMalformed) Unwrap() error {
+	return err.Cause
+}
+
 var (
 	// ErrSessionExpired is returned if the session is either too old or has sent too many messages.
 	ErrSessionExpired = errors.Errorf("session has expired")
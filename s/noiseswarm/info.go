@@ -0,0 +1,40 @@
+package noiseswarm
+
+import (
+	"fmt"
+	"time"
+)
+
+// ResumePattern is the HandshakeInfo.Pattern for sessions established from a resumption ticket
+const ResumePattern = "resume"
+
+// HandshakeInfo describes how a session was established
+type HandshakeInfo struct {
+	// Pattern is the name of the Noise handshake pattern including modifiers e.g. "NN", "XX" or "IKpsk2", or ResumePattern
+	Pattern string
+	// CipherSuite is the name of the Noise cipher suite e.g. "25519_ChaChaPoly_BLAKE2b"
+	CipherSuite string
+	// Initiator is true if the local party started the handshake
+	Initiator bool
+	// Resumed is true if the session was established from a resumption ticket, without a handshake
+	Resumed bool
+	// CompletedAt is the time the session became ready
+	CompletedAt time.Time
+}
+
+func newHandshakeInfo(pattern HandshakePattern, initiator, resumed, usedPSK bool, completedAt time.Time) HandshakeInfo {
+	info := HandshakeInfo{
+		Pattern:     pattern.String(),
+		CipherSuite: string(cipherSuite.Name()),
+		Initiator:   initiator,
+		Resumed:     resumed,
+		CompletedAt: completedAt,
+	}
+	switch {
+	case resumed:
+		info.Pattern = ResumePattern
+	case usedPSK:
+		info.Pattern += fmt.Sprintf("psk%d", pskPlacement)
+	}
+	return info
+}
@@ -0,0 +1,77 @@
+package noiseswarm
+
+import (
+	"sort"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+)
+
+var _ p2p.Inspector = &Swarm{}
+
+// SessionInfo describes one of the swarm's sessions, for debugging.
+type SessionInfo struct {
+	// LowerAddr is the address of the remote party in the lower swarm
+	LowerAddr string
+	Initiator bool
+	// State is "handshaking", "ready" or "errored"
+	State string
+	// Superseded is true if a session in the other direction is used instead, see WithSessionSelectPolicy.
+	Superseded bool
+	CreatedAt  time.Time
+	// LastActivity is the last time a message was sent or received, it is zero if there have been none.
+	LastActivity time.Time
+	// Error is the reason an errored session failed.
+	Error string `json:",omitempty"`
+
+	// The fields below are only set on ready sessions.
+
+	// PeerID is the remote party's id, formatted with the swarm's PeerIDScheme.
+	PeerID       string         `json:",omitempty"`
+	Handshake    *HandshakeInfo `json:",omitempty"`
+	Capabilities string         `json:",omitempty"`
+}
+
+// Sessions returns a SessionInfo for each session, including the ones which are still handshaking, ordered by creation time.
+func (s *Swarm) Sessions() []SessionInfo {
+	var sessions []*session
+	s.sessions.ForEach(func(_ sessionKey, sess *session) bool {
+		sessions = append(sessions, sess)
+		return true
+	})
+	infos := []SessionInfo{}
+	for _, sess := range sessions {
+		lowerAddr, _ := sess.getLowerRaddr().MarshalText()
+		info := SessionInfo{
+			LowerAddr:    string(lowerAddr),
+			Initiator:    sess.initiator,
+			State:        "handshaking",
+			Superseded:   sess.isSuperseded(),
+			CreatedAt:    sess.createdAt,
+			LastActivity: sess.lastActivity(),
+		}
+		switch {
+		case sess.isErrored():
+			info.State = "errored"
+			info.Error = sess.error().Error()
+		case sess.isReady():
+			info.State = "ready"
+			info.PeerID = string(s.peerIDScheme.Format(sess.getRemotePeerID()))
+			hi := sess.getHandshakeInfo()
+			info.Handshake = &hi
+			info.Capabilities = sess.getCaps().String()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.Before(infos[j].CreatedAt)
+	})
+	return infos
+}
+
+// Inspect implements p2p.Inspector, with the Sessions.
+func (s *Swarm) Inspect() map[string]interface{} {
+	return map[string]interface{}{
+		"sessions": s.Sessions(),
+	}
+}
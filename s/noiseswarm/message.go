@@ -13,9 +13,19 @@ const (
 	countSigRespToInit = uint32(3)
 	countPostHandshake = uint32(4)
 
+	// countResume is only sent by initiators redeeming a resumption ticket.
+	// Responders are the only ones to send countResp otherwise, so a party without resumption rejects it like any other unexpected handshake message.
+	countResume = countResp
+
 	countLastMessage = uint32(MaxSessionMessages)
 )
 
+// MaxHandshakeMessageSize is the largest handshake message which will be accepted.
+// The largest legitimate handshake message carries a public key and a signature, which is about 1KB for a 4096 bit RSA key,
+// so this is also small enough to fit in a typical lower swarm MTU without fragmentation.
+// Larger handshake messages are dropped before they reach the Noise state machine.
+const MaxHandshakeMessageSize = 4096
+
 type direction uint8
 
 const (
@@ -41,7 +51,11 @@ func parseMessage(x []byte) (message, error) {
 	if len(x) < 4 {
 		return nil, errors.Errorf("message too short")
 	}
-	return message(x), nil
+	m := message(x)
+	if m.getCounter() < countPostHandshake && len(x) > MaxHandshakeMessageSize {
+		return nil, errors.Errorf("handshake message too large: %d > %d", len(x), MaxHandshakeMessageSize)
+	}
+	return m, nil
 }
 
 func (m message) getDirection() direction {
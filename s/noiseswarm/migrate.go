@@ -0,0 +1,207 @@
+package noiseswarm
+
+import (
+	"bytes"
+	"crypto/rand"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ConnIDSize is the size of the connection id which follows the header of each message sent after the handshake,
+// when WithConnectionIDs is used.
+const ConnIDSize = 8
+
+// connID identifies a session independently of the lower addresses of its parties.
+type connID [ConnIDSize]byte
+
+// connKey is the key of a session in the table of connection ids.
+type connKey struct {
+	id        connID
+	initiator bool
+}
+
+// MaxPathChallenges is the most addresses a session waits for a path response from at once.
+const MaxPathChallenges = 4
+
+// pathNonceSize is the size of the nonce in the path challenge and response frames.
+const pathNonceSize = 8
+
+// pathNonce is sent in a path challenge to an address the session may move to.
+// A response with the same nonce from that address shows the remote party is there,
+// the nonce is encrypted, so a party which only forges the source address of messages can't know it.
+type pathNonce [pathNonceSize]byte
+
+// deriveConnID returns the connection id for a session with the key fingerprint fp.
+// Both parties derive the same id, without exchanging it, and it changes whenever the keys do.
+// Only the parties know the keys, so the id can't be predicted, but it is the same at every address the session moves to.
+func deriveConnID(fp []byte) connID {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	h.Write([]byte("p2p/noiseswarm/connection-id"))
+	h.Write(fp)
+	var id connID
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// carriesConnID returns true if a message with counter count has a connection id, when connection ids are used.
+// Only messages sent in the ready state have one, except for NACKs, which a party can send without a session.
+func carriesConnID(count uint32) bool {
+	return count >= countPostHandshake && count != countLastMessage
+}
+
+// insertConnID returns a copy of m with id between the header and the body.
+func insertConnID(m message, id connID) message {
+	out := make(message, 0, len(m)+ConnIDSize)
+	out = append(out, m[:4]...)
+	out = append(out, id[:]...)
+	return append(out, m[4:]...)
+}
+
+// splitConnID removes the connection id from m, and returns it along with the rest of the message.
+func splitConnID(m message) (connID, message, error) {
+	var id connID
+	if len(m) < 4+ConnIDSize {
+		return id, nil, errors.Errorf("message too short for connection id")
+	}
+	copy(id[:], m[4:])
+	out := make(message, 0, len(m)-ConnIDSize)
+	out = append(out, m[:4]...)
+	return id, append(out, m[4+ConnIDSize:]...), nil
+}
+
+// registerConn adds sess to the table of connection ids, once it is ready.
+func (s *Swarm) registerConn(sess *session) {
+	id, ok := sess.getConnID()
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[connKey{id: id, initiator: sess.initiator}] = sess
+}
+
+// getConn returns the session with a connection id, or nil if there isn't one.
+// Sessions which have been removed from the pool are removed from the table as well.
+func (s *Swarm) getConn(k connKey) *session {
+	s.mu.Lock()
+	sess := s.conns[k]
+	s.mu.Unlock()
+	if sess == nil {
+		return nil
+	}
+	if current := s.getSession(sess.getLowerRaddr(), sess.initiator); current != sess {
+		s.mu.Lock()
+		if s.conns[k] == sess {
+			delete(s.conns, k)
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	return sess
+}
+
+// moveSession moves sess in the pool from the key for prev to the key for next, after next answered a path challenge.
+// If there is already a ready session at next, it was established there, so sess is left where it is and false is returned.
+// A session which is still handshaking at next is replaced.
+func (s *Swarm) moveSession(sess *session, prev, next p2p.Addr) bool {
+	key := sessionKey{raddr: next.Key(), initiator: sess.initiator}
+	s.sessions.DeleteIf(key, func(x *session) bool {
+		return x != sess && !x.isReady()
+	})
+	if x, ok := s.sessions.Get(key); ok && x != sess {
+		logrus.WithFields(logrus.Fields{"from": prev, "to": next}).Debug("noiseswarm: not migrating session, address has one already")
+		return false
+	}
+	sess.setLowerRaddr(next)
+	s.deleteSession(prev, sess)
+	s.sessions.Put(key, sess)
+	logrus.WithFields(logrus.Fields{"from": prev, "to": next}).Debug("noiseswarm: session migrated")
+	return true
+}
+
+// cleanupConns removes the connection ids of sessions which are no longer in the pool.
+func (s *Swarm) cleanupConns() {
+	s.mu.Lock()
+	keys := make([]connKey, 0, len(s.conns))
+	for k := range s.conns {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+	for _, k := range keys {
+		s.getConn(k)
+	}
+}
+
+// challengePath returns the nonce to send in a path challenge to raddr, creating one if raddr has not been challenged.
+// The nonce is the same until raddr responds, so a lost challenge is resent with the next message from raddr.
+// If MaxPathChallenges addresses are waiting, an arbitrary one is replaced.
+// It must be called with mu.
+func (s *session) challengePath(raddr p2p.Addr) pathNonce {
+	if nonce, exists := s.pathChallenges[raddr.Key()]; exists {
+		return nonce
+	}
+	if s.pathChallenges == nil {
+		s.pathChallenges = make(map[string]pathNonce)
+	}
+	for k := range s.pathChallenges {
+		if len(s.pathChallenges) < MaxPathChallenges {
+			break
+		}
+		delete(s.pathChallenges, k)
+	}
+	var nonce pathNonce
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	s.pathChallenges[raddr.Key()] = nonce
+	return nonce
+}
+
+// validatePath returns true if body is the nonce of the path challenge sent to raddr.
+// The challenges are cleared once one is answered.
+func (s *session) validatePath(raddr p2p.Addr, body []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nonce, exists := s.pathChallenges[raddr.Key()]
+	if !exists || len(body) != pathNonceSize || !bytes.Equal(nonce[:], body) {
+		return false
+	}
+	s.pathChallenges = nil
+	return true
+}
+
+// newPathFrame returns a path challenge or response frame carrying nonce.
+func newPathFrame(frameType uint8, nonce []byte) p2p.IOVec {
+	return p2p.IOVec{append([]byte{frameType}, nonce...)}
+}
+
+// handlePathChallenge responds to a path challenge from raddr, sending the response back to raddr.
+func (s *Swarm) handlePathChallenge(sess *session, raddr p2p.Addr, body []byte) error {
+	if len(body) != pathNonceSize {
+		return errors.Errorf("path challenge is wrong size %d", len(body))
+	}
+	frame := newPathFrame(framePathResponse, body)
+	s.workers.Go(func() {
+		if err := sess.downwardTo(s.ctx, raddr, frame); err != nil {
+			logrus.Warn("noiseswarm: error sending path response: ", err)
+		}
+	})
+	return nil
+}
+
+// handlePathResponse moves sess to raddr, if the response matches the challenge sent there.
+func (s *Swarm) handlePathResponse(sess *session, raddr p2p.Addr, body []byte) error {
+	if !sess.validatePath(raddr, body) {
+		return nil
+	}
+	if prev := sess.getLowerRaddr(); prev.Key() != raddr.Key() {
+		s.moveSession(sess, prev, raddr)
+	}
+	return nil
+}
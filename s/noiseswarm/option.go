@@ -0,0 +1,200 @@
+package noiseswarm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/flynn/noise"
+	"github.com/jonboulle/clockwork"
+	"golang.org/x/crypto/curve25519"
+)
+
+type Option func(s *Swarm)
+
+// WithOnMalformed sets a function to be called whenever a message from src is dropped
+// because it could not be parsed, or because it caused a session to error.
+// err is an *ErrMalformed, with the size of the message and the reason it was dropped.
+func WithOnMalformed(fn func(src p2p.Addr, err error)) Option {
+	return func(s *Swarm) {
+		s.onMalformed = fn
+	}
+}
+
+// WithOnWire sets a function to be called with every message sent to and received from the lower swarm,
+// exactly as it is on the wire: after encryption when sending, and before decryption when receiving.
+// This includes handshake messages, and messages which are dropped because they are malformed.
+// It is meant for diagnosing failed handshakes, and is off by default.
+// data is not copied, so fn must not modify it, or retain it after returning.
+// fn is called from goroutines which Close waits for, so it must not call Close.
+func WithOnWire(fn func(dir WireDirection, lower p2p.Addr, data []byte)) Option {
+	return func(s *Swarm) {
+		s.onWire = fn
+	}
+}
+
+// WithOnPeerAddrs exchanges lower swarm addresses with peers after each handshake.
+// Each side sends the LocalAddrs of the lower swarm, and fn is called with the addresses the remote peer sent,
+// as Addrs with its PeerID. Addresses which the lower swarm cannot parse are left out.
+// Addresses are only exchanged if both peers use this option, see CapAddrs.
+// fn is called on the receive path, so it should not block.
+func WithOnPeerAddrs(fn func(id p2p.PeerID, addrs []p2p.Addr)) Option {
+	return func(s *Swarm) {
+		s.onPeerAddrs = fn
+	}
+}
+
+// WithResolver sets the resolver used by DialByID and TellByID to find the lower addresses of a peer.
+// p2p.AddrBook, p2p.StaticPeerResolver and kademlia.DHT are resolvers, and p2p.ChainPeerResolvers combines them.
+func WithResolver(r p2p.PeerResolver) Option {
+	return func(s *Swarm) {
+		s.resolver = r
+	}
+}
+
+// WithCompression compresses messages with DEFLATE before they are encrypted.
+// Messages are only compressed once both parties have advertised it, see CapCompression.
+// Messages which would not get smaller are sent uncompressed.
+// Compression can reveal information about the plaintext through the size of messages,
+// so it should not be used when secrets are mixed with data an attacker controls.
+func WithCompression() Option {
+	return func(s *Swarm) {
+		s.compress = true
+	}
+}
+
+// WithResumption enables session resumption.
+// After a handshake between parties which both use it, the responder issues the initiator a ticket valid for ttl,
+// which can be redeemed once to establish a new session without a handshake.
+// Tickets are bound to the public key of the peer they were issued to.
+// Tells sent on a resumed session before the responder has accepted the ticket will be lost if it is rejected.
+func WithResumption(ttl time.Duration) Option {
+	return func(s *Swarm) {
+		s.resumptionTTL = ttl
+	}
+}
+
+// WithConnectionIDs adds a connection id to each message sent after the handshake, and finds sessions by it before the lower address,
+// so a session survives the remote party's lower address changing, for example when a mobile device moves from WiFi to cellular.
+// When an authentic message, newer than the others received, arrives from a new address, a path challenge is sent there,
+// and the session moves once the response comes back from it, so a party which rewrites source addresses can't redirect the session.
+// Messages to the peer are sent to the old address until then. Sessions with parties from before frames never move.
+// Every peer the swarm talks to must use it as well, and it makes the MTU smaller by ConnIDSize.
+// The id does not change when the session moves, so an observer can link a party's addresses.
+func WithConnectionIDs() Option {
+	return func(s *Swarm) {
+		s.connIDs = true
+	}
+}
+
+// WithClock sets the clock used for session expiry, handshake timeouts, dial backoff and resumption tickets.
+// The default is the real clock.
+func WithClock(clock clockwork.Clock) Option {
+	return func(s *Swarm) {
+		s.clock = clock
+	}
+}
+
+// WithManualCleanup stops the swarm from starting a goroutine to clean up expired sessions.
+// The caller is responsible for calling Cleanup instead.
+func WithManualCleanup() Option {
+	return func(s *Swarm) {
+		s.manualCleanup = true
+	}
+}
+
+// WithIdentities adds more local identities to the swarm, in addition to the one passed to New.
+// LocalAddrs returns addresses for all of them, and received messages have a Dst with the identity they were sent to.
+// Peers which dial with WithPeerIDHint are responded to as the identity they dial,
+// otherwise inbound sessions use the default identity.
+// Outbound sessions use the default identity unless WithIdentitySelector is used.
+//
+// Sessions are identified by the lower address, so only one identity can be used in each direction with
+// a given lower address at a time.
+func WithIdentities(keys ...p2p.PrivateKey) Option {
+	return func(s *Swarm) {
+		s.moreKeys = append(s.moreKeys, keys...)
+	}
+}
+
+// WithPeerIDScheme sets the scheme used to derive PeerIDs from public keys, for the swarm's identities and its peers.
+// It defaults to p2p.DefaultPeerIDScheme, and every peer the swarm talks to must use the same scheme.
+// Addrs still encode the whole p2p.PeerID, including the zero bytes after the scheme's Len.
+func WithPeerIDScheme(scheme p2p.PeerIDScheme) Option {
+	return func(s *Swarm) {
+		s.peerIDScheme = scheme
+	}
+}
+
+// WithIdentitySelector sets a function to choose the local identity to use when sending to dst.
+// fn must return the PeerID of one of the swarm's identities, otherwise sending fails.
+// If an outbound session with dst exists using a different identity, it is replaced.
+func WithIdentitySelector(fn func(dst Addr) p2p.PeerID) Option {
+	return func(s *Swarm) {
+		s.selectIdentity = fn
+	}
+}
+
+// WithPeerIDHint includes the PeerID being dialed in the first handshake message,
+// so a responder with several identities can respond as the right one.
+// The hint is not encrypted, so it reveals which peer is being dialed to anyone who can see the message.
+// Responders without that identity, or which predate hints, ignore it.
+func WithPeerIDHint() Option {
+	return func(s *Swarm) {
+		s.sendHints = true
+	}
+}
+
+// WithHandshakePattern sets the handshake pattern used for sessions the swarm initiates.
+// PatternIK is only used with peers whose static key is known, and falls back to PatternXX otherwise.
+// Whatever the setting, PatternIK is used with peers whose static key was passed to Dial or learned from an earlier handshake.
+// The default is PatternNN.
+func WithHandshakePattern(p HandshakePattern) Option {
+	p.noisePattern() // panics if p is not a pattern
+	return func(s *Swarm) {
+		s.pattern = p
+	}
+}
+
+// WithSessionSelectPolicy sets how the swarm chooses between the outbound and inbound session with a peer,
+// when both are ready. The default is SelectRandom.
+func WithSessionSelectPolicy(p SessionSelectPolicy) Option {
+	_ = p.String() // panics if p is not a policy
+	return func(s *Swarm) {
+		s.selectPolicy = p
+	}
+}
+
+// WithStaticKey sets the private part of the swarm's Noise static key, which is used by the XX and IK patterns.
+// A fixed static key allows peers to use IK with the swarm after it restarts.
+// By default a new key is generated for each swarm.
+// privateKey must be 32 bytes.
+func WithStaticKey(privateKey []byte) Option {
+	if len(privateKey) != StaticKeySize {
+		panic(fmt.Sprintf("static key must be %d bytes, got %d", StaticKeySize, len(privateKey)))
+	}
+	public, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+	key := noise.DHKey{
+		Private: append([]byte{}, privateKey...),
+		Public:  public,
+	}
+	return func(s *Swarm) {
+		s.staticKey = key
+	}
+}
+
+// WithPSK mixes a pre-shared key into every handshake.
+// Only parties with the same psk can complete a handshake with one another.
+// psk must be 32 bytes.
+func WithPSK(psk []byte) Option {
+	if len(psk) != PSKSize {
+		panic(fmt.Sprintf("psk must be %d bytes, got %d", PSKSize, len(psk)))
+	}
+	psk = append([]byte{}, psk...)
+	return func(s *Swarm) {
+		s.psk = psk
+	}
+}
@@ -0,0 +1,99 @@
+package noiseswarm
+
+import (
+	"bytes"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/flynn/noise"
+)
+
+// HandshakePattern is a Noise handshake pattern which can be used to establish sessions.
+// Whatever the pattern, the parties prove their identities after the handshake by signing the channel binding.
+// Responders accept every pattern, the initiator chooses one.
+type HandshakePattern uint8
+
+const (
+	// PatternNN only exchanges ephemeral keys.
+	// It is the default, and takes 2 messages.
+	PatternNN = HandshakePattern(iota)
+	// PatternXX also exchanges static keys, and takes 3 messages.
+	// The initiator learns the responder's static key, so later sessions with it can use IK.
+	PatternXX
+	// PatternIK requires the initiator to know the responder's static key beforehand, and takes 2 messages.
+	// The initiator's static key and the rest of the init message are encrypted to the responder's static key.
+	// It is used whenever the responder's static key is known, see Swarm.Dial.
+	PatternIK
+)
+
+func (p HandshakePattern) String() string {
+	return p.noisePattern().Name
+}
+
+func (p HandshakePattern) noisePattern() noise.HandshakePattern {
+	switch p {
+	case PatternNN:
+		return noise.HandshakeNN
+	case PatternXX:
+		return noise.HandshakeXX
+	case PatternIK:
+		return noise.HandshakeIK
+	default:
+		panic(p)
+	}
+}
+
+// StaticKeySize is the size of the Noise static public keys used by the XX and IK patterns.
+const StaticKeySize = 32
+
+// ikMinInitSize is the smallest an IK init message can be: an ephemeral key,
+// an encrypted static key, and an encrypted payload, which is at least a tag.
+const ikMinInitSize = StaticKeySize + (StaticKeySize + 16) + 16
+
+// markerXX is appended to the init payload by an XX initiator.
+// The first message of XX is the same as NN, so this is how the responder tells them apart.
+const markerXX = 0x58
+
+// markerFrames is sent in the init payload by every initiator, and in the resp payload by a responder which saw it.
+// Plaintexts start with a frame type only once both parties have sent it, since parties before frames take the
+// whole plaintext as a tell, and ignore handshake payloads.
+const markerFrames = 0x46
+
+// makeInitPayload returns the payload of an init message.
+// It is the optional PeerID hint, followed by markerFrames, and markerXX if the pattern is XX.
+// Responders before hints and patterns ignore the payload.
+func makeInitPayload(hint []byte, pattern HandshakePattern) []byte {
+	payload := append(append([]byte{}, hint...), markerFrames)
+	if pattern == PatternXX {
+		payload = append(payload, markerXX)
+	}
+	return payload
+}
+
+// parseInitPayload is the inverse of makeInitPayload.
+// Payloads shorter than a PeerID have no hint, and unknown markers are ignored.
+func parseInitPayload(x []byte) (hint []byte, isXX, framed bool) {
+	if len(x) >= len(p2p.PeerID{}) {
+		hint, x = x[:len(p2p.PeerID{})], x[len(p2p.PeerID{}):]
+	}
+	for _, m := range x {
+		switch m {
+		case markerXX:
+			isXX = true
+		case markerFrames:
+			framed = true
+		}
+	}
+	return hint, isXX, framed
+}
+
+// makeRespPayload returns the payload of a resp message, which has markerFrames if the init did.
+func makeRespPayload(framed bool) []byte {
+	if !framed {
+		return nil
+	}
+	return []byte{markerFrames}
+}
+
+func parseRespPayload(x []byte) (framed bool) {
+	return bytes.IndexByte(x, markerFrames) >= 0
+}
@@ -0,0 +1,226 @@
+package noiseswarm
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/flynn/noise"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	pskSize         = 32
+	resumeNonceSize = 32
+)
+
+var (
+	// ErrTicketExpired is returned when redeeming a ticket after its expiration
+	ErrTicketExpired = errors.Errorf("resumption ticket has expired")
+	// ErrTicketRedeemed is returned when redeeming a ticket which has already been used
+	ErrTicketRedeemed = errors.Errorf("resumption ticket has already been redeemed")
+	// ErrTicketInvalid is returned when a ticket could not be opened
+	ErrTicketInvalid = errors.Errorf("resumption ticket is invalid")
+)
+
+// ticket is held by an initiator, and can be used once to resume a session
+// with the responder which issued it.
+type ticket struct {
+	sealed          []byte
+	psk             [pskSize]byte
+	expiresAt       time.Time
+	remotePublicKey p2p.PublicKey
+	// localID is the identity the ticket was issued to
+	localID p2p.PeerID
+}
+
+// marshalTicket encodes an expiration, psk and the remaining data.
+// It is used for both the ticket sent to the initiator, and the contents of the sealed ticket.
+func marshalTicket(expiresAt time.Time, psk [pskSize]byte, rest []byte) []byte {
+	buf := make([]byte, 8+pskSize, 8+pskSize+len(rest))
+	binary.BigEndian.PutUint64(buf[:8], uint64(expiresAt.Unix()))
+	copy(buf[8:], psk[:])
+	return append(buf, rest...)
+}
+
+func parseTicket(x []byte) (expiresAt time.Time, psk [pskSize]byte, rest []byte, err error) {
+	if len(x) < 8+pskSize {
+		return time.Time{}, psk, nil, errors.Errorf("ticket too short")
+	}
+	expiresAt = time.Unix(int64(binary.BigEndian.Uint64(x[:8])), 0)
+	copy(psk[:], x[8:8+pskSize])
+	return expiresAt, psk, x[8+pskSize:], nil
+}
+
+// ticketIssuer issues and redeems tickets on the responder side.
+// Tickets are sealed with a key which never leaves the issuer, and can only be redeemed once.
+type ticketIssuer struct {
+	aead  cipher.AEAD
+	ttl   time.Duration
+	clock clockwork.Clock
+
+	mu       sync.Mutex
+	redeemed map[string]time.Time
+}
+
+func newTicketIssuer(ttl time.Duration, clock clockwork.Clock) *ticketIssuer {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		panic(err)
+	}
+	return &ticketIssuer{
+		aead:     aead,
+		ttl:      ttl,
+		clock:    clock,
+		redeemed: make(map[string]time.Time),
+	}
+}
+
+// issue creates a ticket for the peer with publicKey, to resume a session with the local identity localID.
+// It returns the ticket message to send to the peer.
+func (ti *ticketIssuer) issue(localID p2p.PeerID, publicKey p2p.PublicKey, now time.Time) ([]byte, error) {
+	var psk [pskSize]byte
+	if _, err := rand.Read(psk[:]); err != nil {
+		return nil, err
+	}
+	expiresAt := now.Add(ti.ttl)
+	ptext := marshalTicket(expiresAt, psk, append(localID[:], p2p.MarshalPublicKey(publicKey)...))
+	nonce := make([]byte, ti.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := ti.aead.Seal(nonce, nonce, ptext, nil)
+	return marshalTicket(expiresAt, psk, sealed), nil
+}
+
+// redeem opens a sealed ticket, and returns the psk, local identity and public key it was issued with.
+// Each ticket can only be redeemed once.
+func (ti *ticketIssuer) redeem(sealed []byte, now time.Time) (psk [pskSize]byte, localID p2p.PeerID, publicKey p2p.PublicKey, err error) {
+	n := ti.aead.NonceSize()
+	if len(sealed) < n {
+		return psk, localID, nil, ErrTicketInvalid
+	}
+	ptext, err := ti.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return psk, localID, nil, ErrTicketInvalid
+	}
+	expiresAt, psk, rest, err := parseTicket(ptext)
+	if err != nil || len(rest) < len(localID) {
+		return psk, localID, nil, ErrTicketInvalid
+	}
+	if !now.Before(expiresAt) {
+		return psk, localID, nil, ErrTicketExpired
+	}
+	copy(localID[:], rest)
+	publicKey, err = p2p.ParsePublicKey(rest[len(localID):])
+	if err != nil {
+		return psk, localID, nil, ErrTicketInvalid
+	}
+	id := string(sealed[:n])
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if _, exists := ti.redeemed[id]; exists {
+		return psk, localID, nil, ErrTicketRedeemed
+	}
+	ti.redeemed[id] = expiresAt
+	return psk, localID, publicKey, nil
+}
+
+// cleanup forgets redeemed tickets which have expired, since they can no longer be redeemed anyway.
+func (ti *ticketIssuer) cleanup(now time.Time) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for id, expiresAt := range ti.redeemed {
+		if !now.Before(expiresAt) {
+			delete(ti.redeemed, id)
+		}
+	}
+}
+
+// sendTicket issues the initiator of sess a ticket to resume the session with the identity it reached.
+// It is only called once the initiator has said it has CapResumption, so tickets are not sent to parties which can't redeem them.
+// Failing to issue a ticket does not affect the session.
+func (s *Swarm) sendTicket(sess *session) {
+	ticketMsg, err := s.issuer.issue(sess.getLocalID(), sess.getRemotePublicKey(), s.clock.Now())
+	if err != nil {
+		logrus.Warn("noiseswarm: error issuing ticket: ", err)
+		return
+	}
+	s.workers.Go(func() {
+		if err := sess.downward(s.ctx, p2p.IOVec{[]byte{frameTicket}, ticketMsg}); err != nil {
+			logrus.Warn("noiseswarm: error sending ticket: ", err)
+		}
+	})
+}
+
+// handleTicket stores a ticket from the responder of sess, which can be redeemed once to resume the session as the same identity.
+func (s *Swarm) handleTicket(sess *session, body []byte) error {
+	if s.issuer == nil || !sess.isInitiator() {
+		return errors.Errorf("unexpected resumption ticket")
+	}
+	expiresAt, psk, sealed, err := parseTicket(body)
+	if err != nil {
+		return err
+	}
+	s.putTicket(sess.getLowerRaddr(), &ticket{
+		sealed:          append([]byte{}, sealed...),
+		psk:             psk,
+		expiresAt:       expiresAt,
+		remotePublicKey: sess.getRemotePublicKey(),
+		localID:         sess.getLocalID(),
+	})
+	return nil
+}
+
+// newResumeMessage creates the message an initiator sends to resume a session using t.
+// It returns the message and the nonce used to derive the session keys.
+func newResumeMessage(t *ticket) (message, [resumeNonceSize]byte) {
+	var nonce [resumeNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	msg := newMessage(directionInitToResp, countResume)
+	msg = append(msg, nonce[:]...)
+	msg = append(msg, t.sealed...)
+	return msg, nonce
+}
+
+func parseResumeMessage(body []byte) (nonce [resumeNonceSize]byte, sealed []byte, err error) {
+	if len(body) < resumeNonceSize {
+		return nonce, nil, errors.Errorf("resume message too short")
+	}
+	copy(nonce[:], body[:resumeNonceSize])
+	return nonce, body[resumeNonceSize:], nil
+}
+
+// deriveResumeCiphers derives a cipher for each direction of a resumed session.
+func deriveResumeCiphers(initiator bool, psk [pskSize]byte, nonce [resumeNonceSize]byte) (outCS, inCS noise.Cipher) {
+	deriveKey := func(label string) [32]byte {
+		h, err := blake2b.New256(psk[:])
+		if err != nil {
+			panic(err)
+		}
+		h.Write([]byte(label))
+		h.Write(nonce[:])
+		var k [32]byte
+		copy(k[:], h.Sum(nil))
+		return k
+	}
+	i2r := noise.CipherChaChaPoly.Cipher(deriveKey("p2p/noiseswarm/resume/init-to-resp"))
+	r2i := noise.CipherChaChaPoly.Cipher(deriveKey("p2p/noiseswarm/resume/resp-to-init"))
+	if initiator {
+		return i2r, r2i
+	}
+	return r2i, i2r
+}
@@ -0,0 +1,74 @@
+package noiseswarm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTicketIssuer(t *testing.T) {
+	now := time.Now()
+	pubKey := p2ptest.NewTestKey(t, 0).Public()
+	localID := p2p.NewPeerID(p2ptest.NewTestKey(t, 1).Public())
+	ti := newTicketIssuer(time.Minute, clockwork.NewRealClock())
+	issue := func() *ticket {
+		ticketMsg, err := ti.issue(localID, pubKey, now)
+		require.NoError(t, err)
+		expiresAt, psk, sealed, err := parseTicket(ticketMsg)
+		require.NoError(t, err)
+		return &ticket{sealed: sealed, psk: psk, expiresAt: expiresAt}
+	}
+
+	tk := issue()
+	psk, actualID, actualKey, err := ti.redeem(tk.sealed, now)
+	require.NoError(t, err)
+	require.Equal(t, tk.psk, psk)
+	require.Equal(t, localID, actualID)
+	require.Equal(t, pubKey, actualKey)
+
+	_, _, _, err = ti.redeem(tk.sealed, now)
+	require.Equal(t, ErrTicketRedeemed, err)
+
+	_, _, _, err = ti.redeem(issue().sealed, now.Add(time.Minute))
+	require.Equal(t, ErrTicketExpired, err)
+
+	forged := issue()
+	forged.sealed[len(forged.sealed)-1] ^= 1
+	_, _, _, err = ti.redeem(forged.sealed, now)
+	require.Equal(t, ErrTicketInvalid, err)
+
+	// tickets from another issuer are invalid
+	_, _, _, err = newTicketIssuer(time.Minute, clockwork.NewRealClock()).redeem(issue().sealed, now)
+	require.Equal(t, ErrTicketInvalid, err)
+
+	ti.cleanup(now.Add(time.Minute))
+	require.Len(t, ti.redeemed, 0)
+}
+
+func TestDeriveResumeCiphers(t *testing.T) {
+	tk := &ticket{}
+	msg, nonce := newResumeMessage(tk)
+	parsedNonce, _, err := parseResumeMessage(msg.getBody())
+	require.NoError(t, err)
+	require.Equal(t, nonce, parsedNonce)
+
+	iOut, iIn := deriveResumeCiphers(true, tk.psk, nonce)
+	rOut, rIn := deriveResumeCiphers(false, tk.psk, parsedNonce)
+	ctext := encryptMessage(iOut, countPostHandshake, nil)
+	_, err = decryptMessage(rIn, countPostHandshake, ctext[4:])
+	require.NoError(t, err)
+	ctext = encryptMessage(rOut, countPostHandshake, nil)
+	_, err = decryptMessage(iIn, countPostHandshake, ctext[4:])
+	require.NoError(t, err)
+
+	// both parties have the same key fingerprint, and each resumption changes it
+	fp := newReadyState(iOut, iIn, nil, true).keyFingerprint(true)
+	require.Equal(t, fp, newReadyState(rOut, rIn, nil, true).keyFingerprint(false))
+	_, nonce2 := newResumeMessage(tk)
+	iOut2, iIn2 := deriveResumeCiphers(true, tk.psk, nonce2)
+	require.NotEqual(t, fp, newReadyState(iOut2, iIn2, nil, true).keyFingerprint(true))
+}
@@ -0,0 +1,88 @@
+package noiseswarm
+
+import (
+	"bytes"
+	"fmt"
+	mrand "math/rand"
+
+	"github.com/brendoncarroll/go-p2p"
+)
+
+// supersededTimeout is how long a superseded session must be idle before it is removed.
+// The remote party may still be using it until it has also unified its sessions, and asks sent on it may still be waiting for a response.
+const supersededTimeout = AskTimeout
+
+// SessionSelectPolicy chooses between the outbound and inbound session with a lower address, when both are ready.
+// Sessions in both directions between the same parties, from simultaneous dials, are unified instead, see unifySessions,
+// so the policy applies to sessions with different parties, such as when one of the parties uses another identity,
+// and to the moment before both sessions are ready.
+type SessionSelectPolicy uint8
+
+const (
+	// SelectRandom chooses either session at random, which spreads messages over both.
+	// It is the default.
+	SelectRandom = SessionSelectPolicy(iota)
+	// SelectPreferOutbound always chooses the outbound session.
+	SelectPreferOutbound
+	// SelectPreferMostRecent chooses the session which most recently sent or received a message.
+	// Ties go to the outbound session.
+	SelectPreferMostRecent
+)
+
+func (p SessionSelectPolicy) String() string {
+	switch p {
+	case SelectRandom:
+		return "Random"
+	case SelectPreferOutbound:
+		return "PreferOutbound"
+	case SelectPreferMostRecent:
+		return "PreferMostRecent"
+	default:
+		panic(fmt.Sprintf("unknown SessionSelectPolicy %d", uint8(p)))
+	}
+}
+
+// choose returns one of out and in, either of which may be nil.
+func (p SessionSelectPolicy) choose(out, in *session) *session {
+	if out == nil {
+		return in
+	}
+	if in == nil {
+		return out
+	}
+	switch p {
+	case SelectPreferOutbound:
+		return out
+	case SelectPreferMostRecent:
+		if in.lastActivity().After(out.lastActivity()) {
+			return in
+		}
+		return out
+	default:
+		if mrand.Intn(2) == 0 {
+			return in
+		}
+		return out
+	}
+}
+
+// unifySessions resolves simultaneous dials, where there are ready sessions in both directions with lowerRaddr between the same parties.
+// Both parties choose the session initiated by the party with the lower PeerID, and supersede the other,
+// so they converge on a single session without having to coordinate.
+// The superseded session still receives until it has been idle for supersededTimeout, in case the remote party sent on it before converging.
+func (s *Swarm) unifySessions(lowerRaddr p2p.Addr) {
+	outSess, inSess := s.getSession(lowerRaddr, true), s.getSession(lowerRaddr, false)
+	if outSess == nil || inSess == nil || !outSess.isReady() || !inSess.isReady() {
+		return
+	}
+	localID, remoteID := outSess.getLocalID(), outSess.getRemotePeerID()
+	if inSess.getLocalID() != localID || inSess.getRemotePeerID() != remoteID {
+		return
+	}
+	switch bytes.Compare(localID[:], remoteID[:]) {
+	case -1:
+		inSess.supersede()
+	case 1:
+		outSess.supersede()
+	}
+}
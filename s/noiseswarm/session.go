@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/brendoncarroll/go-p2p"
+	"github.com/flynn/noise"
+	"github.com/jonboulle/clockwork"
 )
 
 const (
@@ -21,37 +23,108 @@ const (
 	SigPurpose = "p2p/noiseswarm/channel"
 )
 
-type session struct {
-	createdAt  time.Time
-	initiator  bool
+// sessionParams are the parameters for a session
+type sessionParams struct {
+	// privateKey is the local identity for an initiator, and the default identity for a responder.
 	privateKey p2p.PrivateKey
-	send       func(context.Context, []byte) error
+	// peerIDScheme derives the PeerIDs of both parties.
+	peerIDScheme p2p.PeerIDScheme
+	// identities returns the key for one of the swarm's identities, or nil.
+	// It is used by a responder to choose which identity to respond as.
+	identities func(p2p.PeerID) p2p.PrivateKey
+	// hint is sent by an initiator in the init message, if it is not nil.
+	// It is the PeerID being dialed.
+	hint []byte
+	// pattern is the handshake pattern used by an initiator.
+	pattern HandshakePattern
+	// staticKey is the swarm's Noise static key, used by the XX and IK patterns.
+	staticKey noise.DHKey
+	// remoteStatic is the responder's static key, which an IK initiator must know.
+	remoteStatic []byte
+	clock        clockwork.Clock
+	// psk is the pre-shared key mixed into the handshake, it may be empty
+	psk []byte
+	// issuer is only used if resumption is enabled, and may be nil otherwise.
+	issuer *ticketIssuer
+	// connIDs is set by WithConnectionIDs
+	connIDs bool
+}
+
+type session struct {
+	// caps holds the Capabilities both parties have, it is first so it is aligned for atomic access.
+	caps uint64
+
+	createdAt time.Time
+	initiator bool
+	params    sessionParams
+	// send sends a message to a lower address.
+	send func(context.Context, p2p.Addr, []byte) error
 
-	mu       sync.Mutex
-	lastRecv time.Time
-	state    state
+	mu sync.Mutex
+	// lowerRaddr is the remote party's address, it only changes if the session migrates, see WithConnectionIDs.
+	lowerRaddr p2p.Addr
+	// connID is set once the session is ready, if hasConnID is true.
+	connID    connID
+	hasConnID bool
+	// maxInCount is the highest counter of a message received with a connection id,
+	// the session only challenges a new address for messages newer than it.
+	maxInCount uint32
+	// pathChallenges holds the nonces sent to addresses the session may move to, by address key.
+	pathChallenges map[string]pathNonce
+	lastRecv       time.Time
+	lastSend       time.Time
+	localID        p2p.PeerID
+	pattern        HandshakePattern
+	// remoteStatic is the remote party's Noise static key, if the pattern exchanged one.
+	remoteStatic []byte
+	// framed is set if both parties start plaintexts with a frame type, see markerFrames.
+	framed bool
+	state  state
+	// superseded is set when a session in the other direction with the same parties is used instead, see unifySessions.
+	superseded bool
 	// handshake
 	remotePublicKey p2p.PublicKey
+	info            HandshakeInfo
 	handshakeDone   chan struct{}
+
+	// addrsSent is 1 once the local addresses have been advertised on the session
+	addrsSent uint32
+	// capsSent is 1 once the local capabilities have been advertised on the session
+	capsSent uint32
+
+	// asks
+	lastAskID   uint32
+	askMu       sync.Mutex
+	pendingAsks map[uint32]chan askResult
+	// acks, see TellAck
+	lastAckID   uint32
+	pendingAcks map[uint32]chan struct{}
 }
 
-func newSession(initiator bool, privateKey p2p.PrivateKey, send func(context.Context, []byte) error) *session {
+// newSession creates a session with lowerRaddr in the initial state for initiator.
+func newSession(lowerRaddr p2p.Addr, initiator bool, params sessionParams, send func(context.Context, p2p.Addr, []byte) error) *session {
 	var initialState state
 	if initiator {
-		initialState = newAwaitRespState(privateKey)
+		initialState = newAwaitRespState(params)
 	} else {
-		initialState = newAwaitInitState(privateKey)
+		initialState = newAwaitInitState(params)
 	}
-	now := time.Now()
+	now := params.clock.Now()
 	return &session{
 		createdAt:  now,
+		lowerRaddr: lowerRaddr,
 		lastRecv:   now,
-		privateKey: privateKey,
+		lastSend:   now,
+		localID:    params.peerIDScheme.Derive(params.privateKey.Public()),
+		pattern:    params.pattern,
 		initiator:  initiator,
+		params:     params,
 		send:       send,
 
 		state:         initialState,
 		handshakeDone: make(chan struct{}),
+		pendingAsks:   make(map[uint32]chan askResult),
+		pendingAcks:   make(map[uint32]chan struct{}),
 	}
 }
 
@@ -63,15 +136,38 @@ func (s *session) startHandshake(ctx context.Context) error {
 		return nil
 	}
 	msg := newMessage(s.outDirection(), countInit)
-	out, _, _, err := st.hsstate.WriteMessage(msg, nil)
+	out, _, _, err := st.hsstate.WriteMessage(msg, makeInitPayload(s.params.hint, s.pattern))
 	if err != nil {
 		panic(err)
 	}
+	raddr := s.lowerRaddr
+	s.mu.Unlock()
+	return s.send(ctx, raddr, out)
+}
+
+// resume uses t to move straight to the ready state, without performing a handshake.
+// The resume message is sent after the session is ready, so it is safe to tell on the session immediately.
+func (s *session) resume(ctx context.Context, t *ticket) error {
+	s.mu.Lock()
+	if _, ok := s.state.(*awaitRespState); !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	msg, nonce := newResumeMessage(t)
+	outCS, inCS := deriveResumeCiphers(true, t.psk, nonce)
+	s.framed = true
+	s.changeState(newReadyState(outCS, inCS, t.remotePublicKey, true))
+	raddr := s.lowerRaddr
 	s.mu.Unlock()
-	return s.send(ctx, out)
+	msg.setDirection(s.outDirection())
+	return s.send(ctx, raddr, msg)
 }
 
-func (s *session) upward(ctx context.Context, in []byte) (up []byte, err error) {
+// upward handles a message from src, which is the session's lower address unless the session was found by its connection id.
+// If the message is authentic and newer than the others received, a path challenge is sent to src,
+// and the session moves there once src responds, see handlePathResponse.
+// Messages from other addresses which fail are not responded to, so they can't end the session.
+func (s *session) upward(ctx context.Context, src p2p.Addr, in []byte) (up []byte, err error) {
 	msg, err := parseMessage(in)
 	if err != nil {
 		return nil, err
@@ -81,31 +177,78 @@ func (s *session) upward(ctx context.Context, in []byte) (up []byte, err error)
 	}
 	s.mu.Lock()
 	res := s.state.upward(msg)
+	var challenge *pathNonce
+	if count := msg.getCounter(); s.hasConnID && carriesConnID(count) {
+		moved := src.Key() != s.lowerRaddr.Key()
+		switch {
+		case res.Err != nil && moved:
+			res.Resps = nil
+		case res.Err == nil && count > s.maxInCount:
+			s.maxInCount = count
+			// the challenge is a frame, so sessions without them never move.
+			if moved && s.framed {
+				nonce := s.challengePath(src)
+				challenge = &nonce
+			}
+		}
+	}
+	if res.LocalKey != nil {
+		s.localID = s.params.peerIDScheme.Derive(res.LocalKey.Public())
+	}
+	if res.Pattern != nil {
+		s.pattern = *res.Pattern
+	}
+	if res.RemoteStatic != nil {
+		s.remoteStatic = append([]byte{}, res.RemoteStatic...)
+	}
+	if res.Framed {
+		s.framed = true
+	}
 	s.changeState(res.Next)
-	s.lastRecv = time.Now()
+	s.lastRecv = s.params.clock.Now()
+	raddr := s.lowerRaddr
 	s.mu.Unlock()
 	for _, resp := range res.Resps {
 		resp.setDirection(s.outDirection())
-		if err := s.send(ctx, resp); err != nil {
+		if err := s.send(ctx, raddr, resp); err != nil {
 			return nil, err
 		}
 	}
+	if challenge != nil {
+		// if the challenge is lost, it is sent again with the next message from src.
+		s.downwardTo(ctx, src, newPathFrame(framePathChallenge, challenge[:]))
+	}
 	if res.Err != nil {
 		return nil, res.Err
 	}
 	return res.Up, nil
 }
 
-func (s *session) downward(ctx context.Context, in []byte) error {
+func (s *session) downward(ctx context.Context, in p2p.IOVec) error {
+	return s.downwardTo(ctx, nil, in)
+}
+
+// downwardTo is like downward, but sends to raddr instead of the session's lower address, unless it is nil.
+func (s *session) downwardTo(ctx context.Context, raddr p2p.Addr, in p2p.IOVec) error {
 	s.mu.Lock()
 	res := s.state.downward(in)
 	s.changeState(res.Next)
+	if res.Err == nil {
+		s.lastSend = s.params.clock.Now()
+	}
+	id, hasConnID := s.connID, s.hasConnID
+	if raddr == nil {
+		raddr = s.lowerRaddr
+	}
 	s.mu.Unlock()
 	if res.Err != nil {
 		return res.Err
 	}
 	res.Down.setDirection(s.outDirection())
-	return s.send(ctx, res.Down)
+	if hasConnID {
+		res.Down = insertConnID(res.Down, id)
+	}
+	return s.send(ctx, raddr, res.Down)
 }
 
 func (s *session) changeState(next state) {
@@ -116,7 +259,7 @@ func (s *session) changeState(next state) {
 	if prev != next && isChanOpen(s.handshakeDone) {
 		switch x := next.(type) {
 		case *readyState:
-			s.completeHandshake(x.remotePublicKey)
+			s.completeHandshake(x)
 		case *endState:
 			s.failHandshake()
 		}
@@ -125,20 +268,26 @@ func (s *session) changeState(next state) {
 }
 
 // tell waits for the handshake to complete if it hasn't and then sends data over fn
-func (s *session) tell(ctx context.Context, ptext []byte) error {
+func (s *session) tell(ctx context.Context, ptext p2p.IOVec) error {
 	if err := s.waitReady(ctx); err != nil {
 		return err
 	}
-	return s.downward(ctx, ptext)
+	return s.downward(ctx, s.compressFrame(ptext))
 }
 
 // completeHandshake must be called with mu
-func (s *session) completeHandshake(remotePublicKey p2p.PublicKey) {
-	if remotePublicKey == nil {
-		panic(remotePublicKey)
+func (s *session) completeHandshake(x *readyState) {
+	if x.remotePublicKey == nil {
+		panic(x.remotePublicKey)
+	}
+	now := s.params.clock.Now()
+	s.remotePublicKey = x.remotePublicKey
+	s.lastRecv = now
+	s.info = newHandshakeInfo(s.pattern, s.initiator, x.resumed, len(s.params.psk) > 0, now)
+	if s.params.connIDs {
+		s.connID = deriveConnID(x.keyFingerprint(s.initiator))
+		s.hasConnID = true
 	}
-	s.remotePublicKey = remotePublicKey
-	s.lastRecv = time.Now()
 	close(s.handshakeDone)
 }
 
@@ -152,14 +301,19 @@ func (s *session) waitReady(ctx context.Context) error {
 	if !isChanOpen(s.handshakeDone) {
 		return s.error()
 	}
-	ctx, cf := context.WithTimeout(ctx, HandshakeTimeout)
-	defer cf()
+	timer := s.params.clock.NewTimer(HandshakeTimeout)
+	defer timer.Stop()
 	select {
 	case <-ctx.Done():
 		return &ErrHandshake{
 			Message: "timed out waiting for handshake to complete",
 			Cause:   ctx.Err(),
 		}
+	case <-timer.Chan():
+		return &ErrHandshake{
+			Message: "timed out waiting for handshake to complete",
+			Cause:   context.DeadlineExceeded,
+		}
 	case <-s.handshakeDone:
 		return s.error()
 	}
@@ -183,9 +337,48 @@ func (s *session) isExpired(now time.Time) bool {
 	defer s.mu.Unlock()
 	sessionAge := now.Sub(s.createdAt)
 	recvAge := now.Sub(s.lastRecv)
+	if s.superseded && now.Sub(s.lastSend) > supersededTimeout && recvAge > supersededTimeout {
+		return true
+	}
 	return sessionAge > MaxSessionLife || recvAge > SessionIdleTimeout
 }
 
+// supersede stops the session from being chosen for sending.
+// It is removed once it has been idle for supersededTimeout.
+func (s *session) supersede() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.superseded = true
+}
+
+func (s *session) isSuperseded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.superseded
+}
+
+// lastActivity returns the last time a message was sent or received on the session
+func (s *session) lastActivity() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastSend.After(s.lastRecv) {
+		return s.lastSend
+	}
+	return s.lastRecv
+}
+
+// acceptsInit returns true if the session would handle a message with the init counter as part of its handshake.
+func (s *session) acceptsInit() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.state.(type) {
+	case *awaitInitState, *awaitFinishState:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *session) isErrored() bool {
 	return s.error() != nil
 }
@@ -195,7 +388,40 @@ func (s *session) isInitiator() bool {
 }
 
 func (s *session) getRemotePeerID() p2p.PeerID {
-	return p2p.NewPeerID(s.getRemotePublicKey())
+	return s.params.peerIDScheme.Derive(s.getRemotePublicKey())
+}
+
+// getRemoteStatic returns the remote party's Noise static key, or nil if the handshake did not exchange one.
+func (s *session) getRemoteStatic() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remoteStatic
+}
+
+// getLocalID returns the local identity used for the session.
+// For a responder this is only known once the init message has been received.
+func (s *session) getLocalID() p2p.PeerID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.localID
+}
+
+func (s *session) getHandshakeInfo() HandshakeInfo {
+	if isChanOpen(s.handshakeDone) {
+		panic("getHandshakeInfo called before handshake has completed")
+	}
+	return s.info
+}
+
+// getKeyFingerprint returns the fingerprint of the session's transport keys, or nil if the session is not ready.
+func (s *session) getKeyFingerprint() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	x, ok := s.state.(*readyState)
+	if !ok {
+		return nil
+	}
+	return x.keyFingerprint(s.initiator)
 }
 
 func (s *session) getRemotePublicKey() p2p.PublicKey {
@@ -208,6 +434,35 @@ func (s *session) getRemotePublicKey() p2p.PublicKey {
 	return s.remotePublicKey
 }
 
+// isFramed returns true if plaintexts on the session start with a frame type.
+// Otherwise the remote party is from before frames, and plaintexts are tells.
+func (s *session) isFramed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.framed
+}
+
+// getLowerRaddr returns the remote party's current lower address.
+func (s *session) getLowerRaddr() p2p.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lowerRaddr
+}
+
+// setLowerRaddr moves the session to raddr, see moveSession.
+func (s *session) setLowerRaddr(raddr p2p.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lowerRaddr = raddr
+}
+
+// getConnID returns the session's connection id, or false if it is not ready or connection ids are not used.
+func (s *session) getConnID() (connID, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connID, s.hasConnID
+}
+
 func (s *session) outDirection() direction {
 	if s.initiator {
 		return directionInitToResp
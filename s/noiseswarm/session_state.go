@@ -3,10 +3,12 @@ package noiseswarm
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 
 	"github.com/brendoncarroll/go-p2p"
 	"github.com/flynn/noise"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
 	"golang.zx2c4.com/wireguard/replay"
 	"google.golang.org/protobuf/proto"
 )
@@ -14,6 +16,14 @@ import (
 type upwardRes struct {
 	Up    []byte
 	Resps []message
+	// LocalKey is set by a responder when it chooses which identity to respond as
+	LocalKey p2p.PrivateKey
+	// Pattern is set by a responder when it learns which pattern the initiator is using
+	Pattern *HandshakePattern
+	// RemoteStatic is set when the remote party's Noise static key is learned during the handshake
+	RemoteStatic []byte
+	// Framed is set when the handshake shows both parties start plaintexts with a frame type, see markerFrames.
+	Framed bool
 
 	Next state
 	Err  error
@@ -27,15 +37,28 @@ type downwardRes struct {
 }
 
 type state interface {
-	downward(in []byte) downwardRes
+	downward(in p2p.IOVec) downwardRes
 	upward(msg message) upwardRes
 }
 
-func newHandshakeState(initiator bool) *noise.HandshakeState {
+var cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b)
+
+// pskPlacement is where the pre-shared key is mixed into the handshake if one is used.
+// The key is mixed in at the end of the second message, so the initiator detects a mismatch after 1 round trip.
+const pskPlacement = 2
+
+// newHandshakeState returns a handshake state for pattern.
+// If psk is not empty, the psk2 modifier is applied to the pattern.
+// peerStatic is the responder's static key, and is only used by an IK initiator.
+func newHandshakeState(initiator bool, pattern HandshakePattern, psk []byte, staticKey noise.DHKey, peerStatic []byte) *noise.HandshakeState {
 	hsstate, err := noise.NewHandshakeState(noise.Config{
-		CipherSuite: noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b),
-		Initiator:   initiator,
-		Pattern:     noise.HandshakeNN,
+		CipherSuite:           cipherSuite,
+		Initiator:             initiator,
+		Pattern:               pattern.noisePattern(),
+		PresharedKey:          psk,
+		PresharedKeyPlacement: pskPlacement,
+		StaticKeypair:         staticKey,
+		PeerStatic:            peerStatic,
 	})
 	if err != nil {
 		panic(err)
@@ -44,18 +67,66 @@ func newHandshakeState(initiator bool) *noise.HandshakeState {
 }
 
 type awaitInitState struct {
-	hsstate    *noise.HandshakeState
-	privateKey p2p.PrivateKey
+	privateKey   p2p.PrivateKey
+	peerIDScheme p2p.PeerIDScheme
+	identities   func(p2p.PeerID) p2p.PrivateKey
+	psk          []byte
+	staticKey    noise.DHKey
+	issuer       *ticketIssuer
 }
 
-func newAwaitInitState(privateKey p2p.PrivateKey) *awaitInitState {
+// newAwaitInitState returns the initial state for a responder.
+// params.issuer may be nil, in which case no resumption tickets are redeemed.
+func newAwaitInitState(params sessionParams) *awaitInitState {
 	return &awaitInitState{
-		hsstate:    newHandshakeState(false),
-		privateKey: privateKey,
+		privateKey:   params.privateKey,
+		peerIDScheme: params.peerIDScheme,
+		identities:   params.identities,
+		psk:          params.psk,
+		staticKey:    params.staticKey,
+		issuer:       params.issuer,
+	}
+}
+
+// readInit reads an init message, and returns the handshake state for the pattern the initiator is using.
+// An IK init is encrypted to our static key, so it is recognized by successfully reading it as IK.
+// Otherwise the message is read as NN, and then again as XX if the payload is marked as XX.
+// With a psk the payload is encrypted, so an XX init cannot be read as NN, and is read as XX instead.
+// The init payload is returned, see parseInitPayload.
+func (cur *awaitInitState) readInit(in []byte) (hsstate *noise.HandshakeState, pattern HandshakePattern, payload []byte, err error) {
+	if len(in) >= ikMinInitSize {
+		hsstate = newHandshakeState(false, PatternIK, cur.psk, cur.staticKey, nil)
+		if payload, _, _, err := hsstate.ReadMessage(nil, in); err == nil {
+			return hsstate, PatternIK, payload, nil
+		}
+	}
+	hsstate = newHandshakeState(false, PatternNN, cur.psk, cur.staticKey, nil)
+	payload, _, _, err = hsstate.ReadMessage(nil, in)
+	if err == nil {
+		if _, isXX, _ := parseInitPayload(payload); !isXX {
+			return hsstate, PatternNN, payload, nil
+		}
+	}
+	hsstate = newHandshakeState(false, PatternXX, cur.psk, cur.staticKey, nil)
+	payload, _, _, err = hsstate.ReadMessage(nil, in)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if _, isXX, _ := parseInitPayload(payload); !isXX {
+		return nil, 0, nil, errors.Errorf("init message is not marked as XX")
+	}
+	return hsstate, PatternXX, payload, nil
+}
+
+// identity returns the key for the local identity id, or nil if the swarm does not have it.
+func (cur *awaitInitState) identity(id p2p.PeerID) p2p.PrivateKey {
+	if cur.identities == nil {
+		return nil
 	}
+	return cur.identities(id)
 }
 
-func (cur *awaitInitState) downward(in []byte) downwardRes {
+func (cur *awaitInitState) downward(in p2p.IOVec) downwardRes {
 	return downwardRes{
 		Next: cur,
 		Err:  errors.Errorf("cannot send before handshake is done"),
@@ -65,44 +136,67 @@ func (cur *awaitInitState) downward(in []byte) downwardRes {
 func (cur *awaitInitState) upward(msg message) upwardRes {
 	count := msg.getCounter()
 	in := msg.getBody()
+	if count == countResume && cur.issuer != nil {
+		return cur.resume(in)
+	}
 	var resps []message
-	var outCS, inCS *noise.CipherState
+	var outCS, inCS noise.Cipher
+	var hsstate *noise.HandshakeState
+	var pattern HandshakePattern
+	var framed bool
+	localKey := cur.privateKey
 	err := func() error {
 		if count != countInit {
 			return &ErrHandshake{
 				Message: fmt.Sprintf("awaiting init but got non-init %d", count),
 			}
 		}
-		_, _, _, err := cur.hsstate.ReadMessage(nil, in)
+		var payload []byte
+		var err error
+		hsstate, pattern, payload, err = cur.readInit(in)
 		if err != nil {
 			return &ErrHandshake{
 				Message: "noise errored",
 				Cause:   err,
 			}
 		}
+		var hint []byte
+		hint, _, framed = parseInitPayload(payload)
+		// the initiator may say which identity it is dialing, otherwise the default is used.
+		if len(hint) == len(p2p.PeerID{}) {
+			var id p2p.PeerID
+			copy(id[:], hint)
+			if k := cur.identity(id); k != nil {
+				localKey = k
+			}
+		}
 		counterBytes := [4]byte{}
 		binary.BigEndian.PutUint32(counterBytes[:], countResp)
-		out, cs1, cs2, err := cur.hsstate.WriteMessage(counterBytes[:], nil)
+		out, cs1, cs2, err := hsstate.WriteMessage(counterBytes[:], makeRespPayload(framed))
 		if err != nil {
 			return &ErrHandshake{
 				Message: "noise errored",
 				Cause:   err,
 			}
 		}
+		resps = append(resps, out)
+		if pattern == PatternXX {
+			// wait for the initiator's final message before sending the intro.
+			return nil
+		}
 		if cs1 == nil || cs2 == nil {
 			panic("no error and no cipherstates")
 		}
-		resps = append(resps, out)
 		outCS, inCS = pickCS(false, cs1, cs2)
 		// also send intro
-		introBytes, err := signChannelBinding(cur.privateKey, cur.hsstate.ChannelBinding())
+		introBytes, err := signChannelBinding(localKey, hsstate.ChannelBinding())
 		if err != nil {
 			return &ErrHandshake{
 				Message: "could not sign the channel binding",
 				Cause:   err,
 			}
 		}
-		out = encryptMessage(outCS, countSigRespToInit, introBytes)
+		out = encryptMessage(outCS, countSigRespToInit, p2p.IOVec{introBytes})
 		resps = append(resps, out)
 		return nil
 	}()
@@ -113,25 +207,75 @@ func (cur *awaitInitState) upward(msg message) upwardRes {
 			Next:  newEndState(err),
 		}
 	}
+	var next state
+	if pattern == PatternXX {
+		next = newAwaitFinishState(hsstate, localKey, cur.peerIDScheme)
+	} else {
+		next = newAwaitSigState(outCS, inCS, hsstate.ChannelBinding(), false)
+	}
 	return upwardRes{
-		Resps: resps,
-		Next:  newAwaitSigState(outCS, inCS, cur.hsstate.ChannelBinding(), false),
+		Resps:        resps,
+		LocalKey:     localKey,
+		Pattern:      &pattern,
+		RemoteStatic: hsstate.PeerStatic(),
+		Framed:       framed,
+		Next:         next,
+	}
+}
+
+// resume redeems the ticket in a resume message, and skips directly to the ready state.
+func (cur *awaitInitState) resume(in []byte) upwardRes {
+	var outCS, inCS noise.Cipher
+	var remotePublicKey p2p.PublicKey
+	var localKey p2p.PrivateKey
+	err := func() error {
+		nonce, sealed, err := parseResumeMessage(in)
+		if err != nil {
+			return &ErrHandshake{Message: "invalid resume message", Cause: err}
+		}
+		psk, localID, publicKey, err := cur.issuer.redeem(sealed, cur.issuer.clock.Now())
+		if err != nil {
+			return &ErrHandshake{Message: "could not redeem ticket", Cause: err}
+		}
+		if localKey = cur.identity(localID); localKey == nil {
+			return &ErrHandshake{Message: "ticket was issued to an unknown identity"}
+		}
+		remotePublicKey = publicKey
+		outCS, inCS = deriveResumeCiphers(false, psk, nonce)
+		return nil
+	}()
+	if err != nil {
+		return upwardRes{
+			Err:   err,
+			Resps: []message{makeNACK()},
+			Next:  newEndState(err),
+		}
+	}
+	// tickets are only issued over frames, so the initiator has them.
+	return upwardRes{
+		LocalKey: localKey,
+		Framed:   true,
+		Next:     newReadyState(outCS, inCS, remotePublicKey, true),
 	}
 }
 
 type awaitRespState struct {
-	hsstate    *noise.HandshakeState
-	privateKey p2p.PrivateKey
+	hsstate      *noise.HandshakeState
+	pattern      HandshakePattern
+	privateKey   p2p.PrivateKey
+	peerIDScheme p2p.PeerIDScheme
 }
 
-func newAwaitRespState(privateKey p2p.PrivateKey) *awaitRespState {
+func newAwaitRespState(params sessionParams) *awaitRespState {
 	return &awaitRespState{
-		privateKey: privateKey,
-		hsstate:    newHandshakeState(true),
+		privateKey:   params.privateKey,
+		peerIDScheme: params.peerIDScheme,
+		pattern:      params.pattern,
+		hsstate:      newHandshakeState(true, params.pattern, params.psk, params.staticKey, params.remoteStatic),
 	}
 }
 
-func (cur *awaitRespState) downward(in []byte) downwardRes {
+func (cur *awaitRespState) downward(in p2p.IOVec) downwardRes {
 	return downwardRes{
 		Next: cur,
 		Err:  errors.Errorf("cannot send before handshake is done"),
@@ -142,7 +286,15 @@ func (cur *awaitRespState) upward(msg message) upwardRes {
 	count := msg.getCounter()
 	in := msg.getBody()
 	var resps []message
-	var outCS, inCS *noise.CipherState
+	var outCS, inCS noise.Cipher
+	var framed bool
+	if count == countLastMessage {
+		err := &ErrHandshake{Message: "handshake rejected by responder"}
+		return upwardRes{
+			Next: newEndState(err),
+			Err:  err,
+		}
+	}
 	if count != countResp {
 		return upwardRes{
 			Next: cur,
@@ -150,13 +302,28 @@ func (cur *awaitRespState) upward(msg message) upwardRes {
 		}
 	}
 	err := func() error {
-		_, cs1, cs2, err := cur.hsstate.ReadMessage(nil, in)
+		payload, cs1, cs2, err := cur.hsstate.ReadMessage(nil, in)
 		if err != nil {
 			return &ErrHandshake{
 				Message: "noise errored",
 				Cause:   err,
 			}
 		}
+		framed = parseRespPayload(payload)
+		if cur.pattern == PatternXX {
+			// the final message of XX uses the init counter, the responder is expecting it instead of another init.
+			counterBytes := [4]byte{}
+			binary.BigEndian.PutUint32(counterBytes[:], countInit)
+			var out []byte
+			out, cs1, cs2, err = cur.hsstate.WriteMessage(counterBytes[:], nil)
+			if err != nil {
+				return &ErrHandshake{
+					Message: "noise errored",
+					Cause:   err,
+				}
+			}
+			resps = append(resps, out)
+		}
 		if cs1 == nil || cs2 == nil {
 			panic("no error and no cipherstates")
 		}
@@ -169,7 +336,7 @@ func (cur *awaitRespState) upward(msg message) upwardRes {
 				Cause:   err,
 			}
 		}
-		out := encryptMessage(outCS, countSigInitToResp, introBytes)
+		out := encryptMessage(outCS, countSigInitToResp, p2p.IOVec{introBytes})
 		resps = append(resps, out)
 		return nil
 	}()
@@ -180,18 +347,103 @@ func (cur *awaitRespState) upward(msg message) upwardRes {
 		}
 	}
 	return upwardRes{
-		Resps: resps,
-		Next:  newAwaitSigState(outCS, inCS, cur.hsstate.ChannelBinding(), true),
+		Resps:        resps,
+		RemoteStatic: cur.hsstate.PeerStatic(),
+		Framed:       framed,
+		Next:         newAwaitSigState(outCS, inCS, cur.hsstate.ChannelBinding(), true),
+	}
+}
+
+// awaitFinishState is the state of an XX responder which is waiting for the initiator's final message.
+type awaitFinishState struct {
+	hsstate      *noise.HandshakeState
+	privateKey   p2p.PrivateKey
+	peerIDScheme p2p.PeerIDScheme
+	// earlySig holds the initiator's intro if it overtakes the final message
+	earlySig message
+}
+
+func newAwaitFinishState(hsstate *noise.HandshakeState, privateKey p2p.PrivateKey, peerIDScheme p2p.PeerIDScheme) *awaitFinishState {
+	return &awaitFinishState{
+		hsstate:      hsstate,
+		privateKey:   privateKey,
+		peerIDScheme: peerIDScheme,
+	}
+}
+
+func (cur *awaitFinishState) downward(in p2p.IOVec) downwardRes {
+	return downwardRes{
+		Next: cur,
+		Err:  errors.Errorf("cannot send before handshake is done"),
 	}
 }
 
+func (cur *awaitFinishState) upward(msg message) upwardRes {
+	count := msg.getCounter()
+	if count == countSigInitToResp {
+		cur.earlySig = append(message{}, msg...)
+		return upwardRes{Next: cur}
+	}
+	if count != countInit {
+		err := &ErrHandshake{
+			Message: fmt.Sprintf("awaiting final handshake message but got %d", count),
+		}
+		return upwardRes{
+			Err:   err,
+			Resps: []message{makeNACK()},
+			Next:  newEndState(err),
+		}
+	}
+	_, cs1, cs2, err := cur.hsstate.ReadMessage(nil, msg.getBody())
+	if err != nil {
+		// this is probably an init from an initiator which has started again, so it is not NACKed.
+		// the session ends, and fromBelow deletes it and handles the message again with a new session, as an init.
+		err := &ErrHandshake{
+			Message: "noise errored",
+			Cause:   err,
+		}
+		return upwardRes{
+			Err:  err,
+			Next: newEndState(err),
+		}
+	}
+	if cs1 == nil || cs2 == nil {
+		panic("no error and no cipherstates")
+	}
+	outCS, inCS := pickCS(false, cs1, cs2)
+	introBytes, err := signChannelBinding(cur.privateKey, cur.hsstate.ChannelBinding())
+	if err != nil {
+		err := &ErrHandshake{
+			Message: "could not sign the channel binding",
+			Cause:   err,
+		}
+		return upwardRes{
+			Err:   err,
+			Resps: []message{makeNACK()},
+			Next:  newEndState(err),
+		}
+	}
+	res := upwardRes{
+		Resps:        []message{encryptMessage(outCS, countSigRespToInit, p2p.IOVec{introBytes})},
+		RemoteStatic: cur.hsstate.PeerStatic(),
+		Next:         newAwaitSigState(outCS, inCS, cur.hsstate.ChannelBinding(), false),
+	}
+	if cur.earlySig != nil {
+		sigRes := res.Next.upward(cur.earlySig)
+		res.Resps = append(res.Resps, sigRes.Resps...)
+		res.Next = sigRes.Next
+		res.Err = sigRes.Err
+	}
+	return res
+}
+
 type awaitSigState struct {
 	initiator      bool
-	outCS, inCS    *noise.CipherState
+	outCS, inCS    noise.Cipher
 	channelBinding []byte
 }
 
-func newAwaitSigState(outCS, inCS *noise.CipherState, channelBinding []byte, initiator bool) *awaitSigState {
+func newAwaitSigState(outCS, inCS noise.Cipher, channelBinding []byte, initiator bool) *awaitSigState {
 	return &awaitSigState{
 		outCS:          outCS,
 		inCS:           inCS,
@@ -200,7 +452,7 @@ func newAwaitSigState(outCS, inCS *noise.CipherState, channelBinding []byte, ini
 	}
 }
 
-func (cur *awaitSigState) downward(in []byte) downwardRes {
+func (cur *awaitSigState) downward(in p2p.IOVec) downwardRes {
 	return downwardRes{
 		Next: cur,
 		Err:  errors.Errorf("cannot send while awaiting sig"),
@@ -246,19 +498,23 @@ func (cur *awaitSigState) upward(msg message) upwardRes {
 		panic("public key is nil")
 	}
 	return upwardRes{
-		Next: newReadyState(cur.outCS, cur.inCS, remotePublicKey),
+		Next: newReadyState(cur.outCS, cur.inCS, remotePublicKey, false),
 	}
 }
 
 type readyState struct {
-	outCS, inCS     *noise.CipherState
+	resumed         bool
+	outCS, inCS     noise.Cipher
 	outCount        uint32
 	inFilter        *replay.Filter
 	remotePublicKey p2p.PublicKey
 }
 
-func newReadyState(outCS, inCS *noise.CipherState, remotePublicKey p2p.PublicKey) *readyState {
+// newReadyState returns a ready state using outCS and inCS.
+// resumed should be true if the ciphers came from a resumption ticket instead of a handshake.
+func newReadyState(outCS, inCS noise.Cipher, remotePublicKey p2p.PublicKey, resumed bool) *readyState {
 	return &readyState{
+		resumed:         resumed,
 		outCS:           outCS,
 		inCS:            inCS,
 		outCount:        countPostHandshake,
@@ -267,7 +523,25 @@ func newReadyState(outCS, inCS *noise.CipherState, remotePublicKey p2p.PublicKey
 	}
 }
 
-func (cur *readyState) downward(in []byte) downwardRes {
+// keyFingerprint returns a hash identifying the transport keys, which is the same for both parties.
+// Each key authenticates an empty message with a nonce no message can use, since counts are 32 bits,
+// so the fingerprint reveals nothing about the keys, but changes whenever they do.
+func (cur *readyState) keyFingerprint(initiator bool) []byte {
+	i2r, r2i := cur.outCS, cur.inCS
+	if !initiator {
+		i2r, r2i = r2i, i2r
+	}
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	h.Write([]byte("p2p/noiseswarm/key-fingerprint"))
+	h.Write(i2r.Encrypt(nil, math.MaxUint64, nil, nil))
+	h.Write(r2i.Encrypt(nil, math.MaxUint64, nil, nil))
+	return h.Sum(nil)
+}
+
+func (cur *readyState) downward(in p2p.IOVec) downwardRes {
 	count := cur.outCount
 	cur.outCount++
 	var next state = cur
@@ -327,7 +601,7 @@ func newEndState(err error) *endState {
 	return &endState{err: err}
 }
 
-func (s *endState) downward(in []byte) downwardRes {
+func (s *endState) downward(in p2p.IOVec) downwardRes {
 	return downwardRes{
 		Next: s,
 		Err:  s.err,
@@ -347,24 +621,30 @@ func (s *endState) upward(msg message) upwardRes {
 	}
 }
 
-func pickCS(initiator bool, cs1, cs2 *noise.CipherState) (outCS, inCS *noise.CipherState) {
+func pickCS(initiator bool, cs1, cs2 *noise.CipherState) (outCS, inCS noise.Cipher) {
 	if !initiator {
 		cs1, cs2 = cs2, cs1
 	}
-	outCS = cs1
-	inCS = cs2
+	outCS = cs1.Cipher()
+	inCS = cs2.Cipher()
 	return outCS, inCS
 }
 
-func encryptMessage(outCS *noise.CipherState, count uint32, ptext []byte) []byte {
-	cipher := outCS.Cipher()
-	counterBytes := [4]byte{}
-	binary.BigEndian.PutUint32(counterBytes[:], count)
-	return cipher.Encrypt(counterBytes[:], uint64(count), counterBytes[:], ptext)
+// encryptMessage copies ptext into a new message, and encrypts it in place.
+// ptext is not flattened separately, so the only allocation is the returned message.
+func encryptMessage(cipher noise.Cipher, count uint32, ptext p2p.IOVec) []byte {
+	size := p2p.VecSize(ptext)
+	buf := make([]byte, 4+size, Overhead+size)
+	binary.BigEndian.PutUint32(buf[:4], count)
+	n := 4
+	for i := range ptext {
+		n += copy(buf[n:], ptext[i])
+	}
+	// the plaintext and ciphertext start at the same offset, which is allowed by the AEAD
+	return cipher.Encrypt(buf[:4], uint64(count), buf[:4], buf[4:])
 }
 
-func decryptMessage(inCS *noise.CipherState, count uint32, in []byte) ([]byte, error) {
-	cipher := inCS.Cipher()
+func decryptMessage(cipher noise.Cipher, count uint32, in []byte) ([]byte, error) {
 	counterBytes := [4]byte{}
 	binary.BigEndian.PutUint32(counterBytes[:], count)
 	return cipher.Decrypt(nil, uint64(count), counterBytes[:], in)
@@ -2,77 +2,302 @@ package noiseswarm
 
 import (
 	"context"
+	"crypto/rand"
 	mrand "math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/flynn/noise"
+	"github.com/jonboulle/clockwork"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-var _ p2p.SecureSwarm = &Swarm{}
+var _ p2p.SecureAskSwarm = &Swarm{}
 
 const (
 	// Overhead is the per message overhead.
-	// MTU will be smaller than the underlying swarm's MTU by Overhead
-	Overhead = 4 + 16
+	// MTU will be smaller than the underlying swarm's MTU by Overhead.
+	// It includes the frame header, which is only sent to parties which support frames, see ErrNoFrames.
+	Overhead = 4 + 16 + frameOverhead
 	// MaxDialAttempts is the maxmimum number of times to retry a handshake.
 	MaxDialAttempts = 10
 	// MaxDialBackoffDuration is the maximum time to wait between dial attempts
 	MaxDialBackoffDuration = time.Second
+	// PSKSize is the size of the key passed to WithPSK
+	PSKSize = 32
+	// TellQueueSize is the number of received tells held for the tell handler.
+	// Tells which arrive while the queue is full are dropped, so a swarm which is only used for asks does not stall.
+	TellQueueSize = 64
 )
 
 type Swarm struct {
 	swarm      p2p.Swarm
 	privateKey p2p.PrivateKey
 	localID    p2p.PeerID
+	// identities holds the keys for every local identity, including privateKey.
+	// localIDs is the order they were added in.
+	// moreKeys are the keys from WithIdentities, which New adds once the PeerIDScheme is known.
+	identities     map[p2p.PeerID]p2p.PrivateKey
+	localIDs       []p2p.PeerID
+	moreKeys       []p2p.PrivateKey
+	peerIDScheme   p2p.PeerIDScheme
+	selectIdentity func(Addr) p2p.PeerID
+	sendHints      bool
+	pattern        HandshakePattern
+	selectPolicy   SessionSelectPolicy
+	staticKey      noise.DHKey
+	onMalformed    func(p2p.Addr, error)
+	onWire         func(WireDirection, p2p.Addr, []byte)
+	onPeerAddrs    func(p2p.PeerID, []p2p.Addr)
+	resolver       p2p.PeerResolver
+	compress       bool
+	psk            []byte
+	clock          clockwork.Clock
+	// issuer is nil unless resumption is enabled
+	issuer        *ticketIssuer
+	resumptionTTL time.Duration
+	manualCleanup bool
+	connIDs       bool
 
-	cf context.CancelFunc
+	// ctx is canceled, and closed is closed, when the swarm is closed
+	ctx    context.Context
+	cf     context.CancelFunc
+	closed <-chan struct{}
+	// workers are the swarm's goroutines, which Close waits for
+	workers swarmutil.Workers
+	// cleanupStopped is 1 once the cleanup loop has returned, and receiving is 1 while the lower swarm is being served.
+	cleanupStopped int32
+	receiving      int32
+	tells          *swarmutil.TellHub
+	asks           *swarmutil.AskHub
+	// askSlots holds a token for each ask being handled, see MaxConcurrentAsks.
+	askSlots  chan struct{}
+	closeOnce swarmutil.CloseOnce
 
-	mu             sync.RWMutex
-	lowerToSession map[sessionKey]*session
+	sessions *swarmutil.Pool[sessionKey, *session]
+
+	mu sync.Mutex
+	// tickets holds resumption tickets issued by remote parties, by lower address.
+	tickets map[string]*ticket
+	// statics holds the Noise static keys of remote parties, by PeerID.
+	statics map[p2p.PeerID][]byte
+	// conns holds the ready sessions by connection id, if WithConnectionIDs is used.
+	conns map[connKey]*session
 }
 
-func New(x p2p.Swarm, privateKey p2p.PrivateKey) *Swarm {
+// New creates a Swarm on top of x, using privateKey as its identity.
+// More identities can be added with WithIdentities, in which case privateKey is the default identity.
+func New(x p2p.Swarm, privateKey p2p.PrivateKey, opts ...Option) *Swarm {
 	ctx, cf := context.WithCancel(context.Background())
 	s := &Swarm{
 		swarm:      x,
 		privateKey: privateKey,
-		localID:    p2p.NewPeerID(privateKey.Public()),
+		identities: map[p2p.PeerID]p2p.PrivateKey{},
+
+		peerIDScheme: p2p.DefaultPeerIDScheme,
+		clock:        clockwork.NewRealClock(),
 
-		cf: cf,
+		ctx:      ctx,
+		cf:       cf,
+		closed:   ctx.Done(),
+		tells:    swarmutil.NewTellHub(swarmutil.WithQueue(TellQueueSize, swarmutil.OverflowDropNewest)),
+		asks:     swarmutil.NewAskHub(),
+		askSlots: make(chan struct{}, MaxConcurrentAsks),
 
-		lowerToSession: make(map[sessionKey]*session),
+		tickets: make(map[string]*ticket),
+		statics: make(map[p2p.PeerID][]byte),
+		conns:   make(map[connKey]*session),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.localID = s.peerIDScheme.Derive(privateKey.Public())
+	for _, k := range append([]p2p.PrivateKey{privateKey}, s.moreKeys...) {
+		id := s.peerIDScheme.Derive(k.Public())
+		if _, exists := s.identities[id]; exists {
+			continue
+		}
+		s.identities[id] = k
+		s.localIDs = append(s.localIDs, id)
+	}
+	if s.staticKey.Private == nil {
+		staticKey, err := cipherSuite.GenerateKeypair(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		s.staticKey = staticKey
+	}
+	s.sessions = swarmutil.NewPool(swarmutil.PoolParams[sessionKey, *session]{
+		IsStale: func(_ sessionKey, sess *session, now time.Time) bool {
+			return sess.isExpired(now)
+		},
+		Clock: s.clock,
+	})
+	if s.resumptionTTL > 0 {
+		s.issuer = newTicketIssuer(s.resumptionTTL, s.clock)
+	}
+	if !s.manualCleanup {
+		s.workers.Go(func() {
+			s.cleanupLoop(ctx)
+		})
 	}
-	go s.cleanupLoop(ctx)
+	atomic.StoreInt32(&s.receiving, 1)
+	// the receive loop calls the OnMalformed and OnPeerAddrs callbacks, so Close does not wait for it.
+	go func() {
+		defer atomic.StoreInt32(&s.receiving, 0)
+		if err := s.swarm.ServeTells(s.fromBelow); err != nil && err != p2p.ErrSwarmClosed {
+			logrus.Error("noiseswarm: lower swarm stopped serving: ", err)
+		}
+	}()
 	return s
 }
 
+// Tell sends data to addr, dialing a session if there is not one ready.
+// If the message deadline in ctx, see p2p.WithDeadline, passes before the session is ready, the message is dropped
+// and p2p.ErrExpired is returned.
 func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
 	dst := addr.(Addr)
 	return s.withAnyReadySession(ctx, dst, func(sess *session) error {
-		return sess.tell(ctx, p2p.VecBytes(data))
+		if p2p.Expired(ctx, s.clock.Now()) {
+			return p2p.ErrExpired
+		}
+		if !sess.isFramed() {
+			return sess.tell(ctx, data)
+		}
+		return sess.tell(ctx, newTellFrame(data))
 	})
 }
 
+// Dial establishes a session with addr, if there is not one already.
+// If remoteStatic is not nil, it is the remote party's Noise static key, as returned by its StaticPublicKey,
+// and the IK pattern is used for this and later sessions with it.
+// If the IK handshake fails, for example because remoteStatic was wrong, the key is forgotten.
+func (s *Swarm) Dial(ctx context.Context, addr p2p.Addr, remoteStatic []byte) error {
+	dst := addr.(Addr)
+	if remoteStatic != nil {
+		if len(remoteStatic) != StaticKeySize {
+			return errors.Errorf("noiseswarm: static key must be %d bytes, got %d", StaticKeySize, len(remoteStatic))
+		}
+		s.putStatic(dst.ID, remoteStatic)
+	}
+	return s.withAnyReadySession(ctx, dst, func(*session) error {
+		return nil
+	})
+}
+
+// DialVia is like Dial, but establishes a session with the peer id using the lower address lower.
+// Sessions are kept per lower address, so a session with id over another lower address is not used or replaced.
+func (s *Swarm) DialVia(ctx context.Context, id p2p.PeerID, lower p2p.Addr) error {
+	return s.Dial(ctx, Addr{ID: id, Addr: lower}, nil)
+}
+
+// TellVia sends data to the peer id, using a session over the lower address lower, and dialing one if necessary.
+// It can be used to choose a path to a peer with more than one lower address.
+func (s *Swarm) TellVia(ctx context.Context, id p2p.PeerID, lower p2p.Addr, data p2p.IOVec) error {
+	return s.Tell(ctx, Addr{ID: id, Addr: lower}, data)
+}
+
+// DialByID establishes a session with the peer id, using the lower addresses from the resolver set with WithResolver.
+// A ready session over any of the addresses is used if there is one, otherwise the addresses are dialed in order,
+// and the first to succeed is returned.
+// Addresses which are noiseswarm Addrs, such as those from a DHT on this swarm, are dialed over their lower address.
+// If the resolver has no addresses for id, p2p.ErrNoAddrs is returned.
+func (s *Swarm) DialByID(ctx context.Context, id p2p.PeerID) (Addr, error) {
+	if s.resolver == nil {
+		return Addr{}, errors.Errorf("noiseswarm: DialByID requires a resolver, see WithResolver")
+	}
+	addrs, err := s.resolver.Resolve(ctx, id)
+	if err != nil {
+		return Addr{}, err
+	}
+	if len(addrs) == 0 {
+		return Addr{}, p2p.ErrNoAddrs
+	}
+	dsts := make([]Addr, len(addrs))
+	for i, addr := range addrs {
+		if a, ok := addr.(Addr); ok {
+			addr = a.Addr
+		}
+		dsts[i] = Addr{ID: id, Addr: addr}
+		if s.getAnyReadySession(dsts[i]) != nil {
+			return dsts[i], nil
+		}
+	}
+	var firstErr error
+	for _, dst := range dsts {
+		err := s.Dial(ctx, dst, nil)
+		if err == nil {
+			return dst, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return Addr{}, firstErr
+}
+
+// TellByID sends data to the peer id, over a session established by DialByID.
+func (s *Swarm) TellByID(ctx context.Context, id p2p.PeerID, data p2p.IOVec) error {
+	dst, err := s.DialByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.Tell(ctx, dst, data)
+}
+
+// StaticPublicKey returns the public part of the swarm's Noise static key.
+// Peers which know it can use the IK pattern, see Dial.
+func (s *Swarm) StaticPublicKey() []byte {
+	return append([]byte{}, s.staticKey.Public...)
+}
+
 func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
-	return s.swarm.ServeTells(func(msg *p2p.Message) {
-		s.fromBelow(msg, fn)
+	return s.tells.ServeTells(fn)
+}
+
+// ServeTellsAuthenticated is like ServeTells, but passes fn the authenticated PeerID of the sender
+// and its address on the lower swarm, instead of a p2p.Message.
+// payload is only valid until fn returns.
+func (s *Swarm) ServeTellsAuthenticated(fn func(src p2p.PeerID, lower p2p.Addr, payload []byte)) error {
+	return s.ServeTells(func(msg *p2p.Message) {
+		src := msg.Src.(Addr)
+		fn(src.ID, src.Addr, msg.Payload)
 	})
 }
 
+// Close closes the swarm and the lower swarm.
+// It waits for the goroutines sending on the swarm's behalf to exit, but not for ask handlers which are running,
+// whose context is canceled, so it can be called from a handler.
+// The lower swarm is only closed by the first call.
 func (s *Swarm) Close() error {
-	s.cf()
-	return s.swarm.Close()
+	return s.closeOnce.Do(func() error {
+		s.cf()
+		s.tells.CloseWithError(p2p.ErrSwarmClosed)
+		s.asks.CloseWithError(p2p.ErrSwarmClosed)
+		err := s.swarm.Close()
+		s.workers.Wait()
+		return err
+	})
 }
 
+// LocalAddrs returns an address for each of the swarm's identities, at each of the lower swarm's addresses.
+// The addresses for the default identity come first.
 func (s *Swarm) LocalAddrs() (addrs []p2p.Addr) {
-	for _, addr := range s.swarm.LocalAddrs() {
-		addrs = append(addrs, Addr{
-			ID:   p2p.NewPeerID(s.privateKey.Public()),
-			Addr: addr,
-		})
+	lowerAddrs := s.swarm.LocalAddrs()
+	for _, id := range s.localIDs {
+		for _, addr := range lowerAddrs {
+			addrs = append(addrs, Addr{
+				ID:   id,
+				Addr: addr,
+			})
+		}
 	}
 	return addrs
 }
@@ -88,57 +313,210 @@ func (s *Swarm) LookupPublicKey(ctx context.Context, addr p2p.Addr) (p2p.PublicK
 	return nil, p2p.ErrPublicKeyNotFound
 }
 
+// SessionHandshakeInfo returns information about how a ready session with addr was established.
+// If there are sessions in both directions, either may be returned.
+func (s *Swarm) SessionHandshakeInfo(addr p2p.Addr) (*HandshakeInfo, bool) {
+	target := addr.(Addr)
+	sess := s.getAnyReadySession(target)
+	if sess == nil || sess.getRemotePeerID() != target.ID {
+		return nil, false
+	}
+	info := sess.getHandshakeInfo()
+	return &info, true
+}
+
+// SessionKeyFingerprint returns a hash of the transport keys of a ready session with addr, for auditing that keys are rotated.
+// Both parties get the same fingerprint, and it changes whenever the session is replaced by a handshake or resumption, but it can not be used to recover the keys.
+// It returns false if there is no ready session with addr.
+// If there are sessions in both directions, either may be used.
+func (s *Swarm) SessionKeyFingerprint(addr p2p.Addr) ([]byte, bool) {
+	target := addr.(Addr)
+	sess := s.getAnyReadySession(target)
+	if sess == nil || sess.getRemotePeerID() != target.ID {
+		return nil, false
+	}
+	fp := sess.getKeyFingerprint()
+	return fp, fp != nil
+}
+
+// IdleSessions returns the addresses of peers whose ready sessions have not sent or received a message for longer than threshold.
+// A peer with sessions in both directions is only returned if both of them are idle.
+func (s *Swarm) IdleSessions(threshold time.Duration) []p2p.Addr {
+	now := s.clock.Now()
+	var addrs []p2p.Addr
+	for _, p := range s.readyPeers() {
+		if now.Sub(p.lastActivity) > threshold {
+			addrs = append(addrs, p.addr)
+		}
+	}
+	return addrs
+}
+
+// ReadyPeers returns the addresses of peers which the swarm has a ready session with, in either direction.
+func (s *Swarm) ReadyPeers() []p2p.Addr {
+	var addrs []p2p.Addr
+	for _, p := range s.readyPeers() {
+		addrs = append(addrs, p.addr)
+	}
+	return addrs
+}
+
+type readyPeer struct {
+	addr Addr
+	// lastActivity is the latest activity on any of the peer's ready sessions
+	lastActivity time.Time
+}
+
+// readyPeers returns a readyPeer for each lower address with a ready session
+func (s *Swarm) readyPeers() []*readyPeer {
+	var sessions []*session
+	s.sessions.ForEach(func(_ sessionKey, sess *session) bool {
+		sessions = append(sessions, sess)
+		return true
+	})
+	byKey := map[string]*readyPeer{}
+	var peers []*readyPeer
+	for _, sess := range sessions {
+		if !sess.isReady() {
+			continue
+		}
+		lowerRaddr := sess.getLowerRaddr()
+		k := lowerRaddr.Key()
+		last := sess.lastActivity()
+		if p, exists := byKey[k]; exists {
+			if last.After(p.lastActivity) {
+				p.lastActivity = last
+			}
+			continue
+		}
+		p := &readyPeer{
+			addr:         Addr{ID: sess.getRemotePeerID(), Addr: lowerRaddr},
+			lastActivity: last,
+		}
+		byKey[k] = p
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// DropSession removes the sessions in both directions with addr, and returns true if there were any.
+// The next Tell or Ask to addr will perform a new handshake.
+func (s *Swarm) DropSession(addr p2p.Addr) bool {
+	target := addr.(Addr)
+	outKey, inKey := makeSessionKeys(target.Addr)
+	droppedOut := s.sessions.Delete(outKey)
+	droppedIn := s.sessions.Delete(inKey)
+	return droppedOut || droppedIn
+}
+
+// PublicKey returns the public key of the default identity.
 func (s *Swarm) PublicKey() p2p.PublicKey {
 	return s.privateKey.Public()
 }
 
 func (s *Swarm) MTU(ctx context.Context, addr p2p.Addr) int {
 	target := addr.(Addr)
-	return s.swarm.MTU(ctx, target.Addr) - Overhead
+	mtu := s.swarm.MTU(ctx, target.Addr) - Overhead
+	if s.connIDs {
+		mtu -= ConnIDSize
+	}
+	return mtu
 }
 
-func (s *Swarm) fromBelow(msg *p2p.Message, next p2p.TellHandler) {
-	ctx := context.TODO()
+func (s *Swarm) fromBelow(msg *p2p.Message) {
+	ctx := s.ctx
+	s.observeWire(WireRecv, msg.Src, msg.Payload)
 	msg2, err := parseMessage(msg.Payload)
 	if err != nil {
-		logrus.Warn("noiseswarm got short message")
+		logrus.WithFields(malformedFields(msg)).Warn("noiseswarm: dropping message: ", err)
+		s.malformed(msg, err)
 		return
 	}
 	initiator := msg2.getDirection() == directionRespToInit
+	// with connection ids, the session is found by its id first, so it survives the remote party's address changing.
+	var byConn *session
+	if s.connIDs && carriesConnID(msg2.getCounter()) {
+		var id connID
+		if id, msg2, err = splitConnID(msg2); err != nil {
+			logrus.WithFields(malformedFields(msg)).Warn("noiseswarm: dropping message: ", err)
+			s.malformed(msg, err)
+			return
+		}
+		byConn = s.getConn(connKey{id: id, initiator: initiator})
+	}
 	var up []byte
 	for i := 0; i < 2; i++ {
-		sess, _ := s.getOrCreateSession(msg.Src, initiator)
-		up, err = sess.upward(ctx, msg2)
+		var sess *session
+		if byConn != nil && i == 0 {
+			sess = byConn
+		} else if initiator {
+			// sessions where we are the initiator are only created by dialing.
+			if sess = s.getSession(msg.Src, true); sess == nil {
+				err = errors.Errorf("no outbound session for message")
+				break
+			}
+		} else {
+			if msg2.getCounter() == countInit {
+				// the initiator has started a new handshake, which replaces any session which is not expecting it.
+				s.sessions.DeleteIf(sessionKey{raddr: msg.Src.Key(), initiator: false}, func(x *session) bool {
+					return !x.acceptsInit()
+				})
+			}
+			sess, _ = s.getOrCreateSession(msg.Src, false, s.localID, p2p.PeerID{})
+		}
+		wasReady := sess.isReady()
+		prevRaddr := sess.getLowerRaddr()
+		up, err = sess.upward(ctx, msg.Src, msg2)
 		if err != nil {
 			if sess.isErrored() {
-				s.deleteSession(msg.Src, sess)
+				s.deleteSession(prevRaddr, sess)
 				continue
 			}
-			return
+			break
+		}
+		if !wasReady && sess.isReady() {
+			s.registerConn(sess)
+			s.unifySessions(msg.Src)
+		}
+		switch {
+		case initiator && !wasReady && sess.isReady():
+			s.advertiseCaps(sess)
+		case !initiator && msg2.getCounter() == countResume && sess.isReady():
+			s.resumedCaps(sess)
 		}
 		if up != nil {
-			next(&p2p.Message{
-				Src: Addr{
-					ID:   sess.getRemotePeerID(),
-					Addr: msg.Src,
-				},
-				Dst: Addr{
-					ID:   s.localID,
-					Addr: msg.Dst,
-				},
-				Payload: up,
-			})
+			err = s.handleFrame(sess, msg, up)
 		}
 		break
 	}
+	if err != nil {
+		logrus.WithFields(malformedFields(msg)).Debug("noiseswarm: dropping message: ", err)
+		s.malformed(msg, err)
+	}
+}
+
+// malformed passes an ErrMalformed for msg, which was dropped because of err, to the OnMalformed hook.
+func (s *Swarm) malformed(msg *p2p.Message, err error) {
+	if s.onMalformed != nil {
+		s.onMalformed(msg.Src, &ErrMalformed{Src: msg.Src, Len: len(msg.Payload), Cause: err})
+	}
+}
+
+func malformedFields(msg *p2p.Message) logrus.Fields {
+	return logrus.Fields{"src": msg.Src, "len": len(msg.Payload)}
 }
 
 // withAnyReadySession calls fn with a non expired session, dialing a new one if necessary
 // fn will only be called once, although dialSession may be called multiple times.
 // fn will not be called until after the session is ready.
+// Only sessions using the local identity chosen for raddr are used.
 func (s *Swarm) withAnyReadySession(ctx context.Context, raddr Addr, fn func(s *session) error) error {
+	localID, err := s.identityFor(raddr)
+	if err != nil {
+		return err
+	}
 	// check the cache
-	sess := s.getAnyReadySession(raddr)
+	sess := s.getReadySessionAs(raddr, localID)
 	if sess != nil {
 		actualPeerID := sess.getRemotePeerID()
 		if actualPeerID != raddr.ID {
@@ -147,10 +525,12 @@ func (s *Swarm) withAnyReadySession(ctx context.Context, raddr Addr, fn func(s *
 		}
 		return fn(sess)
 	}
-	// try dialing
-	var err error
+	// try dialing, until the swarm is closed
+	dialCtx, cf := s.untilClosed(ctx)
+	defer cf()
 	for i := 0; i < MaxDialAttempts; i++ {
-		sess, err := s.dialSession(ctx, raddr.Addr)
+		var sess *session
+		sess, err = s.dialSession(dialCtx, raddr, localID)
 		if err == nil {
 			actualPeerID := sess.getRemotePeerID()
 			if actualPeerID != raddr.ID {
@@ -159,71 +539,163 @@ func (s *Swarm) withAnyReadySession(ctx context.Context, raddr Addr, fn func(s *
 			}
 			return fn(sess)
 		}
-		time.Sleep(backoffTime(i, MaxDialBackoffDuration))
+		timer := s.clock.NewTimer(backoffTime(i, MaxDialBackoffDuration))
+		select {
+		case <-s.closed:
+			timer.Stop()
+			return p2p.ErrSwarmClosed
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.Chan():
+		}
 	}
 	return err
 }
 
+// untilClosed returns a context which is canceled when ctx is done, or when the swarm is closed.
+func (s *Swarm) untilClosed(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cf := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.closed:
+			cf()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cf
+}
+
 // dialSession get's a session from the cache, or creates a new one.
 // if a new session is created dialSession iniates a handshake and waits for it to complete or error.
-func (s *Swarm) dialSession(ctx context.Context, lowerRaddr p2p.Addr) (*session, error) {
-	sess, created := s.getOrCreateSession(lowerRaddr, true)
+func (s *Swarm) dialSession(ctx context.Context, raddr Addr, localID p2p.PeerID) (*session, error) {
+	lowerRaddr := raddr.Addr
+	sess, created := s.getOrCreateSession(lowerRaddr, true, localID, raddr.ID)
 	if created {
-		if err := sess.startHandshake(ctx); err != nil {
+		start := sess.startHandshake
+		// a ticket is only used if it was issued by the peer being dialed, to the identity dialing it.
+		if t := s.takeTicket(lowerRaddr); t != nil && t.localID == localID && s.peerIDScheme.Derive(t.remotePublicKey) == raddr.ID {
+			start = func(ctx context.Context) error {
+				return sess.resume(ctx, t)
+			}
+		}
+		if err := start(ctx); err != nil {
 			s.deleteSession(lowerRaddr, sess)
 			return nil, err
 		}
 	}
 	if err := sess.waitReady(ctx); err != nil {
+		if sess.pattern == PatternIK && sess.isErrored() {
+			// the static key may be wrong, so fall back to the configured pattern.
+			s.forgetStatic(raddr.ID)
+		}
 		return nil, err
 	}
+	if rs := sess.getRemoteStatic(); rs != nil && sess.getRemotePeerID() == raddr.ID {
+		// the static key is covered by the signed channel binding, so it belongs to raddr.ID
+		s.putStatic(raddr.ID, rs)
+	}
+	// a resumed session becomes ready without a message from below
+	s.registerConn(sess)
+	s.unifySessions(lowerRaddr)
 	return sess, nil
 }
 
 // getOrCreate session returns an existing session in the specified direction.
 // if a new session is created it will return the session, and true otherwise false.
-func (s *Swarm) getOrCreateSession(lowerRaddr p2p.Addr, initiator bool) (sess *session, created bool) {
-	now := time.Now()
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// localID is the identity to use for a new session, and initiators replace existing sessions using a different identity.
+// remoteID is the PeerID an initiator is dialing; it is ignored for responders.
+func (s *Swarm) getOrCreateSession(lowerRaddr p2p.Addr, initiator bool, localID, remoteID p2p.PeerID) (sess *session, created bool) {
 	key := sessionKey{raddr: lowerRaddr.Key(), initiator: initiator}
-	sess, exists := s.lowerToSession[key]
-	if exists {
-		if !sess.isExpired(now) && !sess.isErrored() {
-			return sess, false
+	// errored sessions are kept until they are replaced here, so a message in the other direction can still find them.
+	s.sessions.DeleteIf(key, func(x *session) bool {
+		return x.isErrored() || (initiator && x.getLocalID() != localID)
+	})
+	sess, created, _ = s.sessions.GetOrCreate(key, func() (*session, error) {
+		return s.newSession(lowerRaddr, initiator, localID, remoteID), nil
+	})
+	return sess, created
+}
+
+func (s *Swarm) newSession(lowerRaddr p2p.Addr, initiator bool, localID, remoteID p2p.PeerID) *session {
+	var hint, remoteStatic []byte
+	pattern := s.pattern
+	if initiator {
+		if s.sendHints {
+			hint = append([]byte{}, remoteID[:]...)
+		}
+		if remoteStatic = s.getStatic(remoteID); remoteStatic != nil {
+			pattern = PatternIK
+		} else if pattern == PatternIK {
+			pattern = PatternXX
 		}
 	}
-	sess = newSession(initiator, s.privateKey, func(ctx context.Context, data []byte) error {
-		return s.swarm.Tell(ctx, lowerRaddr, p2p.IOVec{data})
+	params := sessionParams{
+		privateKey:   s.identities[localID],
+		peerIDScheme: s.peerIDScheme,
+		identities:   s.identity,
+		hint:         hint,
+		pattern:      pattern,
+		staticKey:    s.staticKey,
+		remoteStatic: remoteStatic,
+		clock:        s.clock,
+		psk:          s.psk,
+		issuer:       s.issuer,
+		connIDs:      s.connIDs,
+	}
+	return newSession(lowerRaddr, initiator, params, func(ctx context.Context, raddr p2p.Addr, data []byte) error {
+		s.observeWire(WireSend, raddr, data)
+		return s.swarm.Tell(ctx, raddr, p2p.IOVec{data})
 	})
-	s.lowerToSession[key] = sess
-	return sess, true
+}
+
+// getSession returns the session for lowerRaddr in the specified direction, or nil if there isn't one.
+func (s *Swarm) getSession(lowerRaddr p2p.Addr, initiator bool) *session {
+	sess, _ := s.sessions.Get(sessionKey{raddr: lowerRaddr.Key(), initiator: initiator})
+	return sess
 }
 
 // getAnyReadySession gets either an inbound or outbound session for an Addr
 // it biases the outbound session if either handshake's handshake is not done.
 func (s *Swarm) getAnyReadySession(raddr Addr) *session {
-	outKey, inKey := makeSessionKeys(raddr.Addr)
-	now := time.Now()
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	outSess := s.lowerToSession[outKey]
-	inSess := s.lowerToSession[inKey]
-	sessions := []*session{outSess, inSess}
-	for i, sess := range sessions {
-		if sess == nil || sess.isExpired(now) || !sess.isReady() {
-			sessions[i] = nil
-		}
-	}
-	mrand.Shuffle(2, func(i, j int) {
-		sessions[i], sessions[j] = sessions[j], sessions[i]
+	return s.getReadySession(raddr, func(*session) bool { return true })
+}
+
+// getReadySessionAs is like getAnyReadySession, but only returns a session using the local identity localID.
+func (s *Swarm) getReadySessionAs(raddr Addr, localID p2p.PeerID) *session {
+	return s.getReadySession(raddr, func(sess *session) bool {
+		return sess.getLocalID() == localID
 	})
-	for _, sess := range sessions {
-		if sess != nil {
-			return sess
-		}
+}
+
+func (s *Swarm) getReadySession(raddr Addr, match func(*session) bool) *session {
+	outKey, inKey := makeSessionKeys(raddr.Addr)
+	outSess, _ := s.sessions.Get(outKey)
+	inSess, _ := s.sessions.Get(inKey)
+	if outSess != nil && (!outSess.isReady() || outSess.isSuperseded() || !match(outSess)) {
+		outSess = nil
+	}
+	if inSess != nil && (!inSess.isReady() || inSess.isSuperseded() || !match(inSess)) {
+		inSess = nil
 	}
-	return nil
+	return s.selectPolicy.choose(outSess, inSess)
+}
+
+// identity returns the key for the local identity id, or nil if the swarm does not have it.
+func (s *Swarm) identity(id p2p.PeerID) p2p.PrivateKey {
+	return s.identities[id]
+}
+
+// identityFor returns the local identity to use for sessions dialed to raddr.
+func (s *Swarm) identityFor(raddr Addr) (p2p.PeerID, error) {
+	if s.selectIdentity == nil {
+		return s.localID, nil
+	}
+	id := s.selectIdentity(raddr)
+	if _, exists := s.identities[id]; !exists {
+		return p2p.PeerID{}, errors.Errorf("noiseswarm: no local identity %v", id)
+	}
+	return id, nil
 }
 
 // delete session deletes the session at lowerRaddr if it exists
@@ -233,32 +705,90 @@ func (s *Swarm) deleteSession(lowerRaddr p2p.Addr, x *session) {
 		raddr:     lowerRaddr.Key(),
 		initiator: x.initiator,
 	}
+	s.sessions.DeleteIf(key, func(y *session) bool {
+		return x == y
+	})
+}
+
+func (s *Swarm) putTicket(lowerRaddr p2p.Addr, t *ticket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tickets[lowerRaddr.Key()] = t
+}
+
+// takeTicket removes and returns an unexpired ticket for lowerRaddr, or nil if there isn't one.
+// tickets can only be redeemed once, so it is not returned to the map.
+func (s *Swarm) takeTicket(lowerRaddr p2p.Addr) *ticket {
 	s.mu.Lock()
-	y := s.lowerToSession[key]
-	if x == y {
-		delete(s.lowerToSession, key)
+	defer s.mu.Unlock()
+	t := s.tickets[lowerRaddr.Key()]
+	delete(s.tickets, lowerRaddr.Key())
+	if t == nil || !s.clock.Now().Before(t.expiresAt) {
+		return nil
 	}
-	s.mu.Unlock()
+	return t
+}
+
+func (s *Swarm) putStatic(id p2p.PeerID, key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statics[id] = append([]byte{}, key...)
+}
+
+// getStatic returns the static key of the peer with id, or nil if it is not known.
+func (s *Swarm) getStatic(id p2p.PeerID) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statics[id]
+}
+
+func (s *Swarm) forgetStatic(id p2p.PeerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.statics, id)
+}
+
+// CleanupStopped returns true if the goroutine which periodically calls Cleanup has stopped, which happens when the swarm is closed.
+// Swarms created with WithManualCleanup never start it, so always return false.
+func (s *Swarm) CleanupStopped() bool {
+	return atomic.LoadInt32(&s.cleanupStopped) == 1
+}
+
+// Receiving returns true while the swarm is receiving messages from the lower swarm.
+// It becomes false when the lower swarm stops serving, for example because it was closed.
+func (s *Swarm) Receiving() bool {
+	return atomic.LoadInt32(&s.receiving) == 1
 }
 
 func (s *Swarm) cleanupLoop(ctx context.Context) {
-	ticker := time.NewTicker(MaxSessionLife)
+	defer atomic.StoreInt32(&s.cleanupStopped, 1)
+	ticker := s.clock.NewTicker(MaxSessionLife)
 	defer ticker.Stop()
 	for {
-		now := time.Now()
-		s.mu.Lock()
-		for k, sess := range s.lowerToSession {
-			if sess.isExpired(now) {
-				delete(s.lowerToSession, k)
-			}
-		}
-		s.mu.Unlock()
+		s.Cleanup(s.clock.Now())
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-ticker.Chan():
+		}
+	}
+}
+
+// Cleanup removes sessions and resumption tickets which have expired as of now.
+// It is called periodically unless the swarm was created with WithManualCleanup.
+func (s *Swarm) Cleanup(now time.Time) {
+	s.sessions.Cleanup(now)
+	s.cleanupConns()
+	s.mu.Lock()
+	for k, t := range s.tickets {
+		if !now.Before(t.expiresAt) {
+			delete(s.tickets, k)
 		}
 	}
+	s.mu.Unlock()
+	if s.issuer != nil {
+		s.issuer.cleanup(now)
+	}
 }
 
 func backoffTime(n int, max time.Duration) time.Duration {
@@ -1,12 +1,29 @@
 package noiseswarm
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/internal/framing"
 	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/brendoncarroll/go-p2p/s/faultyswarm"
 	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/multiswarm"
 	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/flynn/noise"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestSwarm(t *testing.T) {
@@ -27,6 +44,1550 @@ func TestSwarm(t *testing.T) {
 	})
 }
 
+func TestSwarmXX(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm(), p2ptest.NewTestKey(t, i+1), WithHandshakePattern(PatternXX))
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestSwarmConnectionIDs(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm(), p2ptest.NewTestKey(t, i+1), WithConnectionIDs())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestAskSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteAskSwarm(t, func(t testing.TB, n int) []p2p.AskSwarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.AskSwarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm(), p2ptest.NewTestKey(t, i+1))
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseAskSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestConcurrentAsks(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		// respond out of order
+		time.Sleep(time.Duration(mrand.Intn(10)) * time.Millisecond)
+		w.Write([]byte("response to "))
+		w.Write(msg.Payload)
+	})
+	bAddr := b.LocalAddrs()[0]
+
+	const n = 100
+	eg := errgroup.Group{}
+	for i := 0; i < n; i++ {
+		req := strconv.Itoa(i)
+		eg.Go(func() error {
+			resp, err := a.Ask(ctx, bAddr, p2p.IOVec{[]byte(req)})
+			if err != nil {
+				return err
+			}
+			if string(resp) != "response to "+req {
+				return fmt.Errorf("got response %q for request %q", resp, req)
+			}
+			return nil
+		})
+	}
+	require.NoError(t, eg.Wait())
+}
+
+func TestAskResponseTooLarge(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(1024))
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write(make([]byte, 2048))
+	})
+	_, err := a.Ask(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")})
+	require.Equal(t, p2p.ErrResponseTooLarge, err)
+}
+
+func TestMaxConcurrentAsks(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	started := make(chan struct{}, MaxConcurrentAsks+1)
+	release := make(chan struct{})
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		started <- struct{}{}
+		<-release
+		w.Write(msg.Payload)
+	})
+	bAddr := b.LocalAddrs()[0]
+	require.NoError(t, a.Dial(ctx, bAddr, nil))
+
+	eg := errgroup.Group{}
+	for i := 0; i < MaxConcurrentAsks; i++ {
+		eg.Go(func() error {
+			_, err := a.Ask(ctx, bAddr, p2p.IOVec{[]byte("hello")})
+			return err
+		})
+	}
+	for i := 0; i < MaxConcurrentAsks; i++ {
+		<-started
+	}
+	// every slot is taken, so the next ask is dropped without reaching the handler.
+	ctx2, cf := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cf()
+	_, err := a.Ask(ctx2, bAddr, p2p.IOVec{[]byte("dropped")})
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Len(t, started, 0)
+	close(release)
+	require.NoError(t, eg.Wait())
+	// the slots are freed once the asks have been handled.
+	resp, err := a.Ask(ctx, bAddr, p2p.IOVec{[]byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, "after", string(resp))
+}
+
+func TestAskWithoutServingTells(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write(msg.Payload)
+	})
+	bAddr := b.LocalAddrs()[0]
+	// nothing serves b's tells, so they fill its queue and the rest are dropped.
+	for i := 0; i < TellQueueSize+10; i++ {
+		require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("tell")}))
+	}
+	resp, err := a.Ask(ctx, bAddr, p2p.IOVec{[]byte("ask")})
+	require.NoError(t, err)
+	require.Equal(t, "ask", string(resp))
+}
+
+func TestTellAck(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	bLower := &dropSwarm{Swarm: r.NewSwarm()}
+	clock := clockwork.NewFakeClock()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithClock(clock), WithManualCleanup())
+	b := New(bLower, p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	recv := make(chan string, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	bAddr := b.LocalAddrs()[0]
+
+	require.NoError(t, a.TellAck(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, "hello", <-recv)
+
+	// the message arrives, but the ack is lost
+	bLower.setDrop(true)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- a.TellAck(ctx, bAddr, p2p.IOVec{[]byte("world")})
+	}()
+	require.Equal(t, "world", <-recv)
+	clock.BlockUntil(1)
+	clock.Advance(AskTimeout)
+	require.Equal(t, ErrAckTimeout, <-errs)
+
+	bLower.setDrop(false)
+	require.NoError(t, a.TellAck(ctx, bAddr, p2p.IOVec{[]byte("again")}))
+	require.Equal(t, "again", <-recv)
+}
+
+func TestServeTellsAuthenticated(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	aKey := p2ptest.NewTestKey(t, 0)
+	lower := r.NewSwarm()
+	a := New(lower, aKey)
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+
+	type tell struct {
+		src     p2p.PeerID
+		lower   p2p.Addr
+		payload string
+	}
+	recv := make(chan tell, 1)
+	go b.ServeTellsAuthenticated(func(src p2p.PeerID, lower p2p.Addr, payload []byte) {
+		recv <- tell{src: src, lower: lower, payload: string(payload)}
+	})
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, tell{
+		src:     p2p.NewPeerID(aKey.Public()),
+		lower:   lower.LocalAddrs()[0],
+		payload: "hello",
+	}, <-recv)
+}
+
+func TestOnMalformed(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	raw := r.NewSwarm()
+	go raw.ServeTells(p2p.NoOpTellHandler)
+	type report struct {
+		src p2p.Addr
+		err error
+	}
+	reports := make(chan report, 1)
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithOnMalformed(func(src p2p.Addr, err error) {
+		reports <- report{src: src, err: err}
+	}))
+	go a.ServeTells(func(*p2p.Message) {
+		t.Error("malformed message should not be delivered")
+	})
+
+	for _, payload := range [][]byte{
+		{1, 2},
+		{0, 0, 0, 0, 1, 2, 3},
+	} {
+		require.NoError(t, raw.Tell(ctx, a.LocalAddrs()[0].(Addr).Addr, p2p.IOVec{payload}))
+		rep := <-reports
+		require.Error(t, rep.err)
+		require.Equal(t, raw.LocalAddrs()[0], rep.src)
+		var malformed *ErrMalformed
+		require.True(t, errors.As(rep.err, &malformed))
+		require.Equal(t, raw.LocalAddrs()[0], malformed.Src)
+		require.Equal(t, len(payload), malformed.Len)
+		require.Error(t, malformed.Cause)
+		require.Contains(t, malformed.Error(), fmt.Sprint(raw.LocalAddrs()[0]))
+	}
+}
+
+func TestOnWire(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	type wireMsg struct {
+		dir   WireDirection
+		lower p2p.Addr
+		data  []byte
+	}
+	var mu sync.Mutex
+	wire := map[string][]wireMsg{}
+	observer := func(name string) Option {
+		return WithOnWire(func(dir WireDirection, lower p2p.Addr, data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			wire[name] = append(wire[name], wireMsg{dir: dir, lower: lower, data: append([]byte{}, data...)})
+		})
+	}
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), observer("a"))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), observer("b"))
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan struct{}, 1)
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(func(*p2p.Message) { recv <- struct{}{} })
+
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	<-recv
+	mu.Lock()
+	defer mu.Unlock()
+	aLower, bLower := a.LocalAddrs()[0].(Addr).Addr, b.LocalAddrs()[0].(Addr).Addr
+	// split returns the data of the messages in each direction, checking they were with lower
+	split := func(msgs []wireMsg, lower p2p.Addr) (sent, received [][]byte) {
+		for _, m := range msgs {
+			require.Equal(t, lower, m.lower)
+			if m.dir == WireSend {
+				sent = append(sent, m.data)
+			} else {
+				received = append(received, m.data)
+			}
+		}
+		return sent, received
+	}
+	aSent, aRecv := split(wire["a"], bLower)
+	bSent, bRecv := split(wire["b"], aLower)
+	// each side sees exactly what the other put on the wire
+	require.Equal(t, aSent, bRecv)
+	require.Equal(t, bSent, aRecv)
+
+	// the first message is the handshake, and the last is the encrypted tell
+	first, err := parseMessage(aSent[0])
+	require.NoError(t, err)
+	require.Equal(t, countInit, first.getCounter())
+	last, err := parseMessage(aSent[len(aSent)-1])
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, last.getCounter(), countPostHandshake)
+	require.NotContains(t, string(aSent[len(aSent)-1]), "hello")
+	require.NotEmpty(t, bSent)
+}
+
+func TestCloseFromHandler(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	closed := make(chan error, 1)
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		closed <- b.Close()
+	})
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	ctx2, cf := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cf()
+	go a.Ask(ctx2, b.LocalAddrs()[0], p2p.IOVec{[]byte("close")})
+	require.NoError(t, <-closed)
+}
+
+func TestCloseWithStuckHandler(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	// the handler ignores its context
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		close(started)
+		<-release
+	})
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	go a.Ask(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("stuck")})
+	<-started
+	require.NoError(t, b.Close())
+}
+
+func TestCloseDuringDial(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	for _, tc := range []struct {
+		name  string
+		lower p2p.Swarm
+	}{
+		// the handshake times out, so the Tell is waiting for the session to be ready
+		{name: "drop", lower: faultyswarm.New(r.NewSwarm(), faultyswarm.WithDropRate(1))},
+		// sending fails, so the Tell is waiting to retry
+		{name: "error", lower: &errSwarm{Swarm: r.NewSwarm()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := clockwork.NewFakeClock()
+			a := New(tc.lower, p2ptest.NewTestKey(t, 0), WithClock(clock), WithManualCleanup())
+			b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+			defer b.Close()
+			errs := make(chan error, 1)
+			go func() {
+				errs <- a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")})
+			}()
+			// wait for the Tell to be waiting on the handshake timeout, or the backoff.
+			clock.BlockUntil(1)
+			start := time.Now()
+			require.NoError(t, a.Close())
+			require.Equal(t, p2p.ErrSwarmClosed, <-errs)
+			require.True(t, time.Since(start) < time.Second)
+		})
+	}
+}
+
+// errSwarm fails every Tell
+type errSwarm struct {
+	p2p.Swarm
+}
+
+func (s *errSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	return errors.New("errSwarm: tell failed")
+}
+
+func TestHandshakeTooLarge(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	raw := r.NewSwarm()
+	go raw.ServeTells(p2p.NoOpTellHandler)
+	errs := make(chan error, 1)
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithOnMalformed(func(src p2p.Addr, err error) {
+		errs <- err
+	}))
+	defer a.Close()
+	dst := a.LocalAddrs()[0].(Addr).Addr
+
+	initMsg := newMessage(directionInitToResp, countInit)
+	oversized := initMsg.setBody(make([]byte, MaxHandshakeMessageSize))
+	require.NoError(t, raw.Tell(ctx, dst, p2p.IOVec{oversized}))
+	require.Error(t, <-errs)
+	// the message was dropped before a session was created for it
+	require.Equal(t, 0, a.sessions.Len())
+
+	// the limit does not apply to data messages
+	_, err := parseMessage(initMsg.setBody(make([]byte, MaxHandshakeMessageSize-4)))
+	require.NoError(t, err)
+	dataMsg := newMessage(directionInitToResp, countPostHandshake)
+	_, err = parseMessage(dataMsg.setBody(make([]byte, MaxHandshakeMessageSize)))
+	require.NoError(t, err)
+}
+
+// TestUnframedPeer performs a handshake the way parties before frames did, with empty payloads,
+// and checks that plaintexts are exchanged as tells without a frame type.
+func TestUnframedPeer(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	raw := r.NewSwarm()
+	rawRecv := make(chan message, 10)
+	go raw.ServeTells(func(msg *p2p.Message) {
+		m, err := parseMessage(append([]byte{}, msg.Payload...))
+		require.NoError(t, err)
+		rawRecv <- m
+	})
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithCompression())
+	defer b.Close()
+	recv := make(chan string, 10)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	dst := b.LocalAddrs()[0].(Addr).Addr
+
+	hsstate := newHandshakeState(true, PatternNN, nil, noise.DHKey{}, nil)
+	out, _, _, err := hsstate.WriteMessage(newMessage(directionInitToResp, countInit), nil)
+	require.NoError(t, err)
+	require.NoError(t, raw.Tell(ctx, dst, p2p.IOVec{out}))
+	resp := <-rawRecv
+	require.Equal(t, countResp, resp.getCounter())
+	payload, cs1, cs2, err := hsstate.ReadMessage(nil, resp.getBody())
+	require.NoError(t, err)
+	require.Empty(t, payload)
+	outCS, inCS := pickCS(true, cs1, cs2)
+	key := p2ptest.NewTestKey(t, 0)
+	intro, err := signChannelBinding(key, hsstate.ChannelBinding())
+	require.NoError(t, err)
+	require.NoError(t, raw.Tell(ctx, dst, p2p.IOVec{encryptMessage(outCS, countSigInitToResp, p2p.IOVec{intro})}))
+	sig := <-rawRecv
+	require.Equal(t, countSigRespToInit, sig.getCounter())
+
+	require.NoError(t, raw.Tell(ctx, dst, p2p.IOVec{encryptMessage(outCS, countPostHandshake, p2p.IOVec{[]byte("hello")})}))
+	require.Equal(t, "hello", <-recv)
+	addr := Addr{ID: p2p.NewPeerID(key.Public()), Addr: raw.LocalAddrs()[0]}
+	require.NoError(t, b.Tell(ctx, addr, p2p.IOVec{[]byte("reply")}))
+	reply := <-rawRecv
+	ptext, err := decryptMessage(inCS, reply.getCounter(), reply.getBody())
+	require.NoError(t, err)
+	require.Equal(t, "reply", string(ptext))
+
+	// only tells are sent, so capabilities are not exchanged.
+	_, err = b.Ask(ctx, addr, p2p.IOVec{[]byte("ask")})
+	require.Equal(t, ErrNoFrames, err)
+	require.Equal(t, ErrNoFrames, b.TellAck(ctx, addr, p2p.IOVec{[]byte("ack")}))
+	caps, ok := b.SessionCapabilities(addr)
+	require.True(t, ok)
+	require.Equal(t, Capabilities(0), caps)
+	require.Len(t, rawRecv, 0)
+}
+
+func TestSessionHandshakeInfo(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	aAddr, bAddr := a.LocalAddrs()[0], b.LocalAddrs()[0]
+
+	_, ok := a.SessionHandshakeInfo(bAddr)
+	require.False(t, ok)
+
+	before := time.Now()
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	for _, tc := range []struct {
+		s         *Swarm
+		addr      p2p.Addr
+		initiator bool
+	}{
+		{s: a, addr: bAddr, initiator: true},
+		{s: b, addr: aAddr, initiator: false},
+	} {
+		info, ok := tc.s.SessionHandshakeInfo(tc.addr)
+		require.True(t, ok)
+		require.Equal(t, "NN", info.Pattern)
+		require.Equal(t, "25519_ChaChaPoly_BLAKE2b", info.CipherSuite)
+		require.Equal(t, tc.initiator, info.Initiator)
+		require.False(t, info.Resumed)
+		require.False(t, info.CompletedAt.Before(before))
+		require.False(t, info.CompletedAt.After(time.Now()))
+	}
+}
+
+func TestSessionKeyFingerprint(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	aAddr, bAddr := a.LocalAddrs()[0], b.LocalAddrs()[0]
+
+	_, ok := a.SessionKeyFingerprint(bAddr)
+	require.False(t, ok)
+
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	fp1, ok := a.SessionKeyFingerprint(bAddr)
+	require.True(t, ok)
+	require.Len(t, fp1, 32)
+	// both parties have the same fingerprint, and it does not change while the session is used
+	bfp, ok := b.SessionKeyFingerprint(aAddr)
+	require.True(t, ok)
+	require.Equal(t, fp1, bfp)
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello again")}))
+	fp, ok := a.SessionKeyFingerprint(bAddr)
+	require.True(t, ok)
+	require.Equal(t, fp1, fp)
+
+	// a new handshake uses new keys
+	require.True(t, a.DropSession(bAddr))
+	require.True(t, b.DropSession(aAddr))
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	fp2, ok := a.SessionKeyFingerprint(bAddr)
+	require.True(t, ok)
+	require.NotEqual(t, fp1, fp2)
+	bfp, ok = b.SessionKeyFingerprint(aAddr)
+	require.True(t, ok)
+	require.Equal(t, fp2, bfp)
+}
+
+func TestManualCleanup(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithManualCleanup())
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithManualCleanup())
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	now := time.Now()
+	a.Cleanup(now)
+	b.Cleanup(now)
+	require.Equal(t, 1, a.sessions.Len())
+	require.Equal(t, 1, b.sessions.Len())
+
+	later := now.Add(SessionIdleTimeout + time.Second)
+	a.Cleanup(later)
+	b.Cleanup(later)
+	require.Equal(t, 0, a.sessions.Len())
+	require.Equal(t, 0, b.sessions.Len())
+}
+
+func TestSessionExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithClock(clock), WithManualCleanup())
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithClock(clock), WithManualCleanup())
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	bAddr := b.LocalAddrs()[0]
+
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	clock.Advance(SessionIdleTimeout - time.Second)
+	_, err := a.LookupPublicKey(ctx, bAddr)
+	require.NoError(t, err)
+
+	clock.Advance(2 * time.Second)
+	_, err = a.LookupPublicKey(ctx, bAddr)
+	require.Equal(t, p2p.ErrPublicKeyNotFound, err)
+	require.Equal(t, 1, b.sessions.Len())
+	b.Cleanup(clock.Now())
+	require.Equal(t, 0, b.sessions.Len())
+}
+
+func TestIdleSessions(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithClock(clock), WithManualCleanup())
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithClock(clock), WithManualCleanup())
+	c := New(r.NewSwarm(), p2ptest.NewTestKey(t, 2), WithClock(clock), WithManualCleanup())
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	for _, x := range []*Swarm{a, b, c} {
+		go x.ServeTells(p2p.NoOpTellHandler)
+	}
+	bAddr, cAddr := b.LocalAddrs()[0], c.LocalAddrs()[0]
+
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, a.Tell(ctx, cAddr, p2p.IOVec{[]byte("hello")}))
+	require.Empty(t, a.IdleSessions(10*time.Second))
+
+	clock.Advance(20 * time.Second)
+	// sending keeps a's session with c active, even though nothing is received.
+	require.NoError(t, a.Tell(ctx, cAddr, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, []p2p.Addr{bAddr}, a.IdleSessions(10*time.Second))
+	require.Len(t, b.IdleSessions(10*time.Second), 1)
+	require.Empty(t, c.IdleSessions(10*time.Second))
+
+	require.True(t, a.DropSession(bAddr))
+	require.False(t, a.DropSession(bAddr))
+	require.Empty(t, a.IdleSessions(10*time.Second))
+	_, err := a.LookupPublicKey(ctx, bAddr)
+	require.Equal(t, p2p.ErrPublicKeyNotFound, err)
+	// a new session is established on the next Tell
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	_, err = a.LookupPublicKey(ctx, bAddr)
+	require.NoError(t, err)
+}
+
+func TestPSK(t *testing.T) {
+	ctx := context.Background()
+	psk1 := bytes.Repeat([]byte{1}, PSKSize)
+	psk2 := bytes.Repeat([]byte{2}, PSKSize)
+	for _, tc := range []struct {
+		name       string
+		pskA, pskB []byte
+		ok         bool
+	}{
+		{name: "match", pskA: psk1, pskB: psk1, ok: true},
+		{name: "mismatch", pskA: psk1, pskB: psk2},
+		{name: "initiator-only", pskA: psk1},
+		{name: "responder-only", pskB: psk1},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			optsFor := func(psk []byte) []Option {
+				if psk == nil {
+					return nil
+				}
+				return []Option{WithPSK(psk)}
+			}
+			r := memswarm.NewRealm()
+			a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), optsFor(tc.pskA)...)
+			b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), optsFor(tc.pskB)...)
+			defer a.Close()
+			defer b.Close()
+			recv := make(chan string, 1)
+			go a.ServeTells(p2p.NoOpTellHandler)
+			go b.ServeTells(func(msg *p2p.Message) {
+				recv <- string(msg.Payload)
+			})
+			err := a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")})
+			if !tc.ok {
+				require.Error(t, err)
+				require.Len(t, recv, 0)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "hello", <-recv)
+			info, ok := a.SessionHandshakeInfo(b.LocalAddrs()[0])
+			require.True(t, ok)
+			require.Equal(t, "NNpsk2", info.Pattern)
+		})
+	}
+}
+
+func TestHandshakePatterns(t *testing.T) {
+	ctx := context.Background()
+	psk := bytes.Repeat([]byte{1}, PSKSize)
+	for _, tc := range []struct {
+		name    string
+		opts    []Option
+		usePSK  bool
+		dial    func(a, b *Swarm) error
+		pattern string
+	}{
+		{name: "NN", pattern: "NN"},
+		{name: "XX", opts: []Option{WithHandshakePattern(PatternXX)}, pattern: "XX"},
+		{name: "IK", pattern: "IK", dial: func(a, b *Swarm) error {
+			return a.Dial(ctx, b.LocalAddrs()[0], b.StaticPublicKey())
+		}},
+		// IK without a known static key falls back to XX
+		{name: "IKFallback", opts: []Option{WithHandshakePattern(PatternIK)}, pattern: "XX"},
+		{name: "XXpsk", opts: []Option{WithHandshakePattern(PatternXX)}, usePSK: true, pattern: "XXpsk2"},
+		{name: "IKpsk", usePSK: true, pattern: "IKpsk2", dial: func(a, b *Swarm) error {
+			return a.Dial(ctx, b.LocalAddrs()[0], b.StaticPublicKey())
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := memswarm.NewRealm()
+			aOpts := tc.opts
+			// the responder accepts any pattern, so it only needs the psk.
+			var bOpts []Option
+			if tc.usePSK {
+				aOpts = append(aOpts, WithPSK(psk))
+				bOpts = append(bOpts, WithPSK(psk))
+			}
+			a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), aOpts...)
+			b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), bOpts...)
+			defer a.Close()
+			defer b.Close()
+			recv := make(chan string, 1)
+			go a.ServeTells(p2p.NoOpTellHandler)
+			go b.ServeTells(func(msg *p2p.Message) {
+				recv <- string(msg.Payload)
+			})
+			if tc.dial != nil {
+				require.NoError(t, tc.dial(a, b))
+			}
+			require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+			require.Equal(t, "hello", <-recv)
+
+			aInfo, ok := a.SessionHandshakeInfo(b.LocalAddrs()[0])
+			require.True(t, ok)
+			require.Equal(t, tc.pattern, aInfo.Pattern)
+			bInfo, ok := b.SessionHandshakeInfo(a.LocalAddrs()[0])
+			require.True(t, ok)
+			require.Equal(t, tc.pattern, bInfo.Pattern)
+		})
+	}
+}
+
+func TestPatternXXLearnsStatic(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithHandshakePattern(PatternXX))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	dst := b.LocalAddrs()[0]
+
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, b.StaticPublicKey(), a.getStatic(dst.(Addr).ID))
+
+	// the next session uses IK, since b's static key is known.
+	require.True(t, a.DropSession(dst))
+	require.True(t, b.DropSession(a.LocalAddrs()[0]))
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	info, ok := a.SessionHandshakeInfo(dst)
+	require.True(t, ok)
+	require.Equal(t, "IK", info.Pattern)
+}
+
+func TestPatternIKWrongStatic(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	dst := b.LocalAddrs()[0]
+
+	// a made up static key is forgotten after the IK handshake fails, and a redial with NN succeeds.
+	wrong := New(r.NewSwarm(), p2ptest.NewTestKey(t, 2))
+	defer wrong.Close()
+	require.NoError(t, a.Dial(ctx, dst, wrong.StaticPublicKey()))
+	info, ok := a.SessionHandshakeInfo(dst)
+	require.True(t, ok)
+	require.Equal(t, "NN", info.Pattern)
+	require.Nil(t, a.getStatic(dst.(Addr).ID))
+
+	require.Error(t, a.Dial(ctx, dst, []byte("too short")))
+}
+
+func TestWithStaticKey(t *testing.T) {
+	r := memswarm.NewRealm()
+	staticKey := bytes.Repeat([]byte{2}, StaticKeySize)
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithStaticKey(staticKey))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithStaticKey(staticKey))
+	defer a.Close()
+	defer b.Close()
+	require.Equal(t, a.StaticPublicKey(), b.StaticPublicKey())
+	require.Len(t, a.StaticPublicKey(), StaticKeySize)
+}
+
+func TestParseInitPayload(t *testing.T) {
+	hint := bytes.Repeat([]byte{3}, len(p2p.PeerID{}))
+	for _, tc := range []struct {
+		hint    []byte
+		pattern HandshakePattern
+	}{
+		{nil, PatternNN},
+		{hint, PatternNN},
+		{nil, PatternXX},
+		{hint, PatternXX},
+	} {
+		actualHint, isXX, framed := parseInitPayload(makeInitPayload(tc.hint, tc.pattern))
+		require.Equal(t, len(tc.hint), len(actualHint))
+		require.Equal(t, tc.pattern == PatternXX, isXX)
+		require.True(t, framed)
+	}
+	// parties before frames send an empty payload
+	_, _, framed := parseInitPayload(nil)
+	require.False(t, framed)
+	require.True(t, parseRespPayload(makeRespPayload(true)))
+	require.False(t, parseRespPayload(makeRespPayload(false)))
+}
+
+func TestResumption(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lowerA := &countSwarm{Swarm: r.NewSwarm()}
+	a := New(lowerA, p2ptest.NewTestKey(t, 0), WithResumption(time.Minute))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithResumption(time.Minute))
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan string, 10)
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	dst := b.LocalAddrs()[0]
+	lowerDst := dst.(Addr).Addr
+
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("full")}))
+	require.Equal(t, "full", <-recv)
+	require.Equal(t, countInit, lowerA.getCounts()[0])
+	hasTicket := func() bool { return a.peekTicket(lowerDst) != nil }
+	require.Eventually(t, hasTicket, time.Second, time.Millisecond)
+
+	// forget the session, the next tell should resume.
+	a.clearSessions()
+	lowerA.reset()
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("resumed")}))
+	require.Equal(t, "resumed", <-recv)
+	require.Equal(t, []uint32{countResume, countPostHandshake}, lowerA.getCounts()[:2])
+	info, ok := a.SessionHandshakeInfo(dst)
+	require.True(t, ok)
+	require.True(t, info.Resumed)
+	require.Equal(t, ResumePattern, info.Pattern)
+	// a new ticket is issued for the resumed session.
+	require.Eventually(t, hasTicket, time.Second, time.Millisecond)
+	require.NoError(t, b.Tell(ctx, a.LocalAddrs()[0], p2p.IOVec{[]byte("reply")}))
+}
+
+func TestResumptionRejected(t *testing.T) {
+	ctx := context.Background()
+	for name, corrupt := range map[string]func(*ticket){
+		"forged": func(tk *ticket) {
+			tk.sealed[len(tk.sealed)-1] ^= 1
+		},
+		"redeemed": func(tk *ticket) {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := memswarm.NewRealm()
+			lowerA := &countSwarm{Swarm: r.NewSwarm()}
+			a := New(lowerA, p2ptest.NewTestKey(t, 0), WithResumption(time.Minute))
+			b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithResumption(time.Minute))
+			defer a.Close()
+			defer b.Close()
+			recv := make(chan string, 10)
+			go a.ServeTells(p2p.NoOpTellHandler)
+			go b.ServeTells(func(msg *p2p.Message) {
+				recv <- string(msg.Payload)
+			})
+			dst := b.LocalAddrs()[0]
+			lowerDst := dst.(Addr).Addr
+			require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("full")}))
+			require.Equal(t, "full", <-recv)
+			require.Eventually(t, func() bool { return a.peekTicket(lowerDst) != nil }, time.Second, time.Millisecond)
+
+			tk := a.peekTicket(lowerDst)
+			if name == "redeemed" {
+				// redeem the ticket so that it is spent.
+				_, _, _, err := b.issuer.redeem(tk.sealed, time.Now())
+				require.NoError(t, err)
+			}
+			corrupt(tk)
+			a.clearSessions()
+			lowerA.reset()
+
+			// the ticket is rejected, and a full handshake is performed.
+			require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("after")}))
+			require.Equal(t, "after", <-recv)
+			require.Equal(t, countResume, lowerA.getCounts()[0])
+			require.Contains(t, lowerA.getCounts(), countInit)
+		})
+	}
+}
+
+func TestResumptionUnsupported(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lowerA := &countSwarm{Swarm: r.NewSwarm()}
+	a := New(lowerA, p2ptest.NewTestKey(t, 0), WithResumption(time.Minute))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	dst := b.LocalAddrs()[0]
+	lowerDst := dst.(Addr).Addr
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("full")}))
+	caps, ok := a.SessionCapabilities(dst)
+	require.True(t, ok)
+	require.False(t, caps.Has(CapResumption))
+	require.Nil(t, a.peekTicket(lowerDst))
+
+	// a ticket from somewhere else is NACKed by a responder without resumption, and a full handshake is performed.
+	issuer := newTicketIssuer(time.Minute, a.clock)
+	ticketMsg, err := issuer.issue(a.localID, b.PublicKey(), a.clock.Now())
+	require.NoError(t, err)
+	expiresAt, psk, sealed, err := parseTicket(ticketMsg)
+	require.NoError(t, err)
+	a.putTicket(lowerDst, &ticket{sealed: sealed, psk: psk, expiresAt: expiresAt, remotePublicKey: b.PublicKey(), localID: a.localID})
+	a.clearSessions()
+	lowerA.reset()
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("after")}))
+	require.Equal(t, countResume, lowerA.getCounts()[0])
+	require.Contains(t, lowerA.getCounts(), countInit)
+	info, ok := a.SessionHandshakeInfo(dst)
+	require.True(t, ok)
+	require.False(t, info.Resumed)
+}
+
+func TestOnPeerAddrs(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	type advert struct {
+		id    p2p.PeerID
+		addrs []p2p.Addr
+	}
+	newSwarm := func(i int, ch chan advert) *Swarm {
+		x := New(r.NewSwarm(), p2ptest.NewTestKey(t, i), WithOnPeerAddrs(func(id p2p.PeerID, addrs []p2p.Addr) {
+			ch <- advert{id: id, addrs: addrs}
+		}))
+		t.Cleanup(func() { x.Close() })
+		return x
+	}
+	aCh, bCh := make(chan advert, 1), make(chan advert, 1)
+	a, b := newSwarm(0, aCh), newSwarm(1, bCh)
+	recv := make(chan string, 1)
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, "hello", <-recv)
+	// each side learns the other's addresses, with the other's PeerID
+	aLearned, bLearned := <-aCh, <-bCh
+	require.Equal(t, b.localID, aLearned.id)
+	require.Equal(t, b.LocalAddrs(), aLearned.addrs)
+	require.Equal(t, a.localID, bLearned.id)
+	require.Equal(t, a.LocalAddrs(), bLearned.addrs)
+	// addresses are only advertised once per session
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, "hello", <-recv)
+	require.Len(t, aCh, 0)
+	require.Len(t, bCh, 0)
+
+	// addresses which the lower swarm can't parse are dropped
+	sess := b.getAnyReadySession(a.LocalAddrs()[0].(Addr))
+	require.NotNil(t, sess)
+	body := framing.AppendUvarint(nil, 3)
+	body = append(body, "abc"...)
+	body = framing.AppendUvarint(body, 1)
+	body = append(body, "7"...)
+	require.NoError(t, b.handleAddrs(sess, body))
+	require.Equal(t, []p2p.Addr{Addr{ID: a.localID, Addr: memswarm.Addr{N: 7}}}, (<-bCh).addrs)
+}
+
+func TestAddrsFrame(t *testing.T) {
+	addrs := []p2p.Addr{memswarm.Addr{N: 1}, memswarm.Addr{N: 22}}
+	frame := p2p.VecBytes(newAddrsFrame(addrs, 1024))
+	frameType, _, body, err := parseFrame(frame)
+	require.NoError(t, err)
+	require.Equal(t, frameAddrs, frameType)
+	datas, err := parseAddrsFrame(body)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("1"), []byte("22")}, datas)
+
+	// addresses which don't fit are left out
+	datas, err = parseAddrsFrame(p2p.VecBytes(newAddrsFrame(addrs, 4))[1:])
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("1")}, datas)
+
+	_, err = parseAddrsFrame([]byte{5, '1'})
+	require.Error(t, err)
+}
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	newPair := func(bOpts ...Option) (a, b *Swarm, lowerA *countSwarm, recv chan []byte) {
+		lowerA = &countSwarm{Swarm: r.NewSwarm()}
+		a = New(lowerA, p2ptest.NewTestKey(t, 0), WithCompression())
+		b = New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), bOpts...)
+		t.Cleanup(func() {
+			a.Close()
+			b.Close()
+		})
+		recv = make(chan []byte, 1)
+		go a.ServeTells(p2p.NoOpTellHandler)
+		go b.ServeTells(func(msg *p2p.Message) {
+			recv <- append([]byte{}, msg.Payload...)
+		})
+		require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+		require.Equal(t, "hello", string(<-recv))
+		// a advertises its capabilities after the handshake, wait for it so it isn't counted as a tell.
+		capsSize := p2p.VecSize(newCapsFrame(a.localCaps())) + Overhead - frameOverhead
+		require.Eventually(t, func() bool {
+			for _, size := range lowerA.getSizes() {
+				if size == capsSize {
+					return true
+				}
+			}
+			return false
+		}, time.Second, time.Millisecond)
+		return a, b, lowerA, recv
+	}
+	tellSize := func(a, b *Swarm, lowerA *countSwarm, recv chan []byte, data []byte) int {
+		lowerA.reset()
+		require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{data}))
+		require.Equal(t, data, <-recv)
+		sizes := lowerA.getSizes()
+		require.Len(t, sizes, 1)
+		return sizes[0]
+	}
+	zeros := make([]byte, 1000)
+	random := make([]byte, 1000)
+	mrand.Read(random)
+
+	a, b, lowerA, recv := newPair(WithCompression())
+	sess := a.getAnyReadySession(b.LocalAddrs()[0].(Addr))
+	require.Eventually(t, func() bool {
+		return sess.getCaps().Has(CapCompression)
+	}, time.Second, time.Millisecond)
+	// compressible data shrinks, and incompressible data is sent as is
+	require.Less(t, tellSize(a, b, lowerA, recv, zeros), 100)
+	require.Equal(t, len(random)+len(tellHeader)+Overhead-frameOverhead, tellSize(a, b, lowerA, recv, random))
+
+	// asks and their responses are decompressed as well
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write(msg.Payload)
+	})
+	resp, err := a.Ask(ctx, b.LocalAddrs()[0], p2p.IOVec{zeros})
+	require.NoError(t, err)
+	require.Equal(t, zeros, resp)
+
+	// nothing is compressed unless both sides support it
+	a, b, lowerA, recv = newPair()
+	require.Equal(t, len(zeros)+len(tellHeader)+Overhead-frameOverhead, tellSize(a, b, lowerA, recv, zeros))
+}
+
+func TestCapabilities(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	withAddrs := WithOnPeerAddrs(func(p2p.PeerID, []p2p.Addr) {})
+	for _, tc := range []struct {
+		aOpts, bOpts []Option
+		common       Capabilities
+	}{
+		{aOpts: []Option{WithCompression(), withAddrs}, bOpts: []Option{WithCompression(), withAddrs}, common: CapCompression | CapAddrs},
+		{aOpts: []Option{WithCompression(), withAddrs}, bOpts: []Option{WithCompression()}, common: CapCompression},
+		{aOpts: []Option{WithCompression()}, bOpts: []Option{withAddrs}, common: 0},
+		{aOpts: nil, bOpts: nil, common: 0},
+	} {
+		a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), tc.aOpts...)
+		b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), tc.bOpts...)
+		go a.ServeTells(p2p.NoOpTellHandler)
+		go b.ServeTells(p2p.NoOpTellHandler)
+		require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+		// both sides agree on the capabilities they have in common
+		for _, pair := range [][2]*Swarm{{a, b}, {b, a}} {
+			x, y := pair[0], pair[1]
+			require.Eventually(t, func() bool {
+				caps, ok := x.SessionCapabilities(y.LocalAddrs()[0])
+				return ok && caps == tc.common
+			}, time.Second, time.Millisecond, "local=%v", x.localCaps())
+		}
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	}
+}
+
+func TestResumedCapabilities(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithResumption(time.Minute), WithCompression())
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithResumption(time.Minute), WithCompression())
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	dst := b.LocalAddrs()[0]
+	hasCompression := func() bool {
+		caps, _ := a.SessionCapabilities(dst)
+		return caps.Has(CapCompression)
+	}
+
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("full")}))
+	require.Eventually(t, hasCompression, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool { return a.peekTicket(dst.(Addr).Addr) != nil }, time.Second, time.Millisecond)
+
+	// the resumed session starts without capabilities, and learns them from the responder
+	a.clearSessions()
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("resumed")}))
+	info, ok := a.SessionHandshakeInfo(dst)
+	require.True(t, ok)
+	require.True(t, info.Resumed)
+	require.Eventually(t, hasCompression, time.Second, time.Millisecond)
+}
+
+func TestCapsUnknownBits(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithCompression())
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	sess := a.getAnyReadySession(b.LocalAddrs()[0].(Addr))
+	require.NotNil(t, sess)
+
+	// a later version with more capabilities, and more fields in the frame
+	body := p2p.VecBytes(newCapsFrame(CapCompression | 1<<40))[1:]
+	body = append(body, "extension"...)
+	require.NoError(t, a.handleCaps(sess, body))
+	require.Equal(t, CapCompression, sess.getCaps())
+	require.Error(t, a.handleCaps(sess, []byte{0x80}))
+
+	require.Equal(t, "{compression,addrs}", (CapCompression | CapAddrs).String())
+	require.Equal(t, "{resumption}", CapResumption.String())
+	require.Equal(t, "{compression,0x10000000000}", (CapCompression | 1<<40).String())
+}
+
+func TestPeerIDScheme(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	scheme := p2p.NewShakePeerIDScheme(16)
+	keyA, keyB := p2ptest.NewTestKey(t, 0), p2ptest.NewTestKey(t, 1)
+	idA, idB := scheme.Derive(keyA.Public()), scheme.Derive(keyB.Public())
+	// the identities are derived with the scheme, whatever the order of the options
+	server := New(r.NewSwarm(), keyA, WithIdentities(keyB), WithPeerIDScheme(scheme), WithResumption(time.Minute))
+	client := New(r.NewSwarm(), p2ptest.NewTestKey(t, 2), WithPeerIDScheme(scheme), WithPeerIDHint(), WithHandshakePattern(PatternXX))
+	other := New(r.NewSwarm(), p2ptest.NewTestKey(t, 3))
+	defer server.Close()
+	defer client.Close()
+	defer other.Close()
+	addrs := server.LocalAddrs()
+	require.Len(t, addrs, 2)
+	require.Equal(t, idA, addrs[0].(Addr).ID)
+	require.Equal(t, idB, addrs[1].(Addr).ID)
+
+	recv := make(chan *p2p.Message, 10)
+	go server.ServeTells(func(msg *p2p.Message) {
+		recv <- &p2p.Message{Src: msg.Src, Dst: msg.Dst, Payload: append([]byte{}, msg.Payload...)}
+	})
+	go client.ServeTells(p2p.NoOpTellHandler)
+	go other.ServeTells(p2p.NoOpTellHandler)
+
+	clientID := scheme.Derive(client.PublicKey())
+	require.NoError(t, client.Tell(ctx, addrs[1], p2p.IOVec{[]byte("hello")}))
+	msg := <-recv
+	require.Equal(t, clientID, msg.Src.(Addr).ID)
+	require.Equal(t, idB, msg.Dst.(Addr).ID)
+	pub, err := server.LookupPublicKey(ctx, msg.Src)
+	require.NoError(t, err)
+	require.Equal(t, client.PublicKey(), pub)
+
+	// a swarm using the default scheme derives a different id for the server
+	require.Error(t, other.Tell(ctx, addrs[0], p2p.IOVec{[]byte("hello")}))
+}
+
+func TestMultipleIdentities(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	keyA, keyB := p2ptest.NewTestKey(t, 0), p2ptest.NewTestKey(t, 1)
+	idA, idB := p2p.NewPeerID(keyA.Public()), p2p.NewPeerID(keyB.Public())
+	c1 := New(r.NewSwarm(), p2ptest.NewTestKey(t, 2), WithPeerIDHint(), WithResumption(time.Minute))
+	c2 := New(r.NewSwarm(), p2ptest.NewTestKey(t, 3), WithPeerIDHint(), WithResumption(time.Minute))
+	c2ID := p2p.NewPeerID(c2.PublicKey())
+	// server has 2 identities on one lower swarm, and replies to c2 as B
+	server := New(r.NewSwarm(), keyA,
+		WithIdentities(keyB),
+		WithResumption(time.Minute),
+		WithIdentitySelector(func(dst Addr) p2p.PeerID {
+			if dst.ID == c2ID {
+				return idB
+			}
+			return idA
+		}),
+	)
+	defer c1.Close()
+	defer c2.Close()
+	defer server.Close()
+
+	addrs := server.LocalAddrs()
+	require.Len(t, addrs, 2)
+	addrA, addrB := addrs[0].(Addr), addrs[1].(Addr)
+	require.Equal(t, idA, addrA.ID)
+	require.Equal(t, idB, addrB.ID)
+	require.Equal(t, addrA.Addr, addrB.Addr)
+
+	serverRecv := make(chan *p2p.Message, 10)
+	c2Recv := make(chan *p2p.Message, 10)
+	go server.ServeTells(func(msg *p2p.Message) {
+		serverRecv <- &p2p.Message{Src: msg.Src, Dst: msg.Dst, Payload: append([]byte{}, msg.Payload...)}
+	})
+	go c1.ServeTells(p2p.NoOpTellHandler)
+	go c2.ServeTells(func(msg *p2p.Message) {
+		c2Recv <- &p2p.Message{Src: msg.Src, Dst: msg.Dst, Payload: append([]byte{}, msg.Payload...)}
+	})
+
+	// each client reaches the identity it dials
+	require.NoError(t, c1.Tell(ctx, addrA, p2p.IOVec{[]byte("to A")}))
+	msg := <-serverRecv
+	require.Equal(t, "to A", string(msg.Payload))
+	require.Equal(t, idA, msg.Dst.(Addr).ID)
+	require.NoError(t, c2.Tell(ctx, addrB, p2p.IOVec{[]byte("to B")}))
+	msg = <-serverRecv
+	require.Equal(t, "to B", string(msg.Payload))
+	require.Equal(t, idB, msg.Dst.(Addr).ID)
+	pubKey, err := c2.LookupPublicKey(ctx, addrB)
+	require.NoError(t, err)
+	require.Equal(t, keyB.Public(), pubKey)
+
+	// the server replies as B
+	require.NoError(t, server.Tell(ctx, msg.Src, p2p.IOVec{[]byte("from B")}))
+	msg = <-c2Recv
+	require.Equal(t, "from B", string(msg.Payload))
+	require.Equal(t, idB, msg.Src.(Addr).ID)
+
+	// resumed sessions keep the identity they were established with
+	require.Eventually(t, func() bool { return c2.peekTicket(addrB.Addr) != nil }, time.Second, time.Millisecond)
+	c2.clearSessions()
+	require.NoError(t, c2.Tell(ctx, addrB, p2p.IOVec{[]byte("resumed")}))
+	msg = <-serverRecv
+	require.Equal(t, "resumed", string(msg.Payload))
+	require.Equal(t, idB, msg.Dst.(Addr).ID)
+	info, ok := c2.SessionHandshakeInfo(addrB)
+	require.True(t, ok)
+	require.True(t, info.Resumed)
+
+	// without a hint the default identity responds, so dialing B fails
+	c3 := New(r.NewSwarm(), p2ptest.NewTestKey(t, 4))
+	defer c3.Close()
+	go c3.ServeTells(p2p.NoOpTellHandler)
+	require.Error(t, c3.Tell(ctx, addrB, p2p.IOVec{[]byte("to B")}))
+	require.NoError(t, c3.Tell(ctx, addrA, p2p.IOVec{[]byte("to A")}))
+	msg = <-serverRecv
+	require.Equal(t, idA, msg.Dst.(Addr).ID)
+}
+
+func (s *Swarm) clearSessions() {
+	s.sessions.Clear()
+}
+
+func (s *Swarm) peekTicket(lowerRaddr p2p.Addr) *ticket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tickets[lowerRaddr.Key()]
+}
+
+func TestConnectionMigration(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lowerA := &migrateSwarm{swarms: []*memswarm.Swarm{r.NewSwarm(), r.NewSwarm()}}
+	var mu sync.Mutex
+	var lastSent []byte
+	a := New(lowerA, p2ptest.NewTestKey(t, 0), WithConnectionIDs(), WithOnWire(func(dir WireDirection, _ p2p.Addr, data []byte) {
+		if dir == WireSend {
+			mu.Lock()
+			lastSent = append([]byte{}, data...)
+			mu.Unlock()
+		}
+	}))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithConnectionIDs())
+	defer a.Close()
+	defer b.Close()
+	aRecv := make(chan *p2p.Message, 1)
+	bRecv := make(chan *p2p.Message, 1)
+	go a.ServeTells(func(msg *p2p.Message) {
+		aRecv <- &p2p.Message{Src: msg.Src, Payload: append([]byte{}, msg.Payload...)}
+	})
+	go b.ServeTells(func(msg *p2p.Message) {
+		bRecv <- &p2p.Message{Src: msg.Src, Payload: append([]byte{}, msg.Payload...)}
+	})
+	bAddr := b.LocalAddrs()[0]
+
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	msg := <-bRecv
+	require.Equal(t, lowerA.swarms[0].LocalAddrs()[0], msg.Src.(Addr).Addr)
+	fp, ok := b.SessionKeyFingerprint(msg.Src)
+	require.True(t, ok)
+
+	// a's address changes, and b moves the session to the new one
+	lowerA.use(1)
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("moved")}))
+	msg = <-bRecv
+	require.Equal(t, "moved", string(msg.Payload))
+	require.Equal(t, lowerA.swarms[1].LocalAddrs()[0], msg.Src.(Addr).Addr)
+	// the session moves once the new address answers the path challenge
+	require.Eventually(t, func() bool {
+		_, ok := b.SessionKeyFingerprint(msg.Src)
+		return ok
+	}, time.Second, time.Millisecond)
+	fp2, _ := b.SessionKeyFingerprint(msg.Src)
+	require.Equal(t, fp, fp2)
+	require.Len(t, b.Sessions(), 1)
+	require.NoError(t, b.Tell(ctx, msg.Src, p2p.IOVec{[]byte("reply")}))
+	require.Equal(t, "reply", string((<-aRecv).Payload))
+
+	// a replayed or corrupted message from another address doesn't move the session, or end it.
+	c := r.NewSwarm()
+	defer c.Close()
+	mu.Lock()
+	replay := lastSent
+	mu.Unlock()
+	corrupt := append([]byte{}, replay...)
+	corrupt[len(corrupt)-1] ^= 1
+	bLower := bAddr.(Addr).Addr
+	require.NoError(t, c.Tell(ctx, bLower, p2p.IOVec{replay}))
+	require.NoError(t, c.Tell(ctx, bLower, p2p.IOVec{corrupt}))
+	sessions := b.Sessions()
+	require.Len(t, sessions, 1)
+	movedAddr, _ := lowerA.swarms[1].LocalAddrs()[0].MarshalText()
+	require.Equal(t, string(movedAddr), sessions[0].LowerAddr)
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("still here")}))
+	msg = <-bRecv
+	require.Equal(t, "still here", string(msg.Payload))
+	fp3, ok := b.SessionKeyFingerprint(msg.Src)
+	require.True(t, ok)
+	require.Equal(t, fp, fp3)
+}
+
+func TestConnectionMigrationSpoofed(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lowerA := &dropSwarm{Swarm: r.NewSwarm()}
+	var mu sync.Mutex
+	var lastSent []byte
+	a := New(lowerA, p2ptest.NewTestKey(t, 0), WithConnectionIDs(), WithOnWire(func(dir WireDirection, _ p2p.Addr, data []byte) {
+		if dir == WireSend {
+			mu.Lock()
+			lastSent = append([]byte{}, data...)
+			mu.Unlock()
+		}
+	}))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithConnectionIDs())
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	bRecv := make(chan *p2p.Message, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		bRecv <- &p2p.Message{Src: msg.Src, Payload: append([]byte{}, msg.Payload...)}
+	})
+	bAddr := b.LocalAddrs()[0]
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	<-bRecv
+
+	// a message which b hasn't seen arrives from another address, as if its source was rewritten.
+	lowerA.setDrop(true)
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("fresh")}))
+	mu.Lock()
+	fresh := lastSent
+	mu.Unlock()
+	c := r.NewSwarm()
+	defer c.Close()
+	challenges := make(chan struct{}, 1)
+	go c.ServeTells(func(*p2p.Message) {
+		challenges <- struct{}{}
+	})
+	require.NoError(t, c.Tell(ctx, bAddr.(Addr).Addr, p2p.IOVec{fresh}))
+	require.Equal(t, "fresh", string((<-bRecv).Payload))
+	// c gets a challenge, but can't answer it, so the session stays where it is.
+	<-challenges
+	sessions := b.Sessions()
+	require.Len(t, sessions, 1)
+	aLower, _ := lowerA.LocalAddrs()[0].MarshalText()
+	require.Equal(t, string(aLower), sessions[0].LowerAddr)
+	lowerA.setDrop(false)
+	require.NoError(t, b.Tell(ctx, a.LocalAddrs()[0], p2p.IOVec{[]byte("reply")}))
+}
+
+func TestMoveSession(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithConnectionIDs())
+	defer b.Close()
+	go b.ServeTells(p2p.NoOpTellHandler)
+	var xs []*Swarm
+	for i := 1; i <= 2; i++ {
+		x := New(r.NewSwarm(), p2ptest.NewTestKey(t, i), WithConnectionIDs())
+		defer x.Close()
+		go x.ServeTells(p2p.NoOpTellHandler)
+		require.NoError(t, b.Tell(ctx, x.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+		xs = append(xs, x)
+	}
+	lower0, lower1 := xs[0].swarm.LocalAddrs()[0], xs[1].swarm.LocalAddrs()[0]
+	sess := b.getSession(lower0, true)
+	require.NotNil(t, sess)
+
+	// the address has a ready session, which is kept
+	require.False(t, b.moveSession(sess, lower0, lower1))
+	require.Equal(t, sess, b.getSession(lower0, true))
+	require.NotEqual(t, sess, b.getSession(lower1, true))
+
+	// a session which is still handshaking is replaced
+	other := r.NewSwarm()
+	defer other.Close()
+	lower2 := other.LocalAddrs()[0]
+	b.sessions.Put(sessionKey{raddr: lower2.Key(), initiator: true}, b.newSession(lower2, true, b.localID, p2p.PeerID{}))
+	require.True(t, b.moveSession(sess, lower0, lower2))
+	require.Equal(t, sess, b.getSession(lower2, true))
+	require.Nil(t, b.getSession(lower0, true))
+	require.Equal(t, lower2, sess.getLowerRaddr())
+}
+
+// migrateSwarm sends through one of several swarms, which can be switched to simulate an address change.
+// It receives from all of them.
+type migrateSwarm struct {
+	swarms  []*memswarm.Swarm
+	current int32
+}
+
+func (s *migrateSwarm) use(i int) {
+	atomic.StoreInt32(&s.current, int32(i))
+}
+
+func (s *migrateSwarm) get() *memswarm.Swarm {
+	return s.swarms[atomic.LoadInt32(&s.current)]
+}
+
+func (s *migrateSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	return s.get().Tell(ctx, addr, data)
+}
+
+func (s *migrateSwarm) ServeTells(fn p2p.TellHandler) error {
+	eg := errgroup.Group{}
+	for _, x := range s.swarms {
+		x := x
+		eg.Go(func() error {
+			return x.ServeTells(fn)
+		})
+	}
+	return eg.Wait()
+}
+
+func (s *migrateSwarm) LocalAddrs() []p2p.Addr {
+	return s.get().LocalAddrs()
+}
+
+func (s *migrateSwarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	return s.get().MTU(ctx, addr)
+}
+
+func (s *migrateSwarm) ParseAddr(data []byte) (p2p.Addr, error) {
+	return s.get().ParseAddr(data)
+}
+
+func (s *migrateSwarm) Close() error {
+	for _, x := range s.swarms {
+		x.Close()
+	}
+	return nil
+}
+
+// dropSwarm silently drops every message sent while drop is set
+type dropSwarm struct {
+	p2p.Swarm
+	drop int32
+}
+
+func (s *dropSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	if atomic.LoadInt32(&s.drop) == 1 {
+		return nil
+	}
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+func (s *dropSwarm) setDrop(drop bool) {
+	var x int32
+	if drop {
+		x = 1
+	}
+	atomic.StoreInt32(&s.drop, x)
+}
+
+// countSwarm records the counter and size of every message sent
+type countSwarm struct {
+	p2p.Swarm
+	mu     sync.Mutex
+	counts []uint32
+	sizes  []int
+}
+
+func (s *countSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	msg, err := parseMessage(p2p.VecBytes(data))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.counts = append(s.counts, msg.getCounter())
+	s.sizes = append(s.sizes, p2p.VecSize(data))
+	s.mu.Unlock()
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+func (s *countSwarm) getCounts() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint32{}, s.counts...)
+}
+
+func (s *countSwarm) getSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int{}, s.sizes...)
+}
+
+func (s *countSwarm) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts = nil
+	s.sizes = nil
+}
+
 // func TestNoise(t *testing.T) {
 // 	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b)
 // 	staticI, _ := noise.DH25519.GenerateKeypair(nil)
@@ -66,3 +1627,318 @@ func TestSwarm(t *testing.T) {
 // 	//expected, _ := hex.DecodeString("8127f4b35cdbdf0935fcf1ec99016d1dcbc350055b8af360be196905dfb50a2c1c38a7ca9cb0cfe8f4576f36c47a4933eee32288f590ac4305d4b53187577be7")
 // 	//assert.Equal(msg, expected)
 // }
+
+func BenchmarkTellMultiBuffer(b *testing.B) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	s1 := New(r.NewSwarm(), p2ptest.NewTestKey(b, 0))
+	s2 := New(r.NewSwarm(), p2ptest.NewTestKey(b, 1))
+	defer s1.Close()
+	defer s2.Close()
+	go s1.ServeTells(p2p.NoOpTellHandler)
+	go s2.ServeTells(p2p.NoOpTellHandler)
+
+	data := p2p.IOVec{}
+	for i := 0; i < 4; i++ {
+		data = append(data, make([]byte, 1024))
+	}
+	dst := s2.LocalAddrs()[0]
+	require.NoError(b, s1.Tell(ctx, dst, data))
+	b.SetBytes(int64(p2p.VecSize(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s1.Tell(ctx, dst, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestVia(t *testing.T) {
+	ctx := context.Background()
+	r1, r2 := memswarm.NewRealm(), memswarm.NewRealm()
+	// each swarm is reachable over 2 lower addresses
+	newSwarm := func(i int) *Swarm {
+		x := New(multiswarm.NewSwarm(map[string]p2p.Swarm{
+			"mem1": r1.NewSwarm(),
+			"mem2": r2.NewSwarm(),
+		}), p2ptest.NewTestKey(t, i))
+		t.Cleanup(func() { x.Close() })
+		return x
+	}
+	a, b := newSwarm(0), newSwarm(1)
+	recv := make(chan *p2p.Message, 1)
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- &p2p.Message{Src: msg.Src, Dst: msg.Dst, Payload: append([]byte{}, msg.Payload...)}
+	})
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write([]byte(msg.Dst.(Addr).Addr.Key()))
+	})
+	bAddrs := b.LocalAddrs()
+	require.Len(t, bAddrs, 2)
+	bID := bAddrs[0].(Addr).ID
+	lower1, lower2 := bAddrs[0].(Addr).Addr, bAddrs[1].(Addr).Addr
+	require.NotEqual(t, lower1, lower2)
+
+	require.NoError(t, a.DialVia(ctx, bID, lower1))
+	require.NotNil(t, a.getSession(lower1, true))
+	require.Nil(t, a.getSession(lower2, true))
+
+	// with a session over lower1, pinning lower2 still uses lower2
+	require.NoError(t, a.TellVia(ctx, bID, lower2, p2p.IOVec{[]byte("hello")}))
+	msg := <-recv
+	require.Equal(t, "hello", string(msg.Payload))
+	require.Equal(t, lower2, msg.Dst.(Addr).Addr)
+	require.NotNil(t, a.getSession(lower2, true))
+	require.NotNil(t, a.getSession(lower1, true))
+
+	require.NoError(t, a.TellVia(ctx, bID, lower1, p2p.IOVec{[]byte("hello")}))
+	msg = <-recv
+	require.Equal(t, lower1, msg.Dst.(Addr).Addr)
+
+	for _, lower := range []p2p.Addr{lower1, lower2} {
+		resp, err := a.AskVia(ctx, bID, lower, p2p.IOVec{[]byte("ping")})
+		require.NoError(t, err)
+		require.Equal(t, lower.Key(), string(resp))
+	}
+}
+
+func TestUnifySessions(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithManualCleanup())
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), WithManualCleanup())
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan *p2p.Message, 1)
+	go a.ServeTells(func(msg *p2p.Message) { recv <- msg })
+	go b.ServeTells(func(msg *p2p.Message) { recv <- msg })
+	aAddr, bAddr := a.LocalAddrs()[0].(Addr), b.LocalAddrs()[0].(Addr)
+
+	// both parties dial each other, so each has a session in both directions
+	eg := errgroup.Group{}
+	eg.Go(func() error {
+		_, err := a.dialSession(ctx, bAddr, a.localID)
+		return err
+	})
+	eg.Go(func() error {
+		_, err := b.dialSession(ctx, aAddr, b.localID)
+		return err
+	})
+	require.NoError(t, eg.Wait())
+	// superseded returns the session each party no longer uses
+	superseded := func(x *Swarm, peer Addr) *session {
+		if bytes.Compare(x.localID[:], peer.ID[:]) < 0 {
+			return x.getSession(peer.Addr, false)
+		}
+		return x.getSession(peer.Addr, true)
+	}
+	require.Eventually(t, func() bool {
+		return superseded(a, bAddr).isSuperseded() && superseded(b, aAddr).isSuperseded()
+	}, time.Second, time.Millisecond)
+	for _, x := range []*Swarm{a, b} {
+		require.Equal(t, 2, x.sessions.Len())
+	}
+
+	send := func() {
+		for i := 0; i < 10; i++ {
+			// both parties always choose the same session
+			aFP, ok := a.SessionKeyFingerprint(bAddr)
+			require.True(t, ok)
+			bFP, ok := b.SessionKeyFingerprint(aAddr)
+			require.True(t, ok)
+			require.Equal(t, aFP, bFP)
+		}
+		require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+		require.Equal(t, aAddr, (<-recv).Src)
+		require.NoError(t, b.Tell(ctx, aAddr, p2p.IOVec{[]byte("hello")}))
+		require.Equal(t, bAddr, (<-recv).Src)
+	}
+	send()
+	// the superseded sessions are removed once they are idle, leaving one
+	now := time.Now().Add(supersededTimeout + time.Second)
+	a.Cleanup(now)
+	b.Cleanup(now)
+	for _, x := range []*Swarm{a, b} {
+		require.Equal(t, 1, x.sessions.Len())
+	}
+	require.Nil(t, superseded(a, bAddr))
+	require.Nil(t, superseded(b, aAddr))
+	send()
+}
+
+func TestSessionSelectPolicy(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	x := New(memswarm.NewRealm().NewSwarm(), p2ptest.NewTestKey(t, 0), WithClock(clock), WithManualCleanup())
+	defer x.Close()
+	lower := memswarm.Addr{N: 1}
+	newSessions := func() (out, in *session) {
+		out = x.newSession(lower, true, x.localID, p2p.PeerID{})
+		in = x.newSession(lower, false, x.localID, p2p.PeerID{})
+		return out, in
+	}
+	for _, p := range []SessionSelectPolicy{SelectRandom, SelectPreferOutbound, SelectPreferMostRecent} {
+		out, in := newSessions()
+		// a single session is always chosen
+		require.Equal(t, out, p.choose(out, nil), p.String())
+		require.Equal(t, in, p.choose(nil, in), p.String())
+		require.Nil(t, p.choose(nil, nil), p.String())
+	}
+
+	out, in := newSessions()
+	chosen := map[*session]int{}
+	for i := 0; i < 100; i++ {
+		chosen[SelectRandom.choose(out, in)]++
+	}
+	require.Len(t, chosen, 2)
+
+	clock.Advance(time.Second)
+	in.lastRecv = clock.Now()
+	for i := 0; i < 10; i++ {
+		require.Equal(t, out, SelectPreferOutbound.choose(out, in))
+		require.Equal(t, in, SelectPreferMostRecent.choose(out, in))
+	}
+	clock.Advance(time.Second)
+	out.lastSend = clock.Now()
+	require.Equal(t, out, SelectPreferMostRecent.choose(out, in))
+
+	require.Panics(t, func() { WithSessionSelectPolicy(SessionSelectPolicy(100)) })
+}
+
+// FuzzNoiseParse checks that the parsers for received messages and frames never panic, and reject malformed input.
+func FuzzNoiseParse(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte(newMessage(directionRespToInit, countPostHandshake)))
+	f.Add(append([]byte(newMessage(directionInitToResp, countInit)), make([]byte, MaxHandshakeMessageSize)...))
+	f.Add(p2p.VecBytes(newAskFrame(frameAskReq, 1, p2p.IOVec{[]byte("hello")})))
+	f.Add(p2p.VecBytes(newAddrsFrame([]p2p.Addr{memswarm.Addr{N: 1}}, 1024)))
+	f.Add([]byte{frameTell | frameCompressed, 0xff})
+	f.Add(p2p.VecBytes(newCapsFrame(CapCompression | CapAddrs)))
+	f.Add(p2p.VecBytes(newAskFrame(frameTellAck, 1, p2p.IOVec{[]byte("hello")})))
+	f.Fuzz(func(t *testing.T, x []byte) {
+		if msg, err := parseMessage(x); err == nil {
+			require.GreaterOrEqual(t, len(msg), 4)
+			require.True(t, msg.getCounter() >= countPostHandshake || len(msg) <= MaxHandshakeMessageSize)
+			require.Equal(t, x[4:], msg.getBody())
+		} else {
+			require.True(t, len(x) < 4 || len(x) > MaxHandshakeMessageSize)
+		}
+		if frameType, _, body, err := parseFrame(x); err == nil {
+			require.LessOrEqual(t, frameType, frameAck)
+			require.LessOrEqual(t, len(body), len(x)-1)
+			switch frameType {
+			case frameAddrs:
+				parseAddrsFrame(body)
+			case frameCaps:
+				parseCapsFrame(body)
+			}
+		} else {
+			require.True(t, len(x) < frameOverhead || x[0] > frameAck)
+		}
+		if len(x) > 0 {
+			if ptext, err := decompressFrame(x, 1024); err == nil {
+				require.LessOrEqual(t, len(ptext), 1024)
+			}
+		}
+		parseInitPayload(x)
+		parseTicket(x)
+		parseResumeMessage(x)
+	})
+}
+
+func TestTellByID(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	// the book is never unmarshaled, so it doesn't need a parser.
+	book := p2p.NewAddrBook(nil)
+	static := p2p.StaticPeerResolver{}
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithResolver(p2p.ChainPeerResolvers(book, static)))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	c := New(r.NewSwarm(), p2ptest.NewTestKey(t, 2))
+	for _, x := range []*Swarm{a, b, c} {
+		x := x
+		t.Cleanup(func() { x.Close() })
+	}
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go c.ServeTells(p2p.NoOpTellHandler)
+	recv := make(chan string, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	bAddr := b.LocalAddrs()[0].(Addr)
+
+	require.Equal(t, p2p.ErrNoAddrs, a.TellByID(ctx, bAddr.ID, p2p.IOVec{[]byte("hello")}))
+
+	// the first address belongs to another peer now, so the next one is used.
+	static[bAddr.ID] = []p2p.Addr{c.LocalAddrs()[0].(Addr).Addr, bAddr.Addr}
+	require.NoError(t, a.TellByID(ctx, bAddr.ID, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, "hello", <-recv)
+
+	// the address book comes first, and noiseswarm Addrs in it are dialed over their lower address.
+	a.clearSessions()
+	static[bAddr.ID] = nil
+	book.Add(bAddr.ID, bAddr)
+	dst, err := a.DialByID(ctx, bAddr.ID)
+	require.NoError(t, err)
+	require.Equal(t, bAddr.Addr, dst.Addr)
+	require.NoError(t, a.TellByID(ctx, bAddr.ID, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, "hello", <-recv)
+
+	require.Error(t, b.TellByID(ctx, a.LocalAddrs()[0].(Addr).ID, p2p.IOVec{[]byte("hello")}))
+}
+
+func TestTellDeadline(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithClock(clockwork.NewRealClock()), memswarm.WithLatency(20*time.Millisecond))
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	recv := make(chan string, 1)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	dst := b.LocalAddrs()[0]
+
+	// the handshake takes longer than the deadline, so the message is dropped once the session is ready
+	deadlineCtx := p2p.WithDeadline(ctx, time.Now().Add(time.Millisecond))
+	require.Equal(t, p2p.ErrExpired, a.Tell(deadlineCtx, dst, p2p.IOVec{[]byte("stale")}))
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("fresh")}))
+	require.Equal(t, "fresh", <-recv)
+}
+
+func TestReinitDuringFinish(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), time.Second)
+	defer cf()
+	r := memswarm.NewRealm()
+	a := New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), WithHandshakePattern(PatternXX))
+	b := New(r.NewSwarm(), p2ptest.NewTestKey(t, 1))
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	bLower := b.LocalAddrs()[0].(Addr).Addr
+	// the first session is not in a's pool, so b's response is dropped, and b waits for the final message.
+	first := a.newSession(bLower, true, a.localID, p2p.PeerID{})
+	require.NoError(t, first.startHandshake(ctx))
+	aLower := a.swarm.LocalAddrs()[0]
+	require.Eventually(t, func() bool {
+		sess := b.getSession(aLower, false)
+		if sess == nil {
+			return false
+		}
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		_, ok := sess.state.(*awaitFinishState)
+		return ok
+	}, time.Second, time.Millisecond)
+	// a starts again, and b handles the new init with a new session
+	second := a.newSession(bLower, true, a.localID, p2p.PeerID{})
+	a.sessions.Put(sessionKey{raddr: bLower.Key(), initiator: true}, second)
+	require.NoError(t, second.startHandshake(ctx))
+	require.NoError(t, second.waitReady(ctx))
+	require.True(t, b.getSession(aLower, false).isReady())
+}
@@ -0,0 +1,29 @@
+package noiseswarm
+
+import "github.com/brendoncarroll/go-p2p"
+
+// WireDirection is whether a message passed to the WithOnWire hook was sent or received.
+type WireDirection uint8
+
+const (
+	WireSend = WireDirection(iota)
+	WireRecv
+)
+
+func (d WireDirection) String() string {
+	switch d {
+	case WireSend:
+		return "send"
+	case WireRecv:
+		return "recv"
+	default:
+		return "unknown"
+	}
+}
+
+// observeWire passes a message sent to or received from lower to the WithOnWire hook, if there is one.
+func (s *Swarm) observeWire(dir WireDirection, lower p2p.Addr, data []byte) {
+	if s.onWire != nil {
+		s.onWire(dir, lower, data)
+	}
+}
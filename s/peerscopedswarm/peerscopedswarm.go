@@ -0,0 +1,178 @@
+package peerscopedswarm
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+// ErrNotAllowed is returned when sending to an address which is not in the allow-list.
+var ErrNotAllowed = errors.New("peerscopedswarm: address is not in the allow-list")
+
+// ErrAskRefused is returned by Ask when the remote party's allow-list does not have the local address.
+var ErrAskRefused = errors.New("peerscopedswarm: ask refused by remote party")
+
+var _ p2p.Swarm = &Swarm{}
+
+var _ p2p.AskSwarm = &AskSwarm{}
+
+// Swarm restricts an underlying swarm to an allow-list of addresses.
+// Tells to other addresses fail with ErrNotAllowed, and messages from other addresses are dropped.
+// Addresses are compared by their Key.
+type Swarm struct {
+	p2p.Swarm
+
+	mu      sync.RWMutex
+	allowed map[string]p2p.Addr
+}
+
+func New(x p2p.Swarm, allowed []p2p.Addr) *Swarm {
+	s := &Swarm{Swarm: x}
+	s.SetAllowed(allowed)
+	return s
+}
+
+// Responses start with a status byte, which says whether the ask was allowed.
+const (
+	statusOK = iota
+	statusRefused
+)
+
+// statusSize is the size of the status at the start of each response.
+const statusSize = 1
+
+// AskSwarm is a Swarm which also restricts Asks to the allow-list.
+// Responses carry a 1 byte status, so that an ask which is refused fails with ErrAskRefused,
+// both parties must use AskSwarm.
+type AskSwarm struct {
+	*Swarm
+	asker p2p.Asker
+}
+
+func NewAsk(x p2p.AskSwarm, allowed []p2p.Addr) *AskSwarm {
+	return &AskSwarm{
+		Swarm: New(x, allowed),
+		asker: x,
+	}
+}
+
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	if !s.IsAllowed(addr) {
+		return ErrNotAllowed
+	}
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	return s.Swarm.ServeTells(func(msg *p2p.Message) {
+		if s.checkSrc(msg.Src) {
+			fn(msg)
+		}
+	})
+}
+
+// SetAllowed replaces the allow-list
+func (s *Swarm) SetAllowed(addrs []p2p.Addr) {
+	allowed := make(map[string]p2p.Addr, len(addrs))
+	for _, addr := range addrs {
+		allowed[addr.Key()] = addr
+	}
+	s.mu.Lock()
+	s.allowed = allowed
+	s.mu.Unlock()
+}
+
+// Allow adds addrs to the allow-list
+func (s *Swarm) Allow(addrs ...p2p.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, addr := range addrs {
+		s.allowed[addr.Key()] = addr
+	}
+}
+
+// Disallow removes addrs from the allow-list.
+// Messages from them which are already being handled are not interrupted.
+func (s *Swarm) Disallow(addrs ...p2p.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, addr := range addrs {
+		delete(s.allowed, addr.Key())
+	}
+}
+
+// Allowed returns the addresses in the allow-list, in no particular order.
+func (s *Swarm) Allowed() []p2p.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := make([]p2p.Addr, 0, len(s.allowed))
+	for _, addr := range s.allowed {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// IsAllowed returns true if addr is in the allow-list
+func (s *Swarm) IsAllowed(addr p2p.Addr) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.allowed[addr.Key()]
+	return ok
+}
+
+func (s *Swarm) checkSrc(src p2p.Addr) bool {
+	if s.IsAllowed(src) {
+		return true
+	}
+	log.WithFields(logrus.Fields{"src": src}).Debug("peerscopedswarm: ignoring message from address not in allow-list")
+	return false
+}
+
+func (s *AskSwarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	if !s.IsAllowed(addr) {
+		return nil, ErrNotAllowed
+	}
+	resp, err := s.asker.Ask(ctx, addr, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 1 {
+		return nil, errors.Errorf("peerscopedswarm: response is missing status")
+	}
+	switch resp[0] {
+	case statusOK:
+		return resp[1:], nil
+	case statusRefused:
+		return nil, ErrAskRefused
+	default:
+		return nil, errors.Errorf("peerscopedswarm: unknown response status %d", resp[0])
+	}
+}
+
+// MTU leaves room for the status at the start of responses.
+func (s *AskSwarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	return s.Swarm.MTU(ctx, addr) - statusSize
+}
+
+// ServeAsks serves Asks from addresses in the allow-list.
+// Asks from other addresses are refused without calling fn, and fail with ErrAskRefused.
+// Writes by fn past the MTU fail with p2p.ErrResponseTooLarge.
+func (s *AskSwarm) ServeAsks(fn p2p.AskHandler) error {
+	return s.asker.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		if !s.checkSrc(msg.Src) {
+			w.Write([]byte{statusRefused})
+			return
+		}
+		if _, err := w.Write([]byte{statusOK}); err != nil {
+			return
+		}
+		fn(ctx, msg, &swarmutil.LimitWriter{W: w, N: s.MTU(ctx, msg.Src)})
+	})
+}
@@ -0,0 +1,133 @@
+package peerscopedswarm
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteAskSwarm(t, func(t testing.TB, n int) []p2p.AskSwarm {
+		r := memswarm.NewRealm()
+		lower := make([]*memswarm.Swarm, n)
+		var addrs []p2p.Addr
+		for i := range lower {
+			lower[i] = r.NewSwarm()
+			addrs = append(addrs, lower[i].LocalAddrs()...)
+		}
+		xs := make([]p2p.AskSwarm, n)
+		for i := range xs {
+			xs[i] = NewAsk(lower[i], addrs)
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseAskSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestTells(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a, b, c := r.NewSwarm(), r.NewSwarm(), r.NewSwarm()
+	defer b.Close()
+	defer c.Close()
+	bAddr, cAddr := b.LocalAddrs()[0], c.LocalAddrs()[0]
+	s := New(a, []p2p.Addr{bAddr})
+	defer s.Close()
+
+	recv := make(chan string, 10)
+	go s.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	go b.ServeTells(p2p.NoOpTellHandler)
+	go c.ServeTells(p2p.NoOpTellHandler)
+	sAddr := s.LocalAddrs()[0]
+
+	require.NoError(t, s.Tell(ctx, bAddr, p2p.IOVec{[]byte("to b")}))
+	require.Equal(t, ErrNotAllowed, s.Tell(ctx, cAddr, p2p.IOVec{[]byte("to c")}))
+
+	require.NoError(t, c.Tell(ctx, sAddr, p2p.IOVec{[]byte("from c")}))
+	require.NoError(t, b.Tell(ctx, sAddr, p2p.IOVec{[]byte("from b")}))
+	// memswarm delivers synchronously, so the message from c was dropped before the one from b arrived.
+	require.Equal(t, "from b", <-recv)
+	require.Len(t, recv, 0)
+
+	// the allow-list can be changed at runtime
+	s.Allow(cAddr)
+	s.Disallow(bAddr)
+	require.Equal(t, []p2p.Addr{cAddr}, s.Allowed())
+	require.NoError(t, s.Tell(ctx, cAddr, p2p.IOVec{[]byte("to c")}))
+	require.Equal(t, ErrNotAllowed, s.Tell(ctx, bAddr, p2p.IOVec{[]byte("to b")}))
+	require.NoError(t, b.Tell(ctx, sAddr, p2p.IOVec{[]byte("from b")}))
+	require.NoError(t, c.Tell(ctx, sAddr, p2p.IOVec{[]byte("from c")}))
+	require.Equal(t, "from c", <-recv)
+	require.Len(t, recv, 0)
+}
+
+func TestAsks(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a, lowerB, lowerC := r.NewSwarm(), r.NewSwarm(), r.NewSwarm()
+	aAddr, bAddr, cAddr := a.LocalAddrs()[0], lowerB.LocalAddrs()[0], lowerC.LocalAddrs()[0]
+	s := NewAsk(a, []p2p.Addr{bAddr})
+	b, c := NewAsk(lowerB, []p2p.Addr{aAddr}), NewAsk(lowerC, []p2p.Addr{aAddr})
+	defer s.Close()
+	defer b.Close()
+	defer c.Close()
+	echo := func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write(msg.Payload)
+	}
+	go s.ServeAsks(echo)
+	go b.ServeAsks(echo)
+	go c.ServeAsks(echo)
+
+	resp, err := s.Ask(ctx, bAddr, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(resp))
+	_, err = s.Ask(ctx, cAddr, p2p.IOVec{[]byte("ping")})
+	require.Equal(t, ErrNotAllowed, err)
+
+	resp, err = b.Ask(ctx, aAddr, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(resp))
+	// the ask from c is not passed to the handler, and fails
+	_, err = c.Ask(ctx, aAddr, p2p.IOVec{[]byte("ping")})
+	require.Equal(t, ErrAskRefused, err)
+
+	s.SetAllowed([]p2p.Addr{cAddr})
+	resp, err = c.Ask(ctx, aAddr, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(resp))
+}
+
+func TestAskMTU(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithMTU(100))
+	lowerA, lowerB := r.NewSwarm(), r.NewSwarm()
+	aAddr, bAddr := lowerA.LocalAddrs()[0], lowerB.LocalAddrs()[0]
+	a, b := NewAsk(lowerA, []p2p.Addr{bAddr}), NewAsk(lowerB, []p2p.Addr{aAddr})
+	defer a.Close()
+	defer b.Close()
+	require.Equal(t, 99, a.MTU(ctx, bAddr))
+	errs := make(chan error, 2)
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		_, err := w.Write(make([]byte, b.MTU(ctx, msg.Src)))
+		errs <- err
+		_, err = w.Write([]byte{0})
+		errs <- err
+	})
+	// the status fits alongside a response of exactly the MTU
+	resp, err := a.Ask(ctx, bAddr, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Len(t, resp, a.MTU(ctx, bAddr))
+	require.NoError(t, <-errs)
+	require.Equal(t, p2p.ErrResponseTooLarge, <-errs)
+}
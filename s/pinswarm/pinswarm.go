@@ -0,0 +1,118 @@
+// Package pinswarm restricts a secure swarm to a fixed set of peers, known in advance by their PeerID.
+package pinswarm
+
+import (
+	"context"
+	"io"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+// ErrPeerNotPinned is returned when sending to a peer which is not pinned,
+// or whose identity can not be determined before sending.
+var ErrPeerNotPinned = errors.New("pinswarm: peer is not pinned")
+
+var _ p2p.SecureSwarm = &Swarm{}
+
+// Swarm only sends to and receives from pinned peers.
+// Messages from other peers are dropped before they reach the handler.
+type Swarm struct {
+	p2p.SecureSwarm
+	pins map[p2p.PeerID]struct{}
+}
+
+// New returns a swarm which only communicates with the peers in pins through x.
+// The pins can not be changed afterwards.
+func New(x p2p.SecureSwarm, pins []p2p.PeerID) *Swarm {
+	m := make(map[p2p.PeerID]struct{}, len(pins))
+	for _, id := range pins {
+		m[id] = struct{}{}
+	}
+	return &Swarm{SecureSwarm: x, pins: m}
+}
+
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	if err := s.checkDst(ctx, addr); err != nil {
+		return err
+	}
+	return s.SecureSwarm.Tell(ctx, addr, data)
+}
+
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	return s.SecureSwarm.ServeTells(func(msg *p2p.Message) {
+		if s.checkSrc(msg.Src) {
+			fn(msg)
+		}
+	})
+}
+
+// IsPinned returns true if id is in the pin set.
+func (s *Swarm) IsPinned(id p2p.PeerID) bool {
+	_, ok := s.pins[id]
+	return ok
+}
+
+// checkDst returns ErrPeerNotPinned unless addr belongs to a pinned peer.
+// The peer is taken from addr if it has one, otherwise it is looked up from the lower swarm.
+func (s *Swarm) checkDst(ctx context.Context, addr p2p.Addr) error {
+	id := p2p.ExtractPeerID(addr)
+	if id == p2p.ZeroPeerID() {
+		pubKey, err := s.SecureSwarm.LookupPublicKey(ctx, addr)
+		if err != nil {
+			return ErrPeerNotPinned
+		}
+		id = p2p.NewPeerID(pubKey)
+	}
+	if !s.IsPinned(id) {
+		return ErrPeerNotPinned
+	}
+	return nil
+}
+
+// checkSrc is called inside a handler
+func (s *Swarm) checkSrc(addr p2p.Addr) bool {
+	id := p2p.NewPeerID(p2p.LookupPublicKeyInHandler(s.SecureSwarm, addr))
+	if s.IsPinned(id) {
+		return true
+	}
+	data, _ := addr.MarshalText()
+	log.WithFields(logrus.Fields{
+		"peer_id": id.Short(),
+		"addr":    string(data),
+	}).Warn("pinswarm: dropped message from peer which is not pinned")
+	return false
+}
+
+var _ p2p.SecureAskSwarm = &AskSwarm{}
+
+// AskSwarm is a Swarm which also restricts Asks to pinned peers.
+type AskSwarm struct {
+	*Swarm
+	asker p2p.Asker
+}
+
+func NewAsk(x p2p.SecureAskSwarm, pins []p2p.PeerID) *AskSwarm {
+	return &AskSwarm{
+		Swarm: New(x, pins),
+		asker: x,
+	}
+}
+
+func (s *AskSwarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	if err := s.checkDst(ctx, addr); err != nil {
+		return nil, err
+	}
+	return s.asker.Ask(ctx, addr, data)
+}
+
+func (s *AskSwarm) ServeAsks(fn p2p.AskHandler) error {
+	return s.asker.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		if s.checkSrc(msg.Src) {
+			fn(ctx, msg, w)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package pinswarm
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		lowers, pins := newLowers(t, r, n)
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(lowers[i], pins)
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+	swarmtest.TestSuiteAskSwarm(t, func(t testing.TB, n int) []p2p.AskSwarm {
+		r := memswarm.NewRealm()
+		lowers, pins := newLowers(t, r, n)
+		xs := make([]p2p.AskSwarm, n)
+		for i := range xs {
+			xs[i] = NewAsk(lowers[i], pins)
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseAskSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestNotPinned(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lowers, _ := newLowers(t, r, 3)
+	a, b, c := lowers[0], lowers[1], lowers[2]
+	// a only pins b, and c is not pinned
+	x := NewAsk(a, []p2p.PeerID{p2p.NewPeerID(b.PublicKey())})
+	defer x.Close()
+	defer b.Close()
+	defer c.Close()
+	require.True(t, x.IsPinned(p2p.NewPeerID(b.PublicKey())))
+	require.False(t, x.IsPinned(p2p.NewPeerID(c.PublicKey())))
+
+	tells := make(chan p2p.Addr, 2)
+	asks := make(chan p2p.Addr, 2)
+	go x.ServeTells(func(msg *p2p.Message) {
+		tells <- msg.Src
+	})
+	go x.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		asks <- msg.Src
+	})
+	go b.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeAsks(p2p.NoOpAskHandler)
+	go c.ServeTells(p2p.NoOpTellHandler)
+	go c.ServeAsks(p2p.NoOpAskHandler)
+
+	// sending
+	require.Equal(t, ErrPeerNotPinned, x.Tell(ctx, c.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	_, err := x.Ask(ctx, c.LocalAddrs()[0], p2p.IOVec{[]byte("hello")})
+	require.Equal(t, ErrPeerNotPinned, err)
+	require.NoError(t, x.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	_, err = x.Ask(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")})
+	require.NoError(t, err)
+
+	// receiving: memswarm delivers before returning, so c's messages have been dropped before b's are sent
+	require.NoError(t, c.Tell(ctx, a.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, b.Tell(ctx, a.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, b.LocalAddrs()[0], <-tells)
+	c.Ask(ctx, a.LocalAddrs()[0], p2p.IOVec{[]byte("hello")})
+	_, err = b.Ask(ctx, a.LocalAddrs()[0], p2p.IOVec{[]byte("hello")})
+	require.NoError(t, err)
+	require.Equal(t, b.LocalAddrs()[0], <-asks)
+	require.Len(t, tells, 0)
+	require.Len(t, asks, 0)
+}
+
+func TestUnknownIdentity(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	x := New(r.NewSwarm(), nil)
+	defer x.Close()
+	// the lower swarm can not find a key for an address which does not exist
+	require.Equal(t, ErrPeerNotPinned, x.Tell(ctx, memswarm.Addr{N: 100}, p2p.IOVec{[]byte("hello")}))
+}
+
+func newLowers(t testing.TB, r *memswarm.Realm, n int) ([]*memswarm.Swarm, []p2p.PeerID) {
+	lowers := make([]*memswarm.Swarm, n)
+	pins := make([]p2p.PeerID, n)
+	for i := range lowers {
+		lowers[i] = r.NewSwarmWithKey(p2ptest.NewTestKey(t, i))
+		pins[i] = p2p.NewPeerID(lowers[i].PublicKey())
+	}
+	return lowers, pins
+}
@@ -0,0 +1,40 @@
+package pkcache
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+type Option func(s *Swarm)
+
+// WithMaxSize sets the most entries the cache will hold, the least recently used are evicted first.
+// The default is DefaultMaxSize
+func WithMaxSize(n int) Option {
+	if n <= 0 {
+		panic(n)
+	}
+	return func(s *Swarm) {
+		s.maxSize = n
+	}
+}
+
+// WithNegativeTTL enables caching p2p.ErrPublicKeyNotFound from the lower swarm for ttl.
+// A cached miss is forgotten early if a message arrives from the address.
+// By default misses are not cached.
+func WithNegativeTTL(ttl time.Duration) Option {
+	if ttl <= 0 {
+		panic(ttl)
+	}
+	return func(s *Swarm) {
+		s.negativeTTL = ttl
+	}
+}
+
+// WithClock sets the clock used to expire cached misses.
+// The default is the real clock.
+func WithClock(clock clockwork.Clock) Option {
+	return func(s *Swarm) {
+		s.clock = clock
+	}
+}
@@ -0,0 +1,134 @@
+package pkcache
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+)
+
+// DefaultMaxSize is the default number of entries in the cache.
+const DefaultMaxSize = 1024
+
+var _ p2p.SecureSwarm = &Swarm{}
+
+var _ p2p.SecureAskSwarm = &AskSwarm{}
+
+// Swarm remembers the public keys resolved by the lower swarm's LookupPublicKey,
+// so lookups continue to succeed after the lower swarm forgets them, for example when a session expires.
+// Addresses which implement p2p.HasPeerID are cached by PeerID, so a key resolved at one address is
+// returned for the same peer at any address.
+// Keys for other addresses are not cached, since nothing ties the key to the address, and another party could take it over.
+// Only misses are cached for them, see WithNegativeTTL.
+type Swarm struct {
+	p2p.SecureSwarm
+	maxSize     int
+	negativeTTL time.Duration
+	clock       clockwork.Clock
+
+	cache *swarmutil.Pool[string, entry]
+}
+
+func New(x p2p.SecureSwarm, opts ...Option) *Swarm {
+	s := &Swarm{
+		SecureSwarm: x,
+		maxSize:     DefaultMaxSize,
+		clock:       clockwork.NewRealClock(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.cache = swarmutil.NewPool(swarmutil.PoolParams[string, entry]{
+		MaxSize: s.maxSize,
+		IsStale: func(_ string, e entry, now time.Time) bool {
+			return e.isNegative() && !now.Before(e.expiresAt)
+		},
+		Clock: s.clock,
+	})
+	return s
+}
+
+// AskSwarm is a Swarm which also supports Asks
+type AskSwarm struct {
+	*Swarm
+	asker p2p.Asker
+}
+
+func NewAsk(x p2p.SecureAskSwarm, opts ...Option) *AskSwarm {
+	return &AskSwarm{
+		Swarm: New(x, opts...),
+		asker: x,
+	}
+}
+
+// entry is a cached lookup.
+// A negative entry records that the lower swarm did not know the key, and is stale after expiresAt.
+type entry struct {
+	publicKey p2p.PublicKey
+	expiresAt time.Time
+}
+
+func (e entry) isNegative() bool {
+	return e.publicKey == nil
+}
+
+func (s *Swarm) LookupPublicKey(ctx context.Context, addr p2p.Addr) (p2p.PublicKey, error) {
+	key := cacheKey(addr)
+	if e, ok := s.cache.Get(key); ok {
+		if e.isNegative() {
+			return nil, p2p.ErrPublicKeyNotFound
+		}
+		return e.publicKey, nil
+	}
+	publicKey, err := s.SecureSwarm.LookupPublicKey(ctx, addr)
+	switch {
+	case err == nil:
+		if hasID, ok := addr.(p2p.HasPeerID); ok && p2p.NewPeerID(publicKey) == hasID.GetPeerID() {
+			s.cache.Put(key, entry{publicKey: publicKey})
+		}
+	case err == p2p.ErrPublicKeyNotFound && s.negativeTTL > 0:
+		s.cache.Put(key, entry{expiresAt: s.clock.Now().Add(s.negativeTTL)})
+	}
+	return publicKey, err
+}
+
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	return s.SecureSwarm.ServeTells(func(msg *p2p.Message) {
+		s.forgetMiss(msg.Src)
+		fn(msg)
+	})
+}
+
+// Forget removes any cached entry for addr
+func (s *Swarm) Forget(addr p2p.Addr) {
+	s.cache.Delete(cacheKey(addr))
+}
+
+// forgetMiss removes a negative entry for addr, since a message from addr means the lower swarm may now know its key.
+func (s *Swarm) forgetMiss(addr p2p.Addr) {
+	if s.negativeTTL > 0 {
+		s.cache.DeleteIf(cacheKey(addr), entry.isNegative)
+	}
+}
+
+func (s *AskSwarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	return s.asker.Ask(ctx, addr, data)
+}
+
+func (s *AskSwarm) ServeAsks(fn p2p.AskHandler) error {
+	return s.asker.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		s.forgetMiss(msg.Src)
+		fn(ctx, msg, w)
+	})
+}
+
+func cacheKey(addr p2p.Addr) string {
+	if hasID, ok := addr.(p2p.HasPeerID); ok {
+		id := hasID.GetPeerID()
+		return "id:" + string(id[:])
+	}
+	return "addr:" + addr.Key()
+}
@@ -0,0 +1,150 @@
+package pkcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/noiseswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSecureSwarm(t, func(t testing.TB, n int) []p2p.SecureSwarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.SecureSwarm, n)
+		for i := range xs {
+			xs[i] = New(noiseswarm.New(r.NewSwarm(), p2ptest.NewTestKey(t, i)))
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSecureSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestSessionExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	r := memswarm.NewRealm()
+	a := noiseswarm.New(r.NewSwarm(), p2ptest.NewTestKey(t, 0), noiseswarm.WithClock(clock), noiseswarm.WithManualCleanup())
+	b := noiseswarm.New(r.NewSwarm(), p2ptest.NewTestKey(t, 1), noiseswarm.WithClock(clock), noiseswarm.WithManualCleanup())
+	defer a.Close()
+	defer b.Close()
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(p2p.NoOpTellHandler)
+	s := New(a)
+	bAddr := b.LocalAddrs()[0]
+
+	require.NoError(t, s.Tell(ctx, bAddr, p2p.IOVec{[]byte("hello")}))
+	expected, err := s.LookupPublicKey(ctx, bAddr)
+	require.NoError(t, err)
+	require.Equal(t, b.PublicKey(), expected)
+
+	clock.Advance(noiseswarm.SessionIdleTimeout + time.Second)
+	_, err = a.LookupPublicKey(ctx, bAddr)
+	require.Equal(t, p2p.ErrPublicKeyNotFound, err)
+	actual, err := s.LookupPublicKey(ctx, bAddr)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+}
+
+func TestNegativeTTL(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	lower := &lookupSwarm{SecureSwarm: memswarm.NewRealm().NewSwarmWithKey(p2ptest.NewTestKey(t, 0))}
+	addr := memswarm.Addr{N: 100}
+
+	s := New(lower, WithClock(clock))
+	for i := 0; i < 3; i++ {
+		_, err := s.LookupPublicKey(ctx, addr)
+		require.Equal(t, p2p.ErrPublicKeyNotFound, err)
+	}
+	// misses are not cached by default
+	require.Equal(t, 3, lower.calls)
+
+	lower.calls = 0
+	s = New(lower, WithClock(clock), WithNegativeTTL(time.Minute))
+	for i := 0; i < 3; i++ {
+		_, err := s.LookupPublicKey(ctx, addr)
+		require.Equal(t, p2p.ErrPublicKeyNotFound, err)
+	}
+	require.Equal(t, 1, lower.calls)
+	clock.Advance(time.Minute)
+	_, err := s.LookupPublicKey(ctx, addr)
+	require.Equal(t, p2p.ErrPublicKeyNotFound, err)
+	require.Equal(t, 2, lower.calls)
+
+	// a message from the address forgets the miss
+	s.forgetMiss(addr)
+	_, err = s.LookupPublicKey(ctx, addr)
+	require.Equal(t, p2p.ErrPublicKeyNotFound, err)
+	require.Equal(t, 3, lower.calls)
+}
+
+func TestMaxSize(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lower := &lookupSwarm{SecureSwarm: r.NewSwarmWithKey(p2ptest.NewTestKey(t, 0))}
+	s := New(lower, WithMaxSize(2))
+	var addrs []p2p.Addr
+	for i := 1; i <= 3; i++ {
+		x := r.NewSwarmWithKey(p2ptest.NewTestKey(t, i))
+		addr := idAddr{Addr: x.LocalAddrs()[0].(memswarm.Addr), id: p2p.NewPeerID(x.PublicKey())}
+		addrs = append(addrs, addr)
+		_, err := s.LookupPublicKey(ctx, addr)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, s.cache.Len())
+	require.Equal(t, 3, lower.calls)
+	// the first address was evicted
+	_, err := s.LookupPublicKey(ctx, addrs[0])
+	require.NoError(t, err)
+	require.Equal(t, 4, lower.calls)
+}
+
+func TestNoPeerID(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lower := &lookupSwarm{SecureSwarm: r.NewSwarmWithKey(p2ptest.NewTestKey(t, 0))}
+	s := New(lower)
+	x := r.NewSwarmWithKey(p2ptest.NewTestKey(t, 1))
+	// nothing ties the key to an address without a PeerID, so it is looked up every time.
+	for i := 0; i < 2; i++ {
+		publicKey, err := s.LookupPublicKey(ctx, x.LocalAddrs()[0])
+		require.NoError(t, err)
+		require.Equal(t, x.PublicKey(), publicKey)
+	}
+	require.Equal(t, 2, lower.calls)
+	require.Equal(t, 0, s.cache.Len())
+}
+
+// idAddr is a memswarm address with the PeerID of the party there, like the addresses of a secure swarm.
+type idAddr struct {
+	memswarm.Addr
+	id p2p.PeerID
+}
+
+func (a idAddr) GetPeerID() p2p.PeerID {
+	return a.id
+}
+
+// lookupSwarm counts calls to LookupPublicKey
+type lookupSwarm struct {
+	p2p.SecureSwarm
+	calls int
+}
+
+func (s *lookupSwarm) LookupPublicKey(ctx context.Context, addr p2p.Addr) (p2p.PublicKey, error) {
+	s.calls++
+	if a, ok := addr.(idAddr); ok {
+		addr = a.Addr
+	}
+	return s.SecureSwarm.LookupPublicKey(ctx, addr)
+}
@@ -0,0 +1,49 @@
+package queueswarm
+
+import (
+	"time"
+
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+)
+
+type Option func(s *Swarm)
+
+// WithDepth sets the most messages queued for each destination.
+// The default is DefaultDepth.
+func WithDepth(n int) Option {
+	if n <= 0 {
+		panic(n)
+	}
+	return func(s *Swarm) {
+		s.depth = n
+	}
+}
+
+// WithOverflowPolicy sets what Tell does when the queue for a destination is full.
+// The default is swarmutil.OverflowDropNewest, which returns p2p.ErrWouldBlock.
+func WithOverflowPolicy(p swarmutil.OverflowPolicy) Option {
+	_ = p.String() // panics if p is not a policy
+	return func(s *Swarm) {
+		s.policy = p
+	}
+}
+
+// WithInterval sets the least time between sending two messages to the same destination.
+// The default is 0, which sends each message as soon as the one before it has been passed to the lower swarm.
+func WithInterval(d time.Duration) Option {
+	if d < 0 {
+		panic(d)
+	}
+	return func(s *Swarm) {
+		s.interval = d
+	}
+}
+
+// WithClock sets the clock used for the interval between messages, and for message deadlines.
+// The default is the real clock.
+func WithClock(clock clockwork.Clock) Option {
+	return func(s *Swarm) {
+		s.clock = clock
+	}
+}
@@ -0,0 +1,241 @@
+// Package queueswarm queues outbound messages for each destination, so bursts to one peer are sent one at a time
+// instead of all reaching the lower swarm at once.
+package queueswarm
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+// DefaultDepth is the number of messages queued for each destination, if WithDepth is not used.
+const DefaultDepth = 64
+
+var _ p2p.Swarm = &Swarm{}
+
+var _ p2p.SecureSwarm = &SecureSwarm{}
+
+var _ p2p.Flusher = &Swarm{}
+
+var _ p2p.Inspector = &Swarm{}
+
+func New(x p2p.Swarm, opts ...Option) *Swarm {
+	return newSwarm(x, opts...)
+}
+
+func NewSecure(x p2p.SecureSwarm, opts ...Option) *SecureSwarm {
+	return &SecureSwarm{
+		Swarm:  newSwarm(x, opts...),
+		Secure: x,
+	}
+}
+
+// SecureSwarm is a Swarm which gets its identity from the lower swarm
+type SecureSwarm struct {
+	*Swarm
+	p2p.Secure
+}
+
+// Swarm holds a bounded queue of messages for each destination.
+// Each queue has one goroutine, which sends its messages to the lower swarm in order, one at a time,
+// and exits when the queue is empty.
+// Messages to different destinations are sent independently.
+type Swarm struct {
+	p2p.Swarm
+	depth    int
+	policy   swarmutil.OverflowPolicy
+	interval time.Duration
+	clock    clockwork.Clock
+
+	// ctx is canceled when the swarm is closed
+	ctx       context.Context
+	cf        context.CancelFunc
+	workers   swarmutil.Workers
+	closeOnce swarmutil.CloseOnce
+	dropped   uint64
+
+	mu     sync.Mutex
+	closed bool
+	queues map[string]*queue
+	// changed is notified whenever a message leaves a queue, or a queue is removed
+	changed swarmutil.ChangeNotifier
+}
+
+type queue struct {
+	addr p2p.Addr
+	msgs []queuedMsg
+}
+
+type queuedMsg struct {
+	data     []byte
+	deadline time.Time
+}
+
+func newSwarm(x p2p.Swarm, opts ...Option) *Swarm {
+	ctx, cf := context.WithCancel(context.Background())
+	s := &Swarm{
+		Swarm:  x,
+		depth:  DefaultDepth,
+		policy: swarmutil.OverflowDropNewest,
+		clock:  clockwork.NewRealClock(),
+
+		ctx:    ctx,
+		cf:     cf,
+		queues: make(map[string]*queue),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Tell adds a copy of data to the queue for addr, and returns without waiting for it to be sent.
+// Errors from the lower swarm are logged, since Tell has already returned.
+// If the queue is full, what happens depends on the policy set with WithOverflowPolicy:
+// OverflowDropNewest drops data and returns p2p.ErrWouldBlock, OverflowDropOldest drops the oldest queued message to make room,
+// and OverflowBlock waits for room until ctx is done.
+// If ctx has a message deadline, see p2p.WithDeadline, which passes while data is queued, it is dropped instead of sent.
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	if p2p.Expired(ctx, s.clock.Now()) {
+		return p2p.ErrExpired
+	}
+	if err := p2p.CheckMTU(data, s.Swarm.MTU(ctx, addr)); err != nil {
+		return err
+	}
+	msg := queuedMsg{data: append([]byte{}, p2p.VecBytes(data)...)}
+	msg.deadline, _ = p2p.DeadlineFromContext(ctx)
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return p2p.ErrSwarmClosed
+		}
+		q := s.queues[addr.Key()]
+		if q == nil {
+			q = &queue{addr: addr}
+			s.queues[addr.Key()] = q
+			s.workers.Go(func() {
+				s.drain(q)
+			})
+		}
+		if len(q.msgs) < s.depth || s.policy == swarmutil.OverflowDropOldest {
+			if len(q.msgs) >= s.depth {
+				q.msgs = q.msgs[1:]
+				atomic.AddUint64(&s.dropped, 1)
+			}
+			q.msgs = append(q.msgs, msg)
+			s.mu.Unlock()
+			return nil
+		}
+		if s.policy == swarmutil.OverflowDropNewest {
+			s.mu.Unlock()
+			atomic.AddUint64(&s.dropped, 1)
+			return p2p.ErrWouldBlock
+		}
+		changed := s.changed.Changed()
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.ctx.Done():
+			return p2p.ErrSwarmClosed
+		}
+	}
+}
+
+// Dropped returns the number of messages which were dropped because their queue was full, or their deadline passed,
+// or because the swarm was closed before they were sent.
+func (s *Swarm) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Inspect implements p2p.Inspector, with the number of messages queued for each destination, and the Dropped count.
+func (s *Swarm) Inspect() map[string]interface{} {
+	queues := map[string]int{}
+	s.mu.Lock()
+	for k, q := range s.queues {
+		queues[k] = len(q.msgs)
+	}
+	s.mu.Unlock()
+	return map[string]interface{}{
+		"queues":   queues,
+		"counters": map[string]uint64{"dropped": s.Dropped()},
+	}
+}
+
+// Flush waits until every queue is empty, and its last message has been passed to the lower swarm, and then flushes the lower swarm.
+// Messages queued while Flush is waiting are waited for too.
+func (s *Swarm) Flush(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		n := len(s.queues)
+		changed := s.changed.Changed()
+		s.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return p2p.Flush(ctx, s.Swarm)
+}
+
+// Close drops the queued messages, waits for any being sent, and then closes the lower swarm.
+func (s *Swarm) Close() error {
+	return s.closeOnce.Do(func() error {
+		s.mu.Lock()
+		s.closed = true
+		for _, q := range s.queues {
+			atomic.AddUint64(&s.dropped, uint64(len(q.msgs)))
+			q.msgs = nil
+		}
+		s.mu.Unlock()
+		s.cf()
+		s.workers.Wait()
+		return s.Swarm.Close()
+	})
+}
+
+// drain sends the messages in q until it is empty, and then removes it.
+func (s *Swarm) drain(q *queue) {
+	defer s.changed.Notify()
+	for {
+		s.mu.Lock()
+		if len(q.msgs) == 0 {
+			delete(s.queues, q.addr.Key())
+			s.mu.Unlock()
+			return
+		}
+		msg := q.msgs[0]
+		q.msgs = q.msgs[1:]
+		s.mu.Unlock()
+		s.changed.Notify()
+
+		if !msg.deadline.IsZero() && !s.clock.Now().Before(msg.deadline) {
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		// the Tell which queued the message has returned, so its context is not used.
+		if err := s.Swarm.Tell(s.ctx, q.addr, p2p.IOVec{msg.data}); err != nil {
+			log.WithFields(logrus.Fields{"dst": q.addr}).Debug("queueswarm: error sending queued message: ", err)
+		}
+		if s.interval > 0 {
+			select {
+			case <-s.clock.After(s.interval):
+			case <-s.ctx.Done():
+			}
+		}
+	}
+}
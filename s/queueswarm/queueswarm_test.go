@@ -0,0 +1,211 @@
+package queueswarm
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestBurstSerialized(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lower := &recordSwarm{Swarm: r.NewSwarm()}
+	a := New(lower, WithDepth(100))
+	b := r.NewSwarm()
+	defer a.Close()
+	defer b.Close()
+	go b.ServeTells(func(*p2p.Message) {})
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte(strconv.Itoa(i))}))
+	}
+	require.NoError(t, a.Flush(ctx))
+
+	lower.mu.Lock()
+	defer lower.mu.Unlock()
+	require.Equal(t, 1, lower.maxInflight)
+	require.Len(t, lower.sent, n)
+	for i, data := range lower.sent {
+		require.Equal(t, strconv.Itoa(i), data)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	ctx := context.Background()
+	const depth = 4
+	// fill sends one message to the lower swarm, where it waits to be released, and then fills the queue behind it.
+	fill := func(t *testing.T, p swarmutil.OverflowPolicy) (*Swarm, *gateSwarm, p2p.Addr) {
+		r := memswarm.NewRealm()
+		lower := &gateSwarm{Swarm: r.NewSwarm(), entered: make(chan string, 1), release: make(chan struct{})}
+		s := New(lower, WithDepth(depth), WithOverflowPolicy(p))
+		t.Cleanup(func() {
+			close(lower.release)
+			require.NoError(t, s.Close())
+		})
+		b := r.NewSwarm()
+		t.Cleanup(func() { b.Close() })
+		go b.ServeTells(func(*p2p.Message) {})
+		dst := b.LocalAddrs()[0]
+
+		require.NoError(t, s.Tell(ctx, dst, p2p.IOVec{[]byte("first")}))
+		require.Equal(t, "first", <-lower.entered)
+		for i := 0; i < depth; i++ {
+			require.NoError(t, s.Tell(ctx, dst, p2p.IOVec{[]byte(strconv.Itoa(i))}))
+		}
+		return s, lower, dst
+	}
+
+	t.Run("DropNewest", func(t *testing.T) {
+		s, _, dst := fill(t, swarmutil.OverflowDropNewest)
+		err := s.Tell(ctx, dst, p2p.IOVec{[]byte("extra")})
+		require.Equal(t, p2p.ErrWouldBlock, err)
+		require.Equal(t, uint64(1), s.Dropped())
+	})
+	t.Run("DropOldest", func(t *testing.T) {
+		s, lower, dst := fill(t, swarmutil.OverflowDropOldest)
+		require.NoError(t, s.Tell(ctx, dst, p2p.IOVec{[]byte("extra")}))
+		require.Equal(t, uint64(1), s.Dropped())
+		lower.release <- struct{}{}
+		// "0" was dropped to make room.
+		require.Equal(t, "1", <-lower.entered)
+	})
+	t.Run("Block", func(t *testing.T) {
+		s, lower, dst := fill(t, swarmutil.OverflowBlock)
+		ctx2, cf := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cf()
+		require.Equal(t, context.DeadlineExceeded, s.Tell(ctx2, dst, p2p.IOVec{[]byte("extra")}))
+		require.Equal(t, uint64(0), s.Dropped())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Tell(ctx, dst, p2p.IOVec{[]byte("extra")})
+		}()
+		lower.release <- struct{}{}
+		require.NoError(t, <-done)
+		require.Equal(t, "0", <-lower.entered)
+	})
+}
+
+func TestInterval(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	r := memswarm.NewRealm()
+	lower := &recordSwarm{Swarm: r.NewSwarm()}
+	a := New(lower, WithInterval(time.Second), WithClock(clock))
+	b := r.NewSwarm()
+	defer a.Close()
+	defer b.Close()
+	go b.ServeTells(func(*p2p.Message) {})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte(strconv.Itoa(i))}))
+	}
+	for i := 1; i <= 3; i++ {
+		clock.BlockUntil(1)
+		require.Equal(t, i, lower.count())
+		clock.Advance(time.Second)
+	}
+	require.NoError(t, a.Flush(ctx))
+	require.Equal(t, 3, lower.count())
+}
+
+func TestCloseDropsQueued(t *testing.T) {
+	defer swarmtest.AssertNoLeaks(t)()
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lower := &gateSwarm{Swarm: r.NewSwarm(), entered: make(chan string, 10), release: make(chan struct{})}
+	s := New(lower)
+	b := r.NewSwarm()
+	defer b.Close()
+	go b.ServeTells(func(*p2p.Message) {})
+	dst := b.LocalAddrs()[0]
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Tell(ctx, dst, p2p.IOVec{[]byte(strconv.Itoa(i))}))
+	}
+	<-lower.entered
+	close(lower.release)
+	require.NoError(t, s.Close())
+	require.Equal(t, p2p.ErrSwarmClosed, s.Tell(ctx, dst, p2p.IOVec{[]byte("late")}))
+	// every message was either sent, or dropped by Close.
+	require.Equal(t, uint64(3), s.Dropped()+uint64(len(lower.entered))+1)
+}
+
+// recordSwarm records the messages sent through it, and the most Tells which were running at once.
+type recordSwarm struct {
+	p2p.Swarm
+
+	mu          sync.Mutex
+	inflight    int
+	maxInflight int
+	sent        []string
+}
+
+func (s *recordSwarm) Tell(ctx context.Context, dst p2p.Addr, data p2p.IOVec) error {
+	s.mu.Lock()
+	s.inflight++
+	if s.inflight > s.maxInflight {
+		s.maxInflight = s.inflight
+	}
+	s.sent = append(s.sent, string(p2p.VecBytes(data)))
+	s.mu.Unlock()
+	// give any other Tells a chance to overlap.
+	time.Sleep(100 * time.Microsecond)
+	err := s.Swarm.Tell(ctx, dst, data)
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+	return err
+}
+
+func (s *recordSwarm) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sent)
+}
+
+// gateSwarm reports each message on entered, and then waits for release before sending it.
+type gateSwarm struct {
+	p2p.Swarm
+	entered chan string
+	release chan struct{}
+}
+
+func (s *gateSwarm) Tell(ctx context.Context, dst p2p.Addr, data p2p.IOVec) error {
+	select {
+	case s.entered <- string(p2p.VecBytes(data)):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.Swarm.Tell(ctx, dst, data)
+}
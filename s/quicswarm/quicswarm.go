@@ -37,6 +37,8 @@ type Swarm struct {
 
 	tellHub *swarmutil.TellHub
 	askHub  *swarmutil.AskHub
+
+	closeOnce swarmutil.CloseOnce
 }
 
 func New(laddr string, privKey p2p.PrivateKey) (*Swarm, error) {
@@ -79,8 +81,8 @@ func (s *Swarm) ServeAsks(fn p2p.AskHandler) error {
 
 func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
 	dst := addr.(*Addr)
-	if len(data) > s.mtu {
-		return p2p.ErrMTUExceeded
+	if err := p2p.CheckMTU(data, s.mtu); err != nil {
+		return err
 	}
 	err := s.withSession(ctx, dst, func(sess quic.Session) error {
 		// stream
@@ -105,8 +107,8 @@ func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
 
 func (s *Swarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
 	dst := addr.(*Addr)
-	if len(data) > s.mtu {
-		return nil, p2p.ErrMTUExceeded
+	if err := p2p.CheckMTU(data, s.mtu); err != nil {
+		return nil, err
 	}
 	log := log.WithFields(logrus.Fields{
 		"remote_addr": dst,
@@ -147,17 +149,19 @@ func (s *Swarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte,
 	return respData, nil
 }
 
-func (s *Swarm) Close() (retErr error) {
-	s.tellHub.CloseWithError(p2p.ErrSwarmClosed)
-	s.askHub.CloseWithError(p2p.ErrSwarmClosed)
-	s.cf()
-	if err := s.l.Close(); retErr == nil {
-		retErr = err
-	}
-	if err := s.udpConn.Close(); retErr == nil {
-		retErr = err
-	}
-	return retErr
+func (s *Swarm) Close() error {
+	return s.closeOnce.Do(func() (retErr error) {
+		s.tellHub.CloseWithError(p2p.ErrSwarmClosed)
+		s.askHub.CloseWithError(p2p.ErrSwarmClosed)
+		s.cf()
+		if err := s.l.Close(); retErr == nil {
+			retErr = err
+		}
+		if err := s.udpConn.Close(); retErr == nil {
+			retErr = err
+		}
+		return retErr
+	})
 }
 
 func (s *Swarm) LocalAddrs() []p2p.Addr {
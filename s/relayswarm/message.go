@@ -0,0 +1,52 @@
+package relayswarm
+
+import (
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/pkg/errors"
+)
+
+// Every message to or from a relay starts with a message type.
+// Forward and deliver messages are followed by a PeerID, and then the payload.
+const (
+	// msgRegister is sent by a client to register with the relay, or refresh its registration.
+	msgRegister = uint8(iota)
+	// msgForward is sent by a client, and carries the PeerID of the destination.
+	msgForward
+	// msgDeliver is sent by the relay, and carries the PeerID of the source.
+	msgDeliver
+)
+
+// Overhead is the size of the header added to each relayed message.
+const Overhead = 1 + len(p2p.PeerID{})
+
+func newRegisterMessage() p2p.IOVec {
+	return p2p.IOVec{[]byte{msgRegister}}
+}
+
+func newRelayMessage(msgType uint8, id p2p.PeerID, data p2p.IOVec) p2p.IOVec {
+	header := make([]byte, Overhead)
+	header[0] = msgType
+	copy(header[1:], id[:])
+	msg := make(p2p.IOVec, 0, 1+len(data))
+	msg = append(msg, header)
+	return append(msg, data...)
+}
+
+func parseMessage(x []byte) (msgType uint8, id p2p.PeerID, payload []byte, err error) {
+	if len(x) < 1 {
+		return 0, id, nil, errors.Errorf("relayswarm: empty message")
+	}
+	msgType = x[0]
+	switch msgType {
+	case msgRegister:
+		return msgType, id, nil, nil
+	case msgForward, msgDeliver:
+		if len(x) < Overhead {
+			return 0, id, nil, errors.Errorf("relayswarm: message too short")
+		}
+		copy(id[:], x[1:Overhead])
+		return msgType, id, x[Overhead:], nil
+	default:
+		return 0, id, nil, errors.Errorf("relayswarm: unknown message type %d", msgType)
+	}
+}
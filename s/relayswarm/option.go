@@ -0,0 +1,29 @@
+package relayswarm
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+type Option func(s *Swarm)
+
+// WithRegisterInterval sets how often the client registers with the relay.
+// It should be shorter than the relay's RegistrationTTL.
+// The default is DefaultRegisterInterval.
+func WithRegisterInterval(d time.Duration) Option {
+	if d <= 0 {
+		panic(d)
+	}
+	return func(s *Swarm) {
+		s.interval = d
+	}
+}
+
+// WithClock sets the clock used to schedule registrations.
+// The default is the real clock.
+func WithClock(clock clockwork.Clock) Option {
+	return func(s *Swarm) {
+		s.clock = clock
+	}
+}
@@ -0,0 +1,223 @@
+package relayswarm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRegistrationTTL is how long a registration lasts if it is not refreshed.
+const DefaultRegistrationTTL = time.Minute
+
+// DefaultMaxClients is the default number of clients which can be registered at once.
+const DefaultMaxClients = 4096
+
+// forwardTimeout is the longest the relay spends forwarding a message.
+const forwardTimeout = 10 * time.Second
+
+const (
+	// ForwardQueueSize is the most messages the relay queues for a client, before dropping more sent to it.
+	ForwardQueueSize = 64
+	// MaxQueuedPerClient is the most messages from one client the relay queues at once, across all the clients they are sent to.
+	MaxQueuedPerClient = 16
+)
+
+type RelayParams struct {
+	// Swarm is the swarm clients connect to the relay on.
+	// It must be secure, since the relay identifies clients by the PeerID of their public key.
+	Swarm p2p.SecureSwarm
+	// RegistrationTTL is how long a client stays registered after its last registration.
+	// It defaults to DefaultRegistrationTTL
+	RegistrationTTL time.Duration
+	// MaxClients is the most clients registered at once, once there are that many,
+	// the least recently used registration is removed for each new one.
+	// It defaults to DefaultMaxClients.
+	MaxClients int
+	// Clock is used to expire registrations, it defaults to the real clock.
+	Clock clockwork.Clock
+}
+
+// Relay forwards messages between clients which have registered with it.
+// Clients are addressed by PeerID, and the relay keeps a table of the address each registered from.
+// The relay only sees the payloads sent through it, so clients should secure them end-to-end,
+// for example by running a noiseswarm on top of the client Swarm.
+type Relay struct {
+	swarm p2p.SecureSwarm
+	ttl   time.Duration
+	clock clockwork.Clock
+	ctx   context.Context
+	cf    context.CancelFunc
+	peers *swarmutil.Pool[p2p.PeerID, p2p.Addr]
+
+	mu sync.Mutex
+	// queues holds the messages waiting to be forwarded to each client.
+	// A client's queue has a worker forwarding from it, and is removed when it is empty.
+	queues map[p2p.PeerID][]queuedMessage
+	// queued is the number of messages from each client in queues.
+	queued map[p2p.PeerID]int
+
+	closeOnce swarmutil.CloseOnce
+}
+
+type queuedMessage struct {
+	src     p2p.PeerID
+	dstAddr p2p.Addr
+	payload []byte
+}
+
+func NewRelay(params RelayParams) *Relay {
+	if params.RegistrationTTL == 0 {
+		params.RegistrationTTL = DefaultRegistrationTTL
+	}
+	if params.MaxClients == 0 {
+		params.MaxClients = DefaultMaxClients
+	}
+	if params.Clock == nil {
+		params.Clock = clockwork.NewRealClock()
+	}
+	ctx, cf := context.WithCancel(context.Background())
+	r := &Relay{
+		swarm: params.Swarm,
+		ttl:   params.RegistrationTTL,
+		clock: params.Clock,
+		ctx:   ctx,
+		cf:    cf,
+		peers: swarmutil.NewPool(swarmutil.PoolParams[p2p.PeerID, p2p.Addr]{
+			TTL:     params.RegistrationTTL,
+			MaxSize: params.MaxClients,
+			Clock:   params.Clock,
+		}),
+		queues: make(map[p2p.PeerID][]queuedMessage),
+		queued: make(map[p2p.PeerID]int),
+	}
+	go r.cleanupLoop(ctx)
+	go func() {
+		if err := r.swarm.ServeTells(r.handleTell); err != nil && err != p2p.ErrSwarmClosed {
+			log.Error("relayswarm: relay stopped serving: ", err)
+		}
+	}()
+	return r
+}
+
+// Lookup returns the address id is registered from, if it is registered.
+func (r *Relay) Lookup(id p2p.PeerID) (p2p.Addr, bool) {
+	return r.peers.Get(id)
+}
+
+// Count returns the number of registered clients, including expired registrations which have not been removed.
+func (r *Relay) Count() int {
+	return r.peers.Len()
+}
+
+// Close closes the relay's swarm, and drops the messages waiting to be forwarded.
+func (r *Relay) Close() error {
+	return r.closeOnce.Do(func() error {
+		r.cf()
+		return r.swarm.Close()
+	})
+}
+
+// cleanupLoop removes expired registrations
+func (r *Relay) cleanupLoop(ctx context.Context) {
+	ticker := r.clock.NewTicker(r.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+			r.peers.Cleanup(r.clock.Now())
+		}
+	}
+}
+
+func (r *Relay) handleTell(msg *p2p.Message) {
+	msgType, dst, payload, err := parseMessage(msg.Payload)
+	if err != nil {
+		log.WithFields(logrus.Fields{"src": msg.Src}).Warn(err)
+		return
+	}
+	srcID := p2p.NewPeerID(p2p.LookupPublicKeyInHandler(r.swarm, msg.Src))
+	switch msgType {
+	case msgRegister:
+		r.peers.Put(srcID, msg.Src)
+	case msgForward:
+		// only registered clients can send, so the relay can't be used to reach peers which can't reply.
+		if addr, ok := r.peers.Get(srcID); !ok || addr.Key() != msg.Src.Key() {
+			log.WithFields(logrus.Fields{"src": msg.Src}).Debug("relayswarm: dropping message from unregistered client")
+			return
+		}
+		dstAddr, ok := r.peers.Get(dst)
+		if !ok {
+			log.WithFields(logrus.Fields{"src": srcID, "dst": dst}).Debug("relayswarm: dropping message to unregistered client")
+			return
+		}
+		r.enqueue(srcID, dst, dstAddr, payload)
+	}
+}
+
+// enqueue queues a message to be forwarded to dst, unless dst's queue or the messages queued from src are at their limit.
+// Each client's messages are forwarded in order, which handshakes above rely on,
+// and a slow client only holds up the messages sent to it.
+func (r *Relay) enqueue(src, dst p2p.PeerID, dstAddr p2p.Addr, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queued[src] >= MaxQueuedPerClient {
+		log.WithFields(logrus.Fields{"src": src}).Debug("relayswarm: dropping message, too many are queued from client")
+		return
+	}
+	q, exists := r.queues[dst]
+	if len(q) >= ForwardQueueSize {
+		log.WithFields(logrus.Fields{"dst": dst}).Debug("relayswarm: dropping message, too many are queued for client")
+		return
+	}
+	r.queues[dst] = append(q, queuedMessage{
+		src:     src,
+		dstAddr: dstAddr,
+		payload: append([]byte{}, payload...),
+	})
+	r.queued[src]++
+	if !exists {
+		go r.forwardLoop(dst)
+	}
+}
+
+// forwardLoop forwards the messages queued for dst, until its queue is empty.
+func (r *Relay) forwardLoop(dst p2p.PeerID) {
+	for {
+		r.mu.Lock()
+		q := r.queues[dst]
+		if len(q) == 0 {
+			delete(r.queues, dst)
+			r.mu.Unlock()
+			return
+		}
+		m := q[0]
+		r.queues[dst] = q[1:]
+		r.mu.Unlock()
+
+		// once the relay is closed the rest of the queue is dropped
+		if r.ctx.Err() == nil {
+			r.forward(dst, m)
+		}
+
+		r.mu.Lock()
+		if r.queued[m.src]--; r.queued[m.src] == 0 {
+			delete(r.queued, m.src)
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *Relay) forward(dst p2p.PeerID, m queuedMessage) {
+	ctx, cf := context.WithTimeout(r.ctx, forwardTimeout)
+	defer cf()
+	if err := r.swarm.Tell(ctx, m.dstAddr, newRelayMessage(msgDeliver, m.src, p2p.IOVec{m.payload})); err != nil {
+		log.WithFields(logrus.Fields{"dst": dst}).Debug("relayswarm: error forwarding message: ", err)
+	}
+}
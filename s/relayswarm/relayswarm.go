@@ -0,0 +1,145 @@
+package relayswarm
+
+import (
+	"context"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+// DefaultRegisterInterval is how often a client refreshes its registration with the relay.
+// It is shorter than DefaultRegistrationTTL, so a lost registration is retried before the last one expires.
+const DefaultRegisterInterval = DefaultRegistrationTTL / 3
+
+var _ p2p.Swarm = &Swarm{}
+
+// Swarm is a client of a Relay, which sends and receives messages through the relay.
+// Addresses are PeerIDs, and messages can reach any peer registered with the same relay,
+// even if the peers can't reach each other directly.
+// The client registers with the relay when it is created, and then every register interval.
+// It only supports Tells; a noiseswarm on top provides Asks, and secures messages end-to-end.
+type Swarm struct {
+	lower    p2p.SecureSwarm
+	relay    p2p.Addr
+	localID  p2p.PeerID
+	interval time.Duration
+	clock    clockwork.Clock
+
+	cf        context.CancelFunc
+	tells     *swarmutil.TellHub
+	closeOnce swarmutil.CloseOnce
+}
+
+// New creates a client of the relay at relayAddr on lower.
+// Only messages from relayAddr are accepted, so lower should only be used for the relay.
+func New(lower p2p.SecureSwarm, relayAddr p2p.Addr, opts ...Option) *Swarm {
+	ctx, cf := context.WithCancel(context.Background())
+	s := &Swarm{
+		lower:    lower,
+		relay:    relayAddr,
+		localID:  p2p.NewPeerID(lower.PublicKey()),
+		interval: DefaultRegisterInterval,
+		clock:    clockwork.NewRealClock(),
+
+		cf:    cf,
+		tells: swarmutil.NewTellHub(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	go func() {
+		if err := s.lower.ServeTells(s.handleTell); err != nil && err != p2p.ErrSwarmClosed {
+			log.Error("relayswarm: lower swarm stopped serving: ", err)
+		}
+	}()
+	go s.registerLoop(ctx)
+	return s
+}
+
+// Register registers with the relay, so it forwards messages to this client.
+// Registration is done periodically in the background, but Register can be called to register immediately.
+// The relay does not acknowledge registrations.
+func (s *Swarm) Register(ctx context.Context) error {
+	return s.lower.Tell(ctx, s.relay, newRegisterMessage())
+}
+
+// Tell sends data to the peer with the PeerID addr, through the relay.
+// It returns nil even if the peer is not registered with the relay, just as if the message had been lost.
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	dst, ok := addr.(p2p.PeerID)
+	if !ok {
+		return errors.Errorf("relayswarm: addresses must be PeerIDs, got %T", addr)
+	}
+	if err := p2p.CheckMTU(data, s.MTU(ctx, dst)); err != nil {
+		return err
+	}
+	return s.lower.Tell(ctx, s.relay, newRelayMessage(msgForward, dst, data))
+}
+
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	return s.tells.ServeTells(fn)
+}
+
+// LocalAddrs returns the PeerID of the lower swarm, which is the address other clients of the relay use.
+func (s *Swarm) LocalAddrs() []p2p.Addr {
+	return []p2p.Addr{s.localID}
+}
+
+func (s *Swarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	return s.lower.MTU(ctx, s.relay) - Overhead
+}
+
+func (s *Swarm) ParseAddr(data []byte) (p2p.Addr, error) {
+	var id p2p.PeerID
+	if err := id.UnmarshalText(data); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Close stops registering with the relay, and closes the lower swarm.
+func (s *Swarm) Close() error {
+	return s.closeOnce.Do(func() error {
+		s.cf()
+		s.tells.CloseWithError(p2p.ErrSwarmClosed)
+		return s.lower.Close()
+	})
+}
+
+func (s *Swarm) handleTell(msg *p2p.Message) {
+	if msg.Src.Key() != s.relay.Key() {
+		log.WithFields(logrus.Fields{"src": msg.Src}).Debug("relayswarm: dropping message which is not from the relay")
+		return
+	}
+	msgType, src, payload, err := parseMessage(msg.Payload)
+	if err != nil || msgType != msgDeliver {
+		log.WithFields(logrus.Fields{"src": msg.Src}).Warn("relayswarm: dropping malformed message from relay")
+		return
+	}
+	s.tells.DeliverTell(&p2p.Message{
+		Src:     src,
+		Dst:     s.localID,
+		Payload: payload,
+	})
+}
+
+func (s *Swarm) registerLoop(ctx context.Context) {
+	ticker := s.clock.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Register(ctx); err != nil && ctx.Err() == nil {
+			log.Warn("relayswarm: error registering with relay: ", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+	}
+}
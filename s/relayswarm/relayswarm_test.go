@@ -0,0 +1,180 @@
+package relayswarm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/noiseswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		relay := newTestRelay(t, r, 0, RelayParams{})
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = newTestClient(t, r, relay, i+1)
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestRelayedTell(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	relay := newTestRelay(t, r, 0, RelayParams{})
+	a := newTestClient(t, r, relay, 1)
+	b := newTestClient(t, r, relay, 2)
+	defer a.Close()
+	defer b.Close()
+	// the clients can't reach each other directly
+	r.Block(lowerMemAddr(a), lowerMemAddr(b))
+
+	// noiseswarm secures the messages end-to-end, so the relay can't read them.
+	aE2E := noiseswarm.New(a, p2ptest.NewTestKey(t, 10))
+	bE2E := noiseswarm.New(b, p2ptest.NewTestKey(t, 20))
+	defer aE2E.Close()
+	defer bE2E.Close()
+	recv := make(chan *p2p.Message, 1)
+	go aE2E.ServeTells(p2p.NoOpTellHandler)
+	go bE2E.ServeTells(func(msg *p2p.Message) {
+		recv <- &p2p.Message{Src: msg.Src, Payload: append([]byte{}, msg.Payload...)}
+	})
+
+	require.NoError(t, aE2E.Tell(ctx, bE2E.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	msg := <-recv
+	require.Equal(t, "hello", string(msg.Payload))
+	require.Equal(t, aE2E.LocalAddrs()[0], msg.Src)
+	require.Equal(t, p2p.NewPeerID(aE2E.PublicKey()), p2p.ExtractPeerID(msg.Src))
+}
+
+func TestRegistration(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	clock := clockwork.NewFakeClock()
+	relay := newTestRelay(t, r, 0, RelayParams{RegistrationTTL: time.Minute, Clock: clock})
+	a := newTestClient(t, r, relay, 1)
+	defer a.Close()
+	recv := make(chan string, 1)
+	go a.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+
+	// b uses the relay's swarm, without registering
+	bLower := noiseswarm.New(r.NewSwarm(), p2ptest.NewTestKey(t, 2))
+	defer bLower.Close()
+	go bLower.ServeTells(p2p.NoOpTellHandler)
+	bID := p2p.NewPeerID(bLower.PublicKey())
+	relayAddr := relay.swarm.LocalAddrs()[0]
+	forward := newRelayMessage(msgForward, a.localID, p2p.IOVec{[]byte("hello")})
+	require.NoError(t, bLower.Tell(ctx, relayAddr, forward))
+	require.NoError(t, bLower.Tell(ctx, relayAddr, newRegisterMessage()))
+	require.Eventually(t, func() bool {
+		_, ok := relay.Lookup(bID)
+		return ok
+	}, time.Second, time.Millisecond)
+	require.Len(t, recv, 0)
+	require.NoError(t, bLower.Tell(ctx, relayAddr, forward))
+	require.Equal(t, "hello", <-recv)
+
+	// registrations expire
+	clock.Advance(time.Minute + time.Second)
+	_, ok := relay.Lookup(bID)
+	require.False(t, ok)
+}
+
+func TestMaxClients(t *testing.T) {
+	r := memswarm.NewRealm()
+	relay := newTestRelay(t, r, 0, RelayParams{MaxClients: 2})
+	clients := make([]*Swarm, 3)
+	for i := range clients {
+		clients[i] = newTestClient(t, r, relay, i+1)
+		defer clients[i].Close()
+	}
+	// the oldest registration was removed to make room
+	require.Equal(t, 2, relay.Count())
+	_, ok := relay.Lookup(clients[0].localID)
+	require.False(t, ok)
+	for _, c := range clients[1:] {
+		_, ok := relay.Lookup(c.localID)
+		require.True(t, ok)
+	}
+}
+
+func TestForwardLimits(t *testing.T) {
+	r := memswarm.NewRealm()
+	relay := NewRelay(RelayParams{Swarm: r.NewSwarm()})
+	defer relay.Close()
+	// nothing serves slow's tells, so forwarding to it blocks until it is closed
+	slow, fast := r.NewSwarm(), r.NewSwarm()
+	defer fast.Close()
+	defer slow.Close()
+	recv := make(chan struct{}, 1)
+	go fast.ServeTells(func(*p2p.Message) { recv <- struct{}{} })
+	slowID, fastID := p2p.NewPeerID(slow.PublicKey()), p2p.NewPeerID(fast.PublicKey())
+	queuedFrom := func(src p2p.PeerID) int {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return relay.queued[src]
+	}
+	queuedFor := func(dst p2p.PeerID) int {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return len(relay.queues[dst])
+	}
+
+	// one client can only queue so many messages
+	src := p2ptest.NewTestKey(t, 100)
+	for i := 0; i < MaxQueuedPerClient+5; i++ {
+		relay.enqueue(p2p.NewPeerID(src.Public()), slowID, slow.LocalAddrs()[0], []byte("hello"))
+	}
+	require.Equal(t, MaxQueuedPerClient, queuedFrom(p2p.NewPeerID(src.Public())))
+	// the first message is being forwarded
+	require.Eventually(t, func() bool {
+		return queuedFor(slowID) == MaxQueuedPerClient-1
+	}, time.Second, time.Millisecond)
+	// and so many can be queued for one client
+	for i := 0; i < 2*ForwardQueueSize; i++ {
+		relay.enqueue(p2p.NewPeerID(p2ptest.NewTestKey(t, 200+i).Public()), slowID, slow.LocalAddrs()[0], []byte("hello"))
+	}
+	require.Equal(t, ForwardQueueSize, queuedFor(slowID))
+
+	// other clients are not held up by the slow one
+	relay.enqueue(p2p.NewPeerID(p2ptest.NewTestKey(t, 101).Public()), fastID, fast.LocalAddrs()[0], []byte("hello"))
+	<-recv
+}
+
+func newTestRelay(t testing.TB, r *memswarm.Realm, i int, params RelayParams) *Relay {
+	params.Swarm = noiseswarm.New(r.NewSwarm(), p2ptest.NewTestKey(t, i))
+	relay := NewRelay(params)
+	t.Cleanup(func() {
+		require.NoError(t, relay.Close())
+	})
+	return relay
+}
+
+// newTestClient creates a client of relay, and waits until it is registered.
+func newTestClient(t testing.TB, r *memswarm.Realm, relay *Relay, i int) *Swarm {
+	lower := noiseswarm.New(r.NewSwarm(), p2ptest.NewTestKey(t, i))
+	s := New(lower, relay.swarm.LocalAddrs()[0])
+	require.Eventually(t, func() bool {
+		_, ok := relay.Lookup(s.localID)
+		return ok
+	}, time.Second, time.Millisecond)
+	return s
+}
+
+func lowerMemAddr(s *Swarm) memswarm.Addr {
+	return s.lower.LocalAddrs()[0].(noiseswarm.Addr).Addr.(memswarm.Addr)
+}
@@ -0,0 +1,38 @@
+package securityselect
+
+import (
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/multiswarm"
+)
+
+// Policy decides how traffic with a peer is secured, based on the peer's address in the lower swarm.
+// Both parties must make the same decision about one another, or their messages will be dropped.
+type Policy interface {
+	// UseNoise returns true if traffic with lowerAddr should be secured by noiseswarm,
+	// and false if the lower swarm already secures it.
+	UseNoise(lowerAddr p2p.Addr) bool
+}
+
+// PolicyFunc is a Policy implemented by a function
+type PolicyFunc func(lowerAddr p2p.Addr) bool
+
+func (f PolicyFunc) UseNoise(lowerAddr p2p.Addr) bool {
+	return f(lowerAddr)
+}
+
+// DirectTransports returns a Policy for a multiswarm lower swarm, which sends traffic
+// directly over the named transports, and over noiseswarm for all other transports.
+func DirectTransports(names ...string) Policy {
+	direct := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		direct[name] = struct{}{}
+	}
+	return PolicyFunc(func(lowerAddr p2p.Addr) bool {
+		a, ok := lowerAddr.(multiswarm.Addr)
+		if !ok {
+			return true
+		}
+		_, isDirect := direct[a.Transport]
+		return !isDirect
+	})
+}
@@ -0,0 +1,237 @@
+package securityselect
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/noiseswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+var log = p2p.Logger
+
+var _ p2p.SecureSwarm = &Swarm{}
+
+const (
+	tagDirect = 0
+	tagNoise  = 1
+)
+
+// Overhead is the number of bytes added to each message to distinguish the direct and noise paths
+const Overhead = 1
+
+// Swarm secures traffic with each peer using either noiseswarm, or the security of the lower swarm,
+// as decided by a Policy.
+// Addresses are noiseswarm.Addrs regardless of the path used, so peers are always identified by their PeerID.
+type Swarm struct {
+	lower p2p.Swarm
+	// secure is nil if the lower swarm is not secure
+	secure     p2p.Secure
+	policy     Policy
+	privateKey p2p.PrivateKey
+	localID    p2p.PeerID
+
+	noise          *noiseswarm.Swarm
+	noiseTransport *noiseTransport
+	closeOnce      swarmutil.CloseOnce
+}
+
+// New creates a Swarm on x.
+// If x implements p2p.Secure, its public key must be privateKey's public key, so the local PeerID is the same on both paths.
+// If x does not implement p2p.Secure, policy must always choose noise.
+// opts are passed to noiseswarm.
+func New(x p2p.Swarm, privateKey p2p.PrivateKey, policy Policy, opts ...noiseswarm.Option) *Swarm {
+	secure, _ := x.(p2p.Secure)
+	if secure != nil {
+		if !bytes.Equal(p2p.MarshalPublicKey(secure.PublicKey()), p2p.MarshalPublicKey(privateKey.Public())) {
+			panic("securityselect: lower swarm's public key does not match privateKey")
+		}
+	}
+	nt := &noiseTransport{
+		Swarm: x,
+		hub:   swarmutil.NewTellHub(),
+	}
+	return &Swarm{
+		lower:      x,
+		secure:     secure,
+		policy:     policy,
+		privateKey: privateKey,
+		localID:    p2p.NewPeerID(privateKey.Public()),
+
+		noise:          noiseswarm.New(nt, privateKey, opts...),
+		noiseTransport: nt,
+	}
+}
+
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	dst := addr.(noiseswarm.Addr)
+	if s.policy.UseNoise(dst.Addr) {
+		return s.noise.Tell(ctx, dst, data)
+	}
+	if err := s.checkDirectPeer(ctx, dst); err != nil {
+		return err
+	}
+	msg := make(p2p.IOVec, 0, 1+len(data))
+	msg = append(msg, []byte{tagDirect})
+	msg = append(msg, data...)
+	return s.lower.Tell(ctx, dst.Addr, msg)
+}
+
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	eg := errgroup.Group{}
+	eg.Go(func() error {
+		return s.noise.ServeTells(fn)
+	})
+	// the lower swarm must have the keys of its peers in memory during a handler, see p2p.LookupPublicKeyInHandler,
+	// so lookups are given a context which is already done, and don't wait.
+	ctx, cf := context.WithCancel(context.Background())
+	cf()
+	eg.Go(func() error {
+		return s.lower.ServeTells(func(msg *p2p.Message) {
+			s.fromBelow(ctx, msg, fn)
+		})
+	})
+	return eg.Wait()
+}
+
+func (s *Swarm) fromBelow(ctx context.Context, msg *p2p.Message, next p2p.TellHandler) {
+	if len(msg.Payload) < Overhead {
+		log.Warn("securityselect: empty message from ", msg.Src)
+		return
+	}
+	useNoise := s.policy.UseNoise(msg.Src)
+	switch msg.Payload[0] {
+	case tagNoise:
+		if !useNoise {
+			log.WithFields(logrus.Fields{"src": msg.Src}).Warn("securityselect: dropping noise message from direct peer")
+			return
+		}
+		s.noiseTransport.hub.DeliverTell(&p2p.Message{
+			Src:     msg.Src,
+			Dst:     msg.Dst,
+			Payload: msg.Payload[1:],
+		})
+	case tagDirect:
+		if useNoise || s.secure == nil {
+			log.WithFields(logrus.Fields{"src": msg.Src}).Warn("securityselect: dropping direct message from noise peer")
+			return
+		}
+		publicKey, err := s.secure.LookupPublicKey(ctx, msg.Src)
+		if err != nil {
+			log.WithFields(logrus.Fields{"src": msg.Src}).Warn("securityselect: dropping direct message: ", err)
+			return
+		}
+		next(&p2p.Message{
+			Src: noiseswarm.Addr{
+				ID:   p2p.NewPeerID(publicKey),
+				Addr: msg.Src,
+			},
+			Dst: noiseswarm.Addr{
+				ID:   s.localID,
+				Addr: msg.Dst,
+			},
+			Payload: msg.Payload[1:],
+		})
+	default:
+		log.WithFields(logrus.Fields{"src": msg.Src}).Warn("securityselect: invalid tag ", msg.Payload[0])
+	}
+}
+
+// checkDirectPeer ensures the lower swarm can secure traffic with dst, and that dst.ID is the party it is secured with.
+func (s *Swarm) checkDirectPeer(ctx context.Context, dst noiseswarm.Addr) error {
+	if s.secure == nil {
+		return errors.Errorf("securityselect: policy chose the direct path for %v, but the lower swarm is not secure", dst.Addr)
+	}
+	publicKey, err := s.secure.LookupPublicKey(ctx, dst.Addr)
+	if err != nil {
+		return err
+	}
+	if actual := p2p.NewPeerID(publicKey); actual != dst.ID {
+		return errors.Errorf("wrong peer HAVE: %v WANT: %v", actual, dst.ID)
+	}
+	return nil
+}
+
+// UsesNoise returns true if traffic with addr is secured by noiseswarm,
+// and false if it is secured by the lower swarm.
+func (s *Swarm) UsesNoise(addr p2p.Addr) bool {
+	return s.policy.UseNoise(addr.(noiseswarm.Addr).Addr)
+}
+
+func (s *Swarm) LookupPublicKey(ctx context.Context, addr p2p.Addr) (p2p.PublicKey, error) {
+	target := addr.(noiseswarm.Addr)
+	if s.policy.UseNoise(target.Addr) {
+		return s.noise.LookupPublicKey(ctx, target)
+	}
+	if s.secure == nil {
+		return nil, p2p.ErrPublicKeyNotFound
+	}
+	publicKey, err := s.secure.LookupPublicKey(ctx, target.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if p2p.NewPeerID(publicKey) != target.ID {
+		return nil, p2p.ErrPublicKeyNotFound
+	}
+	return publicKey, nil
+}
+
+func (s *Swarm) PublicKey() p2p.PublicKey {
+	return s.privateKey.Public()
+}
+
+func (s *Swarm) LocalAddrs() []p2p.Addr {
+	return s.noise.LocalAddrs()
+}
+
+func (s *Swarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	target := addr.(noiseswarm.Addr)
+	if s.policy.UseNoise(target.Addr) {
+		return s.noise.MTU(ctx, target)
+	}
+	return s.lower.MTU(ctx, target.Addr) - Overhead
+}
+
+func (s *Swarm) ParseAddr(data []byte) (p2p.Addr, error) {
+	return s.noise.ParseAddr(data)
+}
+
+// Close closes noiseswarm and then the lower swarm.
+func (s *Swarm) Close() error {
+	return s.closeOnce.Do(func() error {
+		s.noise.Close()
+		return s.lower.Close()
+	})
+}
+
+// noiseTransport is the swarm noiseswarm runs on.
+// It tags outbound messages for the noise path, and is delivered the inbound noise messages by the Swarm.
+type noiseTransport struct {
+	p2p.Swarm
+	hub *swarmutil.TellHub
+}
+
+func (t *noiseTransport) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	msg := make(p2p.IOVec, 0, 1+len(data))
+	msg = append(msg, []byte{tagNoise})
+	msg = append(msg, data...)
+	return t.Swarm.Tell(ctx, addr, msg)
+}
+
+func (t *noiseTransport) ServeTells(fn p2p.TellHandler) error {
+	return t.hub.ServeTells(fn)
+}
+
+func (t *noiseTransport) MTU(ctx context.Context, addr p2p.Addr) int {
+	return t.Swarm.MTU(ctx, addr) - Overhead
+}
+
+// Close only stops delivery to noiseswarm, the lower swarm is closed by the Swarm
+func (t *noiseTransport) Close() error {
+	t.hub.CloseWithError(p2p.ErrSwarmClosed)
+	return nil
+}
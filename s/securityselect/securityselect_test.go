@@ -0,0 +1,156 @@
+package securityselect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/p2ptest"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/multiswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name     string
+		useNoise bool
+	}{
+		{name: "Noise", useNoise: true},
+		{name: "Direct", useNoise: false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+				r := memswarm.NewRealm()
+				xs := make([]p2p.Swarm, n)
+				for i := range xs {
+					k := p2ptest.NewTestKey(t, i)
+					xs[i] = New(r.NewSwarmWithKey(k), k, PolicyFunc(func(p2p.Addr) bool {
+						return tc.useNoise
+					}))
+				}
+				t.Cleanup(func() {
+					swarmtest.CloseSwarms(t, xs)
+				})
+				return xs
+			})
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	// traffic between 0 and 1 is direct, everything else uses noise.
+	isDirect := func(a, b int) bool {
+		return (a == 0 && b == 1) || (a == 1 && b == 0)
+	}
+	const n = 3
+	lowers := make([]*recordSwarm, n)
+	xs := make([]*Swarm, n)
+	recvs := make([]chan p2p.Message, n)
+	for i := range xs {
+		i := i
+		k := p2ptest.NewTestKey(t, i)
+		lowers[i] = &recordSwarm{Swarm: r.NewSwarmWithKey(k)}
+		xs[i] = New(lowers[i], k, PolicyFunc(func(addr p2p.Addr) bool {
+			return !isDirect(i, addr.(memswarm.Addr).N)
+		}))
+		recvs[i] = make(chan p2p.Message, 1)
+		go xs[i].ServeTells(func(msg *p2p.Message) {
+			recvs[i] <- p2p.Message{Src: msg.Src, Payload: append([]byte{}, msg.Payload...)}
+		})
+	}
+	defer func() {
+		for _, x := range xs {
+			require.NoError(t, x.Close())
+		}
+	}()
+
+	for i := range xs {
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			dst := xs[j].LocalAddrs()[0]
+			require.Equal(t, !isDirect(i, j), xs[i].UsesNoise(dst))
+			payload := []byte("hello from " + string(rune('0'+i)))
+			require.NoError(t, xs[i].Tell(ctx, dst, p2p.IOVec{payload}))
+			msg := <-recvs[j]
+			require.Equal(t, payload, msg.Payload)
+			require.Equal(t, xs[i].LocalAddrs()[0], msg.Src)
+
+			// only the direct path puts the plaintext on the lower swarm
+			require.Equal(t, isDirect(i, j), lowers[i].sentPlaintext(j, payload))
+
+			publicKey, err := xs[i].LookupPublicKey(ctx, dst)
+			require.NoError(t, err)
+			require.Equal(t, xs[j].PublicKey(), publicKey)
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	r := memswarm.NewRealm()
+	require.Panics(t, func() {
+		New(r.NewSwarmWithKey(p2ptest.NewTestKey(t, 0)), p2ptest.NewTestKey(t, 1), PolicyFunc(func(p2p.Addr) bool {
+			return true
+		}))
+	})
+}
+
+func TestParseAddr(t *testing.T) {
+	k := p2ptest.NewTestKey(t, 0)
+	x := New(multiswarm.NewSwarm(map[string]p2p.Swarm{
+		"mem1": memswarm.NewRealm().NewSwarm(),
+		"mem2": memswarm.NewRealm().NewSwarm(),
+	}), k, DirectTransports())
+	defer x.Close()
+	for _, addr := range x.LocalAddrs() {
+		data, err := addr.MarshalText()
+		require.NoError(t, err)
+		parsed, err := x.ParseAddr(data)
+		require.NoError(t, err)
+		require.Equal(t, addr, parsed)
+	}
+	// the lower swarm's error for an unknown transport is returned
+	id := p2p.NewPeerID(k.Public())
+	_, err := x.ParseAddr([]byte(id.String() + "@udp://127.0.0.1:1234"))
+	require.True(t, errors.Is(err, multiswarm.ErrUnknownAddrScheme))
+}
+
+// recordSwarm records the messages sent to each memswarm address
+type recordSwarm struct {
+	*memswarm.Swarm
+	mu   sync.Mutex
+	sent map[int][][]byte
+}
+
+func (s *recordSwarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	s.mu.Lock()
+	if s.sent == nil {
+		s.sent = make(map[int][][]byte)
+	}
+	n := addr.(memswarm.Addr).N
+	s.sent[n] = append(s.sent[n], append([]byte{}, p2p.VecBytes(data)...))
+	s.mu.Unlock()
+	return s.Swarm.Tell(ctx, addr, data)
+}
+
+func (s *recordSwarm) sentPlaintext(n int, payload []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range s.sent[n] {
+		if bytes.Contains(msg, payload) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package seqswarm
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+type Option func(s *Swarm)
+
+// WithBufferSize sets how far ahead of the missing message a message from a single peer can be,
+// and still be held while waiting for the missing message. Messages further ahead are dropped.
+// The default is DefaultBufferSize.
+func WithBufferSize(n int) Option {
+	if n <= 0 {
+		panic(n)
+	}
+	return func(s *Swarm) {
+		s.bufferSize = n
+	}
+}
+
+// WithGapTimeout sets how long to wait for a missing message before skipping it,
+// and delivering the buffered messages after it.
+// The default is DefaultGapTimeout.
+func WithGapTimeout(d time.Duration) Option {
+	if d <= 0 {
+		panic(d)
+	}
+	return func(s *Swarm) {
+		s.gapTimeout = d
+	}
+}
+
+// WithClock sets the clock used for gap timeouts.
+// The default is the real clock.
+func WithClock(clock clockwork.Clock) Option {
+	return func(s *Swarm) {
+		s.clock = clock
+	}
+}
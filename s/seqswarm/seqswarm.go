@@ -0,0 +1,282 @@
+package seqswarm
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
+	"github.com/jonboulle/clockwork"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+const (
+	// Overhead is the number of bytes added to each message, for the epoch and sequence number.
+	Overhead = 4 + 8
+	// DefaultBufferSize is the default number of out of order messages buffered for each peer.
+	DefaultBufferSize = 32
+	// DefaultGapTimeout is the default amount of time to wait for a missing message.
+	DefaultGapTimeout = 100 * time.Millisecond
+	// MaxPeers is the most peers sequence numbers are kept for, in each direction.
+	// The least recently used are forgotten first.
+	MaxPeers = 4096
+)
+
+var _ p2p.Swarm = &Swarm{}
+
+var _ p2p.SecureSwarm = &SecureSwarm{}
+
+func New(x p2p.Swarm, opts ...Option) *Swarm {
+	return newSwarm(x, opts...)
+}
+
+func NewSecure(x p2p.SecureSwarm, opts ...Option) *SecureSwarm {
+	return &SecureSwarm{
+		Swarm:  newSwarm(x, opts...),
+		Secure: x,
+	}
+}
+
+// SecureSwarm is a Swarm which gets its identity from the lower swarm
+type SecureSwarm struct {
+	*Swarm
+	p2p.Secure
+}
+
+// Swarm delivers the messages from each peer in the order they were sent.
+// Each message is stamped with a sequence number for its destination.
+// Messages which arrive early are buffered until the messages before them arrive,
+// and old or duplicate messages are dropped, as are messages too far ahead to fit in the buffer.
+// Delivery is not reliable: a missing message is skipped after the gap timeout.
+//
+// Each destination gets a new epoch when the Swarm first sends to it, and sequence numbers start at 0 for each epoch.
+// Epochs are taken from the clock, and only increase, so a peer which restarts, or forgets the destination,
+// is not mistaken for one which is replaying old messages, and messages from an older epoch are dropped.
+// If a peer which is still sending is forgotten, its sequence is picked up from the next message it sends.
+type Swarm struct {
+	p2p.Swarm
+	bufferSize int
+	gapTimeout time.Duration
+	clock      clockwork.Clock
+
+	// lastEpoch is the epoch most recently given to a destination
+	lastEpoch uint32
+	// seqs holds the epoch and counter for each destination
+	seqs *swarmutil.Pool[string, *sendState]
+	// peers holds the order of the messages received from each source
+	peers *swarmutil.Pool[string, *peerState]
+}
+
+func newSwarm(x p2p.Swarm, opts ...Option) *Swarm {
+	s := &Swarm{
+		Swarm:      x,
+		bufferSize: DefaultBufferSize,
+		gapTimeout: DefaultGapTimeout,
+		clock:      clockwork.NewRealClock(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.seqs = swarmutil.NewPool(swarmutil.PoolParams[string, *sendState]{
+		MaxSize: MaxPeers,
+		Clock:   s.clock,
+	})
+	s.peers = swarmutil.NewPool(swarmutil.PoolParams[string, *peerState]{
+		MaxSize: MaxPeers,
+		Clock:   s.clock,
+	})
+	return s
+}
+
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	var header [Overhead]byte
+	epoch, seq := s.nextSeq(addr)
+	binary.BigEndian.PutUint32(header[:4], epoch)
+	binary.BigEndian.PutUint64(header[4:], seq)
+	msg := make(p2p.IOVec, 0, 1+len(data))
+	msg = append(msg, header[:])
+	msg = append(msg, data...)
+	return s.Swarm.Tell(ctx, addr, msg)
+}
+
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	return s.Swarm.ServeTells(func(x *p2p.Message) {
+		s.handleTell(x, fn)
+	})
+}
+
+func (s *Swarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	return s.Swarm.MTU(ctx, addr) - Overhead
+}
+
+func (s *Swarm) handleTell(x *p2p.Message, next p2p.TellHandler) {
+	if len(x.Payload) < Overhead {
+		log.WithFields(logrus.Fields{"src": x.Src}).Warn("seqswarm: dropping short message")
+		return
+	}
+	epoch := binary.BigEndian.Uint32(x.Payload[:4])
+	seq := binary.BigEndian.Uint64(x.Payload[4:Overhead])
+	msg := &p2p.Message{
+		Src:     x.Src,
+		Dst:     x.Dst,
+		Payload: x.Payload[Overhead:],
+	}
+	st := s.getPeer(x.Src)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch {
+	case !st.started, isNewer(epoch, st.epoch):
+		st.reset(epoch)
+		if seq >= uint64(s.bufferSize) {
+			// the peer was sending before its state here was forgotten
+			st.next = seq
+		}
+	case epoch != st.epoch:
+		// from before the peer restarted
+		return
+	}
+	switch {
+	case seq < st.next:
+		// old or duplicate
+		return
+	case seq-st.next >= uint64(s.bufferSize):
+		log.WithFields(logrus.Fields{"src": x.Src}).Debug("seqswarm: dropping message too far ahead")
+		return
+	case seq == st.next:
+		next(msg)
+		st.next++
+		st.drain(next)
+	default:
+		if _, exists := st.buf[seq]; exists {
+			return
+		}
+		// the payload is only valid until the handler returns
+		msg.Payload = append([]byte{}, msg.Payload...)
+		st.buf[seq] = msg
+	}
+	if len(st.buf) > 0 && !st.waiting {
+		st.waiting = true
+		go s.waitGap(st, st.gen, next)
+	}
+}
+
+// waitGap skips the missing message in st if it has not arrived before the gap timeout.
+func (s *Swarm) waitGap(st *peerState, gen uint64, next p2p.TellHandler) {
+	<-s.clock.After(s.gapTimeout)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.gen != gen {
+		return
+	}
+	st.waiting = false
+	if len(st.buf) == 0 {
+		return
+	}
+	st.skip(next)
+	if len(st.buf) > 0 {
+		st.waiting = true
+		go s.waitGap(st, st.gen, next)
+	}
+}
+
+func (s *Swarm) getPeer(addr p2p.Addr) *peerState {
+	st, _, _ := s.peers.GetOrCreate(addr.Key(), func() (*peerState, error) {
+		return &peerState{}, nil
+	})
+	return st
+}
+
+// nextSeq returns the epoch and next sequence number for addr.
+func (s *Swarm) nextSeq(addr p2p.Addr) (uint32, uint64) {
+	st, _, _ := s.seqs.GetOrCreate(addr.Key(), func() (*sendState, error) {
+		return &sendState{epoch: s.newEpoch()}, nil
+	})
+	return st.epoch, atomic.AddUint64(&st.next, 1) - 1
+}
+
+// newEpoch returns an epoch newer than any returned before.
+// It is the time in milliseconds, so epochs from before a restart are older.
+func (s *Swarm) newEpoch() uint32 {
+	for {
+		last := atomic.LoadUint32(&s.lastEpoch)
+		epoch := uint32(s.clock.Now().UnixMilli())
+		if !isNewer(epoch, last) {
+			epoch = last + 1
+		}
+		if atomic.CompareAndSwapUint32(&s.lastEpoch, last, epoch) {
+			return epoch
+		}
+	}
+}
+
+// isNewer reports whether epoch a is after epoch b, allowing for wrap around.
+func isNewer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// sendState is the sequence of the messages sent to a single peer.
+type sendState struct {
+	// next is first so it is aligned for atomic access.
+	next  uint64
+	epoch uint32
+}
+
+// peerState is the order of the messages received from a single peer.
+// Messages are delivered with mu held, so they are delivered one at a time.
+type peerState struct {
+	mu      sync.Mutex
+	started bool
+	epoch   uint32
+	// next is the sequence number of the next message to deliver
+	next uint64
+	// buf holds messages which arrived before the messages preceding them
+	buf map[uint64]*p2p.Message
+	// waiting is true if there is a goroutine waiting for the gap timeout.
+	waiting bool
+	// gen is incremented whenever the missing message arrives, to cancel the waiting goroutine.
+	gen uint64
+}
+
+func (st *peerState) reset(epoch uint32) {
+	st.started = true
+	st.epoch = epoch
+	st.next = 0
+	st.buf = make(map[uint64]*p2p.Message)
+	st.waiting = false
+	st.gen++
+}
+
+// drain delivers the buffered messages which follow on from next.
+func (st *peerState) drain(next p2p.TellHandler) {
+	for {
+		msg, exists := st.buf[st.next]
+		if !exists {
+			break
+		}
+		delete(st.buf, st.next)
+		next(msg)
+		st.next++
+	}
+	// the message being waited for has arrived
+	st.waiting = false
+	st.gen++
+}
+
+// skip gives up on the missing messages before the earliest buffered message.
+func (st *peerState) skip(next p2p.TellHandler) {
+	var min uint64
+	first := true
+	for seq := range st.buf {
+		if first || seq < min {
+			min = seq
+			first = false
+		}
+	}
+	st.next = min
+	st.drain(next)
+}
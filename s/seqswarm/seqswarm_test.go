@@ -0,0 +1,215 @@
+package seqswarm
+
+import (
+	"context"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/faultyswarm"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestReorder(t *testing.T) {
+	s, rec := newTestSwarm(t)
+	for _, seq := range []uint64{0, 2, 3, 1, 5, 4} {
+		s.handleTell(newTestMessage(1, seq), rec.handle)
+	}
+	require.Equal(t, []string{"0", "1", "2", "3", "4", "5"}, rec.get())
+}
+
+func TestDuplicates(t *testing.T) {
+	s, rec := newTestSwarm(t)
+	for _, seq := range []uint64{0, 1, 1, 0, 3, 3, 2, 2} {
+		s.handleTell(newTestMessage(1, seq), rec.handle)
+	}
+	require.Equal(t, []string{"0", "1", "2", "3"}, rec.get())
+}
+
+func TestGapTimeout(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	s, rec := newTestSwarm(t, WithClock(clock), WithGapTimeout(time.Second))
+	for _, seq := range []uint64{0, 2, 3} {
+		s.handleTell(newTestMessage(1, seq), rec.handle)
+	}
+	require.Equal(t, []string{"0"}, rec.get())
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	require.Eventually(t, func() bool {
+		return len(rec.get()) == 3
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{"0", "2", "3"}, rec.get())
+
+	// the skipped message is dropped when it arrives late
+	s.handleTell(newTestMessage(1, 1), rec.handle)
+	s.handleTell(newTestMessage(1, 4), rec.handle)
+	require.Equal(t, []string{"0", "2", "3", "4"}, rec.get())
+}
+
+func TestWindow(t *testing.T) {
+	s, rec := newTestSwarm(t, WithBufferSize(2), WithGapTimeout(time.Hour))
+	for _, seq := range []uint64{0, 2, 3, 1 << 40} {
+		s.handleTell(newTestMessage(1, seq), rec.handle)
+	}
+	require.Equal(t, []string{"0"}, rec.get())
+	// the messages too far ahead were dropped, and did not move the window
+	for _, seq := range []uint64{1, 3} {
+		s.handleTell(newTestMessage(1, seq), rec.handle)
+	}
+	require.Equal(t, []string{"0", "1", "2", "3"}, rec.get())
+}
+
+func TestForgottenPeer(t *testing.T) {
+	s, rec := newTestSwarm(t)
+	// the first message from a peer with no state is where its sequence starts
+	for _, seq := range []uint64{100, 101} {
+		s.handleTell(newTestMessage(1, seq), rec.handle)
+	}
+	require.Equal(t, []string{"100", "101"}, rec.get())
+}
+
+func TestEpoch(t *testing.T) {
+	s, rec := newTestSwarm(t)
+	for _, seq := range []uint64{0, 1, 2} {
+		s.handleTell(newTestMessage(1, seq), rec.handle)
+	}
+	// the peer restarted, and starts again from 0
+	for _, seq := range []uint64{0, 1} {
+		s.handleTell(newTestMessage(2, seq), rec.handle)
+	}
+	require.Equal(t, []string{"0", "1", "2", "0", "1"}, rec.get())
+}
+
+func TestMaxPeers(t *testing.T) {
+	s, rec := newTestSwarm(t)
+	for i := 0; i < MaxPeers+10; i++ {
+		msg := newTestMessage(1, 0)
+		msg.Src = memswarm.Addr{N: i}
+		s.handleTell(msg, rec.handle)
+		s.nextSeq(memswarm.Addr{N: i})
+	}
+	require.Equal(t, MaxPeers, s.peers.Len())
+	require.Equal(t, MaxPeers, s.seqs.Len())
+	// a forgotten destination gets a new epoch, and starts again from 0
+	epoch, seq := s.nextSeq(memswarm.Addr{N: 0})
+	require.Equal(t, uint64(0), seq)
+	epoch2, seq := s.nextSeq(memswarm.Addr{N: 0})
+	require.Equal(t, epoch, epoch2)
+	require.Equal(t, uint64(1), seq)
+}
+
+func TestOldEpoch(t *testing.T) {
+	s, rec := newTestSwarm(t)
+	s.handleTell(newTestMessage(2, 0), rec.handle)
+	// messages from before the peer restarted are dropped, and the newer epoch is kept
+	for _, seq := range []uint64{0, 1} {
+		s.handleTell(newTestMessage(1, seq), rec.handle)
+	}
+	s.handleTell(newTestMessage(2, 1), rec.handle)
+	require.Equal(t, []string{"0", "1"}, rec.get())
+	// epochs wrap around
+	s.handleTell(newTestMessage(0, 0), rec.handle)
+	require.Equal(t, []string{"0", "1"}, rec.get())
+	s.handleTell(newTestMessage(1<<31+2, 0), rec.handle)
+	require.Equal(t, []string{"0", "1"}, rec.get())
+	s.handleTell(newTestMessage(1<<31+1, 0), rec.handle)
+	require.Equal(t, []string{"0", "1", "0"}, rec.get())
+}
+
+func TestNewEpoch(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	s, _ := newTestSwarm(t, WithClock(clock))
+	a := s.newEpoch()
+	// epochs increase even if the clock does not
+	b := s.newEpoch()
+	require.True(t, isNewer(b, a))
+	clock.Advance(time.Second)
+	c := s.newEpoch()
+	require.Equal(t, uint32(clock.Now().UnixMilli()), c)
+	require.True(t, isNewer(c, b))
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	faulty := faultyswarm.New(r.NewSwarm(),
+		faultyswarm.WithSeed(1),
+		faultyswarm.WithReorder(0.3, 5*time.Millisecond),
+		faultyswarm.WithDuplicateRate(0.1),
+	)
+	const n = 100
+	a := New(faulty)
+	// every message could arrive while one is delayed, so the buffer must hold all of them
+	b := New(r.NewSwarm(), WithGapTimeout(time.Second), WithBufferSize(n))
+	defer a.Close()
+	defer b.Close()
+
+	recv := make(chan string, 2*n)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- string(msg.Payload)
+	})
+	for i := 0; i < n; i++ {
+		require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte(strconv.Itoa(i))}))
+	}
+	for i := 0; i < n; i++ {
+		require.Equal(t, strconv.Itoa(i), <-recv)
+	}
+	require.Len(t, recv, 0)
+}
+
+func newTestSwarm(t testing.TB, opts ...Option) (*Swarm, *recorder) {
+	s := New(memswarm.NewRealm().NewSwarm(), opts...)
+	t.Cleanup(func() { s.Close() })
+	return s, &recorder{}
+}
+
+// newTestMessage creates a message from a single peer, with its sequence number as the payload.
+func newTestMessage(epoch uint32, seq uint64) *p2p.Message {
+	payload := make([]byte, Overhead)
+	binary.BigEndian.PutUint32(payload[:4], epoch)
+	binary.BigEndian.PutUint64(payload[4:], seq)
+	payload = append(payload, strconv.FormatUint(seq, 10)...)
+	return &p2p.Message{
+		Src:     memswarm.Addr{N: 1},
+		Payload: payload,
+	}
+}
+
+type recorder struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (r *recorder) handle(msg *p2p.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, string(msg.Payload))
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.msgs...)
+}
@@ -0,0 +1,118 @@
+// Package shardswarm spreads peers across several lower swarms, such as one per socket,
+// so the load is shared between them while each peer is always sent to through the same lower swarm.
+package shardswarm
+
+import (
+	"context"
+	"hash/fnv"
+
+	"github.com/brendoncarroll/go-p2p"
+	"golang.org/x/sync/errgroup"
+)
+
+var log = p2p.Logger
+
+var _ p2p.Swarm = &Swarm{}
+
+type Swarm struct {
+	lowers []p2p.Swarm
+}
+
+// New returns a swarm which sends to each address through one of lowers, chosen by a hash of addr.Key().
+// All of lowers must be able to send to the same addresses, and parse them the same way.
+// New panics if lowers is empty.
+func New(lowers ...p2p.Swarm) *Swarm {
+	if len(lowers) == 0 {
+		panic("shardswarm: no lower swarms")
+	}
+	return &Swarm{lowers: lowers}
+}
+
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	return s.lowers[shardFor(addr, len(s.lowers))].Tell(ctx, addr, data)
+}
+
+// ServeTells serves the tells received by all of the lower swarms to fn.
+// It returns once all of the lower swarms have returned.
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	eg := errgroup.Group{}
+	for _, x := range s.lowers {
+		x := x
+		eg.Go(func() error {
+			return x.ServeTells(fn)
+		})
+	}
+	return eg.Wait()
+}
+
+func (s *Swarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	return s.lowers[shardFor(addr, len(s.lowers))].MTU(ctx, addr)
+}
+
+// LocalAddrs returns the addresses of all the lower swarms.
+func (s *Swarm) LocalAddrs() []p2p.Addr {
+	ret := []p2p.Addr{}
+	for _, x := range s.lowers {
+		ret = append(ret, x.LocalAddrs()...)
+	}
+	return ret
+}
+
+func (s *Swarm) ParseAddr(data []byte) (p2p.Addr, error) {
+	return s.lowers[0].ParseAddr(data)
+}
+
+func (s *Swarm) Close() error {
+	var err error
+	for _, x := range s.lowers {
+		if err2 := x.Close(); err2 != nil {
+			err = err2
+			log.Error(err2)
+		}
+	}
+	return err
+}
+
+var _ p2p.AskSwarm = &AskSwarm{}
+
+type AskSwarm struct {
+	*Swarm
+	askers []p2p.Asker
+}
+
+// NewAsk is like New, but also sends asks through the lower swarm chosen for the address.
+func NewAsk(lowers ...p2p.AskSwarm) *AskSwarm {
+	if len(lowers) == 0 {
+		panic("shardswarm: no lower swarms")
+	}
+	swarms := make([]p2p.Swarm, len(lowers))
+	askers := make([]p2p.Asker, len(lowers))
+	for i, x := range lowers {
+		swarms[i] = x
+		askers[i] = x
+	}
+	return &AskSwarm{Swarm: New(swarms...), askers: askers}
+}
+
+func (s *AskSwarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	return s.askers[shardFor(addr, len(s.askers))].Ask(ctx, addr, data)
+}
+
+// ServeAsks serves the asks received by all of the lower swarms to fn.
+func (s *AskSwarm) ServeAsks(fn p2p.AskHandler) error {
+	eg := errgroup.Group{}
+	for _, x := range s.askers {
+		x := x
+		eg.Go(func() error {
+			return x.ServeAsks(fn)
+		})
+	}
+	return eg.Wait()
+}
+
+// shardFor returns the index of the lower swarm used for addr, out of n.
+func shardFor(addr p2p.Addr, n int) int {
+	h := fnv.New64a()
+	h.Write([]byte(addr.Key()))
+	return int(h.Sum64() % uint64(n))
+}
@@ -0,0 +1,113 @@
+package shardswarm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm(), r.NewSwarm(), r.NewSwarm())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+	swarmtest.TestSuiteAskSwarm(t, func(t testing.TB, n int) []p2p.AskSwarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.AskSwarm, n)
+		for i := range xs {
+			xs[i] = NewAsk(r.NewSwarm(), r.NewSwarm(), r.NewSwarm())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseAskSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestShardFor(t *testing.T) {
+	r := memswarm.NewRealm()
+	const n = 4
+	counts := make([]int, n)
+	for i := 0; i < 100; i++ {
+		addr := r.NewSwarm().LocalAddrs()[0]
+		shard := shardFor(addr, n)
+		require.GreaterOrEqual(t, shard, 0)
+		require.Less(t, shard, n)
+		// an address always maps to the same shard, including once parsed again
+		data, err := addr.MarshalText()
+		require.NoError(t, err)
+		addr2, err := r.NewSwarm().ParseAddr(data)
+		require.NoError(t, err)
+		require.Equal(t, shard, shardFor(addr2, n))
+		counts[shard]++
+	}
+	for i, c := range counts {
+		require.NotZero(t, c, "no addresses in shard %d", i)
+	}
+}
+
+func TestTellShard(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lowers := []p2p.Swarm{r.NewSwarm(), r.NewSwarm()}
+	x := New(lowers...)
+	defer x.Close()
+	dst := r.NewSwarm()
+	defer dst.Close()
+
+	recv := make(chan *p2p.Message, 1)
+	go dst.ServeTells(func(msg *p2p.Message) {
+		recv <- msg
+	})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, x.Tell(ctx, dst.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+		msg := <-recv
+		// the tell is sent from the shard chosen for the destination, every time
+		require.Equal(t, lowers[shardFor(dst.LocalAddrs()[0], 2)].LocalAddrs()[0], msg.Src)
+	}
+}
+
+func TestServeTells(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	lowers := []p2p.Swarm{r.NewSwarm(), r.NewSwarm(), r.NewSwarm()}
+	x := New(lowers...)
+	defer x.Close()
+	src := r.NewSwarm()
+	defer src.Close()
+
+	require.Len(t, x.LocalAddrs(), len(lowers))
+	recv := make(chan *p2p.Message, len(lowers))
+	done := make(chan error, 1)
+	go func() {
+		done <- x.ServeTells(func(msg *p2p.Message) {
+			recv <- msg
+		})
+	}()
+	// a tell to any of the shards is delivered to the one handler
+	for i, addr := range x.LocalAddrs() {
+		require.NoError(t, src.Tell(ctx, addr, p2p.IOVec{[]byte{byte(i)}}))
+		msg := <-recv
+		require.Equal(t, lowers[i].LocalAddrs()[0], msg.Dst)
+		require.Equal(t, []byte{byte(i)}, msg.Payload)
+	}
+	require.NoError(t, x.Close())
+	require.Equal(t, p2p.ErrSwarmClosed, <-done)
+}
+
+func TestNewEmpty(t *testing.T) {
+	require.Panics(t, func() { New() })
+	require.Panics(t, func() { NewAsk() })
+}
@@ -38,6 +38,8 @@ type Swarm struct {
 
 	mu    sync.RWMutex
 	conns map[string]*Conn
+
+	closeOnce swarmutil.CloseOnce
 }
 
 func New(laddr string, privateKey p2p.PrivateKey, af AllowFunc) (*Swarm, error) {
@@ -88,9 +90,11 @@ func (s *Swarm) LocalAddrs() []p2p.Addr {
 }
 
 func (s *Swarm) Close() error {
-	s.tellHub.CloseWithError(p2p.ErrSwarmClosed)
-	s.askHub.CloseWithError(p2p.ErrSwarmClosed)
-	return s.l.Close()
+	return s.closeOnce.Do(func() error {
+		s.tellHub.CloseWithError(p2p.ErrSwarmClosed)
+		s.askHub.CloseWithError(p2p.ErrSwarmClosed)
+		return s.l.Close()
+	})
 }
 
 func (s *Swarm) PublicKey() p2p.PublicKey {
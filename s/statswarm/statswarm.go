@@ -0,0 +1,152 @@
+// Package statswarm counts the messages and bytes passing through a swarm,
+// and publishes the counts with expvar, so they are served at /debug/vars with no other dependencies.
+package statswarm
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+
+	"github.com/brendoncarroll/go-p2p"
+)
+
+// The keys in the expvar.Map published by a swarm.
+// The sent counts only include calls which succeeded, calls which failed are counted in the errors.
+// AskRespBytes counts the responses to asks sent, and AskReplyBytes the responses written by the handler.
+const (
+	TellSent      = "tell_sent"
+	TellSentBytes = "tell_sent_bytes"
+	TellErrors    = "tell_errors"
+	TellRecv      = "tell_recv"
+	TellRecvBytes = "tell_recv_bytes"
+
+	AskSent       = "ask_sent"
+	AskSentBytes  = "ask_sent_bytes"
+	AskRespBytes  = "ask_resp_bytes"
+	AskErrors     = "ask_errors"
+	AskRecv       = "ask_recv"
+	AskRecvBytes  = "ask_recv_bytes"
+	AskReplyBytes = "ask_reply_bytes"
+)
+
+var _ p2p.Swarm = &Swarm{}
+
+var _ p2p.Inspector = &Swarm{}
+
+type Swarm struct {
+	p2p.Swarm
+	vars *expvar.Map
+
+	tellSent, tellSentBytes, tellErrors *expvar.Int
+	tellRecv, tellRecvBytes             *expvar.Int
+}
+
+// New returns a swarm which counts the tells passing through x, in an expvar.Map published as name.
+// Each swarm needs its own name; like expvar.Publish, New panics if name is already in use.
+func New(x p2p.Swarm, name string) *Swarm {
+	s := newSwarm(x)
+	expvar.Publish(name, s.vars)
+	return s
+}
+
+func newSwarm(x p2p.Swarm) *Swarm {
+	s := &Swarm{Swarm: x, vars: new(expvar.Map).Init()}
+	s.tellSent = s.newInt(TellSent)
+	s.tellSentBytes = s.newInt(TellSentBytes)
+	s.tellErrors = s.newInt(TellErrors)
+	s.tellRecv = s.newInt(TellRecv)
+	s.tellRecvBytes = s.newInt(TellRecvBytes)
+	return s
+}
+
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	if err := s.Swarm.Tell(ctx, addr, data); err != nil {
+		s.tellErrors.Add(1)
+		return err
+	}
+	s.tellSent.Add(1)
+	s.tellSentBytes.Add(int64(p2p.VecSize(data)))
+	return nil
+}
+
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	return s.Swarm.ServeTells(func(msg *p2p.Message) {
+		s.tellRecv.Add(1)
+		s.tellRecvBytes.Add(int64(len(msg.Payload)))
+		fn(msg)
+	})
+}
+
+// Vars returns the map holding the swarm's counters.
+func (s *Swarm) Vars() *expvar.Map {
+	return s.vars
+}
+
+// Inspect implements p2p.Inspector, with the counters from Vars.
+func (s *Swarm) Inspect() map[string]interface{} {
+	return map[string]interface{}{
+		"counters": json.RawMessage(s.vars.String()),
+	}
+}
+
+func (s *Swarm) newInt(key string) *expvar.Int {
+	x := new(expvar.Int)
+	s.vars.Set(key, x)
+	return x
+}
+
+var _ p2p.AskSwarm = &AskSwarm{}
+
+type AskSwarm struct {
+	*Swarm
+	asker p2p.Asker
+
+	askSent, askSentBytes, askRespBytes, askErrors *expvar.Int
+	askRecv, askRecvBytes, askReplyBytes           *expvar.Int
+}
+
+// NewAsk is like New, but also counts the asks passing through x.
+func NewAsk(x p2p.AskSwarm, name string) *AskSwarm {
+	s := &AskSwarm{Swarm: newSwarm(x), asker: x}
+	s.askSent = s.newInt(AskSent)
+	s.askSentBytes = s.newInt(AskSentBytes)
+	s.askRespBytes = s.newInt(AskRespBytes)
+	s.askErrors = s.newInt(AskErrors)
+	s.askRecv = s.newInt(AskRecv)
+	s.askRecvBytes = s.newInt(AskRecvBytes)
+	s.askReplyBytes = s.newInt(AskReplyBytes)
+	expvar.Publish(name, s.vars)
+	return s
+}
+
+func (s *AskSwarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	resp, err := s.asker.Ask(ctx, addr, data)
+	if err != nil {
+		s.askErrors.Add(1)
+		return nil, err
+	}
+	s.askSent.Add(1)
+	s.askSentBytes.Add(int64(p2p.VecSize(data)))
+	s.askRespBytes.Add(int64(len(resp)))
+	return resp, nil
+}
+
+func (s *AskSwarm) ServeAsks(fn p2p.AskHandler) error {
+	return s.asker.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		s.askRecv.Add(1)
+		s.askRecvBytes.Add(int64(len(msg.Payload)))
+		fn(ctx, msg, countWriter{w: w, n: s.askReplyBytes})
+	})
+}
+
+type countWriter struct {
+	w io.Writer
+	n *expvar.Int
+}
+
+func (cw countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,120 @@
+package statswarm
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
+)
+
+// nameCount makes the names of the vars published by the tests unique.
+var nameCount uint32
+
+func newName() string {
+	return fmt.Sprintf("statswarm_test_%d", atomic.AddUint32(&nameCount, 1))
+}
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm(), newName())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+	swarmtest.TestSuiteAskSwarm(t, func(t testing.TB, n int) []p2p.AskSwarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.AskSwarm, n)
+		for i := range xs {
+			xs[i] = NewAsk(r.NewSwarm(), newName())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseAskSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestCounters(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	aName, bName := newName(), newName()
+	a, b := NewAsk(r.NewSwarm(), aName), NewAsk(r.NewSwarm(), bName)
+	defer a.Close()
+	defer b.Close()
+	recv := make(chan struct{}, 1)
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go a.ServeAsks(p2p.NoOpAskHandler)
+	go b.ServeTells(func(msg *p2p.Message) { recv <- struct{}{} })
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		w.Write([]byte("pong!"))
+	})
+
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	<-recv
+	resp, err := a.Ask(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "pong!", string(resp))
+	// too large to send
+	big := make([]byte, a.MTU(ctx, b.LocalAddrs()[0])+1)
+	require.Error(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{big}))
+
+	// the counters are published under the names given
+	require.Equal(t, a.Vars(), expvar.Get(aName))
+	require.Equal(t, b.Vars(), expvar.Get(bName))
+	for key, expected := range map[string]int64{
+		TellSent:      1,
+		TellSentBytes: 5,
+		TellErrors:    1,
+		AskSent:       1,
+		AskSentBytes:  4,
+		AskRespBytes:  5,
+	} {
+		require.Equal(t, expected, getInt(t, aName, key), key)
+	}
+	for key, expected := range map[string]int64{
+		TellRecv:      1,
+		TellRecvBytes: 5,
+		AskRecv:       1,
+		AskRecvBytes:  4,
+		AskReplyBytes: 5,
+	} {
+		require.Equal(t, expected, getInt(t, bName, key), key)
+	}
+
+	// the same counters are in the debug report
+	var counters map[string]int64
+	require.NoError(t, json.Unmarshal(a.Inspect()["counters"].(json.RawMessage), &counters))
+	require.Equal(t, int64(1), counters[TellSent])
+}
+
+func TestNameCollision(t *testing.T) {
+	r := memswarm.NewRealm()
+	name := newName()
+	x := New(r.NewSwarm(), name)
+	defer x.Close()
+	require.Panics(t, func() {
+		New(r.NewSwarm(), name)
+	})
+}
+
+func getInt(t testing.TB, name, key string) int64 {
+	m, ok := expvar.Get(name).(*expvar.Map)
+	require.True(t, ok)
+	x, ok := m.Get(key).(*expvar.Int)
+	require.True(t, ok)
+	return x.Value()
+}
@@ -20,6 +20,10 @@ func TestSuiteAskSwarm(t *testing.T, newSwarms func(testing.TB, int) []p2p.AskSw
 		require.Len(t, xs, 10)
 		TestMultipleAsks(t, xs)
 	})
+	t.Run("TestDoubleClose", func(t *testing.T) {
+		xs := newSwarms(t, 1)
+		TestDoubleClose(t, xs[0])
+	})
 }
 
 func TestMultipleAsks(t *testing.T, xs []p2p.AskSwarm) {
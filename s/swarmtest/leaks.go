@@ -0,0 +1,44 @@
+package swarmtest
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// LeakTimeout is how long AssertNoLeaks waits for goroutines to exit.
+const LeakTimeout = 2 * time.Second
+
+// leakCheckEnv is set for the duration of each test which checks for leaks.
+const leakCheckEnv = "SWARMTEST_LEAK_CHECK"
+
+// AssertNoLeaks counts the goroutines, and returns a function which fails the test
+// if there are more goroutines when it is called. It is meant to be deferred at the start of a test:
+//
+//	defer swarmtest.AssertNoLeaks(t)()
+//
+// Goroutines which are still exiting, such as calls to ServeTells returning after Close, are given until LeakTimeout to finish.
+// The count is for the whole process, so AssertNoLeaks panics if the test is parallel, and the test can't call t.Parallel after it.
+// Tests which are not parallel never run at the same time as other tests.
+func AssertNoLeaks(t testing.TB) func() {
+	t.Helper()
+	// Setenv panics in parallel tests, and makes later calls to t.Parallel panic.
+	t.Setenv(leakCheckEnv, t.Name())
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(LeakTimeout)
+		for {
+			after := runtime.NumGoroutine()
+			if after <= before {
+				return
+			}
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Fatalf("%d goroutines leaked, %d before and %d after:\n%s", after-before, before, after, buf)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
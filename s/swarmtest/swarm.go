@@ -31,6 +31,10 @@ func TestSuiteSwarm(t *testing.T, newSwarms func(testing.TB, int) []p2p.Swarm) {
 		require.Len(t, xs, 10)
 		TestTellAllPairs(t, xs)
 	})
+	t.Run("TestTellEmpty", func(t *testing.T) {
+		xs := newSwarms(t, 2)
+		TestTellEmpty(t, xs[0], xs[1])
+	})
 	t.Run("TestTellBidirectional", func(t *testing.T) {
 		xs := newSwarms(t, 2)
 		a, b := xs[0], xs[1]
@@ -43,6 +47,17 @@ func TestSuiteSwarm(t *testing.T, newSwarms func(testing.TB, int) []p2p.Swarm) {
 		})
 		TestTellBidirectional(t, a, b, aQueue, bQueue)
 	})
+	t.Run("TestDoubleClose", func(t *testing.T) {
+		xs := newSwarms(t, 1)
+		TestDoubleClose(t, xs[0])
+	})
+}
+
+// TestDoubleClose checks that Close can be called more than once.
+// The swarm is closed again by the cleanup for newSwarms, so every call must return nil.
+func TestDoubleClose(t *testing.T, x p2p.Swarm) {
+	require.NoError(t, x.Close())
+	require.NoError(t, x.Close())
 }
 
 func TestLocalAddrs(t *testing.T, s p2p.Swarm) {
@@ -100,6 +115,29 @@ func testTell(t *testing.T, src p2p.Swarm, dstAddr p2p.Addr, recvChan chan p2p.M
 	assert.NotNil(t, recv.Src, "SRC addr is nil")
 }
 
+// TestTellEmpty checks that zero-length messages from a are delivered to b's handler, with an empty payload.
+// Both a nil IOVec and an IOVec containing only empty buffers are zero-length.
+func TestTellEmpty(t *testing.T, a, b p2p.Swarm) {
+	ctx, cf := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cf()
+	recv := make(chan p2p.Message, 1)
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTells(func(msg *p2p.Message) {
+		recv <- copyMessage(msg)
+	})
+	dst := b.LocalAddrs()[0]
+	for _, data := range []p2p.IOVec{nil, {}, {[]byte{}, nil}} {
+		require.NoError(t, a.Tell(ctx, dst, data))
+		select {
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for empty tell")
+		case msg := <-recv:
+			require.Len(t, msg.Payload, 0)
+			require.Equal(t, dst, msg.Dst)
+		}
+	}
+}
+
 func TestTellBidirectional(t *testing.T, a, b p2p.Swarm, aQueue, bQueue *swarmutil.TellQueue) {
 	const N = 50
 	ctx, cf := context.WithTimeout(context.Background(), 3*time.Second)
@@ -0,0 +1,18 @@
+package swarmutil
+
+import "sync"
+
+// CloseOnce makes a Close method idempotent, for swarms with more than one owner.
+// The zero value is ready to use.
+type CloseOnce struct {
+	once sync.Once
+	err  error
+}
+
+// Do calls fn the first time it is called, and returns the error from fn on every call.
+func (c *CloseOnce) Do(fn func() error) error {
+	c.once.Do(func() {
+		c.err = fn()
+	})
+	return c.err
+}
@@ -41,14 +41,29 @@ func (h *hubCore) serve(setup func()) error {
 	return h.err
 }
 
-func (h *hubCore) deliver(fn func()) {
+// deliver waits for the hub to be served and then calls fn.
+// If the hub is closed, or ctx is done, before it is served, fn is not called and the error is returned.
+func (h *hubCore) deliver(ctx context.Context, fn func()) error {
 	select {
 	case <-h.done:
-		return
+		return h.err
 	default:
-		<-h.ready
-		fn()
 	}
+	select {
+	case <-h.ready:
+	case <-h.done:
+		return h.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// done may have been closed while waiting for ready
+	select {
+	case <-h.done:
+		return h.err
+	default:
+	}
+	fn()
+	return nil
 }
 
 func (h *hubCore) closeWithError(err error) {
@@ -61,22 +76,113 @@ func (h *hubCore) closeWithError(err error) {
 type TellHub struct {
 	*hubCore
 	fn p2p.TellHandler
+	// queue is nil unless WithQueue is used
+	queue   chan *p2p.Message
+	policy  OverflowPolicy
+	dropped uint64
 }
 
-func NewTellHub() *TellHub {
-	return &TellHub{hubCore: newHubCore()}
+func NewTellHub(opts ...HubOption) *TellHub {
+	c := newHubConfig(opts)
+	h := &TellHub{hubCore: newHubCore(), policy: c.policy}
+	if c.queueSize > 0 {
+		h.queue = make(chan *p2p.Message, c.queueSize)
+	}
+	return h
 }
 
+// ServeTells calls fn with delivered messages until the hub is closed.
+// If the hub has a queue, ServeTells also waits for fn to return after the hub is closed.
 func (h *TellHub) ServeTells(fn p2p.TellHandler) error {
-	return h.serve(func() {
+	if h.queue == nil {
+		return h.serve(func() {
+			h.fn = fn
+		})
+	}
+	var drained chan struct{}
+	err := h.serve(func() {
 		h.fn = fn
+		drained = make(chan struct{})
+		go func() {
+			defer close(drained)
+			h.drain()
+		}()
 	})
+	if drained != nil {
+		<-drained
+	}
+	return err
 }
 
-func (h *TellHub) DeliverTell(msg *p2p.Message) {
-	h.deliver(func() {
-		h.fn(msg)
-	})
+// DeliverTell waits for the hub to be served and then calls the handler with msg.
+// If the hub is closed first, msg is dropped.
+//
+// If the hub has a queue, a copy of msg is queued instead, and DeliverTell only waits if the queue is full
+// and the policy is OverflowBlock.
+// DeliverTell returns false if msg was dropped, either because the hub is closed or because the queue was full.
+func (h *TellHub) DeliverTell(msg *p2p.Message) bool {
+	if h.queue == nil {
+		err := h.deliver(context.Background(), func() {
+			h.fn(msg)
+		})
+		return err == nil
+	}
+	select {
+	case <-h.done:
+		return false
+	default:
+	}
+	msg = &p2p.Message{
+		Src:     msg.Src,
+		Dst:     msg.Dst,
+		Payload: append([]byte{}, msg.Payload...),
+	}
+	switch h.policy {
+	case OverflowBlock:
+		select {
+		case h.queue <- msg:
+		case <-h.done:
+			return false
+		}
+	case OverflowDropNewest:
+		select {
+		case h.queue <- msg:
+		default:
+			atomic.AddUint64(&h.dropped, 1)
+			return false
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case h.queue <- msg:
+				return true
+			default:
+			}
+			select {
+			case <-h.queue:
+				atomic.AddUint64(&h.dropped, 1)
+			default:
+			}
+		}
+	}
+	return true
+}
+
+// Dropped returns the number of messages which have been dropped because the queue was full.
+func (h *TellHub) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// drain passes queued messages to the handler until the hub is closed.
+func (h *TellHub) drain() {
+	for {
+		select {
+		case msg := <-h.queue:
+			h.fn(msg)
+		case <-h.done:
+			return
+		}
+	}
 }
 
 func (h *TellHub) CloseWithError(err error) {
@@ -86,10 +192,17 @@ func (h *TellHub) CloseWithError(err error) {
 type AskHub struct {
 	*hubCore
 	fn p2p.AskHandler
+	// limit is nil unless WithQueue is used
+	limit *askLimiter
 }
 
-func NewAskHub() *AskHub {
-	return &AskHub{hubCore: newHubCore()}
+func NewAskHub(opts ...HubOption) *AskHub {
+	c := newHubConfig(opts)
+	h := &AskHub{hubCore: newHubCore()}
+	if c.queueSize > 0 {
+		h.limit = newAskLimiter(c.queueSize, c.policy)
+	}
+	return h
 }
 
 func (h *AskHub) ServeAsks(fn p2p.AskHandler) error {
@@ -98,12 +211,43 @@ func (h *AskHub) ServeAsks(fn p2p.AskHandler) error {
 	})
 }
 
-func (h *AskHub) DeliverAsk(ctx context.Context, msg *p2p.Message, w io.Writer) {
-	h.deliver(func() {
-		h.fn(ctx, msg, w)
+// DeliverAsk waits for the hub to be served and then calls the handler with msg and w.
+// If the hub is closed first, the error passed to CloseWithError is returned without calling the handler,
+// and if ctx is done first, ctx.Err() is returned.
+//
+// If the hub has a queue and the ask is dropped because it is full, ErrQueueFull is returned.
+func (h *AskHub) DeliverAsk(ctx context.Context, msg *p2p.Message, w io.Writer) error {
+	if h.limit == nil {
+		return h.deliver(ctx, func() {
+			h.fn(ctx, msg, w)
+		})
+	}
+	e, waitCtx, err := h.limit.acquire(ctx, h.hubCore)
+	if err != nil {
+		return err
+	}
+	err = h.deliver(waitCtx, func() {
+		if h.limit.start(e) {
+			h.fn(ctx, msg, w)
+		}
 	})
+	if h.limit.release(e) {
+		return ErrQueueFull
+	}
+	return err
+}
+
+// Dropped returns the number of asks which have been dropped because the queue was full.
+func (h *AskHub) Dropped() uint64 {
+	if h.limit == nil {
+		return 0
+	}
+	return h.limit.getDropped()
 }
 
+// CloseWithError closes the hub, so ServeAsks returns err.
+// Every DeliverAsk which is waiting for the hub to be served returns err immediately, as do any later calls.
+// Handlers which are already running are not interrupted.
 func (h *AskHub) CloseWithError(err error) {
 	h.closeWithError(err)
 }
@@ -0,0 +1,213 @@
+package swarmutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAskHubCloseFailsPending(t *testing.T) {
+	before := runtime.NumGoroutine()
+	h := NewAskHub()
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- h.DeliverAsk(context.Background(), &p2p.Message{}, io.Discard)
+		}()
+	}
+	// wait for the asks to be in flight
+	require.Eventually(t, func() bool {
+		return runtime.NumGoroutine() >= before+n
+	}, time.Second, time.Millisecond)
+
+	h.CloseWithError(p2p.ErrSwarmClosed)
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errs:
+			require.Equal(t, p2p.ErrSwarmClosed, err)
+		case <-time.After(time.Second):
+			t.Fatal("DeliverAsk did not return after close")
+		}
+	}
+	// asks after close fail immediately
+	require.Equal(t, p2p.ErrSwarmClosed, h.DeliverAsk(context.Background(), &p2p.Message{}, io.Discard))
+	require.Equal(t, p2p.ErrSwarmClosed, h.ServeAsks(nil))
+	// require.Eventually runs its condition in another goroutine, so poll directly.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), before, "leaked goroutines")
+}
+
+func TestAskHubServe(t *testing.T) {
+	h := NewAskHub()
+	serveDone := make(chan error, 1)
+	go func() {
+		serveDone <- h.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+			w.Write(msg.Payload)
+		})
+	}()
+	var buf bytes.Buffer
+	require.NoError(t, h.DeliverAsk(context.Background(), &p2p.Message{Payload: []byte("hello")}, &buf))
+	require.Equal(t, "hello", buf.String())
+
+	h.CloseWithError(p2p.ErrSwarmClosed)
+	require.Equal(t, p2p.ErrSwarmClosed, <-serveDone)
+}
+
+func TestAskHubContext(t *testing.T) {
+	h := NewAskHub()
+	defer h.CloseWithError(nil)
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cf()
+	require.Equal(t, context.DeadlineExceeded, h.DeliverAsk(ctx, &p2p.Message{}, io.Discard))
+}
+
+func TestTellHubQueue(t *testing.T) {
+	deliverAll := func(h *TellHub, payloads ...string) {
+		for _, p := range payloads {
+			h.DeliverTell(&p2p.Message{Payload: []byte(p)})
+		}
+	}
+	serve := func(h *TellHub) chan string {
+		recv := make(chan string, 10)
+		go h.ServeTells(func(msg *p2p.Message) {
+			recv <- string(msg.Payload)
+		})
+		return recv
+	}
+	for _, tc := range []struct {
+		policy   OverflowPolicy
+		expected []string
+		dropped  uint64
+	}{
+		{OverflowDropNewest, []string{"1", "2"}, 1},
+		{OverflowDropOldest, []string{"2", "3"}, 1},
+	} {
+		h := NewTellHub(WithQueue(2, tc.policy))
+		// the hub isn't served yet, so the third message overflows the queue without blocking.
+		deliverAll(h, "1", "2", "3")
+		require.Equal(t, tc.dropped, h.Dropped(), tc.policy.String())
+		recv := serve(h)
+		for _, x := range tc.expected {
+			require.Equal(t, x, <-recv, tc.policy.String())
+		}
+		// later messages are passed to the handler without waiting
+		deliverAll(h, "4")
+		require.Equal(t, "4", <-recv, tc.policy.String())
+		h.CloseWithError(nil)
+	}
+
+	// DeliverTell reports whether the message was dropped
+	dh := NewTellHub(WithQueue(1, OverflowDropNewest))
+	require.True(t, dh.DeliverTell(&p2p.Message{Payload: []byte("1")}))
+	require.False(t, dh.DeliverTell(&p2p.Message{Payload: []byte("2")}))
+	dh.CloseWithError(nil)
+	require.False(t, dh.DeliverTell(&p2p.Message{Payload: []byte("3")}))
+
+	h := NewTellHub(WithQueue(2, OverflowBlock))
+	defer h.CloseWithError(nil)
+	buf := []byte("1")
+	h.DeliverTell(&p2p.Message{Payload: buf})
+	// queued messages are copied, so the caller can reuse its buffer.
+	buf[0] = '2'
+	h.DeliverTell(&p2p.Message{Payload: buf})
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		deliverAll(h, "3")
+	}()
+	select {
+	case <-delivered:
+		t.Fatal("DeliverTell did not block on a full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+	recv := serve(h)
+	for _, x := range []string{"1", "2", "3"} {
+		require.Equal(t, x, <-recv)
+	}
+	<-delivered
+	require.Equal(t, uint64(0), h.Dropped())
+}
+
+func TestAskHubQueue(t *testing.T) {
+	ctx := context.Background()
+	deliver := func(h *AskHub) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- h.DeliverAsk(ctx, &p2p.Message{}, io.Discard)
+		}()
+		return errs
+	}
+	// waitQueued waits for the first ask to be in the queue.
+	waitQueued := func(h *AskHub) {
+		require.Eventually(t, func() bool {
+			h.limit.mu.Lock()
+			defer h.limit.mu.Unlock()
+			return len(h.limit.entries) == 1
+		}, time.Second, time.Millisecond)
+	}
+	serve := func(h *AskHub) {
+		go h.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {})
+	}
+
+	// the hub isn't served yet, so the first ask waits in the queue.
+	h := NewAskHub(WithQueue(1, OverflowDropNewest))
+	first := deliver(h)
+	waitQueued(h)
+	require.Equal(t, ErrQueueFull, <-deliver(h))
+	require.Equal(t, uint64(1), h.Dropped())
+	serve(h)
+	require.NoError(t, <-first)
+	h.CloseWithError(nil)
+
+	h = NewAskHub(WithQueue(1, OverflowDropOldest))
+	first = deliver(h)
+	waitQueued(h)
+	second := deliver(h)
+	// first can only return once it is dropped, since the hub isn't served.
+	require.Equal(t, ErrQueueFull, <-first)
+	require.Equal(t, uint64(1), h.Dropped())
+	serve(h)
+	require.NoError(t, <-second)
+	h.CloseWithError(nil)
+
+	h = NewAskHub(WithQueue(1, OverflowBlock))
+	first = deliver(h)
+	waitQueued(h)
+	second = deliver(h)
+	serve(h)
+	require.NoError(t, <-first)
+	require.NoError(t, <-second)
+	require.Equal(t, uint64(0), h.Dropped())
+	h.CloseWithError(nil)
+}
+
+func TestAskHubQueueDropOldestStarted(t *testing.T) {
+	ctx := context.Background()
+	h := NewAskHub(WithQueue(1, OverflowDropOldest))
+	defer h.CloseWithError(nil)
+	started, unblock := make(chan struct{}), make(chan struct{})
+	go h.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		close(started)
+		<-unblock
+	})
+	first := make(chan error, 1)
+	go func() {
+		first <- h.DeliverAsk(ctx, &p2p.Message{}, io.Discard)
+	}()
+	<-started
+	// asks which have been passed to the handler are not dropped, so the new ask is.
+	require.Equal(t, ErrQueueFull, h.DeliverAsk(ctx, &p2p.Message{}, io.Discard))
+	close(unblock)
+	require.NoError(t, <-first)
+	require.Equal(t, uint64(1), h.Dropped())
+}
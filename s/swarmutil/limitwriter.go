@@ -1,21 +1,31 @@
 package swarmutil
 
 import (
-	"errors"
 	"io"
+
+	"github.com/brendoncarroll/go-p2p"
 )
 
+// LimitWriter writes to W until N bytes have been written.
+// Any write which would exceed N is rejected without writing any of it, and returns p2p.ErrResponseTooLarge.
 type LimitWriter struct {
-	W     io.Writer
-	N     int
-	total int
+	W        io.Writer
+	N        int
+	total    int
+	exceeded bool
 }
 
 func (lw *LimitWriter) Write(p []byte) (n int, err error) {
 	if len(p)+lw.total > lw.N {
-		return 0, errors.New("write exceeds limit")
+		lw.exceeded = true
+		return 0, p2p.ErrResponseTooLarge
 	}
 	n, err = lw.W.Write(p)
 	lw.total += n
 	return n, err
 }
+
+// Exceeded returns true if any write has been rejected for exceeding N.
+func (lw *LimitWriter) Exceeded() bool {
+	return lw.exceeded
+}
@@ -0,0 +1,31 @@
+package swarmutil
+
+import "sync"
+
+// ChangeNotifier notifies any number of waiters that something has changed.
+// It can be used to implement p2p.LocalAddrsNotifier.
+// The zero value is ready to use.
+type ChangeNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// Changed returns a channel which is closed by the next call to Notify.
+func (n *ChangeNotifier) Changed() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+// Notify closes the channels returned by Changed since the last call to Notify.
+func (n *ChangeNotifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
@@ -0,0 +1,185 @@
+package swarmutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrQueueFull is returned by AskHub.DeliverAsk when an ask is dropped because the hub's queue is full.
+var ErrQueueFull = errors.Errorf("swarmutil: inbound queue is full")
+
+// OverflowPolicy decides what a hub with a queue does with a message which arrives when the queue is full.
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock waits for room in the queue.
+	OverflowBlock = OverflowPolicy(iota)
+	// OverflowDropNewest drops the message which arrived.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest message in the queue which has not been passed to the handler, to make room.
+	OverflowDropOldest
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "Block"
+	case OverflowDropNewest:
+		return "DropNewest"
+	case OverflowDropOldest:
+		return "DropOldest"
+	default:
+		panic(fmt.Sprintf("unknown OverflowPolicy %d", uint8(p)))
+	}
+}
+
+type hubConfig struct {
+	queueSize int
+	policy    OverflowPolicy
+}
+
+type HubOption func(*hubConfig)
+
+// WithQueue gives a hub a queue of size messages, so delivering a message does not wait for the handler.
+// When the queue is full, policy decides which message is dropped, if any.
+// Dropped messages are counted, see TellHub.Dropped and AskHub.Dropped.
+//
+// A TellHub copies queued messages and passes them to the handler one at a time, in order.
+// An AskHub still waits for the handler, since it writes the response,
+// so its queue limits the number of asks which are being delivered at once.
+func WithQueue(size int, policy OverflowPolicy) HubOption {
+	if size < 1 {
+		panic(fmt.Sprintf("queue size must be at least 1, got %d", size))
+	}
+	_ = policy.String() // panics if policy is not a policy
+	return func(c *hubConfig) {
+		c.queueSize = size
+		c.policy = policy
+	}
+}
+
+func newHubConfig(opts []HubOption) hubConfig {
+	var c hubConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// askLimiter limits the number of asks being delivered by an AskHub.
+type askLimiter struct {
+	size   int
+	policy OverflowPolicy
+
+	mu      sync.Mutex
+	entries []*askEntry
+	// freed is closed and replaced whenever an entry is released
+	freed   chan struct{}
+	dropped uint64
+}
+
+type askEntry struct {
+	started bool
+	dropped bool
+	cancel  context.CancelFunc
+}
+
+func newAskLimiter(size int, policy OverflowPolicy) *askLimiter {
+	return &askLimiter{
+		size:   size,
+		policy: policy,
+		freed:  make(chan struct{}),
+	}
+}
+
+// acquire adds an entry for an ask, waiting for room if the policy is OverflowBlock.
+// The returned context is derived from ctx, and is cancelled if the entry is dropped to make room for another.
+// If h is closed while waiting, the error it was closed with is returned.
+func (l *askLimiter) acquire(ctx context.Context, h *hubCore) (*askEntry, context.Context, error) {
+	for {
+		l.mu.Lock()
+		if len(l.entries) < l.size || l.makeRoom() {
+			ctx, cf := context.WithCancel(ctx)
+			e := &askEntry{cancel: cf}
+			l.entries = append(l.entries, e)
+			l.mu.Unlock()
+			return e, ctx, nil
+		}
+		if l.policy != OverflowBlock {
+			l.dropped++
+			l.mu.Unlock()
+			return nil, nil, ErrQueueFull
+		}
+		freed := l.freed
+		l.mu.Unlock()
+		select {
+		case <-freed:
+		case <-h.done:
+			return nil, nil, h.err
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// makeRoom drops the oldest entry which has not started, if the policy is OverflowDropOldest.
+// It must be called with mu, and returns true if an entry was dropped.
+func (l *askLimiter) makeRoom() bool {
+	if l.policy != OverflowDropOldest {
+		return false
+	}
+	for i, e := range l.entries {
+		if !e.started {
+			e.dropped = true
+			e.cancel()
+			l.removeAt(i)
+			l.dropped++
+			return true
+		}
+	}
+	return false
+}
+
+// start marks e as passed to the handler, so it can no longer be dropped.
+// It returns false if e has already been dropped.
+func (l *askLimiter) start(e *askEntry) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e.dropped {
+		return false
+	}
+	e.started = true
+	return true
+}
+
+// release removes e, if it has not been dropped, and reports whether it was dropped.
+func (l *askLimiter) release(e *askEntry) (dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.cancel()
+	if e.dropped {
+		return true
+	}
+	for i := range l.entries {
+		if l.entries[i] == e {
+			l.removeAt(i)
+			break
+		}
+	}
+	return false
+}
+
+func (l *askLimiter) removeAt(i int) {
+	l.entries = append(l.entries[:i], l.entries[i+1:]...)
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+func (l *askLimiter) getDropped() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
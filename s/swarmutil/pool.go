@@ -0,0 +1,251 @@
+package swarmutil
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+// PoolParams configure a Pool.
+type PoolParams[K comparable, V any] struct {
+	// TTL is how long an entry is kept after it is created.
+	// 0 means entries do not expire.
+	TTL time.Duration
+	// MaxSize is the maximum number of entries.
+	// When it is exceeded, the least recently used entry is evicted.
+	// 0 means there is no limit.
+	MaxSize int
+	// IsStale, if set, is checked whenever an entry is looked up or cleaned up, with the current time.
+	// Stale entries are evicted, as if they had expired.
+	// It is called with the pool's lock held and must not call into the pool.
+	IsStale func(k K, v V, now time.Time) bool
+	// OnEvict, if set, is called after an entry is removed by the pool, because it expired, was stale,
+	// was the least recently used entry over MaxSize, or was replaced by Put.
+	// It is not called for entries removed with Delete or DeleteIf.
+	OnEvict func(K, V)
+	// Clock is used to check for expiration, it defaults to the real clock.
+	Clock clockwork.Clock
+}
+
+// Pool is a cache of values, usually connections or sessions, keyed by peer.
+// It supports expiration, a maximum size with LRU eviction, and creating a missing value only once
+// when many callers want it at the same time.
+type Pool[K comparable, V any] struct {
+	params PoolParams[K, V]
+
+	mu      sync.Mutex
+	entries map[K]*list.Element
+	// lru holds *poolEntry, the most recently used entry is at the front.
+	lru     *list.List
+	flights map[K]*flight[V]
+}
+
+func NewPool[K comparable, V any](params PoolParams[K, V]) *Pool[K, V] {
+	if params.Clock == nil {
+		params.Clock = clockwork.NewRealClock()
+	}
+	return &Pool[K, V]{
+		params:  params,
+		entries: make(map[K]*list.Element),
+		lru:     list.New(),
+		flights: make(map[K]*flight[V]),
+	}
+}
+
+type poolEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	createdAt time.Time
+}
+
+// flight is a value being created by GetOrCreate
+type flight[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// Get returns the value for k, if there is one which has not expired.
+func (p *Pool[K, V]) Get(k K) (V, bool) {
+	p.mu.Lock()
+	v, ok, evicted := p.get(k, p.params.Clock.Now())
+	p.mu.Unlock()
+	p.evict(evicted)
+	return v, ok
+}
+
+// GetOrCreate returns the value for k, calling fn to create it if there isn't one.
+// If GetOrCreate is called for the same key while fn is running, it waits for fn and returns the same result.
+// created is only true for the caller which called fn and got a value from it.
+// Errors from fn are returned to all the waiting callers, and nothing is added to the pool.
+func (p *Pool[K, V]) GetOrCreate(k K, fn func() (V, error)) (v V, created bool, err error) {
+	p.mu.Lock()
+	v, ok, evicted := p.get(k, p.params.Clock.Now())
+	if ok {
+		p.mu.Unlock()
+		p.evict(evicted)
+		return v, false, nil
+	}
+	if f, exists := p.flights[k]; exists {
+		p.mu.Unlock()
+		p.evict(evicted)
+		<-f.done
+		return f.value, false, f.err
+	}
+	f := &flight[V]{done: make(chan struct{})}
+	p.flights[k] = f
+	p.mu.Unlock()
+	p.evict(evicted)
+
+	v, err = fn()
+	p.mu.Lock()
+	delete(p.flights, k)
+	if err == nil {
+		evicted = p.put(k, v, p.params.Clock.Now())
+	}
+	p.mu.Unlock()
+	f.value, f.err = v, err
+	close(f.done)
+	p.evict(evicted)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	return v, true, nil
+}
+
+// Put adds v to the pool under k, replacing any existing value.
+func (p *Pool[K, V]) Put(k K, v V) {
+	p.mu.Lock()
+	evicted := p.put(k, v, p.params.Clock.Now())
+	p.mu.Unlock()
+	p.evict(evicted)
+}
+
+// Delete removes the value for k, and returns true if there was one.
+func (p *Pool[K, V]) Delete(k K) bool {
+	return p.DeleteIf(k, func(V) bool { return true })
+}
+
+// DeleteIf removes the value for k only if fn returns true for it.
+// It returns true if a value was removed.
+func (p *Pool[K, V]) DeleteIf(k K, fn func(V) bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el, exists := p.entries[k]
+	if !exists || !fn(el.Value.(*poolEntry[K, V]).value) {
+		return false
+	}
+	p.remove(el)
+	return true
+}
+
+// Clear removes all the entries from the pool, without calling OnEvict.
+func (p *Pool[K, V]) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries = make(map[K]*list.Element)
+	p.lru.Init()
+}
+
+// Cleanup evicts all the entries which have expired or are stale as of now, and returns the number evicted.
+func (p *Pool[K, V]) Cleanup(now time.Time) int {
+	var evicted []*poolEntry[K, V]
+	p.mu.Lock()
+	for el := p.lru.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*poolEntry[K, V]); p.isExpired(e, now) {
+			p.remove(el)
+			evicted = append(evicted, e)
+		}
+		el = next
+	}
+	p.mu.Unlock()
+	p.evict(evicted)
+	return len(evicted)
+}
+
+// ForEach calls fn with each entry in the pool which has not expired, until fn returns false.
+// It is called with the pool's lock held and must not call into the pool.
+func (p *Pool[K, V]) ForEach(fn func(K, V) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.params.Clock.Now()
+	for el := p.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*poolEntry[K, V])
+		if p.isExpired(e, now) {
+			continue
+		}
+		if !fn(e.key, e.value) {
+			return
+		}
+	}
+}
+
+// Len returns the number of entries in the pool, including any which have expired but not been cleaned up.
+func (p *Pool[K, V]) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+// get must be called with mu.
+// If the entry for k has expired it is removed and returned in evicted.
+func (p *Pool[K, V]) get(k K, now time.Time) (v V, ok bool, evicted []*poolEntry[K, V]) {
+	el, exists := p.entries[k]
+	if !exists {
+		return v, false, nil
+	}
+	e := el.Value.(*poolEntry[K, V])
+	if p.isExpired(e, now) {
+		p.remove(el)
+		return v, false, []*poolEntry[K, V]{e}
+	}
+	p.lru.MoveToFront(el)
+	return e.value, true, nil
+}
+
+// put must be called with mu.
+// It returns the replaced entry, and any entry evicted to stay under MaxSize.
+func (p *Pool[K, V]) put(k K, v V, now time.Time) (evicted []*poolEntry[K, V]) {
+	if el, exists := p.entries[k]; exists {
+		e := el.Value.(*poolEntry[K, V])
+		evicted = append(evicted, &poolEntry[K, V]{key: e.key, value: e.value, createdAt: e.createdAt})
+		e.value = v
+		e.createdAt = now
+		p.lru.MoveToFront(el)
+		return evicted
+	}
+	p.entries[k] = p.lru.PushFront(&poolEntry[K, V]{key: k, value: v, createdAt: now})
+	if p.params.MaxSize > 0 && len(p.entries) > p.params.MaxSize {
+		el := p.lru.Back()
+		p.remove(el)
+		evicted = append(evicted, el.Value.(*poolEntry[K, V]))
+	}
+	return evicted
+}
+
+// remove must be called with mu
+func (p *Pool[K, V]) remove(el *list.Element) {
+	p.lru.Remove(el)
+	delete(p.entries, el.Value.(*poolEntry[K, V]).key)
+}
+
+func (p *Pool[K, V]) isExpired(e *poolEntry[K, V], now time.Time) bool {
+	if p.params.TTL > 0 && now.Sub(e.createdAt) >= p.params.TTL {
+		return true
+	}
+	return p.params.IsStale != nil && p.params.IsStale(e.key, e.value, now)
+}
+
+// evict calls OnEvict for each entry, it must be called without mu.
+func (p *Pool[K, V]) evict(entries []*poolEntry[K, V]) {
+	if p.params.OnEvict == nil {
+		return
+	}
+	for _, e := range entries {
+		p.params.OnEvict(e.key, e.value)
+	}
+}
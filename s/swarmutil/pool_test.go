@@ -0,0 +1,192 @@
+package swarmutil
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolGetPut(t *testing.T) {
+	p := NewPool(PoolParams[string, int]{})
+	_, ok := p.Get("a")
+	require.False(t, ok)
+	p.Put("a", 1)
+	v, ok := p.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	require.False(t, p.DeleteIf("a", func(v int) bool { return v == 2 }))
+	require.True(t, p.DeleteIf("a", func(v int) bool { return v == 1 }))
+	require.False(t, p.Delete("a"))
+	require.Equal(t, 0, p.Len())
+}
+
+func TestPoolTTL(t *testing.T) {
+	var evicted []string
+	p := NewPool(PoolParams[string, int]{
+		TTL:     20 * time.Millisecond,
+		OnEvict: func(k string, _ int) { evicted = append(evicted, k) },
+	})
+	p.Put("a", 1)
+	p.Put("b", 2)
+	time.Sleep(30 * time.Millisecond)
+	p.Put("c", 3)
+
+	_, ok := p.Get("a")
+	require.False(t, ok)
+	require.Equal(t, []string{"a"}, evicted)
+	require.Equal(t, 1, p.Cleanup(time.Now()))
+	require.Equal(t, []string{"a", "b"}, evicted)
+	require.Equal(t, 1, p.Len())
+}
+
+func TestPoolForEach(t *testing.T) {
+	p := NewPool(PoolParams[string, int]{
+		IsStale: func(_ string, v int, _ time.Time) bool { return v < 0 },
+	})
+	p.Put("a", 1)
+	p.Put("b", -1)
+	p.Put("c", 3)
+	seen := map[string]int{}
+	p.ForEach(func(k string, v int) bool {
+		seen[k] = v
+		return true
+	})
+	require.Equal(t, map[string]int{"a": 1, "c": 3}, seen)
+
+	var n int
+	p.ForEach(func(string, int) bool {
+		n++
+		return false
+	})
+	require.Equal(t, 1, n)
+}
+
+func TestPoolMaxSize(t *testing.T) {
+	var evicted []string
+	p := NewPool(PoolParams[string, int]{
+		MaxSize: 2,
+		OnEvict: func(k string, _ int) { evicted = append(evicted, k) },
+	})
+	p.Put("a", 1)
+	p.Put("b", 2)
+	// using a makes b the least recently used
+	p.Get("a")
+	p.Put("c", 3)
+
+	require.Equal(t, []string{"b"}, evicted)
+	require.Equal(t, 2, p.Len())
+	_, ok := p.Get("b")
+	require.False(t, ok)
+}
+
+func TestPoolIsStale(t *testing.T) {
+	p := NewPool(PoolParams[string, int]{
+		IsStale: func(_ string, v int, _ time.Time) bool { return v < 0 },
+	})
+	p.Put("a", -1)
+	p.Put("b", 1)
+	_, ok := p.Get("a")
+	require.False(t, ok)
+	_, ok = p.Get("b")
+	require.True(t, ok)
+}
+
+func TestPoolReplace(t *testing.T) {
+	var evicted []int
+	p := NewPool(PoolParams[string, int]{
+		OnEvict: func(_ string, v int) { evicted = append(evicted, v) },
+	})
+	p.Put("a", 1)
+	p.Put("a", 2)
+	require.Equal(t, []int{1}, evicted)
+	v, _ := p.Get("a")
+	require.Equal(t, 2, v)
+}
+
+func TestPoolGetOrCreate(t *testing.T) {
+	p := NewPool(PoolParams[string, int]{})
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 10, nil
+	}
+
+	const n = 50
+	var created int32
+	wg := sync.WaitGroup{}
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			v, yes, err := p.GetOrCreate("a", fn)
+			require.NoError(t, err)
+			require.Equal(t, 10, v)
+			if yes {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), calls)
+	require.Equal(t, int32(1), created)
+}
+
+func TestPoolGetOrCreateError(t *testing.T) {
+	p := NewPool(PoolParams[string, int]{})
+	errFailed := errors.New("failed")
+	_, created, err := p.GetOrCreate("a", func() (int, error) {
+		return 0, errFailed
+	})
+	require.Equal(t, errFailed, err)
+	require.False(t, created)
+	require.Equal(t, 0, p.Len())
+
+	v, created, err := p.GetOrCreate("a", func() (int, error) {
+		return 1, nil
+	})
+	require.NoError(t, err)
+	require.True(t, created)
+	require.Equal(t, 1, v)
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	var evictions int32
+	p := NewPool(PoolParams[int, int]{
+		TTL:     time.Millisecond,
+		MaxSize: 8,
+		OnEvict: func(int, int) { atomic.AddInt32(&evictions, 1) },
+	})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				k := (i + j) % 16
+				switch j % 4 {
+				case 0:
+					p.Put(k, j)
+				case 1:
+					p.Get(k)
+				case 2:
+					p.GetOrCreate(k, func() (int, error) { return j, nil })
+				case 3:
+					p.Cleanup(time.Now())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, p.Len(), 8)
+	require.Greater(t, atomic.LoadInt32(&evictions), int32(0))
+}
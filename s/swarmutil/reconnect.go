@@ -0,0 +1,106 @@
+package swarmutil
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMinReconnectBackoff is the time ServeWithReconnect waits before the first retry.
+	DefaultMinReconnectBackoff = 100 * time.Millisecond
+	// DefaultMaxReconnectBackoff is the longest ServeWithReconnect waits between retries.
+	DefaultMaxReconnectBackoff = 30 * time.Second
+)
+
+type reconnectConfig struct {
+	minBackoff, maxBackoff time.Duration
+	onConnect              func(p2p.Swarm)
+}
+
+type ReconnectOption func(*reconnectConfig)
+
+// WithReconnectBackoff sets the time ServeWithReconnect waits after a failure.
+// It starts at min and doubles with each consecutive failure, up to max.
+func WithReconnectBackoff(min, max time.Duration) ReconnectOption {
+	if min <= 0 || max < min {
+		panic(fmt.Sprintf("invalid backoff min=%v max=%v", min, max))
+	}
+	return func(c *reconnectConfig) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithOnConnect sets a function called with each swarm dialed by ServeWithReconnect, before it is served.
+// The swarm should be used for sending until the next call.
+func WithOnConnect(fn func(p2p.Swarm)) ReconnectOption {
+	return func(c *reconnectConfig) {
+		c.onConnect = fn
+	}
+}
+
+// ServeWithReconnect dials a swarm and serves its tells to fn.
+// When dialing fails, or ServeTells returns, the swarm is closed and dialed again after a backoff, see WithReconnectBackoff.
+// The backoff is reset once a swarm has been served for longer than the maximum backoff.
+// It returns ctx.Err() once ctx is done, after closing the current swarm.
+func ServeWithReconnect(ctx context.Context, dial func() (p2p.Swarm, error), fn p2p.TellHandler, opts ...ReconnectOption) error {
+	c := reconnectConfig{
+		minBackoff: DefaultMinReconnectBackoff,
+		maxBackoff: DefaultMaxReconnectBackoff,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	backoff := c.minBackoff
+	for {
+		start := time.Now()
+		err := serveOnce(ctx, dial, fn, c.onConnect)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(start) > c.maxBackoff {
+			backoff = c.minBackoff
+		}
+		p2p.Logger.WithFields(logrus.Fields{
+			"backoff": backoff,
+		}).Warn("swarmutil: reconnecting: ", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// serveOnce dials a swarm and serves it until ServeTells returns or ctx is done.
+func serveOnce(ctx context.Context, dial func() (p2p.Swarm, error), fn p2p.TellHandler, onConnect func(p2p.Swarm)) error {
+	x, err := dial()
+	if err != nil {
+		return err
+	}
+	if onConnect != nil {
+		onConnect(x)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- x.ServeTells(fn)
+	}()
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		x.Close()
+		<-errs
+	case err = <-errs:
+		x.Close()
+	}
+	return err
+}
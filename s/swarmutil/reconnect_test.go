@@ -0,0 +1,52 @@
+package swarmutil
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeWithReconnect(t *testing.T) {
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	// the first dial fails, the rest return a new swarm
+	dials := 0
+	dial := func() (p2p.Swarm, error) {
+		dials++
+		if dials == 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return newHubSwarm(), nil
+	}
+	connected := make(chan *hubSwarm, 1)
+	tells := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeWithReconnect(ctx, dial, func(msg *p2p.Message) {
+			tells <- string(msg.Payload)
+		}, WithReconnectBackoff(time.Millisecond, 10*time.Millisecond), WithOnConnect(func(x p2p.Swarm) {
+			connected <- x.(*hubSwarm)
+		}))
+	}()
+
+	x := <-connected
+	x.tells.DeliverTell(&p2p.Message{Payload: []byte("1")})
+	require.Equal(t, "1", <-tells)
+
+	// the transport fails, and serving resumes on a new swarm
+	x.tells.CloseWithError(io.ErrClosedPipe)
+	x2 := <-connected
+	require.True(t, x != x2)
+	x2.tells.DeliverTell(&p2p.Message{Payload: []byte("2")})
+	require.Equal(t, "2", <-tells)
+	require.Equal(t, 3, dials)
+
+	cf()
+	require.Equal(t, context.Canceled, <-done)
+	// the last swarm is closed
+	require.Equal(t, p2p.ErrSwarmClosed, x2.asks.DeliverAsk(context.Background(), &p2p.Message{}, io.Discard))
+}
@@ -0,0 +1,41 @@
+package swarmutil
+
+import (
+	"context"
+
+	"github.com/brendoncarroll/go-p2p"
+)
+
+// Serve serves tells to tellFn, and asks to askFn, until ctx is done or either loop returns.
+// A nil handler is replaced with a no-op handler.
+// Serving can only be stopped by closing the swarm, so Serve closes x before returning,
+// which also stops the other loop.
+// It returns ctx.Err() if ctx was done first, or else the first error returned by ServeTells or ServeAsks.
+func Serve(ctx context.Context, x p2p.AskSwarm, tellFn p2p.TellHandler, askFn p2p.AskHandler) error {
+	if tellFn == nil {
+		tellFn = p2p.NoOpTellHandler
+	}
+	if askFn == nil {
+		askFn = p2p.NoOpAskHandler
+	}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- x.ServeTells(tellFn)
+	}()
+	go func() {
+		errs <- x.ServeAsks(askFn)
+	}()
+	remaining := 2
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-errs:
+		remaining--
+	}
+	x.Close()
+	for ; remaining > 0; remaining-- {
+		<-errs
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package swarmutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServe(t *testing.T) {
+	ctx, cf := context.WithCancel(context.Background())
+	x := newHubSwarm()
+	tells := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, x, func(msg *p2p.Message) {
+			tells <- string(msg.Payload)
+		}, func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+			w.Write(msg.Payload)
+		})
+	}()
+
+	// both handlers are served
+	x.tells.DeliverTell(&p2p.Message{Payload: []byte("tell")})
+	require.Equal(t, "tell", <-tells)
+	w := &bytes.Buffer{}
+	require.NoError(t, x.asks.DeliverAsk(ctx, &p2p.Message{Payload: []byte("ask")}, w))
+	require.Equal(t, "ask", w.String())
+
+	// cancelling the context stops both loops
+	cf()
+	select {
+	case err := <-done:
+		require.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+	require.Equal(t, p2p.ErrSwarmClosed, x.asks.DeliverAsk(context.Background(), &p2p.Message{}, io.Discard))
+}
+
+func TestServeLoopReturns(t *testing.T) {
+	x := newHubSwarm()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(context.Background(), x, nil, nil)
+	}()
+	// when one loop returns, the swarm is closed so the other returns too
+	x.tells.CloseWithError(io.ErrUnexpectedEOF)
+	require.Equal(t, io.ErrUnexpectedEOF, <-done)
+	require.Equal(t, p2p.ErrSwarmClosed, x.asks.DeliverAsk(context.Background(), &p2p.Message{}, io.Discard))
+}
+
+// hubSwarm serves the messages delivered to its hubs.
+type hubSwarm struct {
+	p2p.AskSwarm
+	tells *TellHub
+	asks  *AskHub
+}
+
+func newHubSwarm() *hubSwarm {
+	return &hubSwarm{tells: NewTellHub(), asks: NewAskHub()}
+}
+
+func (s *hubSwarm) ServeTells(fn p2p.TellHandler) error {
+	return s.tells.ServeTells(fn)
+}
+
+func (s *hubSwarm) ServeAsks(fn p2p.AskHandler) error {
+	return s.asks.ServeAsks(fn)
+}
+
+func (s *hubSwarm) Close() error {
+	s.tells.CloseWithError(p2p.ErrSwarmClosed)
+	s.asks.CloseWithError(p2p.ErrSwarmClosed)
+	return nil
+}
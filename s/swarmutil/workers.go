@@ -0,0 +1,35 @@
+package swarmutil
+
+import "sync"
+
+// Workers tracks the background goroutines of a swarm, so Close can wait for them to exit.
+// The zero value is ready to use.
+type Workers struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// Go runs fn in a new goroutine, unless Wait has been called, in which case fn is not run and Go returns false.
+func (w *Workers) Go(fn func()) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return false
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// Wait stops new goroutines from being started, and waits for the running ones to return.
+// It must not be called from one of the goroutines.
+func (w *Workers) Wait() {
+	w.mu.Lock()
+	w.stopped = true
+	w.mu.Unlock()
+	w.wg.Wait()
+}
@@ -0,0 +1,28 @@
+package swarmutil
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkers(t *testing.T) {
+	var w Workers
+	var done int32
+	for i := 0; i < 10; i++ {
+		require.True(t, w.Go(func() {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&done, 1)
+		}))
+	}
+	w.Wait()
+	require.Equal(t, int32(10), atomic.LoadInt32(&done))
+	// no goroutines are started after Wait
+	require.False(t, w.Go(func() {
+		atomic.AddInt32(&done, 1)
+	}))
+	w.Wait()
+	require.Equal(t, int32(10), atomic.LoadInt32(&done))
+}
@@ -0,0 +1,66 @@
+package traceswarm
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TraceContext identifies a span in a distributed trace, as in a W3C traceparent header.
+type TraceContext struct {
+	TraceID  [16]byte
+	ParentID [8]byte
+	Flags    uint8
+}
+
+// IsValid returns false if the trace or parent id is all zeros, which the W3C spec forbids.
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.ParentID != [8]byte{}
+}
+
+// String returns tc as a version 00 traceparent header.
+func (tc TraceContext) String() string {
+	return "00-" + hex.EncodeToString(tc.TraceID[:]) + "-" + hex.EncodeToString(tc.ParentID[:]) + "-" + hex.EncodeToString([]byte{tc.Flags})
+}
+
+// ParseTraceparent parses a version 00 traceparent header.
+func ParseTraceparent(s string) (TraceContext, error) {
+	var tc TraceContext
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return tc, errors.Errorf("invalid traceparent %q", s)
+	}
+	var flags [1]byte
+	for _, f := range []struct {
+		dst []byte
+		src string
+	}{{tc.TraceID[:], parts[1]}, {tc.ParentID[:], parts[2]}, {flags[:], parts[3]}} {
+		if len(f.src) != 2*len(f.dst) || strings.ToLower(f.src) != f.src {
+			return tc, errors.Errorf("invalid traceparent %q", s)
+		}
+		if _, err := hex.Decode(f.dst, []byte(f.src)); err != nil {
+			return tc, errors.Wrapf(err, "invalid traceparent %q", s)
+		}
+	}
+	tc.Flags = flags[0]
+	if !tc.IsValid() {
+		return tc, errors.Errorf("invalid traceparent %q: all zero id", s)
+	}
+	return tc, nil
+}
+
+type traceKey struct{}
+
+// ContextWithTrace returns a copy of ctx carrying tc, which Tell and Ask send to the remote peer.
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+// TraceFromContext returns the TraceContext in ctx, if there is one.
+// Handlers are passed a context with the trace of the sender, if it sent one.
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(TraceContext)
+	return tc, ok
+}
@@ -0,0 +1,146 @@
+// Package traceswarm carries distributed tracing context across the network.
+//
+// The TraceContext in the context passed to Tell or Ask is sent in a header on the message,
+// and the receiving swarm puts it in the context passed to its handlers, so spans on either side can be linked.
+// The header is the binary form of a W3C traceparent, or a single zero byte when the sender has no trace.
+package traceswarm
+
+import (
+	"context"
+	"io"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+// Overhead is the largest header added to each message.
+const Overhead = 1 + 16 + 8 + 1
+
+const (
+	headerNone  = 0
+	headerTrace = 1
+)
+
+// ContextTellHandler is like p2p.TellHandler, but is passed a context, which carries the sender's trace.
+type ContextTellHandler = func(ctx context.Context, msg *p2p.Message)
+
+var _ p2p.Swarm = &Swarm{}
+
+type Swarm struct {
+	p2p.Swarm
+}
+
+func New(x p2p.Swarm) *Swarm {
+	return &Swarm{Swarm: x}
+}
+
+// Tell sends data to addr, along with the TraceContext in ctx, if there is one.
+func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	return s.Swarm.Tell(ctx, addr, makeMessage(ctx, data))
+}
+
+// ServeTells calls fn with each message received, without its trace.
+// Use ServeTellsContext to get the trace.
+func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
+	return s.ServeTellsContext(func(ctx context.Context, msg *p2p.Message) {
+		fn(msg)
+	})
+}
+
+// ServeTellsContext is like ServeTells, but passes fn a context carrying the sender's trace, see TraceFromContext.
+func (s *Swarm) ServeTellsContext(fn ContextTellHandler) error {
+	return s.Swarm.ServeTells(func(msg *p2p.Message) {
+		ctx, msg2, err := parseMessage(context.Background(), msg)
+		if err != nil {
+			logDrop(msg.Src, err)
+			return
+		}
+		fn(ctx, msg2)
+	})
+}
+
+func (s *Swarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	return s.Swarm.MTU(ctx, addr) - Overhead
+}
+
+var _ p2p.AskSwarm = &AskSwarm{}
+
+type AskSwarm struct {
+	*Swarm
+	asker p2p.Asker
+}
+
+func NewAsk(x p2p.AskSwarm) *AskSwarm {
+	return &AskSwarm{Swarm: New(x), asker: x}
+}
+
+// Ask sends data to addr, along with the TraceContext in ctx, if there is one.
+func (s *AskSwarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	return s.asker.Ask(ctx, addr, makeMessage(ctx, data))
+}
+
+// ServeAsks calls fn with each ask received, and a context carrying the sender's trace, see TraceFromContext.
+// The sender's trace replaces any trace in the context from the lower swarm.
+func (s *AskSwarm) ServeAsks(fn p2p.AskHandler) error {
+	return s.asker.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		ctx, msg2, err := parseMessage(ctx, msg)
+		if err != nil {
+			logDrop(msg.Src, err)
+			return
+		}
+		fn(ctx, msg2, w)
+	})
+}
+
+func makeMessage(ctx context.Context, data p2p.IOVec) p2p.IOVec {
+	header := []byte{headerNone}
+	if tc, ok := TraceFromContext(ctx); ok && tc.IsValid() {
+		header = make([]byte, 0, Overhead)
+		header = append(header, headerTrace)
+		header = append(header, tc.TraceID[:]...)
+		header = append(header, tc.ParentID[:]...)
+		header = append(header, tc.Flags)
+	}
+	ret := make(p2p.IOVec, 0, len(data)+1)
+	ret = append(ret, header)
+	return append(ret, data...)
+}
+
+// parseMessage removes the header from msg, and returns ctx with the trace from the header, if it had one.
+// Without a trace in the header, any trace in ctx is removed, so it can't be mistaken for the sender's.
+func parseMessage(ctx context.Context, msg *p2p.Message) (context.Context, *p2p.Message, error) {
+	x := msg.Payload
+	if len(x) < 1 {
+		return nil, nil, errors.Errorf("traceswarm: message too short")
+	}
+	var body []byte
+	switch x[0] {
+	case headerNone:
+		if _, ok := TraceFromContext(ctx); ok {
+			ctx = context.WithValue(ctx, traceKey{}, nil)
+		}
+		body = x[1:]
+	case headerTrace:
+		if len(x) < Overhead {
+			return nil, nil, errors.Errorf("traceswarm: message too short")
+		}
+		var tc TraceContext
+		copy(tc.TraceID[:], x[1:17])
+		copy(tc.ParentID[:], x[17:25])
+		tc.Flags = x[25]
+		ctx = ContextWithTrace(ctx, tc)
+		body = x[Overhead:]
+	default:
+		return nil, nil, errors.Errorf("traceswarm: unknown header type %d", x[0])
+	}
+	return ctx, &p2p.Message{Src: msg.Src, Dst: msg.Dst, Payload: body}, nil
+}
+
+func logDrop(src p2p.Addr, err error) {
+	log.WithFields(logrus.Fields{
+		"src": src,
+	}).Warn("traceswarm: dropping message: ", err)
+}
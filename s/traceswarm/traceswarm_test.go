@@ -0,0 +1,101 @@
+package traceswarm
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+	swarmtest.TestSuiteAskSwarm(t, func(t testing.TB, n int) []p2p.AskSwarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.AskSwarm, n)
+		for i := range xs {
+			xs[i] = NewAsk(r.NewSwarm())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseAskSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestPropagation(t *testing.T) {
+	r := memswarm.NewRealm()
+	a, b := NewAsk(r.NewSwarm()), NewAsk(r.NewSwarm())
+	defer a.Close()
+	defer b.Close()
+	type received struct {
+		tc      TraceContext
+		ok      bool
+		payload string
+	}
+	tells := make(chan received, 1)
+	go a.ServeTells(p2p.NoOpTellHandler)
+	go b.ServeTellsContext(func(ctx context.Context, msg *p2p.Message) {
+		tc, ok := TraceFromContext(ctx)
+		tells <- received{tc, ok, string(msg.Payload)}
+	})
+	go b.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		tc, _ := TraceFromContext(ctx)
+		w.Write([]byte(tc.String()))
+	})
+
+	tc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	ctx := ContextWithTrace(context.Background(), tc)
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, received{tc, true, "hello"}, <-tells)
+
+	resp, err := a.Ask(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")})
+	require.NoError(t, err)
+	require.Equal(t, tc.String(), string(resp))
+
+	// without a trace, the handler's context has none
+	require.NoError(t, a.Tell(context.Background(), b.LocalAddrs()[0], p2p.IOVec{[]byte("untraced")}))
+	require.Equal(t, received{payload: "untraced"}, <-tells)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const s = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, err := ParseTraceparent(s)
+	require.NoError(t, err)
+	require.Equal(t, s, tc.String())
+	require.Equal(t, uint8(1), tc.Flags)
+
+	for _, bad := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	} {
+		_, err := ParseTraceparent(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestMTU(t *testing.T) {
+	r := memswarm.NewRealm(memswarm.WithMTU(100))
+	x := New(r.NewSwarm())
+	require.Equal(t, 100-Overhead, x.MTU(context.Background(), x.LocalAddrs()[0]))
+}
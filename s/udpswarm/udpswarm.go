@@ -2,10 +2,13 @@ package udpswarm
 
 import (
 	"context"
+	"errors"
 	"net"
 	"strings"
+	"syscall"
 
 	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -34,6 +37,7 @@ It is included as a transport for secure swarms to be built on.
 type Swarm struct {
 	conn       *net.UDPConn
 	numWorkers int
+	closeOnce  swarmutil.CloseOnce
 }
 
 func New(laddr string, opts ...Option) (*Swarm, error) {
@@ -71,9 +75,12 @@ func (s *Swarm) ServeTells(fn p2p.TellHandler) error {
 
 func (s *Swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
 	a := addr.(Addr)
+	if err := p2p.CheckMTU(data, s.MTU(ctx, addr)); err != nil {
+		return err
+	}
 	a2 := (net.UDPAddr)(a)
 	_, err := s.conn.WriteToUDP(p2p.VecBytes(data), &a2)
-	return err
+	return writeErr(err)
 }
 
 func (s *Swarm) LocalAddrs() []p2p.Addr {
@@ -98,8 +105,18 @@ func (s *Swarm) ParseAddr(x []byte) (p2p.Addr, error) {
 	return a, nil
 }
 
+// Close closes the socket.
 func (s *Swarm) Close() error {
-	return s.conn.Close()
+	return s.closeOnce.Do(s.conn.Close)
+}
+
+// writeErr converts errors from writing to the socket to the errors returned by Tell.
+// ENOBUFS means the kernel dropped the message because its send buffer was full, which is reported as p2p.ErrWouldBlock.
+func writeErr(err error) error {
+	if errors.Is(err, syscall.ENOBUFS) {
+		return p2p.ErrWouldBlock
+	}
+	return err
 }
 
 func (s *Swarm) readLoop(fn p2p.TellHandler) error {
@@ -1,6 +1,11 @@
 package udpswarm
 
 import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
 	"testing"
 
 	"github.com/brendoncarroll/go-p2p"
@@ -23,3 +28,32 @@ func TestSwarm(t *testing.T) {
 		return xs
 	})
 }
+
+func TestMTUExceeded(t *testing.T) {
+	ctx := context.Background()
+	a, err := New("127.0.0.1:")
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := New("127.0.0.1:")
+	require.NoError(t, err)
+	defer b.Close()
+	bAddr := b.LocalAddrs()[0]
+	mtu := a.MTU(ctx, bAddr)
+
+	err = a.Tell(ctx, bAddr, p2p.IOVec{make([]byte, mtu+1)})
+	require.True(t, errors.Is(err, p2p.ErrMTUExceeded))
+	var mtuErr p2p.MTUExceededError
+	require.True(t, errors.As(err, &mtuErr))
+	require.Equal(t, p2p.MTUExceededError{MTU: mtu, Size: mtu + 1}, mtuErr)
+	require.NoError(t, a.Tell(ctx, bAddr, p2p.IOVec{make([]byte, mtu)}))
+}
+
+func TestWriteErr(t *testing.T) {
+	require.NoError(t, writeErr(nil))
+	// errors from the socket are wrapped by net and os
+	enobufs := &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.ENOBUFS)}
+	require.Equal(t, p2p.ErrWouldBlock, writeErr(enobufs))
+	other := &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)}
+	require.Equal(t, other, writeErr(other))
+	require.Equal(t, net.ErrClosed, writeErr(net.ErrClosed))
+}
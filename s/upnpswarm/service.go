@@ -11,6 +11,7 @@ import (
 	"github.com/syncthing/syncthing/lib/upnp"
 
 	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/swarmutil"
 )
 
 var log = p2p.Logger
@@ -35,6 +36,8 @@ type service struct {
 
 	tcpMap map[string]net.TCPAddr
 	udpMap map[string]net.UDPAddr
+	// changes is notified whenever a mapping is added, changed or removed
+	changes swarmutil.ChangeNotifier
 }
 
 func newService(swarm p2p.Swarm) *service {
@@ -103,8 +106,12 @@ func (s *service) discoverLoop(ctx context.Context) {
 	}
 }
 
+// clearMappings must be called with mu
 func (s *service) clearMappings() {
 	log.Debug("clearing all mappings")
+	if len(s.tcpMap) > 0 || len(s.udpMap) > 0 {
+		defer s.changes.Notify()
+	}
 	for k := range s.tcpMap {
 		delete(s.tcpMap, k)
 	}
@@ -119,8 +126,12 @@ func (s *service) putTCP(local, external net.TCPAddr) {
 		"external_addr": external.String(),
 	}).Debug("added tcp mapping")
 	s.mu.Lock()
+	prev, exists := s.tcpMap[local.String()]
 	s.tcpMap[local.String()] = external
 	s.mu.Unlock()
+	if !exists || prev.String() != external.String() {
+		s.changes.Notify()
+	}
 }
 
 func (s *service) putUDP(local, external net.UDPAddr) {
@@ -129,8 +140,12 @@ func (s *service) putUDP(local, external net.UDPAddr) {
 		"external_addr": external.String(),
 	}).Debug("added udp mapping")
 	s.mu.Lock()
+	prev, exists := s.udpMap[local.String()]
 	s.udpMap[local.String()] = external
 	s.mu.Unlock()
+	if !exists || prev.String() != external.String() {
+		s.changes.Notify()
+	}
 }
 
 func (s *service) mapAddr(x p2p.Addr) p2p.Addr {
@@ -21,10 +21,13 @@ func WrapAsk(x p2p.AskSwarm) p2p.AskSwarm {
 }
 
 func WrapSecure(x p2p.SecureSwarm) p2p.SecureSwarm {
-	return p2p.ComposeSecureSwarm(
-		WrapSwarm(x),
-		x,
-	)
+	return &SecureSwarm{
+		Swarm: Swarm{
+			inner: x,
+			s:     newService(x),
+		},
+		secure: x,
+	}
 }
 
 func WrapSecureAsk(x p2p.SecureAskSwarm) p2p.SecureAskSwarm {
@@ -58,6 +61,12 @@ func (s *Swarm) LocalAddrs() []p2p.Addr {
 	return s.s.mapAddrs(s.inner.LocalAddrs())
 }
 
+// LocalAddrsChanged implements p2p.LocalAddrsNotifier.
+// It is notified when NAT mappings are added, changed or removed, not when the addresses of the inner swarm change.
+func (s *Swarm) LocalAddrsChanged() <-chan struct{} {
+	return s.s.changes.Changed()
+}
+
 func (s *Swarm) ParseAddr(data []byte) (p2p.Addr, error) {
 	return s.inner.ParseAddr(data)
 }
@@ -96,6 +105,12 @@ func (s *AskSwarm) LocalAddrs() []p2p.Addr {
 	return s.s.mapAddrs(s.inner.LocalAddrs())
 }
 
+// LocalAddrsChanged implements p2p.LocalAddrsNotifier.
+// It is notified when NAT mappings are added, changed or removed, not when the addresses of the inner swarm change.
+func (s *AskSwarm) LocalAddrsChanged() <-chan struct{} {
+	return s.s.changes.Changed()
+}
+
 func (s *AskSwarm) Close() error {
 	return s.inner.Close()
 }
@@ -104,6 +119,19 @@ func (s *AskSwarm) ParseAddr(data []byte) (p2p.Addr, error) {
 	return s.inner.ParseAddr(data)
 }
 
+type SecureSwarm struct {
+	Swarm
+	secure p2p.Secure
+}
+
+func (s *SecureSwarm) LookupPublicKey(ctx context.Context, addr p2p.Addr) (p2p.PublicKey, error) {
+	return s.secure.LookupPublicKey(ctx, addr)
+}
+
+func (s *SecureSwarm) PublicKey() p2p.PublicKey {
+	return s.secure.PublicKey()
+}
+
 type SecureAskSwarm struct {
 	AskSwarm
 	secure p2p.Secure
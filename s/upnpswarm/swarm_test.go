@@ -0,0 +1,58 @@
+package upnpswarm
+
+import (
+	"net"
+	"testing"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+)
+
+func TestLocalAddrsChanged(t *testing.T) {
+	// the service is not run, so mappings are only created by the test
+	s := &Swarm{
+		inner: memswarm.NewRealm().NewSwarm(),
+		s: &service{
+			tcpMap: make(map[string]net.TCPAddr),
+			udpMap: make(map[string]net.UDPAddr),
+		},
+	}
+	var _ p2p.LocalAddrsNotifier = s
+	local := net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 1234}
+	external := net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 4321}
+
+	ch := s.LocalAddrsChanged()
+	s.s.putUDP(local, external)
+	requireClosed(t, ch)
+
+	// renewing the same mapping is not a change
+	ch = s.LocalAddrsChanged()
+	s.s.putUDP(local, external)
+	requireOpen(t, ch)
+
+	external.Port++
+	s.s.putUDP(local, external)
+	requireClosed(t, ch)
+
+	ch = s.LocalAddrsChanged()
+	s.s.mu.Lock()
+	s.s.clearMappings()
+	s.s.mu.Unlock()
+	requireClosed(t, ch)
+}
+
+func requireClosed(t *testing.T, ch <-chan struct{}) {
+	select {
+	case <-ch:
+	default:
+		t.Fatal("channel should be closed")
+	}
+}
+
+func requireOpen(t *testing.T, ch <-chan struct{}) {
+	select {
+	case <-ch:
+		t.Fatal("channel should not be closed")
+	default:
+	}
+}
@@ -0,0 +1,159 @@
+package versionswarm
+
+import (
+	"context"
+	"io"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = p2p.Logger
+
+// Overhead is the number of bytes added to each message
+const Overhead = 1
+
+// TellFallback is called with tells which have a version other than the swarm's.
+// The version byte has been removed from msg.Payload
+type TellFallback = func(version uint8, msg *p2p.Message)
+
+// AskFallback is called with asks which have a version other than the swarm's.
+// The version byte has been removed from msg.Payload
+type AskFallback = func(ctx context.Context, version uint8, msg *p2p.Message, w io.Writer)
+
+type Option func(*swarm)
+
+// WithTellFallback sets a handler for tells with an unknown version.
+// By default they are logged and dropped.
+func WithTellFallback(fn TellFallback) Option {
+	return func(s *swarm) {
+		s.tellFallback = fn
+	}
+}
+
+// WithAskFallback sets a handler for asks with an unknown version.
+// By default they are logged and dropped.
+func WithAskFallback(fn AskFallback) Option {
+	return func(s *swarm) {
+		s.askFallback = fn
+	}
+}
+
+func New(x p2p.Swarm, version uint8, opts ...Option) p2p.Swarm {
+	return newSwarm(x, nil, version, opts)
+}
+
+func NewSecure(x p2p.SecureSwarm, version uint8, opts ...Option) p2p.SecureSwarm {
+	s := newSwarm(x, nil, version, opts)
+	return p2p.ComposeSecureSwarm(s, x)
+}
+
+func NewAsk(x p2p.AskSwarm, version uint8, opts ...Option) p2p.AskSwarm {
+	s := newSwarm(x, x, version, opts)
+	return p2p.ComposeAskSwarm(s, s)
+}
+
+func NewSecureAsk(x p2p.SecureAskSwarm, version uint8, opts ...Option) p2p.SecureAskSwarm {
+	s := newSwarm(x, x, version, opts)
+	return p2p.ComposeSecureAskSwarm(s, s, x)
+}
+
+type swarm struct {
+	p2p.Swarm
+	asker   p2p.Asker
+	version uint8
+
+	tellFallback TellFallback
+	askFallback  AskFallback
+}
+
+func newSwarm(x p2p.Swarm, asker p2p.Asker, version uint8, opts []Option) *swarm {
+	s := &swarm{
+		Swarm:   x,
+		asker:   asker,
+		version: version,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *swarm) Tell(ctx context.Context, addr p2p.Addr, data p2p.IOVec) error {
+	return s.Swarm.Tell(ctx, addr, s.makeMessage(data))
+}
+
+func (s *swarm) ServeTells(fn p2p.TellHandler) error {
+	return s.Swarm.ServeTells(func(msg *p2p.Message) {
+		version, body, err := parseMessage(msg.Payload)
+		if err != nil {
+			logDrop(msg.Src, err)
+			return
+		}
+		msg2 := &p2p.Message{
+			Src:     msg.Src,
+			Dst:     msg.Dst,
+			Payload: body,
+		}
+		switch {
+		case version == s.version:
+			fn(msg2)
+		case s.tellFallback != nil:
+			s.tellFallback(version, msg2)
+		default:
+			logDrop(msg.Src, errors.Errorf("unknown version %d", version))
+		}
+	})
+}
+
+func (s *swarm) Ask(ctx context.Context, addr p2p.Addr, data p2p.IOVec) ([]byte, error) {
+	return s.asker.Ask(ctx, addr, s.makeMessage(data))
+}
+
+func (s *swarm) ServeAsks(fn p2p.AskHandler) error {
+	return s.asker.ServeAsks(func(ctx context.Context, msg *p2p.Message, w io.Writer) {
+		version, body, err := parseMessage(msg.Payload)
+		if err != nil {
+			logDrop(msg.Src, err)
+			return
+		}
+		msg2 := &p2p.Message{
+			Src:     msg.Src,
+			Dst:     msg.Dst,
+			Payload: body,
+		}
+		switch {
+		case version == s.version:
+			fn(ctx, msg2, w)
+		case s.askFallback != nil:
+			s.askFallback(ctx, version, msg2, w)
+		default:
+			logDrop(msg.Src, errors.Errorf("unknown version %d", version))
+		}
+	})
+}
+
+func (s *swarm) MTU(ctx context.Context, addr p2p.Addr) int {
+	return s.Swarm.MTU(ctx, addr) - Overhead
+}
+
+func (s *swarm) makeMessage(data p2p.IOVec) p2p.IOVec {
+	ret := make(p2p.IOVec, 0, len(data)+1)
+	ret = append(ret, []byte{s.version})
+	ret = append(ret, data...)
+	return ret
+}
+
+func parseMessage(x []byte) (uint8, []byte, error) {
+	if len(x) < Overhead {
+		return 0, nil, errors.Errorf("versionswarm: message too short")
+	}
+	return x[0], x[1:], nil
+}
+
+func logDrop(src p2p.Addr, err error) {
+	log.WithFields(logrus.Fields{
+		"src": src,
+	}).Warn("versionswarm: dropping message: ", err)
+}
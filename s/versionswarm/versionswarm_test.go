@@ -0,0 +1,80 @@
+package versionswarm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brendoncarroll/go-p2p"
+	"github.com/brendoncarroll/go-p2p/s/memswarm"
+	"github.com/brendoncarroll/go-p2p/s/swarmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSuiteSwarm(t, func(t testing.TB, n int) []p2p.Swarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.Swarm, n)
+		for i := range xs {
+			xs[i] = New(r.NewSwarm(), 1)
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+		return xs
+	})
+	swarmtest.TestSuiteAskSwarm(t, func(t testing.TB, n int) []p2p.AskSwarm {
+		r := memswarm.NewRealm()
+		xs := make([]p2p.AskSwarm, n)
+		for i := range xs {
+			xs[i] = NewAsk(r.NewSwarm(), 1)
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseAskSwarms(t, xs)
+		})
+		return xs
+	})
+}
+
+func TestMTU(t *testing.T) {
+	r := memswarm.NewRealm(memswarm.WithMTU(100))
+	x := New(r.NewSwarm(), 1)
+	assert.Equal(t, 99, x.MTU(context.Background(), x.LocalAddrs()[0]))
+}
+
+func TestMixedVersions(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	type versioned struct {
+		version uint8
+		payload string
+	}
+	fallback := make(chan versioned, 1)
+	recvV1 := make(chan string, 1)
+	recvV2 := make(chan string, 1)
+	v1 := New(r.NewSwarm(), 1)
+	v2 := New(r.NewSwarm(), 2, WithTellFallback(func(version uint8, msg *p2p.Message) {
+		fallback <- versioned{version, string(msg.Payload)}
+	}))
+	go v1.ServeTells(func(msg *p2p.Message) {
+		recvV1 <- string(msg.Payload)
+	})
+	go v2.ServeTells(func(msg *p2p.Message) {
+		recvV2 <- string(msg.Payload)
+	})
+
+	// old peer to new peer goes to the fallback
+	require.NoError(t, v1.Tell(ctx, v2.LocalAddrs()[0], p2p.IOVec{[]byte("old")}))
+	assert.Equal(t, versioned{1, "old"}, <-fallback)
+	assert.Len(t, recvV2, 0)
+
+	// new peer to old peer is dropped
+	require.NoError(t, v2.Tell(ctx, v1.LocalAddrs()[0], p2p.IOVec{[]byte("new")}))
+	select {
+	case <-recvV1:
+		t.Error("old peer should not receive message with unknown version")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
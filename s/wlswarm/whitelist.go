@@ -88,7 +88,7 @@ func checkAddr(sec p2p.Secure, af AllowFunc, addr p2p.Addr, isSend bool) bool {
 func logAttemptSend(id p2p.PeerID, addr p2p.Addr) {
 	data, _ := addr.MarshalText()
 	log.WithFields(logrus.Fields{
-		"peer_id": id,
+		"peer_id": id.Short(),
 		"addr":    string(data),
 	}).Warn("tried to send message to peer not in whitelist")
 }
@@ -96,7 +96,7 @@ func logAttemptSend(id p2p.PeerID, addr p2p.Addr) {
 func logRecv(id p2p.PeerID, addr p2p.Addr) {
 	data, _ := addr.MarshalText()
 	log.WithFields(logrus.Fields{
-		"peer_id": id,
+		"peer_id": id.Short(),
 		"addr":    string(data),
 	}).Warn("recieved message from peer not in whitelist")
 }
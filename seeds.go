@@ -0,0 +1,55 @@
+package p2p
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Resolver looks up the IP addresses for a host name.
+// *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ResolveSeeds resolves the host in seed, which must be of the form host:port, using the default resolver.
+// See ResolveSeedsWith.
+func ResolveSeeds(ctx context.Context, seed string, swarm Swarm) ([]Addr, error) {
+	return ResolveSeedsWith(ctx, net.DefaultResolver, seed, swarm)
+}
+
+// ResolveSeedsWith resolves the host in seed, which must be of the form host:port, to all of its A and AAAA records.
+// Each IP is joined with the port and parsed by swarm.ParseAddr, so the swarm must use ip:port addresses, as udpswarm does.
+// Duplicate IPs are only returned once, and an error is returned if the host has no addresses.
+func ResolveSeedsWith(ctx context.Context, r Resolver, seed string, swarm Swarm) ([]Addr, error) {
+	host, port, err := net.SplitHostPort(seed)
+	if err != nil {
+		return nil, err
+	}
+	ipAddrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []Addr
+	seen := map[string]bool{}
+	for _, ipAddr := range ipAddrs {
+		ip := ipAddr.IP.String()
+		if ipAddr.Zone != "" {
+			ip += "%" + ipAddr.Zone
+		}
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		addr, err := swarm.ParseAddr([]byte(net.JoinHostPort(ip, port)))
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no addresses found for seed %s", seed)
+	}
+	return addrs, nil
+}
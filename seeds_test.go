@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSeeds(t *testing.T) {
+	ctx := context.Background()
+	r := mockResolver{
+		"seed.example.com": {
+			{IP: net.ParseIP("192.0.2.1")},
+			{IP: net.ParseIP("192.0.2.2")},
+			{IP: net.ParseIP("2001:db8::1")},
+			// duplicates are removed
+			{IP: net.ParseIP("192.0.2.1")},
+		},
+		"empty.example.com": {},
+	}
+	swarm := parseSwarm{}
+
+	addrs, err := ResolveSeedsWith(ctx, r, "seed.example.com:6000", swarm)
+	require.NoError(t, err)
+	require.Equal(t, []Addr{
+		testAddr("192.0.2.1:6000"),
+		testAddr("192.0.2.2:6000"),
+		testAddr("[2001:db8::1]:6000"),
+	}, addrs)
+
+	_, err = ResolveSeedsWith(ctx, r, "empty.example.com:6000", swarm)
+	require.Error(t, err)
+	_, err = ResolveSeedsWith(ctx, r, "missing.example.com:6000", swarm)
+	require.Error(t, err)
+	// the port is required
+	_, err = ResolveSeedsWith(ctx, r, "seed.example.com", swarm)
+	require.Error(t, err)
+}
+
+type mockResolver map[string][]net.IPAddr
+
+func (r mockResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ipAddrs, ok := r[host]
+	if !ok {
+		return nil, errors.Errorf("no such host %s", host)
+	}
+	return ipAddrs, nil
+}
+
+// parseSwarm is a Swarm which only implements ParseAddr, for ip:port addresses
+type parseSwarm struct {
+	Swarm
+}
+
+func (parseSwarm) ParseAddr(data []byte) (Addr, error) {
+	if _, _, err := net.SplitHostPort(string(data)); err != nil {
+		return nil, err
+	}
+	return testAddr(data), nil
+}
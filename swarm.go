@@ -30,6 +30,14 @@ type Swarm interface {
 	ParseAddr(data []byte) (Addr, error)
 }
 
+// LocalAddrsNotifier is implemented by swarms whose local addresses can change,
+// for example when an interface comes up or a new NAT mapping is created.
+type LocalAddrsNotifier interface {
+	// LocalAddrsChanged returns a channel which is closed the next time the addresses returned by LocalAddrs change.
+	// Call LocalAddrsChanged again after it is closed, and before calling LocalAddrs, to be notified of the next change.
+	LocalAddrsChanged() <-chan struct{}
+}
+
 type IOVec = net.Buffers
 
 // VecSize returns the total size of the vector in bytes if it were contiguous.
@@ -57,6 +65,13 @@ func VecBytes(v IOVec) []byte {
 	return ret
 }
 
+// Teller sends and receives unreliable messages.
+// A zero-length message is a valid message: Tell sends it like any other,
+// and it is delivered to the TellHandler with an empty Payload.
+// If data is larger than the swarm's MTU for addr, Tell returns an error matching ErrMTUExceeded,
+// usually an MTUExceededError, rather than sending part of it.
+// Transports which can tell that a message was dropped, because a send buffer was full, return ErrWouldBlock,
+// so upper layers can apply back-pressure.
 type Teller interface {
 	Tell(ctx context.Context, addr Addr, data IOVec) error
 	ServeTells(TellHandler) error
@@ -67,6 +82,27 @@ type Asker interface {
 	ServeAsks(AskHandler) error
 }
 
+// Flusher is implemented by swarms which buffer outbound messages.
+type Flusher interface {
+	// Flush sends any buffered messages, and waits until they have been passed to the layer below.
+	// Swarms which wrap another Flusher must flush it as well.
+	Flush(ctx context.Context) error
+}
+
+// Flush calls Flush on each of the layers which implement Flusher, in order, and skips the others.
+// Layers should be passed from the top of a stack down, so messages flushed out of one layer
+// are then flushed out of the layers below it.
+func Flush(ctx context.Context, layers ...Swarm) error {
+	for _, x := range layers {
+		if f, ok := x.(Flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type AskSwarm interface {
 	Swarm
 	Asker